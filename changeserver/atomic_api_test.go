@@ -0,0 +1,182 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/apigee-labs/transicator/common"
+	"github.com/apigee-labs/transicator/storage"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const atomicTestDir = "./atomictestdata"
+
+var _ = Describe("Atomic transaction tests", func() {
+	var lastTestSequence = time.Now().Unix() + 300000
+
+	It("Whole transactions", func() {
+		cl := getChanges(fmt.Sprintf("%s/changes?selector=atomictest&limit=%d",
+			baseURL, maxLimitChanges))
+		since := cl.LastSequence
+
+		// Insert one transaction with three rows and another with one
+		tx, err := db.Begin()
+		Expect(err).Should(Succeed())
+		tst := tx.Stmt(insertStmt)
+		for i := 0; i < 3; i++ {
+			lastTestSequence++
+			_, err = tst.Exec(lastTestSequence, "atomictest")
+			Expect(err).Should(Succeed())
+		}
+		err = tx.Commit()
+		Expect(err).Should(Succeed())
+
+		lastTestSequence++
+		_, err = insertStmt.Exec(lastTestSequence, "atomictest")
+		Expect(err).Should(Succeed())
+
+		// Wait for everything to arrive. Incomplete transactions are left
+		// out in atomic mode, so this also waits until both are complete.
+		Eventually(func() int {
+			cl = getChanges(fmt.Sprintf("%s/changes?selector=atomictest&since=%s&atomic=true",
+				baseURL, since))
+			return len(cl.Changes)
+		}, testTimeout, testInterval).Should(Equal(4))
+
+		// Without "atomic," the first transaction is cut in half
+		cl = getChanges(fmt.Sprintf("%s/changes?selector=atomictest&since=%s&limit=2",
+			baseURL, since))
+		Expect(len(cl.Changes)).Should(Equal(2))
+		Expect(cl.Transactions).Should(BeEmpty())
+
+		// With it, we get the whole transaction
+		cl = getChanges(fmt.Sprintf("%s/changes?selector=atomictest&since=%s&limit=2&atomic=true",
+			baseURL, since))
+		Expect(len(cl.Changes)).Should(Equal(3))
+		Expect(compareSequence(cl, 2, lastTestSequence-1)).Should(BeTrue())
+		Expect(cl.LastSequence).Should(Equal(cl.Changes[2].Sequence))
+		Expect(len(cl.Transactions)).Should(Equal(1))
+		Expect(cl.Transactions[0].TransactionID).Should(Equal(cl.Changes[0].TransactionID))
+		Expect(cl.Transactions[0].FirstSequence).Should(Equal(cl.Changes[0].Sequence))
+		Expect(cl.Transactions[0].LastSequence).Should(Equal(cl.Changes[2].Sequence))
+		Expect(cl.Transactions[0].Partial).Should(BeFalse())
+
+		// And the rest of the list is the next transaction
+		cl = getChanges(fmt.Sprintf("%s/changes?selector=atomictest&since=%s&limit=2&atomic=true",
+			baseURL, cl.LastSequence))
+		Expect(len(cl.Changes)).Should(Equal(1))
+		Expect(compareSequence(cl, 0, lastTestSequence)).Should(BeTrue())
+		Expect(len(cl.Transactions)).Should(Equal(1))
+	})
+
+	It("Invalid atomic parameter", func() {
+		url := fmt.Sprintf("%s/changes?selector=atomictest&atomic=maybe", baseURL)
+		req := createStandardRequest("GET", url, jsonContent, nil)
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).Should(Succeed())
+		defer resp.Body.Close()
+		checkAPIErrorCode(resp, http.StatusBadRequest, "PARAMETER_INVALID")
+	})
+})
+
+var _ = Describe("Atomic transactions across batches", func() {
+	var s *server
+
+	BeforeEach(func() {
+		db, err := storage.Open(storage.DefaultEngine(), atomicTestDir)
+		Expect(err).Should(Succeed())
+		horizons, err := loadPurgeHorizons(db)
+		Expect(err).Should(Succeed())
+		s = &server{
+			db:       db,
+			tracker:  createTracker(),
+			cache:    createTailCache(0, emptySequence, emptySequence),
+			queries:  createQueryGroup(),
+			metrics:  createMetrics(),
+			horizons: horizons,
+		}
+	})
+
+	AfterEach(func() {
+		s.tracker.close()
+		s.db.Close()
+		Expect(s.db.Delete()).Should(Succeed())
+	})
+
+	makeTx := func(commit uint64, first, count int) []*common.Change {
+		var changes []*common.Change
+		for i := first; i < first+count; i++ {
+			changes = append(changes, &common.Change{
+				Operation:      common.Insert,
+				Table:          "public.atomic",
+				CommitSequence: commit,
+				CommitIndex:    uint32(i),
+				TransactionID:  commit,
+				NewRow: common.Row{
+					selectorColumn: &common.ColumnVal{Value: "atomic"},
+				},
+			})
+		}
+		return changes
+	}
+
+	query := func(since common.Sequence) *common.ChangeList {
+		since.Index++
+		result := s.queryChanges(jsonContent, []string{"atomic"}, since, defaultLimit, true, nil)
+		Expect(result.err).Should(Succeed())
+		cl, err := common.UnmarshalChangeList(result.body)
+		Expect(err).Should(Succeed())
+		return cl
+	}
+
+	It("Transaction split between batches", func() {
+		s.handleChanges(makeTx(10, 0, 2), emptySequence)
+		s.setProcessedLSN(11)
+
+		// The second transaction is stored in two batches
+		s.handleChanges(makeTx(20, 0, 3), emptySequence)
+		s.setProcessedLSN(20)
+
+		cl := query(emptySequence)
+		Expect(len(cl.Changes)).Should(Equal(2))
+		Expect(len(cl.Transactions)).Should(Equal(1))
+		Expect(cl.Transactions[0].CommitSequence).Should(BeEquivalentTo(10))
+		Expect(cl.LastSequence).Should(Equal(cl.Changes[1].Sequence))
+
+		last, err := common.ParseSequence(cl.LastSequence)
+		Expect(err).Should(Succeed())
+		cl = query(last)
+		Expect(cl.Changes).Should(BeEmpty())
+		Expect(cl.LastSequence).Should(Equal(last.String()))
+
+		s.handleChanges(makeTx(20, 3, 2), emptySequence)
+		cl = query(last)
+		Expect(cl.Changes).Should(BeEmpty())
+
+		// Once a later transaction has been stored, it is complete
+		s.handleChanges(makeTx(30, 0, 1), emptySequence)
+		s.setProcessedLSN(30)
+		cl = query(last)
+		Expect(len(cl.Changes)).Should(Equal(5))
+		Expect(len(cl.Transactions)).Should(Equal(1))
+		Expect(cl.Transactions[0].CommitSequence).Should(BeEquivalentTo(20))
+		Expect(cl.Transactions[0].Partial).Should(BeFalse())
+	})
+})
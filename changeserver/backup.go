@@ -0,0 +1,193 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/apigee-labs/transicator/pgclient"
+	"github.com/apigee-labs/transicator/replication"
+	"github.com/apigee-labs/transicator/storage"
+)
+
+const (
+	backupContent      = "application/octet-stream"
+	processedLSNHeader = "Transicator-Processed-LSN"
+)
+
+// How long to wait for a peer to catch up to a new replication slot
+var (
+	bootstrapRetries    = 10
+	bootstrapRetryDelay = 3 * time.Second
+)
+
+/*
+handleGetBackup streams a consistent copy of the whole database. Since the
+backup has every row for every selector, it is served through adminHandler. The "Transicator-Processed-LSN" header says how far replication had
+gone before the backup started, so every change up to that point is in it.
+*/
+func (s *server) handleGetBackup(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	sw := &statusWriter{ResponseWriter: resp}
+	sw.Header().Set("Content-Type", backupContent)
+	sw.Header().Set(processedLSNHeader,
+		pgclient.FormatLSN(atomic.LoadUint64(&s.processedLSN)))
+	err := s.db.GetBackup(sw)
+	if err != nil {
+		log.Warnf("Error creating backup: %s", err)
+		if sw.status == 0 {
+			// Nothing was sent yet, so we can still report the error
+			sendAPIError(serverError, err.Error(), resp, req)
+		}
+	}
+}
+
+/*
+bootstrapFromPeer fills an empty database directory with a backup downloaded
+from another change server. Our own replication slot is created first, so
+Postgres keeps every change committed after that point. Changes that are
+both in the backup and in the slot are skipped later because they are older
+than the newest change in the database. If there is already a database in
+"dbDir," nothing is downloaded.
+
+The backup must reach the point where the slot starts, or the changes
+in between would be lost. If the peer is behind, the backup is discarded and
+downloaded again after a delay.
+*/
+func bootstrapFromPeer(peerURL, tokenFile, storageEngine, dbDir, pgURL, slotName, plugin string) error {
+	if storage.Exists(storageEngine, dbDir) {
+		log.Infof("Database already exists in %s. Not bootstrapping from %s",
+			dbDir, peerURL)
+		return nil
+	}
+
+	err := replication.CreatePluginSlot(pgURL, slotName, plugin)
+	if err != nil {
+		return fmt.Errorf("Error creating replication slot \"%s\": %s", slotName, err)
+	}
+	slotLSN, err := replication.SlotPosition(pgURL, slotName)
+	if err != nil {
+		return fmt.Errorf("Error reading position of replication slot \"%s\": %s", slotName, err)
+	}
+
+	for attempt := 0; ; attempt++ {
+		backupLSN, err := downloadBackup(peerURL, tokenFile, storageEngine, dbDir)
+		if err != nil {
+			return err
+		}
+		if backupLSN >= slotLSN {
+			log.Infof("Restored database in %s from %s", dbDir, peerURL)
+			return nil
+		}
+
+		removeDatabase(storageEngine, dbDir)
+		if attempt >= bootstrapRetries {
+			return fmt.Errorf("Backup from %s ends at LSN %s, before replication slot \"%s\" starts at %s",
+				peerURL, pgclient.FormatLSN(backupLSN), slotName, pgclient.FormatLSN(slotLSN))
+		}
+		log.Infof("Backup from %s ends at LSN %s, before the slot starts at %s. Retrying",
+			peerURL, pgclient.FormatLSN(backupLSN), pgclient.FormatLSN(slotLSN))
+		time.Sleep(bootstrapRetryDelay)
+	}
+}
+
+/*
+downloadBackup restores the backup from the peer into "dbDir" and returns
+the LSN up to which it has every change.
+*/
+func downloadBackup(peerURL, tokenFile, storageEngine, dbDir string) (uint64, error) {
+	req, err := http.NewRequest("GET", peerURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	if tokenFile != "" {
+		tok, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(tok)))
+	}
+
+	log.Infof("Downloading backup from %s", peerURL)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Error downloading backup from %s: HTTP status %d",
+			peerURL, resp.StatusCode)
+	}
+
+	var peerLSN uint64
+	if hdr := resp.Header.Get(processedLSNHeader); hdr != "" {
+		peerLSN, err = pgclient.ParseLSN(hdr)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid %s header from %s: %s", processedLSNHeader, peerURL, err)
+		}
+	}
+
+	err = storage.Restore(storageEngine, dbDir, resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("Error restoring backup: %s", err)
+	}
+
+	lastLSN, err := verifyRestore(storageEngine, dbDir)
+	if err != nil {
+		removeDatabase(storageEngine, dbDir)
+		return 0, fmt.Errorf("Downloaded backup is not valid: %s", err)
+	}
+	if lastLSN > peerLSN {
+		return lastLSN, nil
+	}
+	return peerLSN, nil
+}
+
+func verifyRestore(storageEngine, dbDir string) (uint64, error) {
+	db, err := storage.Open(storageEngine, dbDir)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	_, _, last, err := db.Scan(nil, 0, 0, 0, nil)
+	return last.LSN, err
+}
+
+func removeDatabase(storageEngine, dbDir string) {
+	db, err := storage.Open(storageEngine, dbDir)
+	if err == nil {
+		db.Close()
+		if db.Delete() == nil {
+			return
+		}
+	}
+	// Remove the database and any journal files so that we start clean
+	dbFile := path.Join(dbDir, "transicator")
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(dbFile + suffix)
+	}
+}
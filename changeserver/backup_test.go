@@ -0,0 +1,156 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"github.com/apigee-labs/transicator/common"
+	"github.com/apigee-labs/transicator/replication"
+	"github.com/apigee-labs/transicator/storage"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	backupTestKey = "backupsecret"
+	bootstrapSlot = "change_server_bootstrap_test"
+)
+
+var _ = Describe("Backup tests", func() {
+	var tmpDir string
+	var backupServer *httptest.Server
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "backuptest")
+		Expect(err).Should(Succeed())
+		keyFile := path.Join(tmpDir, "key")
+		err = ioutil.WriteFile(keyFile, []byte(backupTestKey), 0600)
+		Expect(err).Should(Succeed())
+
+		verifier, err := common.CreateTokenVerifier(keyFile, "")
+		Expect(err).Should(Succeed())
+		backupServer = httptest.NewServer(
+			adminHandler(verifier, testServer.handleGetBackup))
+	})
+
+	AfterEach(func() {
+		backupServer.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	It("Backup requires admin", func() {
+		req, err := http.NewRequest("GET", backupServer.URL, nil)
+		Expect(err).Should(Succeed())
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(http.StatusUnauthorized))
+
+		req.Header.Set("Authorization", "Bearer "+makeBackupToken(false))
+		resp, err = http.DefaultClient.Do(req)
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(http.StatusForbidden))
+	})
+
+	It("Bootstrap from peer", func() {
+		tokenFile := path.Join(tmpDir, "token")
+		err := ioutil.WriteFile(tokenFile, []byte(makeBackupToken(true)+"\n"), 0600)
+		Expect(err).Should(Succeed())
+		dbDir := path.Join(tmpDir, "db")
+		defer replication.DropSlot(dbURL, bootstrapSlot)
+
+		err = bootstrapFromPeer(backupServer.URL, tokenFile, storage.DefaultEngine(), dbDir, dbURL, bootstrapSlot, replication.TransicatorPlugin)
+		Expect(err).Should(Succeed())
+		Expect(storage.Exists(storage.DefaultEngine(), dbDir)).Should(BeTrue())
+
+		restored, err := storage.Open(storage.DefaultEngine(), dbDir)
+		Expect(err).Should(Succeed())
+		_, _, lastRestored, err := restored.Scan(nil, 0, 0, 0, nil)
+		restored.Close()
+		Expect(err).Should(Succeed())
+		_, _, last, err := testServer.db.Scan(nil, 0, 0, 0, nil)
+		Expect(err).Should(Succeed())
+		Expect(lastRestored.Compare(last)).Should(BeNumerically("<=", 0))
+		slotLSN, err := replication.SlotPosition(dbURL, bootstrapSlot)
+		Expect(err).Should(Succeed())
+		Expect(atomic.LoadUint64(&testServer.processedLSN)).Should(BeNumerically(">=", slotLSN))
+
+		// The slot was created, and a second bootstrap does nothing
+		err = bootstrapFromPeer("http://localhost:1/notfound", tokenFile, storage.DefaultEngine(), dbDir,
+			dbURL, bootstrapSlot, replication.TransicatorPlugin)
+		Expect(err).Should(Succeed())
+	})
+
+	It("Bootstrap from peer that is behind", func() {
+		tokenFile := path.Join(tmpDir, "token")
+		err := ioutil.WriteFile(tokenFile, []byte(makeBackupToken(true)), 0600)
+		Expect(err).Should(Succeed())
+		dbDir := path.Join(tmpDir, "db")
+		defer replication.DropSlot(dbURL, bootstrapSlot)
+
+		// A peer that has not seen anything since the slot was created
+		stale := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			resp.Header().Set(processedLSNHeader, "0/1")
+			testServer.db.GetBackup(resp)
+		}))
+		defer stale.Close()
+
+		savedRetries, savedDelay := bootstrapRetries, bootstrapRetryDelay
+		bootstrapRetries, bootstrapRetryDelay = 1, 10*time.Millisecond
+		defer func() {
+			bootstrapRetries, bootstrapRetryDelay = savedRetries, savedDelay
+		}()
+
+		err = bootstrapFromPeer(stale.URL, tokenFile, storage.DefaultEngine(), dbDir, dbURL, bootstrapSlot, replication.TransicatorPlugin)
+		Expect(err).ShouldNot(Succeed())
+		Expect(storage.Exists(storage.DefaultEngine(), dbDir)).Should(BeFalse())
+	})
+
+	It("Bootstrap bad token", func() {
+		tokenFile := path.Join(tmpDir, "token")
+		err := ioutil.WriteFile(tokenFile, []byte(makeBackupToken(false)), 0600)
+		Expect(err).Should(Succeed())
+		dbDir := path.Join(tmpDir, "db")
+		defer replication.DropSlot(dbURL, bootstrapSlot)
+
+		err = bootstrapFromPeer(backupServer.URL, tokenFile, storage.DefaultEngine(), dbDir, dbURL, bootstrapSlot, replication.TransicatorPlugin)
+		Expect(err).ShouldNot(Succeed())
+		Expect(storage.Exists(storage.DefaultEngine(), dbDir)).Should(BeFalse())
+	})
+})
+
+func makeBackupToken(admin bool) string {
+	hdr, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	body, _ := json.Marshal(map[string]interface{}{"admin": admin})
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." +
+		base64.RawURLEncoding.EncodeToString(body)
+	mac := hmac.New(sha256.New, []byte(backupTestKey))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
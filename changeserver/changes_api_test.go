@@ -354,6 +354,34 @@ var _ = Describe("Changes API Tests", func() {
 		}
 	})
 
+	It("Since time", func() {
+		lastTestSequence++
+		_, err := insertStmt.Exec(lastTestSequence, "sincetime")
+		Expect(err).Should(Succeed())
+
+		var change common.Change
+		Eventually(func() int {
+			cl := getChanges(fmt.Sprintf(
+				"%s/changes?since=%s&selector=sincetime", baseURL, lastChangeSequence))
+			if len(cl.Changes) > 0 {
+				change = cl.Changes[0]
+			}
+			return len(cl.Changes)
+		}, testTimeout, testInterval).Should(Equal(1))
+		lastChangeSequence = change.GetSequence()
+
+		// The change is found by its own timestamp, and not by a later time
+		ts := time.Unix(change.Timestamp, 0).UTC()
+		cl := getChanges(fmt.Sprintf(
+			"%s/changes?selector=sincetime&sinceTime=%s", baseURL, ts.Format(time.RFC3339)))
+		Expect(len(cl.Changes)).Should(Equal(1))
+		Expect(cl.Changes[0].Sequence).Should(Equal(change.Sequence))
+
+		cl = getChanges(fmt.Sprintf(
+			"%s/changes?selector=sincetime&sinceTime=%s", baseURL, ts.Add(time.Second).Format(time.RFC3339)))
+		Expect(cl.Changes).Should(BeEmpty())
+	})
+
 	It("Long polling empty", func() {
 		for _, p := range []string{"scope", "selector"} {
 			lastCommit := lastChangeSequence
@@ -494,7 +522,7 @@ var _ = Describe("Changes API Tests", func() {
 	It("Cleanup", func() {
 		for _, p := range []string{"scope", "selector"} {
 			func() {
-				testServer.startCleanup(5 * time.Second)
+				testServer.startCleanup(5*time.Second, 0, nil, nil)
 				defer func() {
 					testServer.cleaner.stop()
 					testServer.cleaner = nil
@@ -624,6 +652,25 @@ var _ = Describe("Changes API Tests", func() {
 			}()
 		}
 	})
+
+	It("should detect invalid sinceTime and minLSN query params", func() {
+		for _, q := range []string{
+			"sinceTime=yesterday",
+			"sinceTime=2017-01-01",
+			"sinceTime=2017-01-01T00:00:00Z&since=0.1.0",
+			"minLSN=16",
+			"minLSN=foo/bar",
+		} {
+			func() {
+				u := fmt.Sprintf("%s/changes?selector=abc123&%s", baseURL, q)
+				req := createStandardRequest("GET", u, "application/json", nil)
+				resp, err := http.DefaultClient.Do(req)
+				Expect(err).Should(Succeed())
+				defer resp.Body.Close()
+				checkAPIErrorCode(resp, http.StatusBadRequest, "PARAMETER_INVALID")
+			}()
+		}
+	})
 })
 
 func createStandardRequest(method string, urlStr string, acceptHdr string, body io.Reader) *http.Request {
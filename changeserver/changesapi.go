@@ -26,6 +26,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/apid/goscaffold"
 	"github.com/apigee-labs/transicator/common"
+	"github.com/apigee-labs/transicator/pgclient"
 	"github.com/apigee-labs/transicator/replication"
 	"github.com/julienschmidt/httprouter"
 )
@@ -37,6 +38,7 @@ const (
 )
 
 var emptySequence = common.Sequence{}
+var errSnapshotOld = errors.New("Snapshot too old")
 var lowestPossibleSequence = common.MakeSequence(0, 1)
 var reChangeSelector = regexp.MustCompile(changeSelectorValidChars)
 
@@ -45,7 +47,8 @@ func (s *server) initChangesAPI(prefix string, router *httprouter.Router) {
 }
 
 func (s *server) handleGetChanges(resp http.ResponseWriter, req *http.Request) {
-	enc := goscaffold.SelectMediaType(req, []string{jsonContent, protoContent})
+	enc := goscaffold.SelectMediaType(req,
+		[]string{jsonContent, protoContent, eventStreamContent})
 	if enc == "" {
 		sendAPIError(unsupportedFormat, "", resp, req)
 		return
@@ -69,132 +72,541 @@ func (s *server) handleGetChanges(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	scopes, err := getCheckChangeSelectorParams(req)
+	atomic, err := getBoolParam(q, "atomic", false)
 	if err != nil {
-		sendAPIError(invalidParameter, err.Error(), resp, req)
+		sendAPIError(invalidParameter, "atomic", resp, req)
 		return
 	}
-	if len(scopes) == 0 {
-		// If no scope specified, replace with the empty scope
-		scopes = []string{""}
+
+	scopes, sinceSeq, snapshotFilter, tables, err := getChangesQueryParams(req)
+	if err != nil {
+		sendParamError(err, resp, req)
+		return
 	}
 
-	var sinceSeq common.Sequence
-	since := q.Get("since")
-	if since == "" {
-		sinceSeq = emptySequence
-	} else {
-		sinceSeq, err = common.ParseSequence(since)
+	maxWait := time.Duration(block) * time.Second
+	minLSN := q.Get("minLSN")
+	if minLSN != "" {
+		lsn, err := pgclient.ParseLSN(minLSN)
 		if err != nil {
-			sendAPIError(invalidParameter, "since", resp, req)
+			sendAPIError(invalidParameter, "minLSN", resp, req)
 			return
 		}
+		// The wait counts against the time that the client will block
+		waitStart := time.Now()
+		s.waitForLSN(lsn, maxWait)
+		maxWait -= time.Since(waitStart)
 	}
 
-	var snapshotFilter func([]byte) bool
-	snapStr := q.Get("snapshot")
-	if snapStr != "" {
-		var snapshot *replication.Snapshot
-		snapshot, err = replication.MakeSnapshot(snapStr)
+	sinceTime := q.Get("sinceTime")
+	if sinceTime != "" {
+		if q.Get("since") != "" {
+			sendAPIError(invalidParameter, "since and sinceTime may not both be set", resp, req)
+			return
+		}
+		t, err := time.Parse(time.RFC3339, sinceTime)
 		if err != nil {
-			sendAPIError(invalidParameter, "snapshot", resp, req)
+			sendAPIError(invalidParameter, "sinceTime", resp, req)
+			return
+		}
+		sinceSeq, err = s.sequenceSince(scopes, t)
+		if err != nil {
+			sendChangesError(err, resp, req)
 			return
 		}
-		snapshotFilter = makeSnapshotFilter(snapshot)
 	}
 
-	// Need to advance past a single "since" value
-	sinceSeq.Index++
+	if enc == eventStreamContent {
+		s.handleChangeEvents(limit, scopes, sinceSeq, snapshotFilter, tables, resp, req)
+		return
+	}
 
-	firstSeq, lastSeq, entries, success :=
-		s.receiveChanges(scopes, sinceSeq, limit, snapshotFilter, resp, req)
-	if !success {
+	// Many clients may ask for exactly the same thing at once, so identical
+	// queries are only run and encoded once.
+	key := makeQueryKey(enc, scopes, sinceSeq, limit, atomic, q)
+	query := func() *queryResult {
+		return s.queryChanges(enc, scopes, sinceSeq, limit, atomic, snapshotFilter)
+	}
+
+	result := s.queries.do(key, query)
+	if result.err != nil {
+		sendChangesError(result.err, resp, req)
 		return
 	}
 
-	if len(entries) == 0 && block > 0 {
+	if result.count == 0 && result.pending != 0 && maxWait > 0 {
+		// The changes are there, but their transaction isn't complete yet
+		log.Debugf("Waiting for transaction at %d for up to %s", result.pending, maxWait)
+		if s.waitForLSN(result.pending+1, maxWait) {
+			result = s.queries.do(key, query)
+			if result.err != nil {
+				sendChangesError(result.err, resp, req)
+				return
+			}
+		}
+	} else if result.count == 0 && maxWait > 0 {
 		// Query -- which was consistent at the "snapshot" level -- didn't
 		// return anything. Wait until something is put in the database and try again.
-		waitSeq := lastSeq
+		waitSeq := result.lastSeq
 		waitSeq.Index++
 
-		log.Debugf("Blocking at %s for up to %d seconds", waitSeq, block)
-		newIndex := s.tracker.timedWait(waitSeq, time.Duration(block)*time.Second, scopes)
+		log.Debugf("Blocking at %s for up to %s", waitSeq, maxWait)
+		newIndex := s.tracker.timedWaitTables(waitSeq,
+			maxWait, scopes, tables.matches)
 
 		if newIndex.Compare(sinceSeq) > 0 {
-			firstSeq, lastSeq, entries, success =
-				s.receiveChanges(scopes, sinceSeq, limit, snapshotFilter, resp, req)
-			if !success {
+			result = s.queries.do(key, query)
+			if result.err == nil && result.lastSeq.Compare(newIndex) < 0 {
+				// We got the result of a query that started before the change
+				// that woke us up, so it can't have seen it.
+				result = s.queries.do(key, query)
+			}
+			if result.err != nil {
+				sendChangesError(result.err, resp, req)
 				return
 			}
 		}
 	}
 
-	changeList := common.ChangeList{
-		FirstSequence: firstSeq.String(),
-		LastSequence:  lastSeq.String(),
+	resp.Header().Set("Content-Type", enc)
+	resp.Write(result.body)
+}
+
+/*
+queryChanges reads the changes for a call to the changes API and encodes
+the response in the media type "enc."
+*/
+func (s *server) queryChanges(
+	enc string, scopes []string, sinceSeq common.Sequence,
+	limit int, atomic bool, filter func([]byte) bool) *queryResult {
+
+	// Read this before the scan, so that every transaction that committed
+	// before it is already completely in the database when we scan.
+	processed := s.getProcessedLSN()
+
+	firstSeq, lastSeq, changes, err := s.fetchChanges(scopes, sinceSeq, limit, filter)
+	if err != nil {
+		return &queryResult{err: err}
 	}
 
-	for _, e := range entries {
-		change, err := decodeChangeProto(e)
+	truncated := len(changes) >= limit && limit > 0
+	partial := false
+	if atomic && truncated {
+		changes, partial, err = s.completeTransaction(scopes, changes, filter)
 		if err != nil {
-			sendAPIError(serverError,
-				fmt.Sprintf("Invalid data in database: %s", err), resp, req)
+			return &queryResult{err: err}
 		}
-		// Database doesn't have value of "Sequence" in it
-		change.Sequence = change.GetSequence().String()
-		changeList.Changes = append(changeList.Changes, *change)
 	}
 
-	// Important to return an intermediate sequence if we ran up against the limit
-	if len(entries) == limit && limit > 0 {
-		changeList.LastSequence = changeList.Changes[len(entries)-1].Sequence
+	var pending uint64
+	if atomic && !partial && len(changes) > 0 &&
+		changes[len(changes)-1].CommitSequence >= processed {
+		// Replication stores changes in batches, which may end in the middle
+		// of a transaction, so the last one may not all be there yet.
+		pending = changes[len(changes)-1].CommitSequence
+		for len(changes) > 0 && changes[len(changes)-1].CommitSequence == pending {
+			changes = changes[:len(changes)-1]
+		}
+		truncated = true
 	}
 
+	changeList := makeChangeList(firstSeq, lastSeq, changes, truncated)
+	if pending != 0 && len(changes) == 0 {
+		// Nothing to return, so the client should ask again from the same place
+		since := sinceSeq
+		since.Index--
+		changeList.LastSequence = since.String()
+	}
+	if atomic {
+		groupTransactions(changeList, partial)
+	}
+
+	result := &queryResult{
+		lastSeq: lastSeq,
+		count:   len(changes),
+		pending: pending,
+	}
 	switch enc {
 	case jsonContent:
-		resp.Header().Set("Content-Type", jsonContent)
-		resp.Write(changeList.Marshal())
+		result.body = changeList.Marshal()
 	case protoContent:
-		resp.Header().Set("Content-Type", protoContent)
-		resp.Write(changeList.MarshalProto())
+		result.body = changeList.MarshalProto()
 	default:
 		panic("Got to an unsupported media type")
 	}
+	return result
 }
 
 func (s *server) receiveChanges(
 	scopes []string, sinceSeq common.Sequence,
 	limit int, filter func([]byte) bool,
-	resp http.ResponseWriter, req *http.Request) (firstSeq, lastSeq common.Sequence, entries [][]byte, success bool) {
+	resp http.ResponseWriter, req *http.Request) (firstSeq, lastSeq common.Sequence, changes []*common.Change, success bool) {
+
+	var err error
+	firstSeq, lastSeq, changes, err = s.fetchChanges(scopes, sinceSeq, limit, filter)
+	if err != nil {
+		sendChangesError(err, resp, req)
+		return
+	}
+
+	success = true
+	return
+}
+
+/*
+sendChangesError sends the right error for a failure to read changes.
+*/
+func sendChangesError(err error, resp http.ResponseWriter, req *http.Request) {
+	if err == errSnapshotOld {
+		sendAPIError(snapshotOld, "", resp, req)
+	} else {
+		sendAPIError(serverError, err.Error(), resp, req)
+	}
+}
+
+/*
+sequenceSince returns the sequence of the first change whose timestamp is
+at or after "t," which may be passed directly to "fetchChanges." Timestamps
+only have whole seconds, so "t" is rounded down. If there is no change
+since then, it returns the sequence right after the last change.
+It returns errSnapshotOld if changes for the scopes from that time may
+already have been purged.
+*/
+func (s *server) sequenceSince(scopes []string, t time.Time) (common.Sequence, error) {
+	t = t.Truncate(time.Second)
+	if s.cleaner != nil && t.Before(s.cleaner.retainedSince(scopes, time.Now())) {
+		log.Debugf("sinceTime of %s is older than the retention period", t)
+		return emptySequence, errSnapshotOld
+	}
+
+	if s.horizons != nil {
+		s.horizons.lock.RLock()
+		defer s.horizons.lock.RUnlock()
+	}
+
+	seq, found, err := s.db.FirstSequenceSince(t)
+	if err != nil {
+		return emptySequence, err
+	}
+	_, firstSeq, lastSeq, err := s.db.Scan(nil, 0, 0, 0, nil)
+	if err != nil {
+		return emptySequence, err
+	}
+	if !found {
+		return nextSequence(lastSeq), nil
+	}
+
+	// If even the first change is from after "t," then the changes that
+	// were purged before it may have been from after "t" too
+	if seq.Compare(firstSeq) <= 0 && s.horizons != nil && s.horizons.purgedAny(scopes) {
+		log.Debugf("sinceTime of %s is older than the first change", t)
+		return emptySequence, errSnapshotOld
+	}
+	return seq, nil
+}
+
+/*
+fetchChanges reads changes for the specified scopes. Recent changes come
+from the tail cache, and older ones from the database. It returns
+errSnapshotOld if "sinceSeq" refers to a change that has already been
+purged. Since selectors may be purged on their own, "firstSeq" is the
+oldest sequence from which every change for the requested scopes is still
+available. The changes may be shared with other requests, so they must
+not be modified.
+*/
+func (s *server) fetchChanges(
+	scopes []string, sinceSeq common.Sequence,
+	limit int, filter func([]byte) bool) (firstSeq, lastSeq common.Sequence, changes []*common.Change, err error) {
 
 	log.Debugf("Receiving changes: scopes = %v since = %s limit = %d",
 		scopes, sinceSeq, limit)
 
-	var err error
-	entries, firstSeq, lastSeq, err = s.db.Scan(
-		scopes, sinceSeq.LSN, sinceSeq.Index, limit, filter)
+	// When a row moves between selectors, there are two changes with the
+	// same sequence. Read one extra entry so that we never return only one
+	// of them, since the client would skip the other on the next call.
+	scanLimit := limit
+	if limit > 0 {
+		scanLimit++
+	}
 
-	if err != nil {
-		sendAPIError(serverError, err.Error(), resp, req)
-		return
+	// Don't let the cleaner purge a selector between reading and checking
+	s.horizons.lock.RLock()
+	defer s.horizons.lock.RUnlock()
+
+	var cached bool
+	firstSeq, lastSeq, changes, cached = s.cache.scan(scopes, sinceSeq, scanLimit, filter)
+	s.metrics.countCacheRequest(cached)
+	if !cached {
+		var entries [][]byte
+		scanStart := time.Now()
+		entries, firstSeq, lastSeq, err = s.db.Scan(
+			scopes, sinceSeq.LSN, sinceSeq.Index, scanLimit, filter)
+		s.metrics.scanLatency.observe(time.Since(scanStart).Seconds())
+		if err != nil {
+			return
+		}
+		changes, err = decodeEntries(entries)
+		if err != nil {
+			return
+		}
+	}
+
+	if limit > 0 && len(changes) > limit &&
+		changes[limit-1].GetSequence().Compare(changes[limit].GetSequence()) != 0 {
+		changes = changes[:limit]
 	}
+	firstSeq = s.horizons.firstSequence(scopes, firstSeq)
 	if sinceSeq.Compare(firstSeq) < 0 && sinceSeq.Compare(lowestPossibleSequence) > 0 {
 		// "since" parameter specified and too old. Need to return an error.
 		log.Debugf("since value of %s is too old compared to %s\n",
 			sinceSeq, firstSeq)
-		sendAPIError(snapshotOld, "", resp, req)
+		err = errSnapshotOld
 		return
 	}
 
-	log.Debugf("Received %d changes", len(entries))
-	success = true
+	log.Debugf("Received %d changes", len(changes))
+	return
+}
+
+func decodeEntries(entries [][]byte) ([]*common.Change, error) {
+	changes := make([]*common.Change, len(entries))
+	for i, e := range entries {
+		change, err := decodeChangeProto(e)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid data in database: %s", err)
+		}
+		changes[i] = change
+	}
+	return changes, nil
+}
+
+/*
+makeChangeList assembles changes into a change list that is ready to be
+marshaled. The changes are copied first since they may be shared.
+If "truncated" is set, then the changes did not include everything
+in the database, so "LastSequence" is set to the last change in the list.
+*/
+func makeChangeList(
+	firstSeq, lastSeq common.Sequence,
+	changes []*common.Change, truncated bool) *common.ChangeList {
+
+	changeList := &common.ChangeList{
+		FirstSequence: firstSeq.String(),
+		LastSequence:  lastSeq.String(),
+	}
+
+	for _, c := range changes {
+		change := *c
+		// Database doesn't have value of "Sequence" in it
+		change.Sequence = change.GetSequence().String()
+		applyColumnPolicy(&change)
+
+		// The synthetic delete for a row that moved between selectors must
+		// come before the insert. They have the same sequence so the database
+		// might return them in either order.
+		n := len(changeList.Changes)
+		if n > 0 && change.Operation == common.Delete && change.Synthetic &&
+			changeList.Changes[n-1].Sequence == change.Sequence {
+			changeList.Changes = append(changeList.Changes, changeList.Changes[n-1])
+			changeList.Changes[n-1] = change
+		} else {
+			changeList.Changes = append(changeList.Changes, change)
+		}
+	}
+
+	// Important to return an intermediate sequence if we ran up against the limit
+	if truncated && len(changeList.Changes) > 0 {
+		changeList.LastSequence = changeList.Changes[len(changeList.Changes)-1].Sequence
+	}
+	return changeList
+}
+
+/*
+applyColumnPolicy removes or hashes columns as directed by the column
+policy. The rules are chosen using the selector of the row, which we find
+before we modify anything in case the selector column itself is dropped.
+*/
+func applyColumnPolicy(change *common.Change) {
+	if !columnPolicy.HasTable(change.Table) {
+		return
+	}
+
+	var selector string
+	if change.NewRow[selectorColumn] != nil {
+		change.NewRow.Get(selectorColumn, &selector)
+	} else {
+		change.OldRow.Get(selectorColumn, &selector)
+	}
+
+	// The rows may be shared with the tail cache, so change copies of them
+	change.NewRow = copyRow(change.NewRow)
+	change.OldRow = copyRow(change.OldRow)
+	columnPolicy.ApplyRow(change.Table, selector, change.NewRow)
+	columnPolicy.ApplyRow(change.Table, selector, change.OldRow)
+}
+
+func copyRow(row common.Row) common.Row {
+	if row == nil {
+		return nil
+	}
+	cp := make(common.Row, len(row))
+	for k, v := range row {
+		cp[k] = v
+	}
+	return cp
+}
+
+/*
+completeTransaction is used when the client asked for atomic transactions
+and the list of entries was cut off by the limit. If we can, we read the
+rest of the last transaction from the database. If that would put us
+over the maximum number of changes, we instead cut the list back to
+the end of the previous transaction. If the list contains only one
+transaction and it is too large, there is nothing we can do, so we
+return it and "partial" is set to true.
+*/
+func (s *server) completeTransaction(
+	scopes []string, changes []*common.Change,
+	filter func([]byte) bool) ([]*common.Change, bool, error) {
+
+	commitSeq := changes[len(changes)-1].CommitSequence
+
+	// Find out where the last transaction started in case we need to truncate
+	txStart := len(changes) - 1
+	for txStart > 0 && changes[txStart-1].CommitSequence == commitSeq {
+		txStart--
+	}
+
+	next := changes[len(changes)-1].GetSequence()
+	next.Index++
+	batchSize := len(changes)
+	extended := changes
+
+	for len(extended) < maxLimitChanges {
+		if batchSize > maxLimitChanges-len(extended) {
+			batchSize = maxLimitChanges - len(extended)
+		}
+		_, _, more, err := s.fetchChanges(scopes, next, batchSize, filter)
+		if err != nil {
+			return nil, false, err
+		}
+
+		for _, c := range more {
+			if c.CommitSequence != commitSeq {
+				// Found the beginning of the next transaction
+				return extended, false, nil
+			}
+			extended = append(extended, c)
+			next = c.GetSequence()
+			next.Index++
+		}
+
+		if len(more) < batchSize {
+			// Nothing else in the database
+			return extended, false, nil
+		}
+	}
+
+	log.Debugf("Transaction at commit sequence %d exceeds %d changes",
+		commitSeq, maxLimitChanges)
+	if txStart > 0 {
+		return changes[:txStart], false, nil
+	}
+	return extended, true, nil
+}
+
+/*
+groupTransactions fills in the "Transactions" field of the change list.
+The changes from a single transaction are always adjacent to each other
+because they all have the same commit sequence.
+*/
+func groupTransactions(changeList *common.ChangeList, partial bool) {
+	for _, c := range changeList.Changes {
+		n := len(changeList.Transactions)
+		if n > 0 && changeList.Transactions[n-1].CommitSequence == c.CommitSequence {
+			changeList.Transactions[n-1].LastSequence = c.Sequence
+			continue
+		}
+		changeList.Transactions = append(changeList.Transactions, common.Transaction{
+			TransactionID:  c.TransactionID,
+			CommitSequence: c.CommitSequence,
+			FirstSequence:  c.Sequence,
+			LastSequence:   c.Sequence,
+		})
+	}
+
+	if partial && len(changeList.Transactions) > 0 {
+		changeList.Transactions[len(changeList.Transactions)-1].Partial = true
+	}
+}
+
+/*
+getChangesQueryParams reads the query parameters that select which changes
+to return, and which are shared by all the variants of the changes API.
+The returned sequence has already been advanced past the "since" value
+so that it may be passed directly to "fetchChanges." The returned filter
+combines the "snapshot" and table parameters, and the table filter is
+also returned separately so that it may be used when waiting for changes.
+*/
+func getChangesQueryParams(req *http.Request) (
+	scopes []string, sinceSeq common.Sequence,
+	filter func([]byte) bool, tables *tableFilter, err error) {
+
+	q := req.URL.Query()
+
+	scopes, err = getCheckChangeSelectorParams(req)
+	if err != nil {
+		return
+	}
+	if len(scopes) == 0 {
+		// If no scope specified, replace with the empty scope
+		scopes = []string{""}
+		err = common.CheckSelectors(req, scopes)
+		if err != nil {
+			return
+		}
+	}
+
+	since := q.Get("since")
+	if since == "" {
+		sinceSeq = emptySequence
+	} else {
+		sinceSeq, err = common.ParseSequence(since)
+		if err != nil {
+			err = errors.New("since")
+			return
+		}
+	}
+
+	snapStr := q.Get("snapshot")
+	if snapStr != "" {
+		var snapshot *replication.Snapshot
+		snapshot, err = replication.MakeSnapshot(snapStr)
+		if err != nil {
+			err = errors.New("snapshot")
+			return
+		}
+		filter = makeSnapshotFilter(snapshot)
+	}
+
+	tables, err = makeTableFilter(q["table"], q["excludeTable"])
+	if err != nil {
+		err = errors.New("table")
+		return
+	}
+	if tables != nil {
+		filter = combineFilters(filter, tables.filterEntry)
+	}
+
+	// Need to advance past a single "since" value
+	sinceSeq.Index++
 	return
 }
 
 /*
 getChangeSelectorParams combines all 'scope' query
-params into one slice after checking for valid characters.
+params into one slice after checking for valid characters, and
+returns a SelectorAccessError if the client's token does not allow them.
 */
 func getCheckChangeSelectorParams(r *http.Request) ([]string, error) {
 	scopes := r.URL.Query()["scope"]
@@ -209,7 +621,12 @@ func getCheckChangeSelectorParams(r *http.Request) ([]string, error) {
 			return nil, errors.New("Invalid char in selector param")
 		}
 	}
-	return append(scopes, selectors...), nil
+	all := append(scopes, selectors...)
+	err := common.CheckSelectors(r, all)
+	if err != nil {
+		return nil, err
+	}
+	return all, nil
 }
 
 func makeSnapshotFilter(ss *replication.Snapshot) func([]byte) bool {
@@ -16,6 +16,7 @@ limitations under the License.
 package main
 
 import (
+	"container/heap"
 	"sync/atomic"
 	"time"
 
@@ -34,13 +35,58 @@ type trackerUpdate struct {
 	key        int32
 	change     common.Sequence
 	selector   string
-	waiter     changeWaiter
+	table      string
+	waiter     *changeWaiter
 }
 
 type changeWaiter struct {
+	key       int32
 	change    common.Sequence
 	selectors map[string]bool
+	tables    func(string) bool
 	rc        chan common.Sequence
+	// Position of this waiter in the heap for each of its selectors
+	indices map[string]int
+}
+
+/*
+A waiterHeap holds all the waiters for one selector, ordered by the change
+that they are waiting for, so that an update only has to look at the
+waiters that it will actually wake up. It implements heap.Interface.
+A waiter with several selectors is in several heaps at once.
+*/
+type waiterHeap struct {
+	selector string
+	waiters  []*changeWaiter
+}
+
+func (h *waiterHeap) Len() int {
+	return len(h.waiters)
+}
+
+func (h *waiterHeap) Less(i, j int) bool {
+	return h.waiters[i].change.Compare(h.waiters[j].change) < 0
+}
+
+func (h *waiterHeap) Swap(i, j int) {
+	h.waiters[i], h.waiters[j] = h.waiters[j], h.waiters[i]
+	h.waiters[i].indices[h.selector] = i
+	h.waiters[j].indices[h.selector] = j
+}
+
+func (h *waiterHeap) Push(x interface{}) {
+	w := x.(*changeWaiter)
+	w.indices[h.selector] = len(h.waiters)
+	h.waiters = append(h.waiters, w)
+}
+
+func (h *waiterHeap) Pop() interface{} {
+	last := len(h.waiters) - 1
+	w := h.waiters[last]
+	h.waiters[last] = nil
+	h.waiters = h.waiters[:last]
+	delete(w.indices, h.selector)
+	return w
 }
 
 /*
@@ -48,11 +94,15 @@ A changeTracker allows clients to submit a change, and to wait for a change
 to occur. The overall effect is like a condition variable, in that waiters
 are notified when something changes. This work is done using a goroutine,
 which is simpler and faster than the equivalent using a condition variable.
+Waiters are indexed by selector so that the cost of an update depends on
+the number of waiters that it wakes up, not the total number of waiters.
 */
 type changeTracker struct {
 	updateChan  chan trackerUpdate
 	lastKey     int32
-	waiters     map[int32]changeWaiter
+	waiterCount int32
+	waiters     map[int32]*changeWaiter
+	selectors   map[string]*waiterHeap
 	lastChanges map[string]common.Sequence
 }
 
@@ -82,10 +132,21 @@ Update indicates that the current sequence has changed. Wake up any waiting
 waiters and tell them about it.
 */
 func (t *changeTracker) update(change common.Sequence, selector string) {
+	t.updateTable(change, selector, "")
+}
+
+/*
+updateTable is like update, but it also records the name of the table that
+changed. Waiters that are only interested in certain tables will not
+be woken up by changes to other tables. An empty table name matches
+every waiter.
+*/
+func (t *changeTracker) updateTable(change common.Sequence, selector, table string) {
 	u := trackerUpdate{
 		updateType: update,
 		change:     change,
 		selector:   selector,
+		table:      table,
 	}
 	t.updateChan <- u
 }
@@ -95,7 +156,7 @@ Wait blocks the calling gorouting forever until the change tracker has reached a
 "curChange." Return the current value when that happens.
 */
 func (t *changeTracker) wait(curChange common.Sequence, selectors []string) common.Sequence {
-	_, resultChan := t.doWait(curChange, selectors)
+	_, resultChan := t.doWait(curChange, selectors, nil)
 	return <-resultChan
 }
 
@@ -105,7 +166,18 @@ TimedWait blocks the current gorouting until either a new value higher than
 */
 func (t *changeTracker) timedWait(
 	curChange common.Sequence, maxWait time.Duration, selectors []string) common.Sequence {
-	key, resultChan := t.doWait(curChange, selectors)
+	return t.timedWaitTables(curChange, maxWait, selectors, nil)
+}
+
+/*
+timedWaitTables is like timedWait, but it is only woken up by changes to
+tables for which "tables" returns true. If "tables" is nil then changes
+to any table will do.
+*/
+func (t *changeTracker) timedWaitTables(
+	curChange common.Sequence, maxWait time.Duration, selectors []string,
+	tables func(string) bool) common.Sequence {
+	key, resultChan := t.doWait(curChange, selectors, tables)
 	timer := time.NewTimer(maxWait)
 	select {
 	case result := <-resultChan:
@@ -120,7 +192,9 @@ func (t *changeTracker) timedWait(
 	}
 }
 
-func (t *changeTracker) doWait(curChange common.Sequence, selectors []string) (int32, chan common.Sequence) {
+func (t *changeTracker) doWait(
+	curChange common.Sequence, selectors []string,
+	tables func(string) bool) (int32, chan common.Sequence) {
 	key := atomic.AddInt32(&t.lastKey, 1)
 	resultChan := make(chan common.Sequence, 1)
 	selectorMap := make(map[string]bool)
@@ -131,22 +205,33 @@ func (t *changeTracker) doWait(curChange common.Sequence, selectors []string) (i
 	u := trackerUpdate{
 		updateType: newWaiter,
 		key:        key,
-		waiter: changeWaiter{
+		waiter: &changeWaiter{
+			key:       key,
 			change:    curChange,
 			selectors: selectorMap,
+			tables:    tables,
 			rc:        resultChan,
+			indices:   make(map[string]int),
 		},
 	}
 	t.updateChan <- u
 	return key, resultChan
 }
 
+/*
+numWaiters returns the number of clients that are currently waiting.
+*/
+func (t *changeTracker) numWaiters() int {
+	return int(atomic.LoadInt32(&t.waiterCount))
+}
+
 /*
  * This is the goroutine. It receives updates for new waiters, and updates
  * for new sequences, and distributes them appropriately.
  */
 func (t *changeTracker) run() {
-	t.waiters = make(map[int32]changeWaiter)
+	t.waiters = make(map[int32]*changeWaiter)
+	t.selectors = make(map[string]*waiterHeap)
 	t.lastChanges = make(map[string]common.Sequence)
 
 	running := true
@@ -162,6 +247,7 @@ func (t *changeTracker) run() {
 		case newWaiter:
 			t.handleWaiter(up)
 		}
+		atomic.StoreInt32(&t.waiterCount, int32(len(t.waiters)))
 	}
 
 	// Close out all waiting waiters
@@ -176,27 +262,70 @@ func (t *changeTracker) handleUpdate(up trackerUpdate) {
 		t.lastChanges[up.selector] = up.change
 	}
 
-	for k, w := range t.waiters {
-		if up.change.Compare(w.change) >= 0 && w.selectors[up.selector] {
-			//log.Debugf("Waking up waiter waiting for change %d with change %d and tag %s",
-			//	w.change, up.change, up.tag)
+	h := t.selectors[up.selector]
+	if h == nil {
+		return
+	}
+
+	// Waiters that are caught up but don't care about this table go back
+	// in the heap once we are done.
+	var skipped []*changeWaiter
+	for h.Len() > 0 && up.change.Compare(h.waiters[0].change) >= 0 {
+		w := heap.Pop(h).(*changeWaiter)
+		if w.tables == nil || up.table == "" || w.tables(up.table) {
 			w.rc <- up.change
-			delete(t.waiters, k)
+			t.removeWaiter(w)
+		} else {
+			skipped = append(skipped, w)
 		}
 	}
+
+	for _, w := range skipped {
+		heap.Push(h, w)
+	}
+	if h.Len() == 0 {
+		delete(t.selectors, up.selector)
+	}
 }
 
 func (t *changeTracker) handleWaiter(u trackerUpdate) {
-	maxAlready := t.getMaxChange(u.waiter.selectors)
-	if maxAlready.Compare(u.waiter.change) >= 0 {
-		u.waiter.rc <- maxAlready
-	} else {
-		t.waiters[u.key] = u.waiter
+	w := u.waiter
+	maxAlready := t.getMaxChange(w.selectors)
+	if maxAlready.Compare(w.change) >= 0 {
+		w.rc <- maxAlready
+		return
+	}
+
+	t.waiters[w.key] = w
+	for selector := range w.selectors {
+		h := t.selectors[selector]
+		if h == nil {
+			h = &waiterHeap{selector: selector}
+			t.selectors[selector] = h
+		}
+		heap.Push(h, w)
 	}
 }
 
 func (t *changeTracker) handleCancel(key int32) {
-	delete(t.waiters, key)
+	w := t.waiters[key]
+	if w != nil {
+		t.removeWaiter(w)
+	}
+}
+
+/*
+removeWaiter takes a waiter out of the heap for each of its selectors.
+*/
+func (t *changeTracker) removeWaiter(w *changeWaiter) {
+	delete(t.waiters, w.key)
+	for selector, ix := range w.indices {
+		h := t.selectors[selector]
+		heap.Remove(h, ix)
+		if h.Len() == 0 {
+			delete(t.selectors, selector)
+		}
+	}
 }
 
 func (t *changeTracker) getMaxChange(selectors map[string]bool) common.Sequence {
@@ -207,6 +207,30 @@ var _ = Describe("Change tracker", func() {
 		Eventually(doneChan).Should(Receive(BeEquivalentTo(4)))
 	})
 
+	It("Cancel with two selectors", func() {
+		doneChan := make(chan uint64, 2)
+
+		go func() {
+			new := tracker.timedWait(common.MakeSequence(4, 0), 250*time.Millisecond,
+				[]string{"bar", "baz"})
+			doneChan <- new.LSN
+		}()
+		go func() {
+			new := tracker.wait(common.MakeSequence(4, 0), []string{"baz"})
+			doneChan <- new.LSN
+		}()
+
+		Eventually(tracker.numWaiters).Should(Equal(2))
+		Eventually(doneChan).Should(Receive(BeZero()))
+		Eventually(tracker.numWaiters).Should(Equal(1))
+
+		tracker.update(common.MakeSequence(4, 0), "bar")
+		Consistently(doneChan, 250*time.Millisecond).ShouldNot(Receive())
+		tracker.update(common.MakeSequence(4, 0), "baz")
+		Eventually(doneChan).Should(Receive(BeEquivalentTo(4)))
+		Eventually(tracker.numWaiters).Should(BeZero())
+	})
+
 	It("Update twice", func() {
 		doneChan := make(chan uint64, 1)
 		doneChan2 := make(chan uint64, 1)
@@ -275,6 +299,24 @@ var _ = Describe("Change tracker", func() {
 		Eventually(done).Should(Receive(BeEquivalentTo(2)))
 	})
 
+	It("Tables", func() {
+		tables, err := makeTableFilter([]string{"public.config_*"}, nil)
+		Expect(err).Should(Succeed())
+		doneChan := make(chan uint64, 1)
+
+		go func() {
+			new := tracker.timedWaitTables(common.MakeSequence(3, 0), 2*time.Second,
+				[]string{"foo"}, tables.matches)
+			doneChan <- new.LSN
+		}()
+
+		time.Sleep(250 * time.Millisecond)
+		tracker.updateTable(common.MakeSequence(3, 0), "foo", "public.other")
+		Consistently(doneChan, 500*time.Millisecond).ShouldNot(Receive())
+		tracker.updateTable(common.MakeSequence(4, 0), "foo", "public.config_one")
+		Eventually(doneChan).Should(Receive(BeEquivalentTo(4)))
+	})
+
 	It("Stress 1, 1", func() {
 		trackerStress(1, 1, trackerCount)
 	})
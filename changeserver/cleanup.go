@@ -16,23 +16,67 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/apigee-labs/transicator/common"
+	"github.com/apigee-labs/transicator/storage"
+)
+
+const (
+	// How often to clean up when there is no maximum age
+	noAgeCleanupDelay = time.Minute
+
+	// How many records to purge at once to get under the maximum size
+	minSizePurgeBatch = 100
+	maxSizePurgeBatch = 100000
 )
 
 type cleaner struct {
-	s        *server
-	maxAge   time.Duration
-	stopChan chan bool
+	s          *server
+	maxAge     time.Duration
+	maxSize    int64
+	policy     *retentionPolicy
+	compaction *compactionPolicy
+	stopChan   chan bool
 }
 
-func (s *server) startCleanup(maxAge time.Duration) {
+/*
+startCleanup starts purging old records in the background. If "policy" is
+nil, then every record older than "maxAge" is purged. Otherwise, each
+selector is purged using the rule for it in the policy. Either way, no
+record after the lowest sequence acknowledged by a consumer is purged.
+If "maxSize" is set, then the oldest records are purged until the
+database uses less space than that, even if consumers still need them.
+If "compaction" is set, then changes that were replaced by later changes
+to the same rows are removed as well.
+*/
+func (s *server) startCleanup(
+	maxAge time.Duration, maxSize int64,
+	policy *retentionPolicy, compaction *compactionPolicy) {
+
+	if compaction != nil && policy == nil {
+		// Compaction removes changes from the middle of the database, so the
+		// first sequence no longer tells us what clients may have missed.
+		// Purge each selector on its own so that they get purge horizons.
+		policy = &retentionPolicy{
+			Default: retentionRule{maxAge: maxAge},
+		}
+	}
 	c := &cleaner{
-		s:        s,
-		maxAge:   maxAge,
-		stopChan: make(chan bool, 1),
+		s:          s,
+		maxAge:     maxAge,
+		maxSize:    maxSize,
+		policy:     policy,
+		compaction: compaction,
+		stopChan:   make(chan bool, 1),
 	}
+	s.horizons.lock.Lock()
+	s.horizons.retention = policy != nil
+	s.horizons.lock.Unlock()
 	s.cleaner = c
 	go c.run()
 }
@@ -42,7 +86,13 @@ func (c *cleaner) stop() {
 }
 
 func (c *cleaner) run() {
-	tick := time.NewTicker(cleanupDelay(c.maxAge))
+	delay := noAgeCleanupDelay
+	if c.policy != nil {
+		delay = c.policy.cleanupDelay()
+	} else if c.maxAge > 0 {
+		delay = cleanupDelay(c.maxAge)
+	}
+	tick := time.NewTicker(delay)
 	defer tick.Stop()
 
 	for {
@@ -56,11 +106,18 @@ func (c *cleaner) run() {
 }
 
 func (c *cleaner) performCleanup() {
-	cleanupAge := time.Now().Add(-c.maxAge)
-	log.Debugf("Cleaning up data records since before %v", cleanupAge)
+	var cleanupAge time.Time
+	if c.policy != nil {
+		if minAge := c.policy.minAge(); minAge > 0 {
+			cleanupAge = time.Now().Add(-minAge)
+		}
+	} else if c.maxAge > 0 {
+		cleanupAge = time.Now().Add(-c.maxAge)
+		log.Debugf("Cleaning up data records since before %v", cleanupAge)
+	}
 
-	// Get the current last sequence
-	_, _, lastSeq, err := c.s.db.Scan(nil, 0, 0, 0, nil)
+	// Get the current first and last sequence
+	_, dbFirst, lastSeq, err := c.s.db.Scan(nil, 0, 0, 0, nil)
 	if err != nil {
 		log.Errorf("Error after preparing for cleanup: %s", err)
 		return
@@ -76,13 +133,265 @@ func (c *cleaner) performCleanup() {
 
 	// Now we can do the cleanup knowing that there will still be one record
 	// so we can keep track of the highest sequence that we processed.
-	cleanupCount, err := c.s.db.Purge(cleanupAge)
+	cleanupCount, err := c.purgeByAge(cleanupAge, dbFirst, lastSeq)
+	if err == nil && c.compaction != nil {
+		var compactCount uint64
+		compactCount, err = c.compact(lastSeq)
+		cleanupCount += compactCount
+	}
+	if err == nil && c.maxSize > 0 {
+		var sizeCount uint64
+		sizeCount, err = c.purgeToSize(lastSeq)
+		cleanupCount += sizeCount
+	}
+	c.s.metrics.addPurged(cleanupCount, err)
 
 	if err != nil {
 		log.Errorf("Error after cleaning up %d records: %s", cleanupCount, err)
 	} else if cleanupCount > 0 {
 		log.Infof("Purged %d old records from the database", cleanupCount)
 	}
+
+	// Make sure that the tail cache doesn't return anything that was purged.
+	// Selectors that were purged by count may still have changes in the
+	// cache, but the purge horizons stop clients from reading past them.
+	_, firstSeq, _, err := c.s.db.Scan(nil, 0, 0, 0, nil)
+	if err == nil {
+		c.s.cache.purge(cleanupAge, firstSeq)
+	} else {
+		log.Errorf("Error reading database after cleanup: %s", err)
+		c.s.cache.reset(lastSeq)
+	}
+}
+
+/*
+purgeByAge purges the records that are too old, or that are over the
+count in the retention policy, but never the records from the lowest
+sequence that a consumer acknowledged onward.
+*/
+func (c *cleaner) purgeByAge(cleanupAge time.Time, dbFirst, lastSeq common.Sequence) (uint64, error) {
+	consumers := c.s.consumers
+	consumers.purgeLock.RLock()
+	defer consumers.purgeLock.RUnlock()
+
+	hold := consumers.hold(time.Now())
+	if hold.Compare(storage.NoLimit) < 0 {
+		log.Debugf("Consumers are holding records from sequence %s", hold)
+	}
+
+	if c.policy != nil {
+		return c.purgeSelectors(dbFirst, lastSeq, hold)
+	}
+	if c.maxAge > 0 {
+		return c.s.db.PurgeBefore(cleanupAge, hold)
+	}
+	return 0, nil
+}
+
+/*
+purgeSelectors purges each selector using its rule from the retention
+policy, and records the last change that was purged for each one so that
+clients that ask for changes from before then get "snapshot too old."
+The records are written at "lastSeq," the last sequence in the database.
+The first time, it also saves "dbFirst" as the baseline for selectors
+that have not been purged. Our own scopes only need their newest record.
+Nothing from "hold" onward is purged from the selectors.
+*/
+func (c *cleaner) purgeSelectors(dbFirst, lastSeq, hold common.Sequence) (uint64, error) {
+	err := c.saveBaseline(dbFirst, lastSeq)
+	if err != nil {
+		return 0, err
+	}
+
+	scopes, err := c.s.db.Scopes()
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	var total uint64
+	for _, scope := range scopes {
+		if isInternalScope(scope) {
+			count, _, err := c.s.db.PurgeScope(scope, time.Time{}, 1, storage.NoLimit)
+			total += count
+			if err != nil {
+				return total, err
+			}
+			continue
+		}
+
+		rule := c.policy.ruleFor(scope)
+		if rule.maxAge == 0 && rule.MaxCount == 0 {
+			continue
+		}
+		var oldest time.Time
+		if rule.maxAge > 0 {
+			oldest = now.Add(-rule.maxAge)
+		}
+
+		count, err := c.purgeSelector(scope, oldest, rule.MaxCount, hold, lastSeq)
+		total += count
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (c *cleaner) purgeSelector(
+	scope string, oldest time.Time, maxCount int,
+	hold, lastSeq common.Sequence) (uint64, error) {
+
+	h := c.s.horizons
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	count, lastPurged, err := c.s.db.PurgeScope(scope, oldest, maxCount, hold)
+	if err != nil || count == 0 {
+		return count, err
+	}
+	log.Debugf("Purged %d records for selector %s through %s", count, scope, lastPurged)
+	first := nextSequence(lastPurged)
+	h.set(scope, first)
+
+	err = c.s.db.Put(purgedScopePrefix+scope, lastSeq.LSN, lastSeq.Index, first.Bytes())
+	return count, err
+}
+
+func (c *cleaner) saveBaseline(dbFirst, lastSeq common.Sequence) error {
+	h := c.s.horizons
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if _, ok := h.first[baselineSelector]; ok {
+		return nil
+	}
+	err := c.s.db.Put(purgedScopePrefix+baselineSelector, lastSeq.LSN, lastSeq.Index, dbFirst.Bytes())
+	if err != nil {
+		return err
+	}
+	h.set(baselineSelector, dbFirst)
+	return nil
+}
+
+/*
+purgeToSize purges the oldest records, no matter what selector they
+belong to, until the database uses less than the maximum size. It never
+purges past "lastSeq," the last sequence when the cleanup started.
+The first batch is small, and after that the number of records in each
+batch is estimated from the space that the previous batch freed.
+*/
+func (c *cleaner) purgeToSize(lastSeq common.Sequence) (uint64, error) {
+	var total uint64
+	var lastPurged common.Sequence
+	var prevSize int64
+	var prevCount uint64
+	batch := minSizePurgeBatch
+
+	for lastPurged.Compare(lastSeq) < 0 {
+		size, err := c.s.db.Size()
+		if err != nil {
+			return total, err
+		}
+		if size <= c.maxSize {
+			break
+		}
+
+		if prevCount > 0 {
+			freed := prevSize - size
+			if freed > 0 {
+				batch = int((size-c.maxSize)*int64(prevCount)/freed) + 1
+			} else {
+				batch *= 2
+			}
+			if batch < minSizePurgeBatch {
+				batch = minSizePurgeBatch
+			} else if batch > maxSizePurgeBatch {
+				batch = maxSizePurgeBatch
+			}
+		}
+
+		count, purged, err := c.purgeOldest(batch, lastSeq)
+		total += count
+		if err != nil {
+			return total, err
+		}
+		if count == 0 {
+			break
+		}
+		lastPurged = purged
+		prevSize = size
+		prevCount = count
+		log.Infof("Purged %d records through sequence %s because the database uses %d bytes",
+			count, lastPurged, size)
+	}
+	if total == 0 {
+		return 0, nil
+	}
+
+	// Just like before the regular cleanup, make sure that the last
+	// sequence is still in the database even if we purged everything.
+	err := c.s.db.Put(internalScope, lastSeq.LSN, lastSeq.Index, nil)
+	if err != nil {
+		return total, err
+	}
+	_, firstSeq, _, err := c.s.db.Scan(nil, 0, 0, 0, nil)
+	if err != nil {
+		return total, err
+	}
+	if c.policy != nil {
+		firstSeq = nextSequence(lastPurged)
+	}
+	log.Warnf("Purged %d records to get the database under %d bytes. "+
+		"Clients that ask for changes since before %s will get SNAPSHOT_TOO_OLD.",
+		total, c.maxSize, firstSeq)
+	return total, nil
+}
+
+/*
+purgeOldest purges "batch" of the oldest records, and records that it did
+so, which sequenceSince needs to know. With a retention policy, the
+baseline also has to move past them, since purgeHorizons doesn't look at
+the first sequence in the database in that case.
+*/
+func (c *cleaner) purgeOldest(batch int, lastSeq common.Sequence) (uint64, common.Sequence, error) {
+	h := c.s.horizons
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	count, lastPurged, err := c.s.db.PurgeOldest(batch, nextSequence(lastSeq))
+	if err != nil || count == 0 {
+		return count, lastPurged, err
+	}
+	first := nextSequence(lastPurged)
+	h.set(sizeSelector, first)
+	err = c.s.db.Put(purgedScopePrefix+sizeSelector, lastSeq.LSN, lastSeq.Index, first.Bytes())
+	if err != nil || c.policy == nil {
+		return count, lastPurged, err
+	}
+	h.set(baselineSelector, first)
+	err = c.s.db.Put(purgedScopePrefix+baselineSelector, lastSeq.LSN, lastSeq.Index, first.Bytes())
+	return count, lastPurged, err
+}
+
+/*
+parseSize parses a number of bytes, which may end with "K," "M," "G," or
+"T" for kilobytes, megabytes, gigabytes, or terabytes (in powers of 1024).
+*/
+func parseSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := int64(1)
+	if num != "" {
+		if i := strings.IndexByte("KMGT", num[len(num)-1]); i >= 0 {
+			mult = 1 << (10 * uint(i+1))
+			num = num[:len(num)-1]
+		}
+	}
+	v, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("Invalid size \"%s\"", s)
+	}
+	return v * mult, nil
 }
 
 /*
@@ -101,3 +410,24 @@ func cleanupDelay(maxAge time.Duration) time.Duration {
 	}
 	return time.Hour
 }
+
+/*
+retainedSince returns the time from which every change for the scopes is
+kept, or the zero time if they are not purged by age. Changes may still be
+purged earlier to stay under the maximum size or a maximum count.
+*/
+func (c *cleaner) retainedSince(scopes []string, now time.Time) time.Time {
+	var since time.Time
+	for _, scope := range scopes {
+		maxAge := c.maxAge
+		if c.policy != nil {
+			maxAge = c.policy.ruleFor(scope).maxAge
+		}
+		if maxAge > 0 {
+			if t := now.Add(-maxAge); t.After(since) {
+				since = t
+			}
+		}
+	}
+	return since
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/apigee-labs/transicator/common"
+	"github.com/apigee-labs/transicator/storage"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const sizeTestDir = "./sizetestdata"
+const sinceTimeTestDir = "./sincetimetestdata"
+
+var _ = Describe("Size cleanup", func() {
+	var s *server
+
+	BeforeEach(func() {
+		db, err := storage.Open(storage.DefaultEngine(), sizeTestDir)
+		Expect(err).Should(Succeed())
+		horizons, err := loadPurgeHorizons(db)
+		Expect(err).Should(Succeed())
+		consumers, err := loadConsumers(db)
+		Expect(err).Should(Succeed())
+
+		var entries []storage.Entry
+		for lsn := uint64(1); lsn <= 1000; lsn++ {
+			c := &common.Change{
+				Operation:      common.Insert,
+				Table:          "public.size",
+				CommitSequence: lsn,
+				NewRow: common.Row{
+					"data": &common.ColumnVal{Value: string(bytes.Repeat([]byte("x"), 1000))},
+				},
+			}
+			entries = append(entries, storage.Entry{
+				Scope: "size",
+				LSN:   lsn,
+				Data:  encodeChangeProto(c),
+			})
+		}
+		Expect(db.PutBatch(entries)).Should(Succeed())
+
+		_, first, last, err := db.Scan(nil, 0, 0, 0, nil)
+		Expect(err).Should(Succeed())
+		s = &server{
+			db:        db,
+			cache:     createTailCache(0, first, last),
+			queries:   createQueryGroup(),
+			metrics:   createMetrics(),
+			horizons:  horizons,
+			consumers: consumers,
+		}
+	})
+
+	AfterEach(func() {
+		s.db.Close()
+		Expect(s.db.Delete()).Should(Succeed())
+	})
+
+	It("Parse size", func() {
+		for in, expected := range map[string]int64{
+			"1000": 1000,
+			"10k":  10 << 10,
+			"20M":  20 << 20,
+			"3GB":  3 << 30,
+			"1T":   1 << 40,
+		} {
+			size, err := parseSize(in)
+			Expect(err).Should(Succeed())
+			Expect(size).Should(Equal(expected))
+		}
+		for _, in := range []string{"", "G", "-1", "0", "10X", "1.5G"} {
+			_, err := parseSize(in)
+			Expect(err).ShouldNot(Succeed())
+		}
+	})
+
+	It("Under the limit", func() {
+		size, err := s.db.Size()
+		Expect(err).Should(Succeed())
+		c := &cleaner{s: s, maxSize: size * 2}
+		c.performCleanup()
+
+		_, _, changes, err := s.fetchChanges([]string{"size"}, common.MakeSequence(0, 1), 10000, nil)
+		Expect(err).Should(Succeed())
+		Expect(len(changes)).Should(Equal(1000))
+	})
+
+	It("Over the limit", func() {
+		size, err := s.db.Size()
+		Expect(err).Should(Succeed())
+		c := &cleaner{s: s, maxSize: size / 2}
+		c.performCleanup()
+
+		newSize, err := s.db.Size()
+		Expect(err).Should(Succeed())
+		Expect(newSize).Should(BeNumerically("<=", size/2))
+
+		first, last, changes, err := s.fetchChanges([]string{"size"}, emptySequence, 10000, nil)
+		Expect(err).Should(Succeed())
+		Expect(len(changes)).Should(BeNumerically("<", 1000))
+		Expect(len(changes)).Should(BeNumerically(">", 100))
+		Expect(last).Should(Equal(common.MakeSequence(1000, 0)))
+		Expect(first.Compare(common.MakeSequence(1, 0))).Should(BeNumerically(">", 0))
+
+		_, _, _, err = s.fetchChanges([]string{"size"}, common.MakeSequence(1, 1), 10000, nil)
+		Expect(err).Should(Equal(errSnapshotOld))
+	})
+
+	It("Purge while changes arrive", func() {
+		_, _, lastSeq, err := s.db.Scan(nil, 0, 0, 0, nil)
+		Expect(err).Should(Succeed())
+		Expect(s.db.Put(purgedScopePrefix+"other", 10, 0,
+			common.MakeSequence(11, 0).Bytes())).Should(Succeed())
+
+		// These were replicated after the cleanup started
+		for lsn := uint64(1001); lsn <= 1010; lsn++ {
+			c := &common.Change{
+				Operation:      common.Insert,
+				Table:          "public.size",
+				CommitSequence: lsn,
+			}
+			Expect(s.db.Put("size", lsn, 0, encodeChangeProto(c))).Should(Succeed())
+		}
+
+		c := &cleaner{s: s, maxSize: 1}
+		_, err = c.purgeToSize(lastSeq)
+		Expect(err).Should(Succeed())
+
+		_, _, changes, err := s.fetchChanges([]string{"size"}, emptySequence, 10000, nil)
+		Expect(err).Should(Succeed())
+		Expect(len(changes)).Should(Equal(10))
+		Expect(changes[0].CommitSequence).Should(BeEquivalentTo(1001))
+
+		val, err := s.db.Get(purgedScopePrefix+"other", 10, 0)
+		Expect(err).Should(Succeed())
+		Expect(val).Should(Equal(common.MakeSequence(11, 0).Bytes()))
+	})
+
+	It("Over the limit with a retention policy", func() {
+		p, err := parseRetentionPolicy([]byte("default:\n  maxCount: 100000\n"), 0)
+		Expect(err).Should(Succeed())
+		size, err := s.db.Size()
+		Expect(err).Should(Succeed())
+		c := &cleaner{s: s, policy: p, maxSize: size / 2}
+		s.horizons.retention = true
+		c.performCleanup()
+
+		first, _, changes, err := s.fetchChanges([]string{"size"}, emptySequence, 10000, nil)
+		Expect(err).Should(Succeed())
+		Expect(len(changes)).Should(BeNumerically("<", 1000))
+		Expect(len(changes)).Should(BeNumerically(">", 100))
+		Expect(first.Compare(common.MakeSequence(1, 0))).Should(BeNumerically(">", 0))
+		Expect(first.Compare(changes[0].GetSequence())).Should(BeNumerically("<=", 0))
+
+		_, _, _, err = s.fetchChanges([]string{"size"}, common.MakeSequence(1, 1), 10000, nil)
+		Expect(err).Should(Equal(errSnapshotOld))
+	})
+})
+
+var _ = Describe("Since time", func() {
+	var s *server
+
+	BeforeEach(func() {
+		db, err := storage.Open(storage.DefaultEngine(), sinceTimeTestDir)
+		Expect(err).Should(Succeed())
+		s = &server{db: db}
+	})
+
+	AfterEach(func() {
+		s.db.Close()
+		Expect(s.db.Delete()).Should(Succeed())
+	})
+
+	// Change timestamps only have whole seconds
+	putAt := func(ts time.Time, scope string, lsn uint64, data string) {
+		Expect(s.db.PutBatch([]storage.Entry{
+			{Scope: scope, LSN: lsn, Data: []byte(data), Timestamp: ts},
+		})).Should(Succeed())
+	}
+
+	It("Sequence since", func() {
+		start := time.Now().Truncate(time.Second)
+		putAt(start.Add(-2*time.Second), "a", 1, "one")
+		putAt(start.Add(-2*time.Second), "a", 2, "two")
+		t := start.Add(500 * time.Millisecond)
+		putAt(start, "b", 3, "three")
+		putAt(start, "a", 4, "four")
+
+		seq, err := s.sequenceSince([]string{"a"}, t)
+		Expect(err).Should(Succeed())
+		Expect(seq).Should(Equal(common.MakeSequence(3, 0)))
+		seq, err = s.sequenceSince([]string{"a"}, t.Add(-time.Hour))
+		Expect(err).Should(Succeed())
+		Expect(seq).Should(Equal(common.MakeSequence(1, 0)))
+
+		// Nothing since then, so start after the last change
+		seq, err = s.sequenceSince([]string{"a"}, t.Add(time.Hour))
+		Expect(err).Should(Succeed())
+		Expect(seq).Should(Equal(common.MakeSequence(4, 1)))
+
+		s.cleaner = &cleaner{s: s, maxAge: time.Minute}
+		_, err = s.sequenceSince([]string{"a"}, t.Add(-time.Hour))
+		Expect(err).Should(Equal(errSnapshotOld))
+		seq, err = s.sequenceSince([]string{"a"}, t)
+		Expect(err).Should(Succeed())
+		Expect(seq).Should(Equal(common.MakeSequence(3, 0)))
+	})
+
+	It("Sequence since after size purge", func() {
+		horizons, err := loadPurgeHorizons(s.db)
+		Expect(err).Should(Succeed())
+		s.horizons = horizons
+		c := &cleaner{s: s, maxSize: 1}
+		s.cleaner = c
+
+		start := time.Now().Truncate(time.Second)
+		putAt(start.Add(-3*time.Second), "a", 1, "one")
+		putAt(start.Add(-2*time.Second), "a", 2, "two")
+		putAt(start.Add(-time.Second), "a", 3, "three")
+		putAt(start, "a", 4, "four")
+
+		// Nothing was purged, so the first change is fine
+		seq, err := s.sequenceSince([]string{"a"}, start.Add(-time.Hour))
+		Expect(err).Should(Succeed())
+		Expect(seq).Should(Equal(common.MakeSequence(1, 0)))
+
+		count, _, err := c.purgeOldest(2, common.MakeSequence(4, 0))
+		Expect(err).Should(Succeed())
+		Expect(count).Should(BeEquivalentTo(2))
+
+		// The purged changes may have been after "t"
+		_, err = s.sequenceSince([]string{"a"}, start.Add(-time.Hour))
+		Expect(err).Should(Equal(errSnapshotOld))
+		_, err = s.sequenceSince([]string{"a"}, start.Add(-time.Second))
+		Expect(err).Should(Equal(errSnapshotOld))
+
+		// A change that we still have is older, so nothing after "t" is gone
+		seq, err = s.sequenceSince([]string{"a"}, start)
+		Expect(err).Should(Succeed())
+		Expect(seq).Should(Equal(common.MakeSequence(4, 0)))
+
+		// The purge is remembered after a restart
+		s.horizons, err = loadPurgeHorizons(s.db)
+		Expect(err).Should(Succeed())
+		_, err = s.sequenceSince([]string{"a"}, start.Add(-time.Hour))
+		Expect(err).Should(Equal(errSnapshotOld))
+	})
+
+	It("Retained since", func() {
+		now := time.Now()
+		c := &cleaner{}
+		Expect(c.retainedSince([]string{"a"}, now).IsZero()).Should(BeTrue())
+		c.maxAge = time.Hour
+		Expect(c.retainedSince([]string{"a"}, now)).Should(Equal(now.Add(-time.Hour)))
+
+		p, err := parseRetentionPolicy([]byte(`
+default:
+  maxAge: 24h
+selectors:
+- pattern: "short-*"
+  maxAge: 1h
+- pattern: "counted-*"
+  maxCount: 10
+`), 0)
+		Expect(err).Should(Succeed())
+		c.policy = p
+		Expect(c.retainedSince([]string{"a"}, now)).Should(Equal(now.Add(-24 * time.Hour)))
+		Expect(c.retainedSince([]string{"a", "short-1"}, now)).Should(Equal(now.Add(-time.Hour)))
+		Expect(c.retainedSince([]string{"counted-1"}, now).IsZero()).Should(BeTrue())
+	})
+})
@@ -0,0 +1,145 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/apigee-labs/transicator/common"
+)
+
+/*
+A queryResult is the outcome of a query for changes, already encoded in
+the media type that the client asked for. Results are shared by every
+request that asked the same question, so they must not be modified.
+*/
+type queryResult struct {
+	lastSeq common.Sequence
+	count   int
+	// Commit sequence of an atomic transaction that was held back because
+	// it was not completely stored yet
+	pending uint64
+	body    []byte
+	err     error
+}
+
+type queryCall struct {
+	done   chan bool
+	result *queryResult
+}
+
+/*
+A queryGroup makes sure that identical queries that are running at the same
+time only run once. When a popular selector changes, many clients wake up at
+once and ask for exactly the same thing, and this way they share a single
+database scan and a single encoding of the results.
+*/
+type queryGroup struct {
+	lock  sync.Mutex
+	calls map[string]*queryCall
+	// Called with the lock held when a request waits for another one's
+	// query. Only tests set it.
+	joined func(key string)
+}
+
+func createQueryGroup() *queryGroup {
+	return &queryGroup{
+		calls: make(map[string]*queryCall),
+	}
+}
+
+/*
+do runs "query" unless a query with the same key is already running, in
+which case it waits for that one and returns its result instead.
+*/
+func (g *queryGroup) do(key string, query func() *queryResult) *queryResult {
+	g.lock.Lock()
+	call := g.calls[key]
+	if call != nil {
+		if g.joined != nil {
+			g.joined(key)
+		}
+		g.lock.Unlock()
+		<-call.done
+		return call.result
+	}
+	call = &queryCall{
+		done: make(chan bool),
+	}
+	g.calls[key] = call
+	g.lock.Unlock()
+
+	defer func() {
+		if call.result == nil {
+			// The query panicked, and the requests that are waiting for it
+			// must not get a nil result
+			call.result = &queryResult{err: errors.New("Query for changes failed")}
+		}
+		g.lock.Lock()
+		delete(g.calls, key)
+		g.lock.Unlock()
+		close(call.done)
+	}()
+	call.result = query()
+	return call.result
+}
+
+/*
+makeQueryKey returns a string that is the same for every request to the
+changes API that would get the same response. Selectors are sorted and
+duplicates are removed, since neither affects the result.
+*/
+func makeQueryKey(enc string, selectors []string, since common.Sequence,
+	limit int, atomic bool, q url.Values) string {
+	sorted := make([]string, len(selectors))
+	copy(sorted, selectors)
+	sort.Strings(sorted)
+
+	buf := &bytes.Buffer{}
+	writeKeyPart(buf, enc)
+	writeKeyPart(buf, since.String())
+	writeKeyPart(buf, strconv.Itoa(limit))
+	writeKeyPart(buf, strconv.FormatBool(atomic))
+	writeKeyPart(buf, q.Get("snapshot"))
+	// A client that waited for an LSN must not get the result of a query
+	// that started before it was stored
+	writeKeyPart(buf, q.Get("minLSN"))
+	for i, s := range sorted {
+		if i == 0 || s != sorted[i-1] {
+			writeKeyPart(buf, "s"+s)
+		}
+	}
+	for _, t := range q["table"] {
+		writeKeyPart(buf, "t"+t)
+	}
+	for _, t := range q["excludeTable"] {
+		writeKeyPart(buf, "x"+t)
+	}
+	return buf.String()
+}
+
+func writeKeyPart(buf *bytes.Buffer, part string) {
+	// Parts come from the URL and may contain anything, so prefix
+	// each one with its length to keep them apart.
+	buf.WriteString(strconv.Itoa(len(part)))
+	buf.WriteByte(':')
+	buf.WriteString(part)
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"github.com/apigee-labs/transicator/common"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Query coalescing", func() {
+	It("Same query", func() {
+		g := createQueryGroup()
+		var joined int32
+		g.joined = func(string) { atomic.AddInt32(&joined, 1) }
+		var runs int32
+		release := make(chan bool)
+		query := func() *queryResult {
+			atomic.AddInt32(&runs, 1)
+			<-release
+			return &queryResult{count: 1}
+		}
+
+		first := make(chan *queryResult, 1)
+		go func() {
+			first <- g.do("foo", query)
+		}()
+		Eventually(func() int32 { return atomic.LoadInt32(&runs) }).Should(BeEquivalentTo(1))
+
+		wg := &sync.WaitGroup{}
+		results := make([]*queryResult, 10)
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = g.do("foo", query)
+			}(i)
+		}
+		Eventually(func() int32 { return atomic.LoadInt32(&joined) }).Should(BeEquivalentTo(len(results)))
+
+		close(release)
+		wg.Wait()
+		r := <-first
+		Expect(atomic.LoadInt32(&runs)).Should(BeEquivalentTo(1))
+		for _, other := range results {
+			Expect(other).Should(BeIdenticalTo(r))
+		}
+
+		// Once the query is finished, the next one runs again
+		g.do("foo", query)
+		Expect(atomic.LoadInt32(&runs)).Should(BeEquivalentTo(2))
+	})
+
+	It("Different queries", func() {
+		g := createQueryGroup()
+		r1 := g.do("foo", func() *queryResult { return &queryResult{count: 1} })
+		r2 := g.do("bar", func() *queryResult { return &queryResult{count: 2} })
+		Expect(r1.count).Should(Equal(1))
+		Expect(r2.count).Should(Equal(2))
+	})
+
+	It("Query panics", func() {
+		g := createQueryGroup()
+		var joined int32
+		g.joined = func(string) { atomic.AddInt32(&joined, 1) }
+		started := make(chan bool)
+		release := make(chan bool)
+
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				panicked <- recover()
+			}()
+			g.do("foo", func() *queryResult {
+				close(started)
+				<-release
+				panic("query failed")
+			})
+		}()
+		<-started
+
+		waiter := make(chan *queryResult, 1)
+		go func() {
+			waiter <- g.do("foo", func() *queryResult { return &queryResult{count: 1} })
+		}()
+		Eventually(func() int32 { return atomic.LoadInt32(&joined) }).Should(BeEquivalentTo(1))
+
+		close(release)
+		Eventually(panicked).Should(Receive(Equal("query failed")))
+		var r *queryResult
+		Eventually(waiter).Should(Receive(&r))
+		Expect(r).ShouldNot(BeNil())
+		Expect(r.err).Should(HaveOccurred())
+	})
+
+	It("Query keys", func() {
+		seq := common.MakeSequence(10, 1)
+		q := url.Values{}
+		k1 := makeQueryKey(jsonContent, []string{"foo", "bar"}, seq, 100, false, q)
+		k2 := makeQueryKey(jsonContent, []string{"bar", "foo", "bar"}, seq, 100, false, q)
+		Expect(k1).Should(Equal(k2))
+
+		Expect(makeQueryKey(protoContent, []string{"foo", "bar"}, seq, 100, false, q)).ShouldNot(Equal(k1))
+		Expect(makeQueryKey(jsonContent, []string{"foo"}, seq, 100, false, q)).ShouldNot(Equal(k1))
+		Expect(makeQueryKey(jsonContent, []string{"foo", "bar"}, common.MakeSequence(10, 2), 100, false, q)).ShouldNot(Equal(k1))
+		Expect(makeQueryKey(jsonContent, []string{"foo", "bar"}, seq, 10, false, q)).ShouldNot(Equal(k1))
+		Expect(makeQueryKey(jsonContent, []string{"foo", "bar"}, seq, 100, true, q)).ShouldNot(Equal(k1))
+
+		q.Set("snapshot", "1:2:")
+		Expect(makeQueryKey(jsonContent, []string{"foo", "bar"}, seq, 100, false, q)).ShouldNot(Equal(k1))
+
+		q = url.Values{}
+		q.Set("minLSN", "0/16B3748")
+		Expect(makeQueryKey(jsonContent, []string{"foo", "bar"}, seq, 100, false, q)).ShouldNot(Equal(k1))
+
+		q = url.Values{}
+		q.Set("table", "public.foo")
+		kt := makeQueryKey(jsonContent, []string{"foo"}, seq, 100, false, q)
+		q = url.Values{}
+		q.Set("excludeTable", "public.foo")
+		Expect(makeQueryKey(jsonContent, []string{"foo"}, seq, 100, false, q)).ShouldNot(Equal(kt))
+	})
+})
@@ -0,0 +1,278 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/apigee-labs/transicator/common"
+	"github.com/apigee-labs/transicator/storage"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultCompactAfter      = time.Hour
+	defaultTombstoneDuration = 24 * time.Hour
+
+	compactionReadBatch = 1000
+)
+
+/*
+A compactionPolicy lists the tables for which only the latest change to
+each primary key is needed. Changes that are older than "after" and that
+were replaced by a later change to the same row of the same selector are
+removed. The delete for a row is kept as a "tombstone" for "tombstones,"
+so that clients that are behind see it before it is removed too.
+*/
+type compactionPolicy struct {
+	After      string       `yaml:"after"`
+	Tombstones string       `yaml:"tombstones"`
+	Tables     []keyedTable `yaml:"tables"`
+	after      time.Duration
+	tombstones time.Duration
+	keys       tableKeys
+}
+
+/*
+loadCompactionPolicy reads a policy from a YAML file.
+*/
+func loadCompactionPolicy(fileName string) (*compactionPolicy, error) {
+	buf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return parseCompactionPolicy(buf)
+}
+
+/*
+parseCompactionPolicy parses a policy from YAML or JSON.
+*/
+func parseCompactionPolicy(buf []byte) (*compactionPolicy, error) {
+	p := &compactionPolicy{}
+	err := yaml.Unmarshal(buf, p)
+	if err != nil {
+		return nil, err
+	}
+
+	p.after, err = parsePositiveDuration(p.After, defaultCompactAfter)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid value for \"after\": %s", err)
+	}
+	p.tombstones, err = parsePositiveDuration(p.Tombstones, defaultTombstoneDuration)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid value for \"tombstones\": %s", err)
+	}
+
+	p.keys, err = makeTableKeys(p.Tables)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func parsePositiveDuration(s string, defaultValue time.Duration) (time.Duration, error) {
+	if s == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return d, nil
+}
+
+/*
+A compactedEntry tracks a change while a selector is compacted. "refs" is
+the number of rows for which it is still the latest change.
+*/
+type compactedEntry struct {
+	entry     storage.Entry
+	timestamp time.Time
+	delete    bool
+	refs      int
+}
+
+/*
+compact removes the changes that were replaced by later changes to the
+same rows from every selector. Nothing from "hold" onward is removed.
+*/
+func (c *cleaner) compact(lastSeq common.Sequence) (uint64, error) {
+	consumers := c.s.consumers
+	consumers.purgeLock.RLock()
+	defer consumers.purgeLock.RUnlock()
+
+	hold := consumers.hold(time.Now())
+
+	scopes, err := c.s.db.Scopes()
+	if err != nil {
+		return 0, err
+	}
+
+	var total uint64
+	for _, scope := range scopes {
+		if isInternalScope(scope) {
+			continue
+		}
+		count, err := c.compactSelector(scope, hold, lastSeq)
+		total += count
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+/*
+compactSelector reads every change for one selector and removes the ones
+that are no longer needed. When tombstones are removed, the selector gets
+a purge horizon just like when it is purged by a retention policy, since
+a client that was behind would never see those rows deleted.
+*/
+func (c *cleaner) compactSelector(scope string, hold, lastSeq common.Sequence) (uint64, error) {
+	now := time.Now()
+	compactBefore := now.Add(-c.compaction.after)
+	tombstonesBefore := now.Add(-c.compaction.tombstones)
+
+	latest := make(map[string]*compactedEntry)
+	var superseded []storage.Entry
+
+	var next common.Sequence
+	for {
+		entries, err := c.s.db.ScanAll(scope, next.LSN, next.Index, compactionReadBatch)
+		if err != nil {
+			return 0, err
+		}
+		done := len(entries) < compactionReadBatch
+		for _, e := range entries {
+			if e.Scope != scope {
+				done = true
+				break
+			}
+			next = nextSequence(common.MakeSequence(e.LSN, e.Index))
+
+			change, err := decodeChangeProto(e.Data)
+			if err != nil {
+				log.Warnf("Not compacting invalid change %d.%d for %s: %s", e.LSN, e.Index, scope, err)
+				continue
+			}
+			keys := c.compaction.keys.changeKeys(change)
+			if len(keys) == 0 {
+				continue
+			}
+
+			ce := &compactedEntry{
+				entry:     storage.Entry{Scope: e.Scope, LSN: e.LSN, Index: e.Index},
+				timestamp: time.Unix(change.Timestamp, 0),
+				delete:    change.Operation == common.Delete,
+				refs:      len(keys),
+			}
+			for _, k := range keys {
+				prev := latest[k]
+				latest[k] = ce
+				if prev == nil {
+					continue
+				}
+				prev.refs--
+				if prev.refs == 0 && prev.timestamp.Before(compactBefore) && prev.sequence().Compare(hold) < 0 {
+					superseded = append(superseded, prev.entry)
+				}
+			}
+		}
+		if done {
+			break
+		}
+	}
+
+	var tombstones []storage.Entry
+	var lastTombstone common.Sequence
+	for _, ce := range latest {
+		if ce.delete && ce.refs > 0 && ce.timestamp.Before(tombstonesBefore) && ce.sequence().Compare(hold) < 0 {
+			// A delete only has one row, so it is only in the map once
+			tombstones = append(tombstones, ce.entry)
+			if ce.sequence().Compare(lastTombstone) > 0 {
+				lastTombstone = ce.sequence()
+			}
+		}
+	}
+
+	count, err := c.deleteEntries(superseded)
+	if err != nil || len(tombstones) == 0 {
+		if count > 0 {
+			log.Debugf("Compacted %d superseded changes for selector %s", count, scope)
+		}
+		return count, err
+	}
+
+	tombstoneCount, err := c.removeTombstones(scope, tombstones, lastTombstone, lastSeq)
+	log.Debugf("Compacted %d superseded changes and %d tombstones for selector %s through %s",
+		count, tombstoneCount, scope, lastTombstone)
+	return count + tombstoneCount, err
+}
+
+/*
+removeTombstones deletes the tombstones and moves the purge horizon for
+the selector past them while the horizon lock is held, so that no client
+reads changes after the tombstones are gone but before the horizon moves.
+*/
+func (c *cleaner) removeTombstones(
+	scope string, tombstones []storage.Entry,
+	lastTombstone, lastSeq common.Sequence) (uint64, error) {
+
+	h := c.s.horizons
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	count, err := c.deleteEntries(tombstones)
+	if err != nil {
+		return count, err
+	}
+	first := nextSequence(lastTombstone)
+	h.set(scope, first)
+
+	err = c.s.db.Put(purgedScopePrefix+scope, lastSeq.LSN, lastSeq.Index, first.Bytes())
+	if err != nil {
+		return count, err
+	}
+	_, _, err = c.s.db.PurgeScope(purgedScopePrefix+scope, time.Time{}, 1, storage.NoLimit)
+	return count, err
+}
+
+func (c *cleaner) deleteEntries(entries []storage.Entry) (uint64, error) {
+	var count uint64
+	for len(entries) > 0 {
+		batch := entries
+		if len(batch) > compactionReadBatch {
+			batch = batch[:compactionReadBatch]
+		}
+		err := c.s.db.DeleteBatch(batch)
+		if err != nil {
+			return count, err
+		}
+		count += uint64(len(batch))
+		entries = entries[len(batch):]
+	}
+	return count, nil
+}
+
+func (ce *compactedEntry) sequence() common.Sequence {
+	return common.MakeSequence(ce.entry.LSN, ce.entry.Index)
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"time"
+
+	"github.com/apigee-labs/transicator/common"
+	"github.com/apigee-labs/transicator/storage"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const compactionTestDir = "./compactiontestdata"
+
+const testCompactionPolicy = `
+after: 1h
+tombstones: 24h
+tables:
+- table: public.config
+  keys: [id]
+- table: public.settings
+  keys: [tenant, name]
+`
+
+var _ = Describe("Compaction policy", func() {
+	It("Parse", func() {
+		p, err := parseCompactionPolicy([]byte(testCompactionPolicy))
+		Expect(err).Should(Succeed())
+		Expect(p.after).Should(Equal(time.Hour))
+		Expect(p.tombstones).Should(Equal(24 * time.Hour))
+		Expect(p.keys["public.settings"]).Should(Equal([]string{"tenant", "name"}))
+
+		p, err = parseCompactionPolicy([]byte("tables:\n- table: t\n  keys: [id]\n"))
+		Expect(err).Should(Succeed())
+		Expect(p.after).Should(Equal(defaultCompactAfter))
+		Expect(p.tombstones).Should(Equal(defaultTombstoneDuration))
+	})
+
+	It("Invalid", func() {
+		_, err := parseCompactionPolicy([]byte("after: 1h\n"))
+		Expect(err).ShouldNot(Succeed())
+		_, err = parseCompactionPolicy([]byte("tables:\n- keys: [id]\n"))
+		Expect(err).ShouldNot(Succeed())
+		_, err = parseCompactionPolicy([]byte("tables:\n- table: t\n"))
+		Expect(err).ShouldNot(Succeed())
+		_, err = parseCompactionPolicy([]byte("tables:\n- table: t\n  keys: [id]\n- table: t\n  keys: [id]\n"))
+		Expect(err).ShouldNot(Succeed())
+		_, err = parseCompactionPolicy([]byte("after: -1h\ntables:\n- table: t\n  keys: [id]\n"))
+		Expect(err).ShouldNot(Succeed())
+		_, err = parseCompactionPolicy([]byte("tombstones: never\ntables:\n- table: t\n  keys: [id]\n"))
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("Keys", func() {
+		p, err := parseCompactionPolicy([]byte(testCompactionPolicy))
+		Expect(err).Should(Succeed())
+
+		row := common.Row{
+			"tenant": &common.ColumnVal{Value: "a"},
+			"name":   &common.ColumnVal{Value: "b"},
+		}
+		Expect(p.keys.rowKey("public.settings", row)).ShouldNot(BeEmpty())
+		Expect(p.keys.rowKey("public.other", row)).Should(BeEmpty())
+		Expect(p.keys.rowKey("public.config", row)).Should(BeEmpty())
+
+		// An update that changes the key replaces both rows
+		c := &common.Change{
+			Operation: common.Update,
+			Table:     "public.config",
+			NewRow:    common.Row{"id": &common.ColumnVal{Value: 2}},
+			OldRow:    common.Row{"id": &common.ColumnVal{Value: 1}},
+		}
+		Expect(len(p.keys.changeKeys(c))).Should(Equal(2))
+		c.OldRow = common.Row{"id": &common.ColumnVal{Value: 2}}
+		Expect(len(p.keys.changeKeys(c))).Should(Equal(1))
+	})
+})
+
+var _ = Describe("Compaction", func() {
+	var s *server
+	var c *cleaner
+	var old, ancient int64
+
+	BeforeEach(func() {
+		db, err := storage.Open(storage.DefaultEngine(), compactionTestDir)
+		Expect(err).Should(Succeed())
+		horizons, err := loadPurgeHorizons(db)
+		Expect(err).Should(Succeed())
+		consumers, err := loadConsumers(db)
+		Expect(err).Should(Succeed())
+		s = &server{
+			db:        db,
+			queries:   createQueryGroup(),
+			metrics:   createMetrics(),
+			horizons:  horizons,
+			consumers: consumers,
+		}
+		p, err := parseCompactionPolicy([]byte(testCompactionPolicy))
+		Expect(err).Should(Succeed())
+		c = &cleaner{s: s, policy: &retentionPolicy{}, compaction: p}
+		s.horizons.retention = true
+
+		old = time.Now().Add(-2 * time.Hour).Unix()
+		ancient = time.Now().Add(-48 * time.Hour).Unix()
+	})
+
+	AfterEach(func() {
+		s.db.Close()
+		Expect(s.db.Delete()).Should(Succeed())
+	})
+
+	putChange := func(scope string, lsn uint64, op common.Operation, table string, id int, ts int64) {
+		c := &common.Change{
+			Operation:      op,
+			Table:          table,
+			CommitSequence: lsn,
+			Timestamp:      ts,
+		}
+		row := common.Row{"id": &common.ColumnVal{Value: id}}
+		if op == common.Delete {
+			c.OldRow = row
+		} else {
+			c.NewRow = row
+		}
+		Expect(s.db.Put(scope, lsn, 0, encodeChangeProto(c))).Should(Succeed())
+	}
+
+	compact := func() {
+		// Like at startup, the empty cache starts at the end of the database
+		_, first, last, err := s.db.Scan(nil, 0, 0, 0, nil)
+		Expect(err).Should(Succeed())
+		s.cache = createTailCache(0, first, last)
+		c.performCleanup()
+	}
+
+	fetch := func(scope string, since common.Sequence) []uint64 {
+		_, _, changes, err := s.fetchChanges([]string{scope}, since, 100, nil)
+		Expect(err).Should(Succeed())
+		var lsns []uint64
+		for _, ch := range changes {
+			lsns = append(lsns, ch.CommitSequence)
+		}
+		return lsns
+	}
+
+	It("Superseded changes", func() {
+		now := time.Now().Unix()
+		putChange("a", 1, common.Insert, "public.config", 1, old)
+		putChange("a", 2, common.Insert, "public.config", 2, old)
+		putChange("a", 3, common.Update, "public.config", 1, old)
+		putChange("a", 4, common.Update, "public.other", 1, old)
+		putChange("a", 5, common.Update, "public.other", 1, old)
+		putChange("a", 6, common.Update, "public.config", 2, now)
+		putChange("a", 7, common.Update, "public.config", 2, now)
+		putChange("a", 8, common.Update, "public.config", 1, now)
+		// Changes in other selectors don't replace each other
+		putChange("b", 9, common.Insert, "public.config", 1, old)
+
+		compact()
+
+		// Only old changes are removed, and only for compacted tables
+		Expect(fetch("a", lowestPossibleSequence)).Should(Equal([]uint64{4, 5, 6, 7, 8}))
+		Expect(fetch("b", lowestPossibleSequence)).Should(Equal([]uint64{9}))
+
+		// Nothing was deleted, so clients that are behind may go on
+		Expect(fetch("a", common.MakeSequence(2, 0))).Should(Equal([]uint64{4, 5, 6, 7, 8}))
+	})
+
+	It("Tombstones", func() {
+		putChange("a", 1, common.Insert, "public.config", 1, ancient)
+		putChange("a", 2, common.Insert, "public.config", 2, ancient)
+		putChange("a", 3, common.Delete, "public.config", 1, ancient)
+		putChange("a", 4, common.Delete, "public.config", 2, old)
+		putChange("a", 5, common.Insert, "public.config", 3, old)
+
+		compact()
+
+		// The newer tombstone is still there
+		Expect(fetch("a", lowestPossibleSequence)).Should(Equal([]uint64{4, 5}))
+
+		// Clients from before the old tombstone may have missed a delete
+		_, _, _, err := s.fetchChanges([]string{"a"}, common.MakeSequence(2, 0), 100, nil)
+		Expect(err).Should(Equal(errSnapshotOld))
+		Expect(fetch("a", common.MakeSequence(3, 1))).Should(Equal([]uint64{4, 5}))
+
+		// The horizon is still there after a restart
+		horizons, err := loadPurgeHorizons(s.db)
+		Expect(err).Should(Succeed())
+		Expect(horizons.firstSequence([]string{"a"}, emptySequence)).Should(
+			Equal(common.MakeSequence(3, 1)))
+	})
+
+	It("Hold back compaction", func() {
+		putChange("a", 1, common.Insert, "public.config", 1, ancient)
+		putChange("a", 2, common.Update, "public.config", 1, ancient)
+		putChange("a", 3, common.Update, "public.config", 1, ancient)
+		putChange("a", 4, common.Delete, "public.config", 1, ancient)
+		s.consumers.consumers["billing"] = &consumer{
+			Name:     "billing",
+			Acked:    time.Now(),
+			sequence: common.MakeSequence(2, 0),
+		}
+
+		compact()
+		Expect(fetch("a", lowestPossibleSequence)).Should(Equal([]uint64{2, 3, 4}))
+	})
+})
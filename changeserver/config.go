@@ -16,6 +16,10 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
+	"strings"
+
+	"github.com/apigee-labs/transicator/storage"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
@@ -31,12 +35,35 @@ func setConfigDefaults() {
 
 	pflag.StringP("dbdir", "d", "", "Location of database files")
 	viper.SetDefault("dbDir", "")
+	pflag.String("storage", storage.DefaultEngine(),
+		fmt.Sprintf("Storage engine (%s)", strings.Join(storage.Engines(), ", ")))
+	viper.SetDefault("storageEngine", storage.DefaultEngine())
 	pflag.StringP("url", "u", "", "URL to connect to Postgres")
 	viper.SetDefault("pgURL", "")
 	pflag.StringP("pgslot", "s", "", "Slot name for Postgres logical replication")
 	viper.SetDefault("pgSlot", "")
+	pflag.String("publication", "", "Read this publication with the built-in pgoutput plugin instead of the transicator plugin")
+	viper.SetDefault("publication", "")
+	pflag.String("plugin", "", "Logical decoding plugin: transicator_output, pgoutput, or wal2json")
+	viper.SetDefault("plugin", "")
+	pflag.Int("wal2json-version", defaultWal2JSONVersion, "Format version for the wal2json plugin (1 or 2)")
+	viper.SetDefault("wal2JSONVersion", defaultWal2JSONVersion)
 	pflag.StringP("maxage", "m", "", "Purge records older than this age.")
 	viper.SetDefault("maxAgeParam", "")
+	pflag.String("maxsize", "", "Purge the oldest records when the database uses more space than this")
+	viper.SetDefault("maxSizeParam", "")
+	pflag.String("retention", "", "YAML file with retention rules for each selector")
+	viper.SetDefault("retentionFile", "")
+	pflag.String("compaction", "", "YAML file listing tables for which only the latest change to each row is kept")
+	viper.SetDefault("compactionFile", "")
+	pflag.String("state", "", "YAML file listing tables whose current rows are served by the state API")
+	viper.SetDefault("stateFile", "")
+	pflag.String("maxhold", defaultMaxHold, "Consumers that don't acknowledge changes for this long stop holding back purging")
+	viper.SetDefault("maxHoldParam", defaultMaxHold)
+	pflag.Int("cachesize", defaultCacheSize, "Number of recent changes to keep in memory")
+	viper.SetDefault("cacheSize", defaultCacheSize)
+	pflag.Int64("maxlag", 0, "Not ready if replication is this many bytes behind")
+	viper.SetDefault("maxLag", 0)
 	pflag.String("cert", "", "TLS certificate PEM file")
 	viper.SetDefault("cert", "")
 	pflag.String("key", "", "TLS key PEM file (must be unencrypted)")
@@ -45,6 +72,16 @@ func setConfigDefaults() {
 	pflag.StringP("selectorcolumn", "S", "", "Set the selector column")
 	viper.SetDefault("prefix", "")
 	viper.SetDefault("selectorColumn", defaultSelectorColumn)
+	pflag.String("policy", "", "YAML file listing columns to drop or hash")
+	viper.SetDefault("policyFile", "")
+	pflag.String("hmackey", "", "File containing the secret for HMAC-signed bearer tokens")
+	viper.SetDefault("hmacKeyFile", "")
+	pflag.String("rsakey", "", "PEM file containing the public key for RSA-signed bearer tokens")
+	viper.SetDefault("rsaKeyFile", "")
+	pflag.String("bootstrap-from", "", "URL of a peer's backup API to load the database from on first start")
+	viper.SetDefault("bootstrapURL", "")
+	pflag.String("bootstrap-token", "", "File containing the bearer token for the bootstrap peer")
+	viper.SetDefault("bootstrapTokenFile", "")
 
 	pflag.StringP("config", "C", "", "specify the config directory (ONLY) for changeserver.properties")
 	pflag.BoolP("debug", "D", false, "Turn on debugging")
@@ -58,9 +95,20 @@ func getConfig() error {
 	viper.BindPFlag("mgmtPort", pflag.Lookup("mgmtport"))
 
 	viper.BindPFlag("dbDir", pflag.Lookup("dbdir"))
+	viper.BindPFlag("storageEngine", pflag.Lookup("storage"))
 	viper.BindPFlag("pgURL", pflag.Lookup("url"))
 	viper.BindPFlag("pgSlot", pflag.Lookup("pgslot"))
+	viper.BindPFlag("publication", pflag.Lookup("publication"))
+	viper.BindPFlag("plugin", pflag.Lookup("plugin"))
+	viper.BindPFlag("wal2JSONVersion", pflag.Lookup("wal2json-version"))
 	viper.BindPFlag("maxAgeParam", pflag.Lookup("maxage"))
+	viper.BindPFlag("maxSizeParam", pflag.Lookup("maxsize"))
+	viper.BindPFlag("retentionFile", pflag.Lookup("retention"))
+	viper.BindPFlag("compactionFile", pflag.Lookup("compaction"))
+	viper.BindPFlag("stateFile", pflag.Lookup("state"))
+	viper.BindPFlag("maxHoldParam", pflag.Lookup("maxhold"))
+	viper.BindPFlag("maxLag", pflag.Lookup("maxlag"))
+	viper.BindPFlag("cacheSize", pflag.Lookup("cachesize"))
 	viper.BindPFlag("cert", pflag.Lookup("cert"))
 	viper.BindPFlag("key", pflag.Lookup("key"))
 	viper.BindPFlag("prefix", pflag.Lookup("prefix"))
@@ -68,6 +116,11 @@ func getConfig() error {
 	viper.BindPFlag("configFile", pflag.Lookup("config"))
 	viper.BindPFlag("debug", pflag.Lookup("debug"))
 	viper.BindPFlag("selectorColumn", pflag.Lookup("selectorcolumn"))
+	viper.BindPFlag("policyFile", pflag.Lookup("policy"))
+	viper.BindPFlag("hmacKeyFile", pflag.Lookup("hmackey"))
+	viper.BindPFlag("rsaKeyFile", pflag.Lookup("rsakey"))
+	viper.BindPFlag("bootstrapURL", pflag.Lookup("bootstrap-from"))
+	viper.BindPFlag("bootstrapTokenFile", pflag.Lookup("bootstrap-token"))
 
 	viper.SetConfigName(appName)
 	// Load config values from file
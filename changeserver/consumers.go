@@ -0,0 +1,439 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/apigee-labs/transicator/common"
+	"github.com/apigee-labs/transicator/storage"
+	"github.com/julienschmidt/httprouter"
+)
+
+// consumerKeyPrefix starts the metadata key for each consumer
+const consumerKeyPrefix = "consumer/"
+
+/*
+A consumer is a named cursor for a client that must never miss a change.
+"Sequence" is the last sequence that the consumer acknowledged, and the
+cleaner won't purge any change after it. Consumers are saved as JSON in
+the database metadata.
+*/
+type consumer struct {
+	Name     string    `json:"name"`
+	Sequence string    `json:"sequence"`
+	Created  time.Time `json:"created"`
+	Acked    time.Time `json:"acked"`
+	sequence common.Sequence
+}
+
+/*
+consumerStatus is what the API returns for each consumer. "LagBytes" is
+how far the consumer is behind the last change in the database, and
+"IdleSeconds" is how long ago it last acknowledged a sequence.
+"Holding" is false if the consumer has not acknowledged anything for so
+long that it no longer stops the cleaner, and "SnapshotTooOld" means that
+changes that the consumer has not seen were purged.
+*/
+type consumerStatus struct {
+	consumer
+	LagBytes       uint64 `json:"lagBytes"`
+	IdleSeconds    int64  `json:"idleSeconds"`
+	Holding        bool   `json:"holding"`
+	SnapshotTooOld bool   `json:"snapshotTooOld"`
+}
+
+type consumerList struct {
+	FirstSequence string           `json:"firstSequence"`
+	LastSequence  string           `json:"lastSequence"`
+	Consumers     []consumerStatus `json:"consumers"`
+}
+
+/*
+consumerRegistry keeps all the consumers in memory so that the cleaner can
+find the lowest sequence quickly. "purgeLock" is held for reading while the
+cleaner purges, so that a new consumer can't be created at a sequence that
+the cleaner is about to purge.
+
+A consumer that has not acknowledged anything for longer than "maxHold"
+is assumed to be gone, and stops holding back the cleaner, so that one
+broken client can't fill up the disk. If "maxHold" is zero then consumers
+hold changes forever.
+*/
+type consumerRegistry struct {
+	lock      sync.Mutex
+	purgeLock sync.RWMutex
+	consumers map[string]*consumer
+	maxHold   time.Duration
+}
+
+/*
+loadConsumers reads all the consumers from the database metadata.
+*/
+func loadConsumers(db storage.DB) (*consumerRegistry, error) {
+	r := &consumerRegistry{
+		consumers: make(map[string]*consumer),
+	}
+
+	md, err := db.ListMetadata(consumerKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+	for key, buf := range md {
+		c := &consumer{}
+		err = json.Unmarshal(buf, c)
+		if err == nil {
+			c.sequence, err = common.ParseSequence(c.Sequence)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid consumer record %s: %s", key, err)
+		}
+		r.consumers[c.Name] = c
+	}
+	return r, nil
+}
+
+/*
+hold returns the lowest sequence that any consumer that is still holding
+acknowledged, or storage.NoLimit if there are none.
+*/
+func (r *consumerRegistry) hold(now time.Time) common.Sequence {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	hold := storage.NoLimit
+	for _, c := range r.consumers {
+		if r.isHolding(c, now) && c.sequence.Compare(hold) < 0 {
+			hold = c.sequence
+		}
+	}
+	return hold
+}
+
+func (r *consumerRegistry) isHolding(c *consumer, now time.Time) bool {
+	return r.maxHold <= 0 || now.Sub(c.Acked) <= r.maxHold
+}
+
+/*
+list returns a copy of every consumer, sorted by name.
+*/
+func (r *consumerRegistry) list() []consumer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	var names []string
+	for name := range r.consumers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var ret []consumer
+	for _, name := range names {
+		ret = append(ret, *r.consumers[name])
+	}
+	return ret
+}
+
+func (r *consumerRegistry) get(name string) (consumer, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	c := r.consumers[name]
+	if c == nil {
+		return consumer{}, false
+	}
+	return *c, true
+}
+
+/*
+initConsumersAPI adds the consumer API. Consumers hold changes for every
+selector, and they show how far each client has read, so when bearer tokens
+are in use, every call needs the "admin" claim.
+*/
+func (s *server) initConsumersAPI(prefix string, router *httprouter.Router) {
+	router.GET(prefix+"/consumers", requireAdmin(s.handleListConsumers))
+	router.GET(prefix+"/consumers/:name", requireAdmin(s.handleGetConsumer))
+	router.PUT(prefix+"/consumers/:name", requireAdmin(s.handleCreateConsumer))
+	router.DELETE(prefix+"/consumers/:name", requireAdmin(s.handleDeleteConsumer))
+	router.POST(prefix+"/consumers/:name/ack", requireAdmin(s.handleAckConsumer))
+}
+
+func requireAdmin(h httprouter.Handle) httprouter.Handle {
+	return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		if err := common.CheckAdmin(req); err != nil {
+			sendAPIError(forbidden, err.Error(), resp, req)
+			return
+		}
+		h(resp, req, params)
+	}
+}
+
+func (s *server) handleListConsumers(
+	resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	_, firstSeq, lastSeq, err := s.db.Scan(nil, 0, 0, 0, nil)
+	if err != nil {
+		sendAPIError(serverError, err.Error(), resp, req)
+		return
+	}
+	firstSeq = s.firstSequence(firstSeq)
+
+	list := &consumerList{
+		FirstSequence: firstSeq.String(),
+		LastSequence:  lastSeq.String(),
+		Consumers:     []consumerStatus{},
+	}
+	now := time.Now()
+	for _, c := range s.consumers.list() {
+		list.Consumers = append(list.Consumers,
+			s.consumers.makeStatus(c, firstSeq, lastSeq, now))
+	}
+	sendJSON(list, http.StatusOK, resp)
+}
+
+func (s *server) handleGetConsumer(
+	resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	c, ok := s.consumers.get(params.ByName("name"))
+	if !ok {
+		sendAPIError(notFound, params.ByName("name"), resp, req)
+		return
+	}
+	s.sendConsumer(c, http.StatusOK, resp, req)
+}
+
+/*
+handleCreateConsumer creates a consumer at the sequence in the "since"
+query parameter, or at the last sequence in the database. It is fine to
+create a consumer that already exists, and the existing one is returned.
+*/
+func (s *server) handleCreateConsumer(
+	resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	name := params.ByName("name")
+	if !reChangeSelector.MatchString(name) {
+		sendAPIError(invalidParameter, "name", resp, req)
+		return
+	}
+
+	r := s.consumers
+	r.purgeLock.Lock()
+	defer r.purgeLock.Unlock()
+
+	if c, ok := r.get(name); ok {
+		s.sendConsumer(c, http.StatusOK, resp, req)
+		return
+	}
+
+	_, firstSeq, lastSeq, err := s.db.Scan(nil, 0, 0, 0, nil)
+	if err != nil {
+		sendAPIError(serverError, err.Error(), resp, req)
+		return
+	}
+
+	since := lastSeq
+	if sinceStr := req.URL.Query().Get("since"); sinceStr != "" {
+		since, err = common.ParseSequence(sinceStr)
+		if err != nil {
+			sendAPIError(invalidParameter, "since", resp, req)
+			return
+		}
+		if since.Compare(lastSeq) > 0 {
+			sendAPIError(invalidParameter,
+				fmt.Sprintf("since is after the last sequence %s", lastSeq), resp, req)
+			return
+		}
+		if since.Compare(s.firstSequence(firstSeq)) < 0 &&
+			since.Compare(lowestPossibleSequence) > 0 {
+			sendAPIError(snapshotOld, "", resp, req)
+			return
+		}
+	}
+
+	now := time.Now()
+	c := &consumer{
+		Name:     name,
+		Created:  now,
+		Acked:    now,
+		sequence: since,
+	}
+	err = s.saveConsumer(c)
+	if err != nil {
+		sendAPIError(serverError, err.Error(), resp, req)
+		return
+	}
+	log.Infof("Created consumer %s at sequence %s", name, since)
+	s.sendConsumer(*c, http.StatusCreated, resp, req)
+}
+
+func (s *server) handleDeleteConsumer(
+	resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	name := params.ByName("name")
+	r := s.consumers
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.consumers[name] == nil {
+		sendAPIError(notFound, name, resp, req)
+		return
+	}
+	err := s.db.DeleteMetadata(consumerKeyPrefix + name)
+	if err != nil {
+		sendAPIError(serverError, err.Error(), resp, req)
+		return
+	}
+	delete(r.consumers, name)
+	log.Infof("Deleted consumer %s", name)
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+/*
+handleAckConsumer moves a consumer to the sequence in the "sequence" query
+parameter, which would usually be the "lastSequence" from the last batch
+of changes that the consumer finished with. Consumers can't move
+backwards, because the changes before their sequence may already be gone.
+*/
+func (s *server) handleAckConsumer(
+	resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	name := params.ByName("name")
+	seqStr := req.URL.Query().Get("sequence")
+	if seqStr == "" {
+		sendAPIError(missingParameter, "sequence", resp, req)
+		return
+	}
+	seq, err := common.ParseSequence(seqStr)
+	if err != nil {
+		sendAPIError(invalidParameter, "sequence", resp, req)
+		return
+	}
+
+	_, _, lastSeq, err := s.db.Scan(nil, 0, 0, 0, nil)
+	if err != nil {
+		sendAPIError(serverError, err.Error(), resp, req)
+		return
+	}
+	if seq.Compare(lastSeq) > 0 {
+		sendAPIError(invalidParameter,
+			fmt.Sprintf("sequence is after the last sequence %s", lastSeq), resp, req)
+		return
+	}
+
+	r := s.consumers
+	r.lock.Lock()
+	cur := r.consumers[name]
+	if cur == nil {
+		r.lock.Unlock()
+		sendAPIError(notFound, name, resp, req)
+		return
+	}
+	if seq.Compare(cur.sequence) < 0 {
+		r.lock.Unlock()
+		sendAPIError(invalidParameter,
+			fmt.Sprintf("sequence is before the acknowledged sequence %s", cur.sequence),
+			resp, req)
+		return
+	}
+
+	c := *cur
+	c.sequence = seq
+	c.Acked = time.Now()
+	err = s.putConsumer(&c)
+	if err == nil {
+		r.consumers[name] = &c
+	}
+	r.lock.Unlock()
+
+	if err != nil {
+		sendAPIError(serverError, err.Error(), resp, req)
+		return
+	}
+	s.sendConsumer(c, http.StatusOK, resp, req)
+}
+
+func (s *server) saveConsumer(c *consumer) error {
+	r := s.consumers
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	err := s.putConsumer(c)
+	if err == nil {
+		r.consumers[c.Name] = c
+	}
+	return err
+}
+
+// putConsumer writes a consumer to the database metadata
+func (s *server) putConsumer(c *consumer) error {
+	c.Sequence = c.sequence.String()
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return s.db.PutMetadata(consumerKeyPrefix+c.Name, buf)
+}
+
+func (s *server) sendConsumer(c consumer, code int,
+	resp http.ResponseWriter, req *http.Request) {
+	_, firstSeq, lastSeq, err := s.db.Scan(nil, 0, 0, 0, nil)
+	if err != nil {
+		sendAPIError(serverError, err.Error(), resp, req)
+		return
+	}
+	status := s.consumers.makeStatus(c, s.firstSequence(firstSeq), lastSeq, time.Now())
+	sendJSON(&status, code, resp)
+}
+
+/*
+firstSequence returns the oldest sequence that a client can ask for without
+getting "snapshot too old," given the first sequence in the database.
+*/
+func (s *server) firstSequence(dbFirst common.Sequence) common.Sequence {
+	s.horizons.lock.RLock()
+	defer s.horizons.lock.RUnlock()
+	return s.horizons.firstSequence(nil, dbFirst)
+}
+
+func (r *consumerRegistry) makeStatus(c consumer, firstSeq, lastSeq common.Sequence, now time.Time) consumerStatus {
+	status := consumerStatus{
+		consumer:    c,
+		IdleSeconds: int64(now.Sub(c.Acked) / time.Second),
+		Holding:     r.isHolding(&c, now),
+	}
+	status.LagBytes = c.lag(lastSeq)
+	status.SnapshotTooOld = c.sequence.Compare(firstSeq) < 0 &&
+		c.sequence.Compare(lowestPossibleSequence) > 0
+	return status
+}
+
+/*
+lag returns the number of bytes of WAL between the consumer and "lastSeq."
+*/
+func (c *consumer) lag(lastSeq common.Sequence) uint64 {
+	if lastSeq.LSN > c.sequence.LSN {
+		return lastSeq.LSN - c.sequence.LSN
+	}
+	return 0
+}
+
+func sendJSON(v interface{}, code int, resp http.ResponseWriter) {
+	buf, _ := json.Marshal(v)
+	resp.Header().Set("Content-Type", jsonContent)
+	resp.WriteHeader(code)
+	resp.Write(buf)
+}
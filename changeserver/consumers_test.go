@@ -0,0 +1,247 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"time"
+
+	"github.com/apigee-labs/transicator/common"
+	"github.com/apigee-labs/transicator/storage"
+	"github.com/julienschmidt/httprouter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const consumersTestDir = "./consumerstestdata"
+
+var _ = Describe("Consumers", func() {
+	var s *server
+	var router *httprouter.Router
+
+	BeforeEach(func() {
+		db, err := storage.Open(storage.DefaultEngine(), consumersTestDir)
+		Expect(err).Should(Succeed())
+		horizons, err := loadPurgeHorizons(db)
+		Expect(err).Should(Succeed())
+		consumers, err := loadConsumers(db)
+		Expect(err).Should(Succeed())
+		s = &server{
+			db:        db,
+			queries:   createQueryGroup(),
+			metrics:   createMetrics(),
+			horizons:  horizons,
+			consumers: consumers,
+		}
+		router = httprouter.New()
+		s.initConsumersAPI("", router)
+	})
+
+	AfterEach(func() {
+		s.db.Close()
+		Expect(s.db.Delete()).Should(Succeed())
+	})
+
+	putChanges := func(lsns ...uint64) {
+		for _, lsn := range lsns {
+			c := &common.Change{
+				Operation:      common.Insert,
+				Table:          "public.consumers",
+				CommitSequence: lsn,
+			}
+			Expect(s.db.Put("consumers", lsn, 0, encodeChangeProto(c))).Should(Succeed())
+		}
+		_, first, last, err := s.db.Scan(nil, 0, 0, 0, nil)
+		Expect(err).Should(Succeed())
+		s.cache = createTailCache(0, first, last)
+	}
+
+	call := func(method, path string, expectedCode int) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		Expect(rec.Code).Should(Equal(expectedCode))
+		return rec
+	}
+
+	getStatus := func(method, path string, expectedCode int) consumerStatus {
+		var status consumerStatus
+		rec := call(method, path, expectedCode)
+		Expect(json.Unmarshal(rec.Body.Bytes(), &status)).Should(Succeed())
+		return status
+	}
+
+	It("API", func() {
+		putChanges(1, 2, 3, 4)
+
+		status := getStatus("PUT", "/consumers/billing?since=0.2.0", http.StatusCreated)
+		Expect(status.Name).Should(Equal("billing"))
+		Expect(status.Sequence).Should(Equal("0.2.0"))
+		Expect(status.LagBytes).Should(BeEquivalentTo(2))
+		Expect(status.Holding).Should(BeTrue())
+
+		// Creating it again returns the one that is there
+		status = getStatus("PUT", "/consumers/billing", http.StatusOK)
+		Expect(status.Sequence).Should(Equal("0.2.0"))
+
+		// Without "since," consumers start at the end
+		status = getStatus("PUT", "/consumers/audit", http.StatusCreated)
+		Expect(status.Sequence).Should(Equal("0.4.0"))
+		Expect(status.LagBytes).Should(BeZero())
+
+		status = getStatus("POST", "/consumers/billing/ack?sequence=0.3.0", http.StatusOK)
+		Expect(status.Sequence).Should(Equal("0.3.0"))
+		status = getStatus("GET", "/consumers/billing", http.StatusOK)
+		Expect(status.Sequence).Should(Equal("0.3.0"))
+		Expect(status.LagBytes).Should(BeEquivalentTo(1))
+
+		rec := call("GET", "/consumers", http.StatusOK)
+		var list consumerList
+		Expect(json.Unmarshal(rec.Body.Bytes(), &list)).Should(Succeed())
+		Expect(list.LastSequence).Should(Equal("0.4.0"))
+		Expect(len(list.Consumers)).Should(Equal(2))
+		Expect(list.Consumers[0].Name).Should(Equal("audit"))
+		Expect(list.Consumers[1].Name).Should(Equal("billing"))
+
+		// Consumers are saved in the database
+		consumers, err := loadConsumers(s.db)
+		Expect(err).Should(Succeed())
+		c, ok := consumers.get("billing")
+		Expect(ok).Should(BeTrue())
+		Expect(c.sequence).Should(Equal(common.MakeSequence(3, 0)))
+
+		call("DELETE", "/consumers/audit", http.StatusNoContent)
+		call("DELETE", "/consumers/audit", http.StatusNotFound)
+		call("GET", "/consumers/audit", http.StatusNotFound)
+		consumers, err = loadConsumers(s.db)
+		Expect(err).Should(Succeed())
+		_, ok = consumers.get("audit")
+		Expect(ok).Should(BeFalse())
+	})
+
+	It("Invalid requests", func() {
+		putChanges(1, 2, 3, 4)
+		call("PUT", "/consumers/Not%20Valid", http.StatusBadRequest)
+		call("PUT", "/consumers/ahead?since=0.5.0", http.StatusBadRequest)
+		call("PUT", "/consumers/bad?since=foo", http.StatusBadRequest)
+
+		getStatus("PUT", "/consumers/billing?since=0.3.0", http.StatusCreated)
+		call("POST", "/consumers/billing/ack", http.StatusBadRequest)
+		call("POST", "/consumers/billing/ack?sequence=foo", http.StatusBadRequest)
+		call("POST", "/consumers/billing/ack?sequence=0.2.0", http.StatusBadRequest)
+		call("POST", "/consumers/billing/ack?sequence=0.5.0", http.StatusBadRequest)
+		call("POST", "/consumers/nope/ack?sequence=0.4.0", http.StatusNotFound)
+	})
+
+	It("Tokens need admin", func() {
+		putChanges(1, 2, 3, 4)
+		getStatus("PUT", "/consumers/billing?since=0.2.0", http.StatusCreated)
+
+		tmpDir, err := ioutil.TempDir("", "consumerstest")
+		Expect(err).Should(Succeed())
+		defer os.RemoveAll(tmpDir)
+		keyFile := path.Join(tmpDir, "key")
+		Expect(ioutil.WriteFile(keyFile, []byte(backupTestKey), 0600)).Should(Succeed())
+		verifier, err := common.CreateTokenVerifier(keyFile, "")
+		Expect(err).Should(Succeed())
+		h := verifier.Handler(router)
+
+		callWithToken := func(method, path, tok string, expectedCode int) {
+			req := httptest.NewRequest(method, path, nil)
+			req.Header.Set("Authorization", "Bearer "+tok)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			Expect(rec.Code).Should(Equal(expectedCode))
+		}
+
+		tok := makeBackupToken(false)
+		callWithToken("GET", "/consumers", tok, http.StatusForbidden)
+		callWithToken("GET", "/consumers/billing", tok, http.StatusForbidden)
+		callWithToken("PUT", "/consumers/audit", tok, http.StatusForbidden)
+		callWithToken("POST", "/consumers/billing/ack?sequence=0.3.0", tok, http.StatusForbidden)
+		callWithToken("DELETE", "/consumers/billing", tok, http.StatusForbidden)
+		_, ok := s.consumers.get("audit")
+		Expect(ok).Should(BeFalse())
+		c, _ := s.consumers.get("billing")
+		Expect(c.sequence).Should(Equal(common.MakeSequence(2, 0)))
+
+		adminTok := makeBackupToken(true)
+		callWithToken("GET", "/consumers", adminTok, http.StatusOK)
+		callWithToken("POST", "/consumers/billing/ack?sequence=0.3.0", adminTok, http.StatusOK)
+		callWithToken("DELETE", "/consumers/billing", adminTok, http.StatusNoContent)
+	})
+
+	It("Hold back purging", func() {
+		putChanges(1, 2, 3, 4, 5)
+		getStatus("PUT", "/consumers/billing?since=0.3.0", http.StatusCreated)
+		time.Sleep(100 * time.Millisecond)
+
+		c := &cleaner{s: s, maxAge: 50 * time.Millisecond}
+		c.performCleanup()
+
+		first, _, changes, err := s.fetchChanges([]string{"consumers"}, common.MakeSequence(3, 0), 100, nil)
+		Expect(err).Should(Succeed())
+		Expect(first).Should(Equal(common.MakeSequence(3, 0)))
+		Expect(len(changes)).Should(Equal(3))
+
+		// Once the consumer moves on, the cleaner does too
+		getStatus("POST", "/consumers/billing/ack?sequence=0.5.0", http.StatusOK)
+		c.performCleanup()
+		_, _, _, err = s.fetchChanges([]string{"consumers"}, common.MakeSequence(3, 0), 100, nil)
+		Expect(err).Should(Equal(errSnapshotOld))
+		_, _, _, err = s.fetchChanges([]string{"consumers"}, common.MakeSequence(5, 0), 100, nil)
+		Expect(err).Should(Succeed())
+	})
+
+	It("Hold back purging with a retention policy", func() {
+		p, err := parseRetentionPolicy([]byte("default:\n  maxCount: 1\n"), 0)
+		Expect(err).Should(Succeed())
+		s.horizons.retention = true
+		putChanges(1, 2, 3, 4, 5)
+		getStatus("PUT", "/consumers/billing?since=0.2.0", http.StatusCreated)
+
+		c := &cleaner{s: s, policy: p}
+		c.performCleanup()
+
+		first, _, changes, err := s.fetchChanges([]string{"consumers"}, common.MakeSequence(2, 0), 100, nil)
+		Expect(err).Should(Succeed())
+		Expect(first).Should(Equal(common.MakeSequence(1, 1)))
+		Expect(len(changes)).Should(Equal(4))
+	})
+
+	It("Stop holding after the maximum", func() {
+		putChanges(1, 2, 3, 4, 5)
+		getStatus("PUT", "/consumers/billing?since=0.2.0", http.StatusCreated)
+		s.consumers.maxHold = 50 * time.Millisecond
+		time.Sleep(100 * time.Millisecond)
+
+		status := getStatus("GET", "/consumers/billing", http.StatusOK)
+		Expect(status.Holding).Should(BeFalse())
+		Expect(status.SnapshotTooOld).Should(BeFalse())
+
+		c := &cleaner{s: s, maxAge: 50 * time.Millisecond}
+		c.performCleanup()
+
+		status = getStatus("GET", "/consumers/billing", http.StatusOK)
+		Expect(status.SnapshotTooOld).Should(BeTrue())
+		_, _, _, err := s.fetchChanges([]string{"consumers"}, common.MakeSequence(2, 0), 100, nil)
+		Expect(err).Should(Equal(errSnapshotOld))
+	})
+})
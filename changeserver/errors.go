@@ -17,8 +17,11 @@ limitations under the License.
 package main
 
 import (
-	"github.com/apigee-labs/transicator/common"
+	"encoding/json"
 	"net/http"
+
+	"github.com/apigee-labs/transicator/common"
+	"golang.org/x/net/websocket"
 )
 
 type errorCode int
@@ -29,6 +32,8 @@ const (
 	missingParameter  errorCode = iota
 	snapshotOld       errorCode = iota
 	serverError       errorCode = iota
+	forbidden         errorCode = iota
+	notFound          errorCode = iota
 )
 
 func sendAPIError(code errorCode, description string,
@@ -38,6 +43,40 @@ func sendAPIError(code errorCode, description string,
 	common.SendAPIError(ec, em, description, sc, resp, req)
 }
 
+/*
+sendParamError sends the right error for a problem with the query
+parameters, which is a 403 if the client may not use a selector.
+*/
+func sendParamError(err error, resp http.ResponseWriter, req *http.Request) {
+	if _, ok := err.(*common.SelectorAccessError); ok {
+		sendAPIError(forbidden, err.Error(), resp, req)
+	} else {
+		sendAPIError(invalidParameter, err.Error(), resp, req)
+	}
+}
+
+/*
+sendStreamError sends an error to a WebSocket client as a JSON
+text frame, since the HTTP response has already been sent.
+*/
+func sendStreamError(code errorCode, description string, ws *websocket.Conn) {
+	websocket.Message.Send(ws, string(marshalAPIError(code, description)))
+}
+
+/*
+marshalAPIError returns the JSON form of an error, for APIs that can't use
+the HTTP response code because they already started streaming.
+*/
+func marshalAPIError(code errorCode, description string) []byte {
+	ec, em, _ := code.errInfo()
+	buf, _ := json.Marshal(&common.APIError{
+		Code:        ec,
+		Error:       em,
+		Description: description,
+	})
+	return buf
+}
+
 func (e errorCode) errInfo() (string, string, int) {
 	switch e {
 	case unsupportedFormat:
@@ -50,6 +89,10 @@ func (e errorCode) errInfo() (string, string, int) {
 		return "SNAPSHOT_TOO_OLD", "The client is operating on an old snapshot", http.StatusBadRequest
 	case serverError:
 		return "INTERNAL_SERVER_ERROR", "An error occurred in the server", http.StatusInternalServerError
+	case forbidden:
+		return "FORBIDDEN", "The client may not access the requested data", http.StatusForbidden
+	case notFound:
+		return "NOT_FOUND", "The requested resource does not exist", http.StatusNotFound
 	default:
 		return "UNKNOWN", "An unknown error occurred", http.StatusInternalServerError
 	}
@@ -0,0 +1,111 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/apigee-labs/transicator/common"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Event stream API Tests", func() {
+	var lastTestSequence = time.Now().Unix() + 200000
+
+	It("Stream events", func() {
+		cl := getChanges(fmt.Sprintf("%s/changes?selector=eventtest&limit=%d",
+			baseURL, maxLimitChanges))
+
+		resp := openEventStream("/changes?selector=eventtest", cl.LastSequence)
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(200))
+		Expect(resp.Header.Get("Content-Type")).Should(Equal(eventStreamContent))
+		rdr := bufio.NewReader(resp.Body)
+
+		lastTestSequence++
+		_, err := insertStmt.Exec(lastTestSequence, "eventtest")
+		Expect(err).Should(Succeed())
+
+		id, change := readEvent(rdr)
+		var newSeq int64
+		err = change.NewRow.Get("sequence", &newSeq)
+		Expect(err).Should(Succeed())
+		Expect(newSeq).Should(Equal(lastTestSequence))
+		Expect(id).Should(Equal(change.Sequence))
+		resp.Body.Close()
+
+		// Resume from the last event and make sure we get the next one only
+		lastTestSequence++
+		_, err = insertStmt.Exec(lastTestSequence, "eventtest")
+		Expect(err).Should(Succeed())
+
+		resp = openEventStream("/changes?selector=eventtest", id)
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(200))
+		rdr = bufio.NewReader(resp.Body)
+
+		_, change = readEvent(rdr)
+		err = change.NewRow.Get("sequence", &newSeq)
+		Expect(err).Should(Succeed())
+		Expect(newSeq).Should(Equal(lastTestSequence))
+	})
+
+	It("Stream events bad ID", func() {
+		resp := openEventStream("/changes?selector=eventtest", "notasequence")
+		defer resp.Body.Close()
+		checkAPIErrorCode(resp, http.StatusBadRequest, "PARAMETER_INVALID")
+	})
+})
+
+func openEventStream(path, lastID string) *http.Response {
+	req := createStandardRequest("GET", baseURL+path, eventStreamContent, nil)
+	req.Header.Set("Last-Event-ID", lastID)
+	resp, err := http.DefaultClient.Do(req)
+	Expect(err).Should(Succeed())
+	return resp
+}
+
+/*
+readEvent reads the next event from the stream, skipping heartbeats.
+*/
+func readEvent(rdr *bufio.Reader) (string, *common.Change) {
+	var id string
+	var data []string
+
+	for {
+		line, err := rdr.ReadString('\n')
+		Expect(err).Should(Succeed())
+		line = strings.TrimRight(line, "\n")
+
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				change, err := common.UnmarshalChange([]byte(strings.Join(data, "\n")))
+				Expect(err).Should(Succeed())
+				return id, change
+			}
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		}
+	}
+}
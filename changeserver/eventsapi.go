@@ -0,0 +1,189 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/apigee-labs/transicator/common"
+)
+
+const (
+	eventStreamContent = "text/event-stream"
+
+	// eventHeartbeatInterval is how often we send a comment to the client
+	// when there are no changes, so that proxies keep the connection open.
+	eventHeartbeatInterval = 15 * time.Second
+
+	// movedEventSuffix ends the ID of the synthetic delete for a row that
+	// moved between selectors. The insert that follows it has the same
+	// sequence, so the client must resume at that sequence, not after it.
+	movedEventSuffix = "-moved"
+)
+
+/*
+handleChangeEvents implements the "/changes" API for clients that asked for
+"text/event-stream." The response is kept open, and each change is sent
+as a separate server-sent event whose ID is the sequence of the change.
+A client that reconnects with the "Last-Event-ID" header resumes right
+after that change, just as if it had used the "since" parameter.
+*/
+func (s *server) handleChangeEvents(
+	limit int, scopes []string, sinceSeq common.Sequence,
+	filter func([]byte) bool, tables *tableFilter,
+	resp http.ResponseWriter, req *http.Request) {
+
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		sendAPIError(serverError, "Streaming not supported", resp, req)
+		return
+	}
+
+	lastID := req.Header.Get("Last-Event-ID")
+	moved := strings.HasSuffix(lastID, movedEventSuffix)
+	if lastID != "" {
+		lastSeq, err := common.ParseSequence(strings.TrimSuffix(lastID, movedEventSuffix))
+		if err != nil {
+			sendAPIError(invalidParameter, "Last-Event-ID", resp, req)
+			return
+		}
+		sinceSeq = lastSeq
+		if !moved {
+			sinceSeq.Index++
+		}
+	}
+
+	// Check the first set of changes before sending any headers so that
+	// we can still return a regular error.
+	firstSeq, lastSeq, changes, success :=
+		s.receiveChanges(scopes, sinceSeq, limit, filter, resp, req)
+	if !success {
+		return
+	}
+	if moved {
+		// The client already has the delete, but maybe not the insert
+		changes = dropMovedDelete(changes, sinceSeq)
+	}
+
+	resp.Header().Set("Content-Type", eventStreamContent)
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	clientGone := req.Context().Done()
+
+	for {
+		select {
+		case <-clientGone:
+			log.Debug("Event stream client went away")
+			return
+		default:
+		}
+
+		if len(changes) > 0 {
+			changeList := makeChangeList(firstSeq, lastSeq, changes,
+				len(changes) >= limit)
+
+			for _, c := range changeList.Changes {
+				writeChangeEvent(&c, resp)
+			}
+			flusher.Flush()
+
+			sinceSeq = changeList.Changes[len(changeList.Changes)-1].GetSequence()
+			sinceSeq.Index++
+
+		} else {
+			waitSeq := lastSeq
+			waitSeq.Index++
+			newSeq := s.tracker.timedWaitTables(waitSeq, eventHeartbeatInterval,
+				scopes, tables.matches)
+
+			if newSeq.Compare(waitSeq) < 0 {
+				// Timed out waiting. Heartbeat so that proxies keep the connection open.
+				_, err := io.WriteString(resp, ": heartbeat\n\n")
+				if err != nil {
+					return
+				}
+				flusher.Flush()
+				continue
+			}
+		}
+
+		var err error
+		firstSeq, lastSeq, changes, err = s.fetchChanges(scopes, sinceSeq, limit, filter)
+		if err == errSnapshotOld {
+			writeErrorEvent(snapshotOld, "", resp)
+			return
+		}
+		if err != nil {
+			writeErrorEvent(serverError, err.Error(), resp)
+			return
+		}
+	}
+}
+
+/*
+dropMovedDelete removes the synthetic delete at "seq" from a list of changes.
+*/
+func dropMovedDelete(changes []*common.Change, seq common.Sequence) []*common.Change {
+	for i, c := range changes {
+		if c.Operation == common.Delete && c.Synthetic &&
+			c.GetSequence().Compare(seq) == 0 {
+			ret := make([]*common.Change, 0, len(changes)-1)
+			ret = append(ret, changes[:i]...)
+			return append(ret, changes[i+1:]...)
+		}
+	}
+	return changes
+}
+
+/*
+writeChangeEvent writes a single change in event stream format.
+Each line of the JSON becomes a separate "data" line.
+*/
+func writeChangeEvent(c *common.Change, w io.Writer) {
+	id := c.Sequence
+	if c.Operation == common.Delete && c.Synthetic {
+		id += movedEventSuffix
+	}
+	fmt.Fprintf(w, "id: %s\n", id)
+	writeEventData(c.Marshal(), w)
+}
+
+/*
+writeErrorEvent sends an error to an event stream client, since the HTTP
+response code has already been sent. The event has the type "error."
+*/
+func writeErrorEvent(code errorCode, description string, resp http.ResponseWriter) {
+	io.WriteString(resp, "event: error\n")
+	writeEventData(marshalAPIError(code, description), resp)
+	if f, ok := resp.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func writeEventData(buf []byte, w io.Writer) {
+	for _, line := range bytes.Split(buf, []byte{'\n'}) {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	io.WriteString(w, "\n")
+}
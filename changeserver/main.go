@@ -24,14 +24,19 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/apid/goscaffold"
+	"github.com/apigee-labs/transicator/common"
+	"github.com/apigee-labs/transicator/replication"
+	"github.com/apigee-labs/transicator/storage"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 const (
-	packageName      string = "transicator"
-	appName          string = "changeserver"
-	defaultCacheSize        = 65536
+	packageName            string = "transicator"
+	appName                string = "changeserver"
+	defaultCacheSize              = 65536
+	defaultMaxHold                = "168h"
+	defaultWal2JSONVersion        = 2
 )
 
 func main() {
@@ -52,6 +57,23 @@ func printUsage() {
 	fmt.Fprintln(os.Stderr)
 	fmt.Fprintln(os.Stderr, "  The value of the \"-m\" parameter for maximum age is a Golang")
 	fmt.Fprintln(os.Stderr, "\"duration\": use \"m\", \"s\", and \"h\" for minutes, seconds, and hours")
+	fmt.Fprintln(os.Stderr, "  If \"--retention\" is set, then \"-m\" is the maximum age for selectors")
+	fmt.Fprintln(os.Stderr, "that no rule in the file matches, unless the file has a default age.")
+	fmt.Fprintln(os.Stderr, "  If \"--compaction\" is set without \"--retention\", then each selector")
+	fmt.Fprintln(os.Stderr, "is purged on its own, as if every selector used the default rule.")
+	fmt.Fprintln(os.Stderr, "  The value of \"--maxsize\" is a number of bytes, optionally followed")
+	fmt.Fprintln(os.Stderr, "by \"K\", \"M\", \"G\", or \"T\", like \"20G\"")
+	fmt.Fprintln(os.Stderr, "  \"--maxhold\" is a duration like \"-m\". Use \"0\" to let consumers")
+	fmt.Fprintln(os.Stderr, "hold back purging for as long as they exist.")
+}
+
+func isStorageEngine(name string) bool {
+	for _, e := range storage.Engines() {
+		if e == name {
+			return true
+		}
+	}
+	return false
 }
 
 func runMain() int {
@@ -78,13 +100,29 @@ func runMain() int {
 	mgmtPort := viper.GetInt("mgmtPort")
 
 	dbDir := viper.GetString("dbDir")
+	storageEngine := viper.GetString("storageEngine")
 	pgURL := viper.GetString("pgURL")
 	pgSlot := viper.GetString("pgSlot")
+	publication := viper.GetString("publication")
+	plugin := viper.GetString("plugin")
+	wal2JSONVersion := viper.GetInt("wal2JSONVersion")
 	maxAgeParam := viper.GetString("maxAgeParam")
+	maxSizeParam := viper.GetString("maxSizeParam")
+	retentionFile := viper.GetString("retentionFile")
+	compactionFile := viper.GetString("compactionFile")
+	stateFile := viper.GetString("stateFile")
+	maxHoldParam := viper.GetString("maxHoldParam")
+	maxLag := viper.GetInt64("maxLag")
+	cacheSize := viper.GetInt("cacheSize")
 	cert := viper.GetString("cert")
 	key := viper.GetString("key")
 	prefix := viper.GetString("prefix")
 	selectorColumnParam := viper.GetString("selectorColumn")
+	policyFile := viper.GetString("policyFile")
+	hmacKeyFile := viper.GetString("hmacKeyFile")
+	rsaKeyFile := viper.GetString("rsaKeyFile")
+	bootstrapURL := viper.GetString("bootstrapURL")
+	bootstrapTokenFile := viper.GetString("bootstrapTokenFile")
 
 	debug := viper.GetBool("debug")
 
@@ -107,26 +145,152 @@ func runMain() int {
 			return 4
 		}
 	}
+	var maxSize int64
+	if maxSizeParam != "" {
+		maxSize, err = parseSize(maxSizeParam)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid value for max size: %s\n", err)
+			printUsage()
+			return 4
+		}
+	}
+	maxHold, err := time.ParseDuration(maxHoldParam)
+	if err != nil || maxHold < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid value for max hold: \"%s\"\n", maxHoldParam)
+		printUsage()
+		return 4
+	}
+	if maxLag < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid value for max lag: %d\n", maxLag)
+		printUsage()
+		return 4
+	}
+	if !isStorageEngine(storageEngine) {
+		fmt.Fprintf(os.Stderr, "Invalid storage engine \"%s\"\n", storageEngine)
+		printUsage()
+		return 4
+	}
+	if cacheSize < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid value for cache size: %d\n", cacheSize)
+		printUsage()
+		return 4
+	}
+	if plugin == "" {
+		if publication == "" {
+			plugin = replication.TransicatorPlugin
+		} else {
+			plugin = replication.PgOutputPlugin
+		}
+	}
+	err = replication.CheckPlugin(plugin, wal2JSONVersion)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		printUsage()
+		return 4
+	}
+	if plugin == replication.PgOutputPlugin && publication == "" {
+		fmt.Fprintln(os.Stderr, "The pgoutput plugin requires \"--publication\"")
+		printUsage()
+		return 4
+	}
+
+	var retention *retentionPolicy
+	if retentionFile != "" {
+		retention, err = loadRetentionPolicy(retentionFile, maxAge)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid retention policy \"%s\": %s\n",
+				retentionFile, err)
+			return 4
+		}
+	}
+
+	var compaction *compactionPolicy
+	if compactionFile != "" {
+		compaction, err = loadCompactionPolicy(compactionFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid compaction policy \"%s\": %s\n",
+				compactionFile, err)
+			return 4
+		}
+	}
+
+	var stateTables tableKeys
+	if stateFile != "" {
+		stateTables, err = loadStateConfig(stateFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid state configuration \"%s\": %s\n",
+				stateFile, err)
+			return 4
+		}
+	}
 
 	// Set the global scopeField from server.go to the user supplied value
 	selectorColumn = selectorColumnParam
 
+	if policyFile != "" {
+		columnPolicy, err = common.LoadColumnPolicy(policyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid column policy \"%s\": %s\n",
+				policyFile, err)
+			return 4
+		}
+	}
+
+	if hmacKeyFile != "" || rsaKeyFile != "" {
+		tokenVerifier, err = common.CreateTokenVerifier(hmacKeyFile, rsaKeyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid token key: %s\n", err)
+			return 4
+		}
+	}
+
 	if debug {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
+	if bootstrapURL != "" {
+		err = bootstrapFromPeer(bootstrapURL, bootstrapTokenFile, storageEngine, dbDir, pgURL,
+			sanitizeSlotName(pgSlot), plugin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error bootstrapping from %s: %s\n", bootstrapURL, err)
+			return 4
+		}
+	}
+
 	mux := http.NewServeMux()
 
-	server, err := createChangeServer(mux, dbDir, pgURL, pgSlot, prefix)
+	server, err := createChangeServer(mux, storageEngine, dbDir, pgURL, pgSlot, prefix)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error starting server: %s\n", err)
 		return 4
 	}
+	server.maxLag = uint64(maxLag)
+	server.repl.SetPublication(publication)
+	server.repl.SetPlugin(plugin, wal2JSONVersion)
+	server.cache.size = cacheSize
+	server.consumers.maxHold = maxHold
+	if stateTables != nil {
+		server.state, err = openState(server.db, stateTables)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading state: %s\n", err)
+			server.db.Close()
+			return 4
+		}
+	}
 	server.start()
 	defer server.stop()
 
-	if maxAge > 0 {
-		server.startCleanup(maxAge)
+	// These are not part of the router so that they don't count in the
+	// metrics. They are about every selector, so they need an admin token.
+	mux.Handle(prefix+"/metrics", adminHandler(tokenVerifier, server.handleGetMetrics))
+	if tokenVerifier == nil {
+		logrus.Info("Backup API is disabled because no token key was specified")
+	} else {
+		mux.Handle(prefix+"/backup", adminHandler(tokenVerifier, server.handleGetBackup))
+	}
+
+	if maxAge > 0 || maxSize > 0 || retention != nil || compaction != nil {
+		server.startCleanup(maxAge, maxSize, retention, compaction)
 	}
 
 	scaf := goscaffold.CreateHTTPScaffold()
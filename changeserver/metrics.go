@@ -0,0 +1,371 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apigee-labs/transicator/replication"
+)
+
+const metricsContent = "text/plain; version=0.0.4"
+
+var (
+	latencyBuckets = []float64{
+		0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60,
+	}
+	batchBuckets = []float64{
+		1, 2, 5, 10, 20, 50, 100, 200,
+	}
+	replicationStates = []replication.State{
+		replication.Connecting, replication.Running, replication.Stopped,
+	}
+)
+
+/*
+A histogram counts observations in buckets, like a Prometheus histogram.
+The buckets are cumulative only when the histogram is written.
+*/
+type histogram struct {
+	lock    sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) write(w io.Writer, name, labels string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var total uint64
+	for i, b := range h.buckets {
+		total += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n",
+			name, labels, sep, formatFloat(b), total)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(labels), formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braces(labels), h.count)
+}
+
+/*
+serverMetrics keeps track of everything that we report on the "/metrics"
+path. Values that are cheap to get elsewhere, like the replication state,
+are read when the metrics are written.
+*/
+type serverMetrics struct {
+	// Fields used with "atomic" come first so they are aligned
+	receivedLSN      uint64
+	acknowledgedLSN  uint64
+	purgedRecords    uint64
+	purgeErrors      uint64
+	cacheHits        uint64
+	cacheMisses      uint64
+	lock             sync.Mutex
+	requestLatencies map[int]*histogram
+	batchSizes       *histogram
+	scanLatency      *histogram
+}
+
+func createMetrics() *serverMetrics {
+	return &serverMetrics{
+		requestLatencies: make(map[int]*histogram),
+		batchSizes:       newHistogram(batchBuckets),
+		scanLatency:      newHistogram(latencyBuckets),
+	}
+}
+
+func (m *serverMetrics) observeRequest(code int, latency time.Duration) {
+	m.lock.Lock()
+	h := m.requestLatencies[code]
+	if h == nil {
+		h = newHistogram(latencyBuckets)
+		m.requestLatencies[code] = h
+	}
+	m.lock.Unlock()
+	h.observe(latency.Seconds())
+}
+
+func (m *serverMetrics) setReceivedLSN(lsn uint64) {
+	if lsn > atomic.LoadUint64(&m.receivedLSN) {
+		atomic.StoreUint64(&m.receivedLSN, lsn)
+	}
+}
+
+func (m *serverMetrics) setAcknowledgedLSN(lsn uint64) {
+	atomic.StoreUint64(&m.acknowledgedLSN, lsn)
+}
+
+func (m *serverMetrics) countCacheRequest(hit bool) {
+	if hit {
+		atomic.AddUint64(&m.cacheHits, 1)
+	} else {
+		atomic.AddUint64(&m.cacheMisses, 1)
+	}
+}
+
+func (m *serverMetrics) addPurged(count uint64, err error) {
+	atomic.AddUint64(&m.purgedRecords, count)
+	if err != nil {
+		atomic.AddUint64(&m.purgeErrors, 1)
+	}
+}
+
+/*
+handler wraps an HTTP handler so that the number and latency of requests
+is recorded for each response code. Long-polling, streaming, and WebSocket
+requests are counted, and their latency includes the time spent waiting.
+*/
+func (m *serverMetrics) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: resp}
+		h.ServeHTTP(sw, req)
+		m.observeRequest(sw.code(), time.Since(start))
+	})
+}
+
+func (s *server) handleGetMetrics(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	buf := &bytes.Buffer{}
+	s.writeMetrics(buf)
+	resp.Header().Set("Content-Type", metricsContent)
+	resp.Write(buf.Bytes())
+}
+
+func (s *server) writeMetrics(w io.Writer) {
+	m := s.metrics
+
+	m.lock.Lock()
+	var codes []int
+	latencies := make(map[int]*histogram)
+	for code, h := range m.requestLatencies {
+		codes = append(codes, code)
+		latencies[code] = h
+	}
+	m.lock.Unlock()
+	sort.Ints(codes)
+
+	writeHeader(w, "transicator_http_requests_total", "counter",
+		"Number of API requests by response code")
+	for _, code := range codes {
+		h := latencies[code]
+		h.lock.Lock()
+		count := h.count
+		h.lock.Unlock()
+		fmt.Fprintf(w, "transicator_http_requests_total{code=\"%d\"} %d\n", code, count)
+	}
+
+	writeHeader(w, "transicator_http_request_duration_seconds", "histogram",
+		"Latency of API requests by response code")
+	for _, code := range codes {
+		latencies[code].write(w, "transicator_http_request_duration_seconds",
+			fmt.Sprintf("code=\"%d\"", code))
+	}
+
+	writeHeader(w, "transicator_replication_batch_size", "histogram",
+		"Number of changes written to the database in each batch")
+	m.batchSizes.write(w, "transicator_replication_batch_size", "")
+
+	writeHeader(w, "transicator_replication_received_lsn", "gauge",
+		"Highest commit LSN received from Postgres")
+	fmt.Fprintf(w, "transicator_replication_received_lsn %d\n",
+		atomic.LoadUint64(&m.receivedLSN))
+
+	writeHeader(w, "transicator_replication_acknowledged_lsn", "gauge",
+		"Highest commit LSN acknowledged to Postgres")
+	fmt.Fprintf(w, "transicator_replication_acknowledged_lsn %d\n",
+		atomic.LoadUint64(&m.acknowledgedLSN))
+
+	writeHeader(w, "transicator_replication_lag_bytes", "gauge",
+		"Bytes of WAL between the Postgres position and the received position")
+	fmt.Fprintf(w, "transicator_replication_lag_bytes %d\n", s.repl.Lag())
+
+	writeHeader(w, "transicator_replication_state", "gauge",
+		"Current state of replication. The current state has the value 1")
+	curState := s.repl.State()
+	for _, st := range replicationStates {
+		v := 0
+		if st == curState {
+			v = 1
+		}
+		fmt.Fprintf(w, "transicator_replication_state{state=\"%s\"} %d\n", st, v)
+	}
+
+	writeHeader(w, "transicator_waiters", "gauge",
+		"Number of clients waiting for changes")
+	fmt.Fprintf(w, "transicator_waiters %d\n", s.tracker.numWaiters())
+
+	writeHeader(w, "transicator_db_scan_duration_seconds", "histogram",
+		"Latency of database scans for changes")
+	m.scanLatency.write(w, "transicator_db_scan_duration_seconds", "")
+
+	writeHeader(w, "transicator_cache_requests_total", "counter",
+		"Number of reads that were answered by the tail cache, or not")
+	fmt.Fprintf(w, "transicator_cache_requests_total{result=\"hit\"} %d\n",
+		atomic.LoadUint64(&m.cacheHits))
+	fmt.Fprintf(w, "transicator_cache_requests_total{result=\"miss\"} %d\n",
+		atomic.LoadUint64(&m.cacheMisses))
+
+	writeHeader(w, "transicator_purged_records_total", "counter",
+		"Number of old records purged from the database")
+	fmt.Fprintf(w, "transicator_purged_records_total %d\n",
+		atomic.LoadUint64(&m.purgedRecords))
+
+	writeHeader(w, "transicator_purge_errors_total", "counter",
+		"Number of times that purging old records failed")
+	fmt.Fprintf(w, "transicator_purge_errors_total %d\n",
+		atomic.LoadUint64(&m.purgeErrors))
+
+	consumers := s.consumers.list()
+	if len(consumers) > 0 {
+		_, _, lastSeq, err := s.db.Scan(nil, 0, 0, 0, nil)
+		if err == nil {
+			writeHeader(w, "transicator_consumer_lag_bytes", "gauge",
+				"Bytes of WAL between the last change and each consumer")
+			for _, c := range consumers {
+				fmt.Fprintf(w, "transicator_consumer_lag_bytes{consumer=\"%s\"} %d\n",
+					c.Name, c.lag(lastSeq))
+			}
+		}
+	}
+
+	dbSize, err := dirSize(s.dbDir)
+	if err == nil {
+		writeHeader(w, "transicator_db_size_bytes", "gauge",
+			"Total size of the database files")
+		fmt.Fprintf(w, "transicator_db_size_bytes %d\n", dbSize)
+	}
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+/*
+statusWriter remembers the response code. It passes through flushing and
+hijacking so that server-sent events and WebSockets still work.
+*/
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(buf []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(buf)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Connection cannot be hijacked")
+	}
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+func (w *statusWriter) code() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+
+	"github.com/apigee-labs/transicator/common"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Metrics tests", func() {
+	It("Histogram", func() {
+		h := newHistogram([]float64{1, 10})
+		h.observe(0.5)
+		h.observe(5)
+		h.observe(50)
+
+		buf := &bytes.Buffer{}
+		h.write(buf, "test", "code=\"200\"")
+		Expect(buf.String()).Should(Equal(
+			"test_bucket{code=\"200\",le=\"1\"} 1\n" +
+				"test_bucket{code=\"200\",le=\"10\"} 2\n" +
+				"test_bucket{code=\"200\",le=\"+Inf\"} 3\n" +
+				"test_sum{code=\"200\"} 55.5\n" +
+				"test_count{code=\"200\"} 3\n"))
+	})
+
+	It("Admin handler", func() {
+		tmpDir, err := ioutil.TempDir("", "metricstest")
+		Expect(err).Should(Succeed())
+		defer os.RemoveAll(tmpDir)
+		keyFile := path.Join(tmpDir, "key")
+		Expect(ioutil.WriteFile(keyFile, []byte(backupTestKey), 0600)).Should(Succeed())
+		verifier, err := common.CreateTokenVerifier(keyFile, "")
+		Expect(err).Should(Succeed())
+
+		h := adminHandler(verifier, func(resp http.ResponseWriter, req *http.Request) {
+			resp.WriteHeader(http.StatusOK)
+		})
+		call := func(tok string) int {
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			if tok != "" {
+				req.Header.Set("Authorization", "Bearer "+tok)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			return rec.Code
+		}
+		Expect(call("")).Should(Equal(http.StatusUnauthorized))
+		Expect(call(makeBackupToken(false))).Should(Equal(http.StatusForbidden))
+		Expect(call(makeBackupToken(true))).Should(Equal(http.StatusOK))
+	})
+
+	It("Metrics API", func() {
+		resp, err := http.Get(fmt.Sprintf("%s/changes?selector=foo", baseURL))
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		resp, err = http.Get(fmt.Sprintf("%s/changes?limit=bad", baseURL))
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		testServer.handleGetMetrics(rec, req)
+		Expect(rec.Code).Should(Equal(http.StatusOK))
+		Expect(rec.Header().Get("Content-Type")).Should(Equal(metricsContent))
+
+		out := rec.Body.String()
+		Expect(out).Should(MatchRegexp(`transicator_http_requests_total{code="200"} [1-9]`))
+		Expect(out).Should(MatchRegexp(`transicator_http_requests_total{code="400"} [1-9]`))
+		Expect(out).Should(ContainSubstring(`transicator_replication_state{state="Running"} 1`))
+		Expect(out).Should(MatchRegexp(`transicator_db_scan_duration_seconds_count [1-9]`))
+		Expect(out).Should(ContainSubstring("transicator_waiters "))
+		Expect(out).Should(ContainSubstring("transicator_db_size_bytes "))
+	})
+})
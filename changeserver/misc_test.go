@@ -20,6 +20,7 @@ import (
 	"encoding/binary"
 	"time"
 
+	"github.com/apid/goscaffold"
 	"github.com/apigee-labs/transicator/common"
 	"github.com/golang/protobuf/proto"
 	. "github.com/onsi/ginkgo"
@@ -27,6 +28,12 @@ import (
 )
 
 var _ = Describe("Miscellaneous tests", func() {
+	It("Health check", func() {
+		status, err := testServer.checkHealth()
+		Expect(err).Should(Succeed())
+		Expect(status).Should(Equal(goscaffold.OK))
+	})
+
 	It("Sanitize slot name", func() {
 		Expect(sanitizeSlotName("foo")).Should(Equal("foo"))
 		Expect(sanitizeSlotName("foo bar")).Should(Equal("foobar"))
@@ -41,6 +41,7 @@ func (s *server) runReplication(firstChange common.Sequence) {
 	for {
 		select {
 		case change := <-s.repl.Changes():
+			s.metrics.setReceivedLSN(change.CommitSequence)
 			changeBatch = append(changeBatch, change)
 			if len(changeBatch) >= maxBatchSize {
 				newChange := s.handleChanges(changeBatch, firstChange)
@@ -51,6 +52,11 @@ func (s *server) runReplication(firstChange common.Sequence) {
 			}
 
 		case <-ackTimer.C:
+			// If nothing is waiting in the channel, then every change up to
+			// this position is already in the batch.
+			received := s.repl.ReceivedLSN()
+			caughtUp := len(s.repl.Changes()) == 0
+
 			if len(changeBatch) > 0 {
 				newChange := s.handleChanges(changeBatch, firstChange)
 				if newChange.Compare(lastChange) > 0 {
@@ -58,9 +64,16 @@ func (s *server) runReplication(firstChange common.Sequence) {
 				}
 				changeBatch = nil
 			}
+
+			if caughtUp && received > lastChange.LSN {
+				s.setProcessedLSN(received)
+			} else {
+				s.setProcessedLSN(lastChange.LSN)
+			}
 			if lastChange.LSN > lastAck {
 				lastAck = lastChange.LSN
 				s.repl.Acknowledge(lastAck)
+				s.metrics.setAcknowledgedLSN(lastAck)
 			}
 
 		case stopped := <-s.stopChan:
@@ -79,6 +92,7 @@ func (s *server) runReplication(firstChange common.Sequence) {
 func (s *server) handleChanges(cb []*common.Change, firstChange common.Sequence) common.Sequence {
 
 	var entryBatch []storage.Entry
+	var entryTables []string
 	var lastSeq common.Sequence
 
 	for _, c := range cb {
@@ -87,27 +101,84 @@ func (s *server) handleChanges(cb []*common.Change, firstChange common.Sequence)
 			if c.Timestamp == 0 {
 				c.Timestamp = time.Now().Unix()
 			}
-			e := storage.Entry{
-				Scope: getSelector(c),
-				LSN:   c.CommitSequence,
-				Index: c.CommitIndex,
-				Data:  encodeChangeProto(c),
+			// The time index is on the time of the change, so that
+			// "sinceTime" and purging by age both go by it
+			ts := time.Unix(c.Timestamp, 0)
+			oldSelector, newSelector, moved := getSelectorMove(c)
+			if moved {
+				// Subscribers of the new selector would never see the row otherwise
+				log.Debugf("Row in %s moved from selector %s to %s",
+					c.Table, oldSelector, newSelector)
+				del, ins := splitSelectorMove(c)
+				entryBatch = append(entryBatch,
+					storage.Entry{
+						Scope:     oldSelector,
+						LSN:       c.CommitSequence,
+						Index:     c.CommitIndex,
+						Data:      encodeChangeProto(del),
+						Timestamp: ts,
+					},
+					storage.Entry{
+						Scope:     newSelector,
+						LSN:       c.CommitSequence,
+						Index:     c.CommitIndex,
+						Data:      encodeChangeProto(ins),
+						Timestamp: ts,
+					})
+				entryTables = append(entryTables, c.Table, c.Table)
+			} else {
+				e := storage.Entry{
+					Scope:     getSelector(c),
+					LSN:       c.CommitSequence,
+					Index:     c.CommitIndex,
+					Data:      encodeChangeProto(c),
+					Timestamp: ts,
+				}
+				entryBatch = append(entryBatch, e)
+				entryTables = append(entryTables, c.Table)
 			}
-			entryBatch = append(entryBatch, e)
 			lastSeq = cs
 		}
 	}
 
-	s.db.PutBatch(entryBatch)
-	log.Debugf("Inserted a batch of %d changes", len(entryBatch))
+	err := s.db.PutBatch(entryBatch)
+	if err == nil {
+		s.metrics.batchSizes.observe(float64(len(entryBatch)))
+		log.Debugf("Inserted a batch of %d changes", len(entryBatch))
+		s.cacheEntries(entryBatch)
+		if s.state != nil && len(entryBatch) > 0 {
+			s.state.apply(entryBatch, lastSeq)
+		}
+	} else {
+		log.Errorf("Error inserting a batch of %d changes: %s", len(entryBatch), err)
+		// We don't know what is in the database, so the cache can't be used
+		s.cache.reset(lastSeq)
+	}
 
-	for _, e := range entryBatch {
-		s.tracker.update(common.MakeSequence(e.LSN, e.Index), e.Scope)
+	for i, e := range entryBatch {
+		s.tracker.updateTable(common.MakeSequence(e.LSN, e.Index), e.Scope, entryTables[i])
 	}
 
 	return lastSeq
 }
 
+/*
+cacheEntries adds entries that were just written to the database to the
+tail cache. Each entry is decoded from what is in the database, so that
+the cache returns exactly what a scan would.
+*/
+func (s *server) cacheEntries(entries []storage.Entry) {
+	for _, e := range entries {
+		change, err := decodeChangeProto(e.Data)
+		if err != nil {
+			log.Warnf("Error decoding change for the cache: %s", err)
+			s.cache.reset(common.MakeSequence(e.LSN, e.Index))
+			continue
+		}
+		s.cache.add(e.Scope, common.MakeSequence(e.LSN, e.Index), e.Data, change)
+	}
+}
+
 func getSelector(c *common.Change) string {
 	var selector string
 	if c.NewRow != nil {
@@ -118,3 +189,50 @@ func getSelector(c *common.Change) string {
 	}
 	return selector
 }
+
+/*
+getSelectorMove checks whether an update changed the selector of a row.
+We can only tell if the old row includes the selector column, which
+depends on the replica identity of the table.
+*/
+func getSelectorMove(c *common.Change) (oldSelector, newSelector string, moved bool) {
+	if c.Operation != common.Update ||
+		c.OldRow[selectorColumn] == nil || c.NewRow[selectorColumn] == nil {
+		return
+	}
+	c.OldRow.Get(selectorColumn, &oldSelector)
+	c.NewRow.Get(selectorColumn, &newSelector)
+	moved = oldSelector != newSelector
+	return
+}
+
+/*
+splitSelectorMove turns an update that moved a row between selectors
+into a delete of the old row and an insert of the new one. Both have
+the same sequence as the original update.
+*/
+func splitSelectorMove(c *common.Change) (del, ins *common.Change) {
+	del = &common.Change{
+		Operation:      common.Delete,
+		Table:          c.Table,
+		CommitSequence: c.CommitSequence,
+		ChangeSequence: c.ChangeSequence,
+		CommitIndex:    c.CommitIndex,
+		TransactionID:  c.TransactionID,
+		Timestamp:      c.Timestamp,
+		OldRow:         c.OldRow,
+		Synthetic:      true,
+	}
+	ins = &common.Change{
+		Operation:      common.Insert,
+		Table:          c.Table,
+		CommitSequence: c.CommitSequence,
+		ChangeSequence: c.ChangeSequence,
+		CommitIndex:    c.CommitIndex,
+		TransactionID:  c.TransactionID,
+		Timestamp:      c.Timestamp,
+		NewRow:         c.NewRow,
+		Synthetic:      true,
+	}
+	return
+}
@@ -0,0 +1,298 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apigee-labs/transicator/common"
+	"github.com/apigee-labs/transicator/storage"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// purgedScopePrefix starts the scope of the records that remember the
+	// last change that was purged for each selector. Clients can't ask for
+	// these scopes because "/" is not valid in a selector.
+	purgedScopePrefix = "__transicator_purged/"
+	// baselineSelector is where purgeHorizons keeps the baseline. It can't
+	// be confused with a real selector, including the empty one, because
+	// it has a "/" in it.
+	baselineSelector = "/baseline"
+	// sizeSelector is where purgeHorizons remembers the first sequence after
+	// the last change that was purged to get under the maximum size.
+	sizeSelector = "/size"
+
+	horizonReadBatch = 100
+)
+
+/*
+A retentionPolicy decides how long the changes for each selector are kept.
+The first rule whose pattern matches the selector is used, and selectors
+that match no rule use the default.
+*/
+type retentionPolicy struct {
+	Default   retentionRule   `yaml:"default"`
+	Selectors []retentionRule `yaml:"selectors"`
+}
+
+/*
+A retentionRule keeps changes up to a maximum age, and keeps up to a
+maximum number of changes. Either may be left out. The pattern uses the
+syntax of "path.Match," so "tenant-*" matches every selector that starts
+with "tenant-".
+*/
+type retentionRule struct {
+	Pattern  string `yaml:"pattern"`
+	MaxAge   string `yaml:"maxAge"`
+	MaxCount int    `yaml:"maxCount"`
+	maxAge   time.Duration
+}
+
+/*
+loadRetentionPolicy reads a policy from a YAML file. If the default rule
+has no maximum age, then "defaultMaxAge" is used.
+*/
+func loadRetentionPolicy(fileName string, defaultMaxAge time.Duration) (*retentionPolicy, error) {
+	buf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return parseRetentionPolicy(buf, defaultMaxAge)
+}
+
+/*
+parseRetentionPolicy parses a policy from YAML or JSON.
+*/
+func parseRetentionPolicy(buf []byte, defaultMaxAge time.Duration) (*retentionPolicy, error) {
+	p := &retentionPolicy{}
+	err := yaml.Unmarshal(buf, p)
+	if err != nil {
+		return nil, err
+	}
+
+	err = p.Default.parse()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid default retention rule: %s", err)
+	}
+	if p.Default.Pattern != "" {
+		return nil, fmt.Errorf("The default retention rule may not have a pattern")
+	}
+	if p.Default.maxAge == 0 {
+		p.Default.maxAge = defaultMaxAge
+	}
+
+	for i := range p.Selectors {
+		r := &p.Selectors[i]
+		if r.Pattern == "" {
+			return nil, fmt.Errorf("Retention rule %d is missing a pattern", i+1)
+		}
+		if _, err = path.Match(r.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern \"%s\": %s", r.Pattern, err)
+		}
+		err = r.parse()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid retention rule for \"%s\": %s", r.Pattern, err)
+		}
+	}
+	return p, nil
+}
+
+func (r *retentionRule) parse() error {
+	if r.MaxAge != "" {
+		age, err := time.ParseDuration(r.MaxAge)
+		if err != nil {
+			return err
+		}
+		if age <= 0 {
+			return fmt.Errorf("maxAge must be positive")
+		}
+		r.maxAge = age
+	}
+	if r.MaxCount < 0 {
+		return fmt.Errorf("maxCount may not be negative")
+	}
+	return nil
+}
+
+/*
+ruleFor returns the rule that applies to a selector.
+*/
+func (p *retentionPolicy) ruleFor(selector string) retentionRule {
+	for _, r := range p.Selectors {
+		if match, _ := path.Match(r.Pattern, selector); match {
+			return r
+		}
+	}
+	return p.Default
+}
+
+/*
+minAge returns the shortest maximum age of any rule, or zero if no rule
+has one.
+*/
+func (p *retentionPolicy) minAge() time.Duration {
+	age := p.Default.maxAge
+	for _, r := range p.Selectors {
+		if r.maxAge > 0 && (age == 0 || r.maxAge < age) {
+			age = r.maxAge
+		}
+	}
+	return age
+}
+
+/*
+cleanupDelay selects how often to run the cleanup task for the policy.
+*/
+func (p *retentionPolicy) cleanupDelay() time.Duration {
+	age := p.minAge()
+	if age == 0 {
+		return noAgeCleanupDelay
+	}
+	return cleanupDelay(age)
+}
+
+/*
+purgeHorizons tracks, for each selector that has been purged on its own,
+the first sequence after the last change that was purged. A client whose
+"since" sequence is older than that may have missed changes.
+
+When selectors are purged on their own, the first sequence in the whole
+database only tells us about the selector that was purged the most, so
+the first sequence from when the retention policy was first used is saved
+as the "baseline" and used instead. It is saved as "baselineSelector,"
+which clients can't ask for.
+
+The lock must be held for reading while changes are read and checked
+against the horizons, and for writing while a selector is purged.
+*/
+type purgeHorizons struct {
+	lock      sync.RWMutex
+	first     map[string]common.Sequence
+	retention bool
+}
+
+/*
+loadPurgeHorizons reads the horizons that were saved in the database.
+*/
+func loadPurgeHorizons(db storage.DB) (*purgeHorizons, error) {
+	h := &purgeHorizons{
+		first: make(map[string]common.Sequence),
+	}
+
+	scopes, err := db.Scopes()
+	if err != nil {
+		return nil, err
+	}
+	for _, scope := range scopes {
+		if strings.HasPrefix(scope, purgedScopePrefix) {
+			err = h.load(db, scope)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return h, nil
+}
+
+func (h *purgeHorizons) load(db storage.DB, scope string) error {
+	var next common.Sequence
+	for {
+		entries, err := db.ScanAll(scope, next.LSN, next.Index, horizonReadBatch)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Scope != scope {
+				return nil
+			}
+			first, err := common.ParseSequenceBytes(e.Data)
+			if err != nil {
+				return fmt.Errorf("Invalid purge record for %s: %s", scope, err)
+			}
+			h.set(strings.TrimPrefix(scope, purgedScopePrefix), first)
+			next = nextSequence(common.MakeSequence(e.LSN, e.Index))
+		}
+		if len(entries) < horizonReadBatch {
+			return nil
+		}
+	}
+}
+
+/*
+set records that every change for "selector" before "first" may be gone.
+The lock must be held for writing.
+*/
+func (h *purgeHorizons) set(selector string, first common.Sequence) {
+	if cur, ok := h.first[selector]; !ok || first.Compare(cur) > 0 {
+		h.first[selector] = first
+	}
+}
+
+/*
+firstSequence returns the oldest sequence from which every change for the
+selectors is still available. "dbFirst" is the first sequence in the
+whole database. The lock must be held for reading.
+*/
+func (h *purgeHorizons) firstSequence(selectors []string, dbFirst common.Sequence) common.Sequence {
+	first := dbFirst
+	if baseline, ok := h.first[baselineSelector]; ok && h.retention {
+		first = baseline
+	}
+	for _, s := range selectors {
+		if f, ok := h.first[s]; ok && f.Compare(first) > 0 {
+			first = f
+		}
+	}
+	return first
+}
+
+/*
+purgedAny returns true if changes for any of the selectors, or the oldest
+changes in the database, have been purged. The lock must be held for
+reading.
+*/
+func (h *purgeHorizons) purgedAny(selectors []string) bool {
+	if _, ok := h.first[sizeSelector]; ok {
+		return true
+	}
+	for _, s := range selectors {
+		if _, ok := h.first[s]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+nextSequence returns the sequence right after "s."
+*/
+func nextSequence(s common.Sequence) common.Sequence {
+	if s.Index == math.MaxUint32 {
+		return common.MakeSequence(s.LSN+1, 0)
+	}
+	return common.MakeSequence(s.LSN, s.Index+1)
+}
+
+func isInternalScope(scope string) bool {
+	return scope == internalScope || strings.HasPrefix(scope, purgedScopePrefix)
+}
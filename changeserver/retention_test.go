@@ -0,0 +1,224 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"time"
+
+	"github.com/apigee-labs/transicator/common"
+	"github.com/apigee-labs/transicator/storage"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const retentionTestDir = "./retentiontestdata"
+
+const testRetentionPolicy = `
+default:
+  maxCount: 1000
+selectors:
+  - pattern: "audit-*"
+    maxAge: 720h
+  - pattern: "tenant-*"
+    maxAge: 1h
+    maxCount: 3
+  - pattern: "tenant-big"
+    maxCount: 100000
+`
+
+var _ = Describe("Retention policy", func() {
+	It("Parse", func() {
+		p, err := parseRetentionPolicy([]byte(testRetentionPolicy), 24*time.Hour)
+		Expect(err).Should(Succeed())
+
+		r := p.ruleFor("foo")
+		Expect(r.maxAge).Should(Equal(24 * time.Hour))
+		Expect(r.MaxCount).Should(Equal(1000))
+
+		r = p.ruleFor("audit-1")
+		Expect(r.maxAge).Should(Equal(720 * time.Hour))
+		Expect(r.MaxCount).Should(BeZero())
+
+		// The first rule that matches wins
+		r = p.ruleFor("tenant-big")
+		Expect(r.maxAge).Should(Equal(time.Hour))
+		Expect(r.MaxCount).Should(Equal(3))
+
+		Expect(p.minAge()).Should(Equal(time.Hour))
+	})
+
+	It("Count only", func() {
+		p, err := parseRetentionPolicy([]byte("default:\n  maxCount: 10\n"), 0)
+		Expect(err).Should(Succeed())
+		Expect(p.minAge()).Should(BeZero())
+		Expect(p.cleanupDelay()).Should(Equal(noAgeCleanupDelay))
+	})
+
+	It("Invalid", func() {
+		_, err := parseRetentionPolicy([]byte("default:\n  maxAge: forever\n"), 0)
+		Expect(err).ShouldNot(Succeed())
+		_, err = parseRetentionPolicy([]byte("default:\n  maxCount: -1\n"), 0)
+		Expect(err).ShouldNot(Succeed())
+		_, err = parseRetentionPolicy([]byte("selectors:\n  - maxCount: 1\n"), 0)
+		Expect(err).ShouldNot(Succeed())
+		_, err = parseRetentionPolicy([]byte("selectors:\n  - pattern: \"[\"\n"), 0)
+		Expect(err).ShouldNot(Succeed())
+		_, err = parseRetentionPolicy([]byte("default:\n  pattern: foo\n"), 0)
+		Expect(err).ShouldNot(Succeed())
+	})
+})
+
+var _ = Describe("Retention cleanup", func() {
+	var s *server
+
+	BeforeEach(func() {
+		db, err := storage.Open(storage.DefaultEngine(), retentionTestDir)
+		Expect(err).Should(Succeed())
+		horizons, err := loadPurgeHorizons(db)
+		Expect(err).Should(Succeed())
+		consumers, err := loadConsumers(db)
+		Expect(err).Should(Succeed())
+		s = &server{
+			db:        db,
+			queries:   createQueryGroup(),
+			metrics:   createMetrics(),
+			horizons:  horizons,
+			consumers: consumers,
+		}
+	})
+
+	AfterEach(func() {
+		s.db.Close()
+		Expect(s.db.Delete()).Should(Succeed())
+	})
+
+	putChanges := func(scope string, lsns ...uint64) {
+		for _, lsn := range lsns {
+			c := &common.Change{
+				Operation:      common.Insert,
+				Table:          "public.retention",
+				CommitSequence: lsn,
+			}
+			Expect(s.db.Put(scope, lsn, 0, encodeChangeProto(c))).Should(Succeed())
+		}
+		// Like at startup, the empty cache starts at the end of the database
+		_, first, last, err := s.db.Scan(nil, 0, 0, 0, nil)
+		Expect(err).Should(Succeed())
+		s.cache = createTailCache(0, first, last)
+	}
+
+	It("Purge by count", func() {
+		p, err := parseRetentionPolicy([]byte(
+			"selectors:\n  - pattern: small\n    maxCount: 2\n"), 0)
+		Expect(err).Should(Succeed())
+		c := &cleaner{s: s, policy: p}
+		s.horizons.retention = true
+
+		putChanges("small", 1, 3, 5, 7)
+		putChanges("large", 2, 4, 6, 8)
+		c.performCleanup()
+
+		// The oldest two changes for "small" are gone
+		first, _, changes, err := s.fetchChanges([]string{"small"}, common.MakeSequence(3, 1), 100, nil)
+		Expect(err).Should(Succeed())
+		Expect(len(changes)).Should(Equal(2))
+		Expect(first).Should(Equal(common.MakeSequence(3, 1)))
+
+		_, _, _, err = s.fetchChanges([]string{"small"}, common.MakeSequence(3, 0), 100, nil)
+		Expect(err).Should(Equal(errSnapshotOld))
+		_, _, _, err = s.fetchChanges([]string{"small", "large"}, common.MakeSequence(2, 1), 100, nil)
+		Expect(err).Should(Equal(errSnapshotOld))
+
+		// "large" has no rule, so everything is still there, even though
+		// the first change in the database is newer than "since"
+		first, _, changes, err = s.fetchChanges([]string{"large"}, common.MakeSequence(1, 1), 100, nil)
+		Expect(err).Should(Succeed())
+		Expect(len(changes)).Should(Equal(4))
+		Expect(first).Should(Equal(common.MakeSequence(1, 0)))
+
+		// The horizon is still there after a restart
+		horizons, err := loadPurgeHorizons(s.db)
+		Expect(err).Should(Succeed())
+		Expect(horizons.firstSequence([]string{"small"}, emptySequence)).Should(
+			Equal(common.MakeSequence(3, 1)))
+		Expect(horizons.firstSequence([]string{"large"}, emptySequence)).Should(
+			Equal(emptySequence))
+	})
+
+	It("Purge empty selector", func() {
+		p, err := parseRetentionPolicy([]byte(
+			"default:\n  maxCount: 2\n"), 0)
+		Expect(err).Should(Succeed())
+		c := &cleaner{s: s, policy: p}
+		s.horizons.retention = true
+
+		putChanges("", 1, 3, 5, 7)
+		putChanges("other", 2, 4)
+		c.performCleanup()
+
+		_, _, _, err = s.fetchChanges([]string{""}, common.MakeSequence(2, 0), 100, nil)
+		Expect(err).Should(Equal(errSnapshotOld))
+
+		// Purging the empty selector doesn't move the baseline
+		first, _, changes, err := s.fetchChanges([]string{"other"}, common.MakeSequence(1, 1), 100, nil)
+		Expect(err).Should(Succeed())
+		Expect(len(changes)).Should(Equal(2))
+		Expect(first).Should(Equal(common.MakeSequence(1, 0)))
+
+		horizons, err := loadPurgeHorizons(s.db)
+		Expect(err).Should(Succeed())
+		horizons.retention = true
+		Expect(horizons.firstSequence([]string{"other"}, emptySequence)).Should(
+			Equal(common.MakeSequence(1, 0)))
+		Expect(horizons.firstSequence([]string{""}, emptySequence)).Should(
+			Equal(common.MakeSequence(3, 1)))
+	})
+
+	It("Purge by age", func() {
+		p, err := parseRetentionPolicy([]byte(
+			"selectors:\n  - pattern: \"short*\"\n    maxAge: 50ms\n"), 0)
+		Expect(err).Should(Succeed())
+		c := &cleaner{s: s, policy: p}
+		s.horizons.retention = true
+
+		putChanges("short1", 1, 2)
+		putChanges("long1", 3)
+		time.Sleep(100 * time.Millisecond)
+		putChanges("short1", 4)
+		c.performCleanup()
+
+		_, _, changes, err := s.fetchChanges([]string{"short1"}, common.MakeSequence(2, 1), 100, nil)
+		Expect(err).Should(Succeed())
+		Expect(len(changes)).Should(Equal(1))
+		_, _, _, err = s.fetchChanges([]string{"short1"}, common.MakeSequence(1, 1), 100, nil)
+		Expect(err).Should(Equal(errSnapshotOld))
+
+		_, _, changes, err = s.fetchChanges([]string{"long1"}, common.MakeSequence(1, 1), 100, nil)
+		Expect(err).Should(Succeed())
+		Expect(len(changes)).Should(Equal(1))
+
+		// The internal scopes only keep their newest record
+		putChanges("short1", 5)
+		c.performCleanup()
+		putChanges("short1", 6)
+		c.performCleanup()
+		for _, scope := range []string{internalScope, purgedScopePrefix + "short1"} {
+			entries, _, _, err := s.db.Scan([]string{scope}, 0, 0, 100, nil)
+			Expect(err).Should(Succeed())
+			Expect(len(entries)).Should(BeNumerically("<=", 2))
+		}
+	})
+})
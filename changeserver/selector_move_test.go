@@ -0,0 +1,96 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"time"
+
+	"github.com/apigee-labs/transicator/common"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Selector move tests", func() {
+	It("Move row between selectors", func() {
+		// Old row only includes the selector if the whole row is replicated
+		executeSQL("alter table changeserver_test replica identity full")
+		defer executeSQL("alter table changeserver_test replica identity default")
+
+		testSequence := time.Now().Unix() + 400000
+		cl := getChanges(fmt.Sprintf("%s/changes?selector=movea&selector=moveb&limit=%d",
+			baseURL, maxLimitChanges))
+		since := cl.LastSequence
+
+		_, err := insertStmt.Exec(testSequence, "movea")
+		Expect(err).Should(Succeed())
+		_, err = db.Exec(
+			"update changeserver_test set _change_selector = 'moveb' where sequence = $1",
+			testSequence)
+		Expect(err).Should(Succeed())
+
+		// Old selector sees the insert and then a delete
+		Eventually(func() int {
+			cl = getChanges(fmt.Sprintf("%s/changes?selector=movea&since=%s", baseURL, since))
+			return len(cl.Changes)
+		}, testTimeout, testInterval).Should(Equal(2))
+		Expect(cl.Changes[0].Operation).Should(Equal(common.Insert))
+		Expect(cl.Changes[0].Synthetic).Should(BeFalse())
+		Expect(cl.Changes[1].Operation).Should(Equal(common.Delete))
+		Expect(cl.Changes[1].Synthetic).Should(BeTrue())
+		moveSequence := cl.Changes[1].Sequence
+
+		// New selector sees only an insert
+		cl = getChanges(fmt.Sprintf("%s/changes?selector=moveb&since=%s", baseURL, since))
+		Expect(len(cl.Changes)).Should(Equal(1))
+		Expect(cl.Changes[0].Operation).Should(Equal(common.Insert))
+		Expect(cl.Changes[0].Synthetic).Should(BeTrue())
+		Expect(cl.Changes[0].Sequence).Should(Equal(moveSequence))
+		var selector string
+		err = cl.Changes[0].NewRow.Get("_change_selector", &selector)
+		Expect(err).Should(Succeed())
+		Expect(selector).Should(Equal("moveb"))
+
+		// Both selectors see the delete before the insert, and the limit
+		// does not separate them.
+		cl = getChanges(fmt.Sprintf("%s/changes?selector=movea&selector=moveb&since=%s&limit=2",
+			baseURL, since))
+		Expect(len(cl.Changes)).Should(Equal(3))
+		Expect(cl.Changes[1].Operation).Should(Equal(common.Delete))
+		Expect(cl.Changes[2].Operation).Should(Equal(common.Insert))
+		Expect(cl.LastSequence).Should(Equal(moveSequence))
+
+		// An event stream client that stops after the delete still gets
+		// the insert when it reconnects
+		resp := openEventStream("/changes?selector=movea&selector=moveb", since)
+		defer resp.Body.Close()
+		rdr := bufio.NewReader(resp.Body)
+		readEvent(rdr)
+		id, change := readEvent(rdr)
+		Expect(change.Operation).Should(Equal(common.Delete))
+		Expect(id).Should(Equal(moveSequence + movedEventSuffix))
+		resp.Body.Close()
+
+		resp = openEventStream("/changes?selector=movea&selector=moveb", id)
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(200))
+		rdr = bufio.NewReader(resp.Body)
+		id, change = readEvent(rdr)
+		Expect(change.Operation).Should(Equal(common.Insert))
+		Expect(id).Should(Equal(moveSequence))
+	})
+})
@@ -17,6 +17,7 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -44,26 +45,42 @@ const (
 
 var selectorColumn = defaultSelectorColumn
 
+// columnPolicy lists columns to drop or hash before changes are returned
+var columnPolicy *common.ColumnPolicy
+
+// tokenVerifier checks bearer tokens on every API call, if it is set
+var tokenVerifier *common.TokenVerifier
+
 type server struct {
-	db          storage.DB
-	repl        *replication.Replicator
-	tracker     *changeTracker
-	cleaner     *cleaner
-	firstChange common.Sequence
-	slotName    string
-	dropSlot    int32
-	stopChan    chan chan<- bool
+	// Updated atomically, so it comes first to be aligned on 32-bit systems
+	processedLSN uint64
+	db           storage.DB
+	repl         *replication.Replicator
+	tracker      *changeTracker
+	cache        *tailCache
+	queries      *queryGroup
+	cleaner      *cleaner
+	horizons     *purgeHorizons
+	consumers    *consumerRegistry
+	state        *stateStore
+	firstChange  common.Sequence
+	slotName     string
+	dbDir        string
+	maxLag       uint64
+	dropSlot     int32
+	stopChan     chan chan<- bool
+	metrics      *serverMetrics
 }
 
 type errMsg struct {
 	Error string `json:"error"`
 }
 
-func createChangeServer(mux *http.ServeMux, dbDir, pgURL, pgSlot, urlPrefix string) (*server, error) {
+func createChangeServer(mux *http.ServeMux, storageEngine, dbDir, pgURL, pgSlot, urlPrefix string) (*server, error) {
 	success := false
 	slotName := sanitizeSlotName(pgSlot)
 
-	db, err := storage.Open(dbDir)
+	db, err := storage.Open(storageEngine, dbDir)
 	if err != nil {
 		return nil, err
 	}
@@ -75,7 +92,17 @@ func createChangeServer(mux *http.ServeMux, dbDir, pgURL, pgSlot, urlPrefix stri
 
 	// Retrieve the highest sequence from the DB so that we don't
 	// process duplicate updates that might come from PG.
-	_, _, firstChange, err := db.Scan(nil, 0, 0, 0, nil)
+	_, firstSeq, firstChange, err := db.Scan(nil, 0, 0, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	horizons, err := loadPurgeHorizons(db)
+	if err != nil {
+		return nil, err
+	}
+
+	consumers, err := loadConsumers(db)
 	if err != nil {
 		return nil, err
 	}
@@ -91,19 +118,52 @@ func createChangeServer(mux *http.ServeMux, dbDir, pgURL, pgSlot, urlPrefix stri
 		db:          db,
 		repl:        repl,
 		slotName:    slotName,
+		dbDir:       dbDir,
 		firstChange: firstChange,
 		tracker:     createTracker(),
+		cache:       createTailCache(defaultCacheSize, firstSeq, firstChange),
 		stopChan:    make(chan chan<- bool, 1),
+		queries:     createQueryGroup(),
+		horizons:    horizons,
+		consumers:   consumers,
+		metrics:     createMetrics(),
 	}
 
 	router := httprouter.New()
-	mux.Handle("/", router)
+	if tokenVerifier == nil {
+		mux.Handle("/", s.metrics.handler(router))
+	} else {
+		mux.Handle("/", s.metrics.handler(tokenVerifier.Handler(router)))
+	}
 
 	s.initChangesAPI(urlPrefix, router)
+	s.initStreamAPI(urlPrefix, router)
 	s.initDiagAPI(urlPrefix, router)
+	s.initConsumersAPI(urlPrefix, router)
+	s.initStateAPI(urlPrefix, router)
+	s.initSyncAPI(urlPrefix, router)
 
 	return s, nil
 }
+
+/*
+adminHandler wraps a management API so that, if "verifier" is set, it
+needs a bearer token with the "admin" claim.
+*/
+func adminHandler(verifier *common.TokenVerifier, h http.HandlerFunc) http.Handler {
+	checked := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if err := common.CheckAdmin(req); err != nil {
+			sendAPIError(forbidden, err.Error(), resp, req)
+			return
+		}
+		h(resp, req)
+	})
+	if verifier == nil {
+		return checked
+	}
+	return verifier.Handler(checked)
+}
+
 func (s *server) start() {
 	s.repl.Start()
 	go s.runReplication(s.firstChange)
@@ -127,12 +187,27 @@ func (s *server) delete() error {
 func (s *server) checkHealth() (goscaffold.HealthStatus, error) {
 	// Scan the first and last sequence numbers from the DB
 	_, _, _, err := s.db.Scan(nil, 0, 0, 0, nil)
-	if err == nil {
-		return goscaffold.OK, nil
+	if err != nil {
+		// If we get an error reading from LevelDB, things are really bad.
+		// Mark ourselves "unhealthy" and we may get restarted
+		return goscaffold.Failed, err
+	}
+
+	// If we aren't getting changes from Postgres, then clients will not
+	// see new data, so the load balancer should send them somewhere else.
+	state := s.repl.State()
+	if state != replication.Running {
+		return goscaffold.NotReady, fmt.Errorf("Replication state is %s", state)
+	}
+	if s.maxLag > 0 {
+		lag := s.repl.Lag()
+		if lag > s.maxLag {
+			return goscaffold.NotReady,
+				fmt.Errorf("Replication is %d bytes behind, which exceeds the maximum of %d",
+					lag, s.maxLag)
+		}
 	}
-	// If we get an error reading from LevelDB, things are really bad.
-	// Mark ourselves "unhealthy" and we may get restarted
-	return goscaffold.Failed, err
+	return goscaffold.OK, nil
 }
 
 func getIntParam(q url.Values, key string, dflt int) (int, error) {
@@ -147,6 +222,14 @@ func getIntParam(q url.Values, key string, dflt int) (int, error) {
 	return int(v), nil
 }
 
+func getBoolParam(q url.Values, key string, dflt bool) (bool, error) {
+	qs := q.Get(key)
+	if qs == "" {
+		return dflt, nil
+	}
+	return strconv.ParseBool(qs)
+}
+
 func sendError(resp http.ResponseWriter, req *http.Request, code int, msg string) {
 	log.Debugf("sendError: code = %d msg = %s req = %v", code, msg, req)
 	ct := goscaffold.SelectMediaType(req, []string{jsonContent, textContent})
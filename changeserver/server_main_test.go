@@ -29,6 +29,7 @@ import (
 	"github.com/apigee-labs/transicator/common"
 	"github.com/apigee-labs/transicator/pgclient"
 	"github.com/apigee-labs/transicator/replication"
+	"github.com/apigee-labs/transicator/storage"
 	. "github.com/onsi/ginkgo"
 	"github.com/onsi/ginkgo/reporters"
 	. "github.com/onsi/gomega"
@@ -84,7 +85,7 @@ var _ = BeforeSuite(func() {
 	// Start the server, which will be ready to respond to API calls
 	// and which will also start replication with the database
 	mux := http.NewServeMux()
-	testServer, err = createChangeServer(mux, testDataDir, dbURL, replicationSlot, "")
+	testServer, err = createChangeServer(mux, storage.DefaultEngine(), testDataDir, dbURL, replicationSlot, "")
 	Expect(err).Should(Succeed())
 
 	// For the tests, filter out changes for tables not part of these unit
@@ -0,0 +1,382 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/apid/goscaffold"
+	"github.com/apigee-labs/transicator/common"
+	"github.com/apigee-labs/transicator/storage"
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// stateKeyPrefix starts the metadata keys of the rows in the state,
+	// which are followed by the selector, the table, and the primary key.
+	stateKeyPrefix = "state/"
+	// stateSequenceKey is the metadata key of the last sequence that was
+	// applied to the state.
+	stateSequenceKey = "statesequence"
+
+	stateReadBatch = 1000
+)
+
+/*
+A stateConfig lists the tables whose current rows are kept in the state.
+*/
+type stateConfig struct {
+	Tables []keyedTable `yaml:"tables"`
+}
+
+/*
+stateResponse is what the state API returns. "Sequence" is the last change
+that is included, so clients may ask for changes since then.
+*/
+type stateResponse struct {
+	Sequence string         `json:"sequence"`
+	Tables   []common.Table `json:"tables"`
+}
+
+/*
+A stateStore keeps the current row for each primary key of the listed
+tables, for each selector. It is built from the changes as they are
+stored, and it is saved with the database metadata along with the
+sequence of the last change that was applied, in one atomic batch, so
+that the rows always match the sequence.
+*/
+type stateStore struct {
+	lock     sync.RWMutex
+	db       storage.DB
+	keys     tableKeys
+	sequence common.Sequence
+	behind   bool
+}
+
+/*
+loadStateConfig reads the list of tables from a YAML file.
+*/
+func loadStateConfig(fileName string) (tableKeys, error) {
+	buf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return parseStateConfig(buf)
+}
+
+/*
+parseStateConfig parses the list of tables from YAML or JSON.
+*/
+func parseStateConfig(buf []byte) (tableKeys, error) {
+	cfg := &stateConfig{}
+	err := yaml.Unmarshal(buf, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return makeTableKeys(cfg.Tables)
+}
+
+/*
+openState reads the sequence of the state from the database, and applies
+any changes that were stored after it, which happens if the change server
+stopped before it updated the state or if the state is new.
+*/
+func openState(db storage.DB, keys tableKeys) (*stateStore, error) {
+	st := &stateStore{
+		db:   db,
+		keys: keys,
+	}
+
+	buf, err := db.GetMetadata(stateSequenceKey)
+	if err != nil {
+		return nil, err
+	}
+	if buf != nil {
+		st.sequence, err = common.ParseSequenceBytes(buf)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid state sequence: %s", err)
+		}
+	}
+
+	err = st.catchUp()
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+/*
+apply updates the state with entries that were just written to the
+database. "lastSeq" is the last sequence in the batch. If the state can't
+be saved, then the next call reads everything that it missed from the
+database instead.
+*/
+func (st *stateStore) apply(entries []storage.Entry, lastSeq common.Sequence) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	if st.behind {
+		err := st.catchUp()
+		if err != nil {
+			log.Errorf("Error catching up the state from %s: %s", st.sequence, err)
+		}
+		return
+	}
+
+	values := make(map[string][]byte)
+	st.update(entries, values)
+	values[stateSequenceKey] = lastSeq.Bytes()
+
+	err := st.db.PutMetadataBatch(values)
+	if err != nil {
+		log.Errorf("Error updating the state through %s: %s", lastSeq, err)
+		st.behind = true
+		return
+	}
+	st.sequence = lastSeq
+}
+
+/*
+catchUp applies every change in the database after the sequence of the
+state. Each selector is read on its own, which is fine because the rows of
+one selector don't depend on any other. The lock must be held for writing,
+unless nobody else has the state yet.
+*/
+func (st *stateStore) catchUp() error {
+	_, _, lastSeq, err := st.db.Scan(nil, 0, 0, 0, nil)
+	if err != nil {
+		return err
+	}
+	if lastSeq.Compare(st.sequence) <= 0 {
+		st.behind = false
+		return nil
+	}
+
+	scopes, err := st.db.Scopes()
+	if err != nil {
+		return err
+	}
+	for _, scope := range scopes {
+		if isInternalScope(scope) {
+			continue
+		}
+		err = st.catchUpSelector(scope, nextSequence(st.sequence), lastSeq)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = st.db.PutMetadata(stateSequenceKey, lastSeq.Bytes())
+	if err != nil {
+		return err
+	}
+	log.Debugf("Caught up the state from %s to %s", st.sequence, lastSeq)
+	st.sequence = lastSeq
+	st.behind = false
+	return nil
+}
+
+func (st *stateStore) catchUpSelector(scope string, next, lastSeq common.Sequence) error {
+	for {
+		entries, err := st.db.ScanAll(scope, next.LSN, next.Index, stateReadBatch)
+		if err != nil {
+			return err
+		}
+		done := len(entries) < stateReadBatch
+		var batch []storage.Entry
+		for _, e := range entries {
+			seq := common.MakeSequence(e.LSN, e.Index)
+			if e.Scope != scope || seq.Compare(lastSeq) > 0 {
+				done = true
+				break
+			}
+			batch = append(batch, e)
+			next = nextSequence(seq)
+		}
+
+		values := make(map[string][]byte)
+		st.update(batch, values)
+		if len(values) > 0 {
+			err = st.db.PutMetadataBatch(values)
+			if err != nil {
+				return err
+			}
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+/*
+update adds the rows that the entries change to "values." A row that was
+deleted has a nil value, so that it is deleted from the metadata.
+*/
+func (st *stateStore) update(entries []storage.Entry, values map[string][]byte) {
+	for _, e := range entries {
+		change, err := decodeChangeProto(e.Data)
+		if err != nil {
+			log.Warnf("Not adding invalid change %d.%d to the state: %s", e.LSN, e.Index, err)
+			continue
+		}
+		if change.Operation == common.Update || change.Operation == common.Delete {
+			if k := st.keys.rowKey(change.Table, change.OldRow); k != "" {
+				values[stateKey(e.Scope, k)] = nil
+			}
+		}
+		if change.Operation == common.Insert || change.Operation == common.Update {
+			if k := st.keys.rowKey(change.Table, change.NewRow); k != "" {
+				values[stateKey(e.Scope, k)] = e.Data
+			}
+		}
+	}
+}
+
+/*
+read returns the rows for the selectors that pass the table filter, along
+with the sequence of the last change that is included.
+*/
+func (st *stateStore) read(selectors []string, tables *tableFilter) (common.Sequence, []common.Table, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
+	rows := make(map[string][]common.Row)
+	seen := make(map[string]bool)
+	for _, selector := range selectors {
+		if seen[selector] {
+			continue
+		}
+		seen[selector] = true
+
+		values, err := st.db.ListMetadata(stateKey(selector, ""))
+		if err != nil {
+			return emptySequence, nil, err
+		}
+		var keys []string
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			change, err := decodeChangeProto(values[k])
+			if err != nil {
+				return emptySequence, nil, fmt.Errorf("Invalid state for %s: %s", k, err)
+			}
+			if !tables.matches(change.Table) {
+				continue
+			}
+			applyColumnPolicy(change)
+			rows[change.Table] = append(rows[change.Table], stringifyRow(change.NewRow))
+		}
+	}
+
+	var names []string
+	for name := range rows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ret := make([]common.Table, len(names))
+	for i, name := range names {
+		ret[i] = common.Table{
+			Name: name,
+			Rows: rows[name],
+		}
+	}
+	return st.sequence, ret, nil
+}
+
+func stateKey(selector, rowKey string) string {
+	return stateKeyPrefix + selector + "/" + rowKey
+}
+
+/*
+stringifyRow turns every value into a string, like the JSON changes and
+snapshots do.
+*/
+func stringifyRow(row common.Row) common.Row {
+	nr := make(common.Row, len(row))
+	for k, v := range row {
+		nv := *v
+		if nv.Value != nil {
+			nv.Value = nv.String()
+		}
+		nr[k] = &nv
+	}
+	return nr
+}
+
+func (s *server) initStateAPI(prefix string, router *httprouter.Router) {
+	router.HandlerFunc("GET", prefix+"/state", s.handleGetState)
+}
+
+/*
+handleGetState returns the current rows for the selectors, so that clients
+can start from them instead of from a snapshot, and then ask for changes
+since the sequence in the response.
+*/
+func (s *server) handleGetState(resp http.ResponseWriter, req *http.Request) {
+	enc := goscaffold.SelectMediaType(req, []string{jsonContent})
+	if enc == "" {
+		sendAPIError(unsupportedFormat, "", resp, req)
+		return
+	}
+	if s.state == nil {
+		sendAPIError(notFound, "The change server is not keeping state", resp, req)
+		return
+	}
+
+	scopes, err := getCheckChangeSelectorParams(req)
+	if err != nil {
+		sendParamError(err, resp, req)
+		return
+	}
+	if len(scopes) == 0 {
+		// Just like the changes API, use the empty selector
+		scopes = []string{""}
+		err = common.CheckSelectors(req, scopes)
+		if err != nil {
+			sendParamError(err, resp, req)
+			return
+		}
+	}
+
+	q := req.URL.Query()
+	tables, err := makeTableFilter(q["table"], q["excludeTable"])
+	if err != nil {
+		sendParamError(errors.New("table"), resp, req)
+		return
+	}
+
+	seq, ret, err := s.state.read(scopes, tables)
+	if err != nil {
+		log.Errorf("Error reading state: %s", err)
+		sendAPIError(serverError, err.Error(), resp, req)
+		return
+	}
+
+	sendJSON(&stateResponse{
+		Sequence: seq.String(),
+		Tables:   ret,
+	}, http.StatusOK, resp)
+}
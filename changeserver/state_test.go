@@ -0,0 +1,194 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/apigee-labs/transicator/common"
+	"github.com/apigee-labs/transicator/storage"
+	"github.com/julienschmidt/httprouter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const stateTestDir = "./statetestdata"
+
+const testStateConfig = `
+tables:
+- table: public.config
+  keys: [id]
+`
+
+var _ = Describe("State", func() {
+	var s *server
+	var keys tableKeys
+
+	BeforeEach(func() {
+		db, err := storage.Open(storage.DefaultEngine(), stateTestDir)
+		Expect(err).Should(Succeed())
+		s = &server{db: db}
+		keys, err = parseStateConfig([]byte(testStateConfig))
+		Expect(err).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		s.db.Close()
+		Expect(s.db.Delete()).Should(Succeed())
+	})
+
+	makeEntry := func(scope string, lsn uint64, op common.Operation, table string, id, oldID int, val string) storage.Entry {
+		c := &common.Change{
+			Operation:      op,
+			Table:          table,
+			CommitSequence: lsn,
+		}
+		if op != common.Delete {
+			c.NewRow = common.Row{
+				"id":  &common.ColumnVal{Value: id},
+				"val": &common.ColumnVal{Value: val},
+			}
+		}
+		if oldID != 0 {
+			c.OldRow = common.Row{"id": &common.ColumnVal{Value: oldID}}
+		}
+		return storage.Entry{Scope: scope, LSN: lsn, Data: encodeChangeProto(c)}
+	}
+
+	testEntries := []storage.Entry{
+		makeEntry("a", 1, common.Insert, "public.config", 1, 0, "one"),
+		makeEntry("a", 2, common.Insert, "public.config", 2, 0, "two"),
+		makeEntry("a", 3, common.Insert, "public.other", 1, 0, "other"),
+		makeEntry("b", 4, common.Insert, "public.config", 1, 0, "b"),
+		makeEntry("a", 5, common.Update, "public.config", 1, 0, "uno"),
+		makeEntry("a", 6, common.Delete, "public.config", 0, 2, ""),
+		// The key changes
+		makeEntry("a", 7, common.Update, "public.config", 3, 1, "tres"),
+		makeEntry("a", 8, common.Insert, "public.config", 4, 0, "four"),
+	}
+
+	readState := func(st *stateStore, selectors ...string) (common.Sequence, []string) {
+		seq, tables, err := st.read(selectors, nil)
+		Expect(err).Should(Succeed())
+		var vals []string
+		for _, t := range tables {
+			Expect(t.Name).Should(Equal("public.config"))
+			for _, r := range t.Rows {
+				var val string
+				Expect(r.Get("val", &val)).Should(Succeed())
+				vals = append(vals, val)
+			}
+		}
+		return seq, vals
+	}
+
+	It("Parse", func() {
+		_, err := parseStateConfig([]byte("tables:\n"))
+		Expect(err).ShouldNot(Succeed())
+		_, err = parseStateConfig([]byte("tables:\n- table: t\n"))
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("Apply changes", func() {
+		st, err := openState(s.db, keys)
+		Expect(err).Should(Succeed())
+		Expect(st.sequence).Should(Equal(emptySequence))
+
+		for i := 0; i < len(testEntries); i += 3 {
+			end := i + 3
+			if end > len(testEntries) {
+				end = len(testEntries)
+			}
+			batch := testEntries[i:end]
+			Expect(s.db.PutBatch(batch)).Should(Succeed())
+			st.apply(batch, common.MakeSequence(batch[len(batch)-1].LSN, 0))
+		}
+
+		seq, vals := readState(st, "a")
+		Expect(seq).Should(Equal(common.MakeSequence(8, 0)))
+		Expect(vals).Should(ConsistOf("tres", "four"))
+		_, vals = readState(st, "b")
+		Expect(vals).Should(Equal([]string{"b"}))
+		_, vals = readState(st, "a", "b", "a")
+		Expect(vals).Should(HaveLen(3))
+		_, vals = readState(st, "c")
+		Expect(vals).Should(BeEmpty())
+
+		// The state is saved, so there is nothing to do after a restart
+		st, err = openState(s.db, keys)
+		Expect(err).Should(Succeed())
+		seq, vals = readState(st, "a")
+		Expect(seq).Should(Equal(common.MakeSequence(8, 0)))
+		Expect(vals).Should(ConsistOf("tres", "four"))
+	})
+
+	It("Catch up", func() {
+		Expect(s.db.PutBatch(testEntries[:4])).Should(Succeed())
+		st, err := openState(s.db, keys)
+		Expect(err).Should(Succeed())
+		seq, vals := readState(st, "a")
+		Expect(seq).Should(Equal(common.MakeSequence(4, 0)))
+		Expect(vals).Should(ConsistOf("one", "two"))
+
+		// Changes that were stored without updating the state
+		Expect(s.db.PutBatch(testEntries[4:])).Should(Succeed())
+		st, err = openState(s.db, keys)
+		Expect(err).Should(Succeed())
+		seq, vals = readState(st, "a")
+		Expect(seq).Should(Equal(common.MakeSequence(8, 0)))
+		Expect(vals).Should(ConsistOf("tres", "four"))
+	})
+
+	It("API", func() {
+		router := httprouter.New()
+		s.initStateAPI("", router)
+		call := func(path string, expectedCode int) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+			Expect(rec.Code).Should(Equal(expectedCode))
+			return rec
+		}
+
+		call("/state?selector=a", http.StatusNotFound)
+
+		Expect(s.db.PutBatch(testEntries)).Should(Succeed())
+		var err error
+		s.state, err = openState(s.db, keys)
+		Expect(err).Should(Succeed())
+
+		rec := call("/state?selector=a", http.StatusOK)
+		var st stateResponse
+		Expect(json.Unmarshal(rec.Body.Bytes(), &st)).Should(Succeed())
+		Expect(st.Sequence).Should(Equal("0.8.0"))
+		Expect(st.Tables).Should(HaveLen(1))
+		Expect(st.Tables[0].Name).Should(Equal("public.config"))
+		Expect(st.Tables[0].Rows).Should(HaveLen(2))
+		// Values are strings, like in the changes API
+		Expect(st.Tables[0].Rows[0]["id"].Value).Should(Equal("3"))
+		Expect(st.Tables[0].Rows[1]["id"].Value).Should(Equal("4"))
+
+		rec = call("/state?selector=a&excludeTable=public.*", http.StatusOK)
+		st = stateResponse{}
+		Expect(json.Unmarshal(rec.Body.Bytes(), &st)).Should(Succeed())
+		Expect(st.Sequence).Should(Equal("0.8.0"))
+		Expect(st.Tables).Should(BeEmpty())
+
+		call("/state?selector=Not%20Valid", http.StatusBadRequest)
+		call("/state?selector=a&table=%5B", http.StatusBadRequest)
+	})
+})
@@ -0,0 +1,132 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/apigee-labs/transicator/common"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/websocket"
+)
+
+var _ = Describe("Stream API Tests", func() {
+	var lastTestSequence = time.Now().Unix() + 100000
+
+	It("Stream changes", func() {
+		// Find out where the end of the stream is right now
+		cl := getChanges(fmt.Sprintf("%s/changes?selector=streamtest&limit=%d",
+			baseURL, maxLimitChanges))
+		since := cl.LastSequence
+
+		ws := openStream(fmt.Sprintf("/changes/stream?selector=streamtest&since=%s", since),
+			jsonContent)
+		defer ws.Close()
+
+		lastTestSequence++
+		_, err := insertStmt.Exec(lastTestSequence, "streamtest")
+		Expect(err).Should(Succeed())
+
+		cl = readStreamJSON(ws)
+		Expect(len(cl.Changes)).Should(Equal(1))
+		Expect(compareSequence(cl, 0, lastTestSequence)).Should(BeTrue())
+
+		err = websocket.Message.Send(ws, cl.LastSequence)
+		Expect(err).Should(Succeed())
+
+		lastTestSequence++
+		_, err = insertStmt.Exec(lastTestSequence, "streamtest")
+		Expect(err).Should(Succeed())
+
+		cl = readStreamJSON(ws)
+		Expect(len(cl.Changes)).Should(Equal(1))
+		Expect(compareSequence(cl, 0, lastTestSequence)).Should(BeTrue())
+	})
+
+	It("Stream changes protobuf", func() {
+		cl := getChanges(fmt.Sprintf("%s/changes?selector=streamtest&limit=%d",
+			baseURL, maxLimitChanges))
+		since := cl.LastSequence
+
+		ws := openStream(fmt.Sprintf("/changes/stream?selector=streamtest&since=%s", since),
+			protoContent)
+		defer ws.Close()
+
+		lastTestSequence++
+		_, err := insertStmt.Exec(lastTestSequence, "streamtest")
+		Expect(err).Should(Succeed())
+
+		var buf []byte
+		ws.SetReadDeadline(time.Now().Add(testTimeout))
+		err = websocket.Message.Receive(ws, &buf)
+		Expect(err).Should(Succeed())
+		cl, err = common.UnmarshalChangeListProto(buf)
+		Expect(err).Should(Succeed())
+		Expect(len(cl.Changes)).Should(Equal(1))
+		Expect(compareSequence(cl, 0, lastTestSequence)).Should(BeTrue())
+	})
+
+	It("Stream invalid ack", func() {
+		ws := openStream("/changes/stream?selector=streamtest", jsonContent)
+		defer ws.Close()
+
+		err := websocket.Message.Send(ws, "notasequence")
+		Expect(err).Should(Succeed())
+
+		var msg string
+		ws.SetReadDeadline(time.Now().Add(testTimeout))
+		for {
+			err = websocket.Message.Receive(ws, &msg)
+			Expect(err).Should(Succeed())
+			if strings.Contains(msg, "PARAMETER_INVALID") {
+				break
+			}
+		}
+	})
+
+	It("Stream invalid parameters", func() {
+		url := fmt.Sprintf("%s/changes/stream?selector=streamtest&since=foo", baseURL)
+		req := createStandardRequest("GET", url, jsonContent, nil)
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).Should(Succeed())
+		defer resp.Body.Close()
+		checkAPIErrorCode(resp, http.StatusBadRequest, "PARAMETER_INVALID")
+	})
+})
+
+func openStream(path, contentType string) *websocket.Conn {
+	wsURL := strings.Replace(baseURL, "http://", "ws://", 1) + path
+	cfg, err := websocket.NewConfig(wsURL, baseURL)
+	Expect(err).Should(Succeed())
+	cfg.Header.Set("Accept", contentType)
+	ws, err := websocket.DialConfig(cfg)
+	Expect(err).Should(Succeed())
+	return ws
+}
+
+func readStreamJSON(ws *websocket.Conn) *common.ChangeList {
+	var msg string
+	ws.SetReadDeadline(time.Now().Add(testTimeout))
+	err := websocket.Message.Receive(ws, &msg)
+	Expect(err).Should(Succeed())
+	cl, err := common.UnmarshalChangeList([]byte(msg))
+	Expect(err).Should(Succeed())
+	return cl
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/apid/goscaffold"
+	"github.com/apigee-labs/transicator/common"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/net/websocket"
+)
+
+// streamWaitInterval is how long we wait for new changes before checking
+// whether the client has gone away.
+const streamWaitInterval = 10 * time.Second
+
+/*
+A changeStream holds the state of a single WebSocket client of the
+"/changes/stream" API.
+*/
+type changeStream struct {
+	s        *server
+	enc      string
+	limit    int
+	scopes   []string
+	filter   func([]byte) bool
+	tables   *tableFilter
+	cursor   common.Sequence
+	acks     chan common.Sequence
+	doneChan chan bool
+}
+
+func (s *server) initStreamAPI(prefix string, router *httprouter.Router) {
+	router.HandlerFunc("GET", prefix+"/changes/stream", s.handleChangeStream)
+}
+
+/*
+handleChangeStream validates the parameters of the streaming API and then
+upgrades the connection to a WebSocket. Parameter errors are returned as
+regular HTTP errors, since the client has not yet started streaming.
+*/
+func (s *server) handleChangeStream(resp http.ResponseWriter, req *http.Request) {
+	enc := goscaffold.SelectMediaType(req, []string{jsonContent, protoContent})
+	if enc == "" {
+		sendAPIError(unsupportedFormat, "", resp, req)
+		return
+	}
+
+	limit, err := getIntParam(req.URL.Query(), "limit", defaultLimit)
+	if err != nil || limit <= 0 {
+		sendAPIError(invalidParameter, "limit", resp, req)
+		return
+	}
+	if limit > maxLimitChanges {
+		sendAPIError(invalidParameter, "limit too high, exceeds max "+strconv.Itoa(maxLimitChanges), resp, req)
+		return
+	}
+
+	scopes, sinceSeq, filter, tables, err := getChangesQueryParams(req)
+	if err != nil {
+		sendParamError(err, resp, req)
+		return
+	}
+
+	cs := &changeStream{
+		s:        s,
+		enc:      enc,
+		limit:    limit,
+		scopes:   scopes,
+		filter:   filter,
+		tables:   tables,
+		cursor:   sinceSeq,
+		acks:     make(chan common.Sequence),
+		doneChan: make(chan bool),
+	}
+
+	// Use "Server" rather than "Handler" because the latter rejects
+	// clients that do not send an "Origin" header.
+	ws := websocket.Server{
+		Handler: cs.run,
+	}
+	ws.ServeHTTP(resp, req)
+}
+
+/*
+run is the main loop of the stream. It sends a batch of changes as soon as
+they are available, then waits for the client to acknowledge the batch
+before sending the next one. Each acknowledgement is the sequence of the
+last change that the client processed, and the next batch starts right
+after it.
+*/
+func (c *changeStream) run(ws *websocket.Conn) {
+	defer ws.Close()
+	go c.readAcks(ws)
+
+	log.Debugf("Starting change stream for %v at %s", c.scopes, c.cursor)
+
+	for {
+		firstSeq, lastSeq, changes, err :=
+			c.s.fetchChanges(c.scopes, c.cursor, c.limit, c.filter)
+		if err == errSnapshotOld {
+			sendStreamError(snapshotOld, "", ws)
+			return
+		}
+		if err != nil {
+			sendStreamError(serverError, err.Error(), ws)
+			return
+		}
+
+		if len(changes) == 0 {
+			waitSeq := lastSeq
+			waitSeq.Index++
+			c.s.tracker.timedWaitTables(waitSeq, streamWaitInterval,
+				c.scopes, c.tables.matches)
+			if c.isDone() {
+				return
+			}
+			continue
+		}
+
+		changeList := makeChangeList(firstSeq, lastSeq, changes,
+			len(changes) >= c.limit)
+
+		switch c.enc {
+		case jsonContent:
+			err = websocket.Message.Send(ws, string(changeList.Marshal()))
+		case protoContent:
+			err = websocket.Message.Send(ws, changeList.MarshalProto())
+		default:
+			panic("Got to an unsupported media type")
+		}
+		if err != nil {
+			log.Debugf("Error sending to change stream: %s", err)
+			return
+		}
+
+		select {
+		case ack := <-c.acks:
+			c.cursor = ack
+			c.cursor.Index++
+		case <-c.doneChan:
+			return
+		}
+	}
+}
+
+/*
+readAcks runs in its own goroutine and reads acknowledgements from the
+client. It closes "doneChan" when the client goes away or sends something
+that we do not understand.
+*/
+func (c *changeStream) readAcks(ws *websocket.Conn) {
+	defer close(c.doneChan)
+
+	for {
+		var msg string
+		err := websocket.Message.Receive(ws, &msg)
+		if err != nil {
+			log.Debugf("Change stream closed: %s", err)
+			return
+		}
+
+		ack, err := common.ParseSequence(strings.TrimSpace(msg))
+		if err != nil {
+			sendStreamError(invalidParameter, "ack", ws)
+			return
+		}
+
+		select {
+		case c.acks <- ack:
+		case <-time.After(streamWaitInterval):
+			// Client sent an ack for a batch that we did not send yet.
+			sendStreamError(invalidParameter, "unexpected ack", ws)
+			return
+		}
+	}
+}
+
+func (c *changeStream) isDone() bool {
+	select {
+	case <-c.doneChan:
+		return true
+	default:
+		return false
+	}
+}
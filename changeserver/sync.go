@@ -0,0 +1,114 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/apigee-labs/transicator/common"
+	"github.com/apigee-labs/transicator/pgclient"
+	"github.com/julienschmidt/httprouter"
+)
+
+// lsnTrackerKey is the key in the change tracker for the replication
+// progress. It can't be a selector because selectors may not contain "/".
+const lsnTrackerKey = "__transicator/lsn"
+
+/*
+syncResponse is what the sync API returns. "ProcessedLSN" is the position
+in the Postgres WAL up to which every change was stored, and "Synced" is
+true if that is at or after the LSN that the client asked for.
+*/
+type syncResponse struct {
+	ProcessedLSN string `json:"processedLSN"`
+	Synced       bool   `json:"synced"`
+}
+
+/*
+setProcessedLSN records that every change up to "lsn" in the WAL has been
+stored, and wakes up the clients that were waiting for it.
+*/
+func (s *server) setProcessedLSN(lsn uint64) {
+	if lsn <= atomic.LoadUint64(&s.processedLSN) {
+		return
+	}
+	atomic.StoreUint64(&s.processedLSN, lsn)
+	s.tracker.update(common.MakeSequence(lsn, 0), lsnTrackerKey)
+}
+
+/*
+getProcessedLSN returns the position in the WAL up to which every change
+has been stored. A transaction that commits at or after it may be only
+partly in the database.
+*/
+func (s *server) getProcessedLSN() uint64 {
+	return atomic.LoadUint64(&s.processedLSN)
+}
+
+/*
+waitForLSN blocks for up to "maxWait" until every change up to "lsn" in the
+WAL has been stored. It returns false if that didn't happen in time.
+*/
+func (s *server) waitForLSN(lsn uint64, maxWait time.Duration) bool {
+	if lsn <= atomic.LoadUint64(&s.processedLSN) {
+		return true
+	}
+	if maxWait <= 0 {
+		return false
+	}
+	log.Debugf("Waiting for LSN %s for up to %s", pgclient.FormatLSN(lsn), maxWait)
+	seq := s.tracker.timedWait(common.MakeSequence(lsn, 0), maxWait, []string{lsnTrackerKey})
+	return seq.LSN >= lsn
+}
+
+func (s *server) initSyncAPI(prefix string, router *httprouter.Router) {
+	router.HandlerFunc("GET", prefix+"/sync", s.handleSync)
+}
+
+/*
+handleSync waits until the change server has stored every change up to
+the "minLSN" parameter, or until "block" seconds have passed, so that a
+client that just wrote to Postgres knows when the changes API has it.
+*/
+func (s *server) handleSync(resp http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+
+	minLSN := q.Get("minLSN")
+	if minLSN == "" {
+		sendAPIError(missingParameter, "minLSN", resp, req)
+		return
+	}
+	lsn, err := pgclient.ParseLSN(minLSN)
+	if err != nil {
+		sendAPIError(invalidParameter, "minLSN", resp, req)
+		return
+	}
+
+	block, err := getIntParam(q, "block", 0)
+	if err != nil {
+		sendAPIError(invalidParameter, "block", resp, req)
+		return
+	}
+
+	synced := s.waitForLSN(lsn, time.Duration(block)*time.Second)
+	sendJSON(&syncResponse{
+		ProcessedLSN: pgclient.FormatLSN(atomic.LoadUint64(&s.processedLSN)),
+		Synced:       synced,
+	}, http.StatusOK, resp)
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sync", func() {
+	var s *server
+
+	BeforeEach(func() {
+		s = &server{tracker: createTracker()}
+	})
+
+	AfterEach(func() {
+		s.tracker.close()
+	})
+
+	It("Wait for LSN", func() {
+		s.setProcessedLSN(100)
+		Expect(s.waitForLSN(100, 0)).Should(BeTrue())
+		Expect(s.waitForLSN(101, 0)).Should(BeFalse())
+		Expect(s.waitForLSN(101, 10*time.Millisecond)).Should(BeFalse())
+
+		done := make(chan bool, 1)
+		go func() {
+			done <- s.waitForLSN(200, 10*time.Second)
+		}()
+		s.setProcessedLSN(150)
+		Consistently(done, 50*time.Millisecond).ShouldNot(Receive())
+		s.setProcessedLSN(250)
+		Eventually(done).Should(Receive(BeTrue()))
+
+		// The position never goes backwards
+		s.setProcessedLSN(10)
+		Expect(s.waitForLSN(250, 0)).Should(BeTrue())
+	})
+
+	It("API", func() {
+		router := httprouter.New()
+		s.initSyncAPI("", router)
+		call := func(path string, expectedCode int) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+			Expect(rec.Code).Should(Equal(expectedCode))
+			return rec
+		}
+		getSync := func(path string) syncResponse {
+			var sr syncResponse
+			rec := call(path, http.StatusOK)
+			Expect(json.Unmarshal(rec.Body.Bytes(), &sr)).Should(Succeed())
+			return sr
+		}
+
+		s.setProcessedLSN(0x100000010)
+		sr := getSync("/sync?minLSN=1/10")
+		Expect(sr.Synced).Should(BeTrue())
+		Expect(sr.ProcessedLSN).Should(Equal("1/10"))
+		sr = getSync("/sync?minLSN=1/11&block=1")
+		Expect(sr.Synced).Should(BeFalse())
+		Expect(sr.ProcessedLSN).Should(Equal("1/10"))
+
+		call("/sync", http.StatusBadRequest)
+		call("/sync?minLSN=foo", http.StatusBadRequest)
+		call("/sync?minLSN=1/10&block=foo", http.StatusBadRequest)
+	})
+})
@@ -0,0 +1,110 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"path"
+)
+
+/*
+A tableFilter decides which tables a client is interested in, based on the
+"table" and "excludeTable" query parameters. Both may contain glob patterns
+like "public.config_*". A table matches if it matches any of the "include"
+patterns (or there are none) and none of the "exclude" patterns.
+*/
+type tableFilter struct {
+	include []string
+	exclude []string
+}
+
+/*
+makeTableFilter validates the patterns and returns a new filter. It returns
+nil if there are no patterns, so that callers can skip filtering entirely.
+*/
+func makeTableFilter(include, exclude []string) (*tableFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+
+	for _, p := range include {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range exclude {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return &tableFilter{
+		include: include,
+		exclude: exclude,
+	}, nil
+}
+
+/*
+matches returns true if the client wants changes for the table. A nil
+filter matches everything.
+*/
+func (f *tableFilter) matches(table string) bool {
+	if f == nil {
+		return true
+	}
+
+	if len(f.include) > 0 && !matchesAny(f.include, table) {
+		return false
+	}
+	return !matchesAny(f.exclude, table)
+}
+
+/*
+filterEntry may be passed to "Scan." If the entry can't be decoded we let
+it through so that the error is reported when we build the change list.
+*/
+func (f *tableFilter) filterEntry(buf []byte) bool {
+	change, err := decodeChangeProto(buf)
+	if err != nil {
+		return true
+	}
+	return f.matches(change.Table)
+}
+
+func matchesAny(patterns []string, table string) bool {
+	for _, p := range patterns {
+		// Patterns were validated when the filter was created
+		if m, _ := path.Match(p, table); m {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+combineFilters returns a "Scan" filter that only accepts entries that pass
+both filters. Either one may be nil.
+*/
+func combineFilters(f1, f2 func([]byte) bool) func([]byte) bool {
+	if f1 == nil {
+		return f2
+	}
+	if f2 == nil {
+		return f1
+	}
+	return func(buf []byte) bool {
+		return f1(buf) && f2(buf)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/apigee-labs/transicator/common"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Table filter tests", func() {
+	It("Empty filter", func() {
+		f, err := makeTableFilter(nil, nil)
+		Expect(err).Should(Succeed())
+		Expect(f).Should(BeNil())
+		Expect(f.matches("public.anything")).Should(BeTrue())
+	})
+
+	It("Include", func() {
+		f, err := makeTableFilter([]string{"public.config_*", "public.users"}, nil)
+		Expect(err).Should(Succeed())
+		Expect(f.matches("public.config_one")).Should(BeTrue())
+		Expect(f.matches("public.users")).Should(BeTrue())
+		Expect(f.matches("public.users2")).Should(BeFalse())
+		Expect(f.matches("other.config_one")).Should(BeFalse())
+	})
+
+	It("Exclude", func() {
+		f, err := makeTableFilter(nil, []string{"*.secret*"})
+		Expect(err).Should(Succeed())
+		Expect(f.matches("public.config")).Should(BeTrue())
+		Expect(f.matches("public.secrets")).Should(BeFalse())
+	})
+
+	It("Include and exclude", func() {
+		f, err := makeTableFilter([]string{"public.*"}, []string{"public.big_*"})
+		Expect(err).Should(Succeed())
+		Expect(f.matches("public.config")).Should(BeTrue())
+		Expect(f.matches("public.big_blobs")).Should(BeFalse())
+		Expect(f.matches("other.config")).Should(BeFalse())
+	})
+
+	It("Invalid pattern", func() {
+		_, err := makeTableFilter([]string{"public.[config"}, nil)
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("Filter entries", func() {
+		f, err := makeTableFilter([]string{"public.config_*"}, nil)
+		Expect(err).Should(Succeed())
+		Expect(f.filterEntry(encodeChangeProto(&common.Change{
+			Table: "public.config_one",
+		}))).Should(BeTrue())
+		Expect(f.filterEntry(encodeChangeProto(&common.Change{
+			Table: "public.other",
+		}))).Should(BeFalse())
+	})
+
+	It("Changes API", func() {
+		testSequence := time.Now().Unix() + 500000
+		_, err := insertStmt.Exec(testSequence, "tabletest")
+		Expect(err).Should(Succeed())
+
+		Eventually(func() int {
+			cl := getChanges(fmt.Sprintf(
+				"%s/changes?selector=tabletest&table=public.changeserver_*", baseURL))
+			return len(cl.Changes)
+		}, testTimeout, testInterval).Should(Equal(1))
+
+		cl := getChanges(fmt.Sprintf(
+			"%s/changes?selector=tabletest&table=public.nothere", baseURL))
+		Expect(cl.Changes).Should(BeEmpty())
+
+		cl = getChanges(fmt.Sprintf(
+			"%s/changes?selector=tabletest&excludeTable=public.changeserver_*", baseURL))
+		Expect(cl.Changes).Should(BeEmpty())
+
+		// Long polling should not be woken up by other tables
+		go func() {
+			time.Sleep(250 * time.Millisecond)
+			insertStmt.Exec(testSequence+1, "tabletest")
+		}()
+		start := time.Now()
+		cl = getChanges(fmt.Sprintf(
+			"%s/changes?selector=tabletest&table=public.nothere&block=1&since=%s",
+			baseURL, cl.LastSequence))
+		Expect(cl.Changes).Should(BeEmpty())
+		Expect(time.Since(start)).Should(BeNumerically(">=", time.Second))
+	})
+
+	It("Changes API invalid pattern", func() {
+		url := fmt.Sprintf("%s/changes?selector=tabletest&table=[bad", baseURL)
+		req := createStandardRequest("GET", url, jsonContent, nil)
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).Should(Succeed())
+		defer resp.Body.Close()
+		checkAPIErrorCode(resp, http.StatusBadRequest, "PARAMETER_INVALID")
+	})
+})
@@ -0,0 +1,108 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/apigee-labs/transicator/common"
+)
+
+/*
+A keyedTable names a table and the columns of its primary key. The change
+server can't see the primary keys of tables in Postgres, so features that
+need them list them in their YAML files.
+*/
+type keyedTable struct {
+	Table string   `yaml:"table"`
+	Keys  []string `yaml:"keys"`
+}
+
+/*
+tableKeys maps the name of each table to the columns of its primary key.
+*/
+type tableKeys map[string][]string
+
+/*
+makeTableKeys validates a list of tables and their keys.
+*/
+func makeTableKeys(tables []keyedTable) (tableKeys, error) {
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("No tables are listed")
+	}
+	keys := make(tableKeys)
+	for i, t := range tables {
+		if t.Table == "" {
+			return nil, fmt.Errorf("Table %d is missing a name", i+1)
+		}
+		if len(t.Keys) == 0 {
+			return nil, fmt.Errorf("Table \"%s\" has no key columns", t.Table)
+		}
+		if _, ok := keys[t.Table]; ok {
+			return nil, fmt.Errorf("Table \"%s\" is listed more than once", t.Table)
+		}
+		keys[t.Table] = t.Keys
+	}
+	return keys, nil
+}
+
+/*
+rowKey returns a string that identifies the row of a listed table, or an
+empty string if the table is not listed or the row does not have every
+key column. The key is the table name followed by a JSON array of the
+values of the key columns, so it is safe to use as a database key.
+*/
+func (k tableKeys) rowKey(table string, row common.Row) string {
+	keys := k[table]
+	if len(keys) == 0 || row == nil {
+		return ""
+	}
+	vals := make([]interface{}, len(keys))
+	for i, name := range keys {
+		col := row[name]
+		if col == nil {
+			return ""
+		}
+		vals[i] = col.Value
+	}
+	buf, err := json.Marshal(vals)
+	if err != nil {
+		return ""
+	}
+	return table + "/" + string(buf)
+}
+
+/*
+changeKeys returns the rows that a change leaves behind. An insert or
+update replaces the state of its new row, and a delete replaces the
+state of its old one. An update that changes the primary key also
+replaces the old row, since that row is gone afterward.
+*/
+func (k tableKeys) changeKeys(c *common.Change) []string {
+	var keys []string
+	if c.Operation == common.Insert || c.Operation == common.Update {
+		if nk := k.rowKey(c.Table, c.NewRow); nk != "" {
+			keys = append(keys, nk)
+		}
+	}
+	if c.Operation == common.Update || c.Operation == common.Delete {
+		if ok := k.rowKey(c.Table, c.OldRow); ok != "" && (len(keys) == 0 || ok != keys[0]) {
+			keys = append(keys, ok)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,255 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/apigee-labs/transicator/common"
+)
+
+type cacheEntry struct {
+	scope    string
+	sequence common.Sequence
+	data     []byte
+	change   *common.Change
+	added    time.Time
+}
+
+/*
+A tailCache holds the most recent changes that were written to the database,
+already decoded, so that clients that are nearly caught up don't need to
+scan the database at all. It holds up to a fixed number of changes, and the
+oldest ones are dropped as new ones arrive. The changes are also indexed by
+selector so that a request only looks at the selectors that it asked for.
+
+The cache can only answer a request if it is sure that it has every change
+after the "since" sequence for the requested selectors. For each selector,
+"start" is the sequence of the newest change that was dropped, and the cache
+has every change after that. Selectors that have nothing in the cache use
+the "start" of the whole cache, which begins at the last sequence in the
+database when the cache was created.
+*/
+type tailCache struct {
+	lock      sync.RWMutex
+	size      int
+	entries   []*cacheEntry
+	selectors map[string]*selectorCache
+	start     common.Sequence
+	firstSeq  common.Sequence
+	lastSeq   common.Sequence
+}
+
+/*
+A selectorCache holds the entries for one selector in sequence order.
+*/
+type selectorCache struct {
+	entries []*cacheEntry
+	start   common.Sequence
+}
+
+/*
+createTailCache creates a cache that holds up to "size" changes.
+"firstSeq" and "lastSeq" are the first and last sequences in the database.
+If "size" is zero then no changes are kept, but requests from clients that
+are caught up can still be answered.
+*/
+func createTailCache(size int, firstSeq, lastSeq common.Sequence) *tailCache {
+	return &tailCache{
+		size:      size,
+		selectors: make(map[string]*selectorCache),
+		start:     lastSeq,
+		firstSeq:  firstSeq,
+		lastSeq:   lastSeq,
+	}
+}
+
+/*
+add saves a change that was just written to the database. The changes
+must be added in the same order as they were committed.
+*/
+func (c *tailCache) add(scope string, seq common.Sequence, data []byte, change *common.Change) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.firstSeq.Compare(emptySequence) == 0 {
+		c.firstSeq = seq
+	}
+	if seq.Compare(c.lastSeq) > 0 {
+		c.lastSeq = seq
+	}
+	if c.size <= 0 {
+		c.start = c.lastSeq
+		return
+	}
+
+	sc := c.selectors[scope]
+	if sc == nil {
+		sc = &selectorCache{
+			start: c.start,
+		}
+		c.selectors[scope] = sc
+	}
+
+	e := &cacheEntry{
+		scope:    scope,
+		sequence: seq,
+		data:     data,
+		change:   change,
+		added:    time.Now(),
+	}
+	c.entries = append(c.entries, e)
+	sc.entries = append(sc.entries, e)
+
+	if len(c.entries) > c.size {
+		c.dropOldest()
+	}
+}
+
+/*
+dropOldest removes the oldest entry. The entries for each selector are
+in the same order as the whole cache, so it is also the oldest entry
+for its selector.
+*/
+func (c *tailCache) dropOldest() {
+	e := c.entries[0]
+	c.entries[0] = nil
+	c.entries = c.entries[1:]
+
+	sc := c.selectors[e.scope]
+	sc.entries[0] = nil
+	sc.entries = sc.entries[1:]
+	sc.start = e.sequence
+	if len(sc.entries) == 0 {
+		// Nothing after "start" for this selector, so the cache-wide
+		// value works just as well and we can save the memory.
+		delete(c.selectors, e.scope)
+		if sc.start.Compare(c.start) > 0 {
+			c.start = sc.start
+		}
+	}
+}
+
+/*
+reset empties the cache. It is used when we are not sure that the cache
+matches the database, for instance after an error writing to it.
+*/
+func (c *tailCache) reset(lastSeq common.Sequence) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if lastSeq.Compare(c.lastSeq) > 0 {
+		c.lastSeq = lastSeq
+	}
+	c.start = c.lastSeq
+	c.entries = nil
+	c.selectors = make(map[string]*selectorCache)
+}
+
+/*
+purge drops every change that was added before "oldest," just like
+"Purge" on the database, and records the new first sequence in the
+database.
+*/
+func (c *tailCache) purge(oldest time.Time, firstSeq common.Sequence) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.firstSeq = firstSeq
+	for len(c.entries) > 0 && c.entries[0].added.Before(oldest) {
+		c.dropOldest()
+	}
+}
+
+/*
+scan works like "Scan" on the database. If the cache has every change after
+"since" for all the selectors, then it returns the changes, up to "limit,"
+along with the first and last sequences in the database, and "ok" is true.
+Otherwise "ok" is false and the database must be used instead. The changes
+are shared with other callers and must not be modified.
+*/
+func (c *tailCache) scan(scopes []string, since common.Sequence,
+	limit int, filter func([]byte) bool) (firstSeq, lastSeq common.Sequence,
+	changes []*common.Change, ok bool) {
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var results cacheEntries
+	for _, scope := range scopes {
+		sc := c.selectors[scope]
+		if sc == nil {
+			if since.Compare(c.start) <= 0 {
+				return
+			}
+			continue
+		}
+		if since.Compare(sc.start) <= 0 {
+			return
+		}
+		results = sc.appendRange(results, since, limit, filter)
+	}
+
+	if len(scopes) > 1 {
+		sort.Stable(results)
+	}
+	for i := 0; i < len(results) && i < limit; i++ {
+		changes = append(changes, results[i].change)
+	}
+	firstSeq = c.firstSeq
+	lastSeq = c.lastSeq
+	ok = true
+	return
+}
+
+/*
+appendRange appends up to "limit" entries with a sequence of at least
+"since" that pass the filter.
+*/
+func (sc *selectorCache) appendRange(results cacheEntries, since common.Sequence,
+	limit int, filter func([]byte) bool) cacheEntries {
+	first := sort.Search(len(sc.entries), func(i int) bool {
+		return sc.entries[i].sequence.Compare(since) >= 0
+	})
+
+	count := 0
+	for _, e := range sc.entries[first:] {
+		if count >= limit {
+			break
+		}
+		if filter == nil || filter(e.data) {
+			results = append(results, e)
+			count++
+		}
+	}
+	return results
+}
+
+type cacheEntries []*cacheEntry
+
+func (e cacheEntries) Len() int {
+	return len(e)
+}
+
+func (e cacheEntries) Less(i, j int) bool {
+	return e[i].sequence.Compare(e[j].sequence) < 0
+}
+
+func (e cacheEntries) Swap(i, j int) {
+	e[i], e[j] = e[j], e[i]
+}
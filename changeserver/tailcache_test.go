@@ -0,0 +1,151 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"time"
+
+	"github.com/apigee-labs/transicator/common"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Tail cache", func() {
+	var cache *tailCache
+
+	BeforeEach(func() {
+		cache = createTailCache(4, common.MakeSequence(1, 0), common.MakeSequence(10, 0))
+	})
+
+	addCached := func(scope string, lsn uint64, table string) {
+		c := &common.Change{
+			Operation:      common.Insert,
+			Table:          table,
+			CommitSequence: lsn,
+		}
+		cache.add(scope, common.MakeSequence(lsn, 0), encodeChangeProto(c), c)
+	}
+
+	cachedLSNs := func(changes []*common.Change) []uint64 {
+		var lsns []uint64
+		for _, c := range changes {
+			lsns = append(lsns, c.CommitSequence)
+		}
+		return lsns
+	}
+
+	It("Caught up", func() {
+		first, last, changes, ok := cache.scan([]string{"foo"}, common.MakeSequence(10, 1), 100, nil)
+		Expect(ok).Should(BeTrue())
+		Expect(changes).Should(BeEmpty())
+		Expect(first).Should(Equal(common.MakeSequence(1, 0)))
+		Expect(last).Should(Equal(common.MakeSequence(10, 0)))
+
+		_, _, _, ok = cache.scan([]string{"foo"}, common.MakeSequence(10, 0), 100, nil)
+		Expect(ok).Should(BeFalse())
+	})
+
+	It("Selectors", func() {
+		addCached("foo", 11, "t1")
+		addCached("bar", 12, "t1")
+		addCached("foo", 13, "t2")
+
+		_, last, changes, ok := cache.scan([]string{"foo"}, common.MakeSequence(10, 1), 100, nil)
+		Expect(ok).Should(BeTrue())
+		Expect(cachedLSNs(changes)).Should(Equal([]uint64{11, 13}))
+		Expect(last).Should(Equal(common.MakeSequence(13, 0)))
+
+		_, _, changes, ok = cache.scan([]string{"foo", "bar"}, common.MakeSequence(11, 1), 100, nil)
+		Expect(ok).Should(BeTrue())
+		Expect(cachedLSNs(changes)).Should(Equal([]uint64{12, 13}))
+
+		_, _, changes, ok = cache.scan([]string{"foo", "bar"}, common.MakeSequence(10, 1), 2, nil)
+		Expect(ok).Should(BeTrue())
+		Expect(cachedLSNs(changes)).Should(Equal([]uint64{11, 12}))
+
+		tables, err := makeTableFilter([]string{"t2"}, nil)
+		Expect(err).Should(Succeed())
+		_, _, changes, ok = cache.scan([]string{"foo"}, common.MakeSequence(10, 1), 100, tables.filterEntry)
+		Expect(ok).Should(BeTrue())
+		Expect(cachedLSNs(changes)).Should(Equal([]uint64{13}))
+	})
+
+	It("Evict", func() {
+		for lsn := uint64(11); lsn <= 16; lsn++ {
+			addCached("foo", lsn, "t1")
+		}
+
+		_, _, _, ok := cache.scan([]string{"foo"}, common.MakeSequence(12, 0), 100, nil)
+		Expect(ok).Should(BeFalse())
+		_, _, changes, ok := cache.scan([]string{"foo"}, common.MakeSequence(12, 1), 100, nil)
+		Expect(ok).Should(BeTrue())
+		Expect(cachedLSNs(changes)).Should(Equal([]uint64{13, 14, 15, 16}))
+
+		// Nothing was evicted for "bar" but it had no changes anyway
+		_, _, changes, ok = cache.scan([]string{"bar"}, common.MakeSequence(10, 1), 100, nil)
+		Expect(ok).Should(BeTrue())
+		Expect(changes).Should(BeEmpty())
+	})
+
+	It("Evict selector", func() {
+		addCached("foo", 11, "t1")
+		for lsn := uint64(12); lsn <= 15; lsn++ {
+			addCached("bar", lsn, "t1")
+		}
+
+		_, _, _, ok := cache.scan([]string{"foo"}, common.MakeSequence(10, 1), 100, nil)
+		Expect(ok).Should(BeFalse())
+		_, _, changes, ok := cache.scan([]string{"foo"}, common.MakeSequence(11, 1), 100, nil)
+		Expect(ok).Should(BeTrue())
+		Expect(changes).Should(BeEmpty())
+	})
+
+	It("Purge", func() {
+		addCached("foo", 11, "t1")
+		addCached("foo", 12, "t1")
+		cache.purge(time.Now().Add(time.Second), common.MakeSequence(12, 0))
+
+		_, _, _, ok := cache.scan([]string{"foo"}, common.MakeSequence(10, 1), 100, nil)
+		Expect(ok).Should(BeFalse())
+		first, _, changes, ok := cache.scan([]string{"foo"}, common.MakeSequence(12, 1), 100, nil)
+		Expect(ok).Should(BeTrue())
+		Expect(changes).Should(BeEmpty())
+		Expect(first).Should(Equal(common.MakeSequence(12, 0)))
+	})
+
+	It("Reset", func() {
+		addCached("foo", 11, "t1")
+		cache.reset(common.MakeSequence(12, 0))
+
+		_, _, _, ok := cache.scan([]string{"foo"}, common.MakeSequence(11, 1), 100, nil)
+		Expect(ok).Should(BeFalse())
+		_, last, _, ok := cache.scan([]string{"foo"}, common.MakeSequence(12, 1), 100, nil)
+		Expect(ok).Should(BeTrue())
+		Expect(last).Should(Equal(common.MakeSequence(12, 0)))
+	})
+
+	It("Disabled", func() {
+		cache = createTailCache(0, common.MakeSequence(1, 0), common.MakeSequence(10, 0))
+		addCached("foo", 11, "t1")
+
+		_, _, _, ok := cache.scan([]string{"foo"}, common.MakeSequence(10, 1), 100, nil)
+		Expect(ok).Should(BeFalse())
+		_, last, changes, ok := cache.scan([]string{"foo"}, common.MakeSequence(11, 1), 100, nil)
+		Expect(ok).Should(BeTrue())
+		Expect(changes).Should(BeEmpty())
+		Expect(last).Should(Equal(common.MakeSequence(11, 0)))
+	})
+})
@@ -16,6 +16,7 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
 	"sync"
 	"testing"
 	"time"
@@ -47,6 +48,14 @@ func BenchmarkTrackerTimeout100(b *testing.B) {
 	runTrackerBench(100, true, b)
 }
 
+func BenchmarkTrackerParked50000(b *testing.B) {
+	runParkedBench(50000, 5000, b)
+}
+
+func BenchmarkTrackerWakeup50000(b *testing.B) {
+	runWakeupBench(50000, 5000, b)
+}
+
 func runTrackerBench(consumers int, useTimeout bool, b *testing.B) {
 	tracker := createTracker()
 	defer func() {
@@ -86,3 +95,86 @@ func runTrackerBench(consumers int, useTimeout bool, b *testing.B) {
 		tracker.update(newSeq, "bench")
 	}
 }
+
+/*
+runParkedBench measures updates while a large number of waiters are parked
+on many selectors, waiting for changes that never arrive. The cost of an
+update should not depend on the number of waiters.
+*/
+func runParkedBench(waiters, selectorCount int, b *testing.B) {
+	tracker := createTracker()
+	defer tracker.close()
+	selectors := makeBenchSelectors(selectorCount)
+
+	parked := common.Sequence{LSN: 1 << 62}
+	for w := 0; w < waiters; w++ {
+		tracker.doWait(parked, []string{selectors[w%selectorCount]}, nil)
+	}
+	syncTracker(tracker)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		newSeq := common.Sequence{
+			LSN: uint64(i),
+		}
+		tracker.update(newSeq, selectors[i%selectorCount])
+	}
+	syncTracker(tracker)
+	b.StopTimer()
+}
+
+/*
+runWakeupBench measures updates that each wake up the waiters on one
+selector, which then wait for the next change, like long-polling clients.
+*/
+func runWakeupBench(waiters, selectorCount int, b *testing.B) {
+	tracker := createTracker()
+	defer tracker.close()
+	selectors := makeBenchSelectors(selectorCount)
+	last := uint64(b.N)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(waiters)
+	for w := 0; w < waiters; w++ {
+		go func(selector []string) {
+			defer wg.Done()
+			var cur uint64
+			for cur < last {
+				seq := common.Sequence{
+					LSN: cur + 1,
+				}
+				cur = tracker.wait(seq, selector).LSN
+			}
+		}([]string{selectors[w%selectorCount]})
+	}
+	for tracker.numWaiters() < waiters {
+		time.Sleep(time.Millisecond)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		newSeq := common.Sequence{
+			LSN: uint64(i + 1),
+		}
+		tracker.update(newSeq, selectors[i%selectorCount])
+	}
+	// Release every waiter so that the goroutines exit
+	for _, s := range selectors {
+		tracker.update(common.Sequence{LSN: last}, s)
+	}
+	wg.Wait()
+	b.StopTimer()
+}
+
+func makeBenchSelectors(count int) []string {
+	selectors := make([]string, count)
+	for i := range selectors {
+		selectors[i] = fmt.Sprintf("selector%d", i)
+	}
+	return selectors
+}
+
+// syncTracker returns once the tracker has handled every earlier request
+func syncTracker(tracker *changeTracker) {
+	tracker.wait(common.Sequence{}, []string{"sync"})
+}
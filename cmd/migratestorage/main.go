@@ -0,0 +1,100 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apigee-labs/transicator/storage"
+)
+
+const defaultBatchSize = 1000
+
+func main() {
+	os.Exit(runMain())
+}
+
+func runMain() int {
+	var srcEngine, srcDir, dstEngine, dstDir string
+	var batchSize int
+
+	engines := strings.Join(storage.Engines(), ", ")
+	flag.StringVar(&srcEngine, "from-storage", storage.DefaultEngine(),
+		fmt.Sprintf("Storage engine of the source database (%s)", engines))
+	flag.StringVar(&srcDir, "from", "", "Directory of the source database")
+	flag.StringVar(&dstEngine, "to-storage", storage.DefaultEngine(),
+		fmt.Sprintf("Storage engine of the destination database (%s)", engines))
+	flag.StringVar(&dstDir, "to", "", "Directory of the destination database")
+	flag.IntVar(&batchSize, "batch", defaultBatchSize, "Number of entries to copy at a time")
+	flag.Parse()
+	if !flag.Parsed() || srcDir == "" || dstDir == "" || batchSize <= 0 {
+		flag.Usage()
+		return 2
+	}
+	if samePath(srcDir, dstDir) {
+		fmt.Fprintln(os.Stderr, "The source and destination must be different")
+		return 2
+	}
+
+	src, err := storage.OpenReadOnly(srcEngine, srcDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening source database: %s\n", err)
+		return 3
+	}
+	defer src.Close()
+
+	dst, err := storage.Open(dstEngine, dstDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening destination database: %s\n", err)
+		return 3
+	}
+	defer dst.Close()
+
+	fmt.Printf("Copying from %s database in %s to %s database in %s\n",
+		srcEngine, srcDir, dstEngine, dstDir)
+	copied, skipped, err := storage.Migrate(src, dst, batchSize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error copying entries: %s\n", err)
+		fmt.Fprintln(os.Stderr, "Run the same command again to resume.")
+		return 4
+	}
+	fmt.Printf("Copied %d entries. %d were already copied.\n", copied, skipped)
+
+	err = storage.VerifyMigration(src, dst, batchSize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Verification failed: %s\n", err)
+		return 5
+	}
+	fmt.Println("Verified the number of entries and the first and last sequences.")
+	return 0
+}
+
+func samePath(a, b string) bool {
+	aa, err := filepath.Abs(a)
+	if err != nil {
+		return false
+	}
+	ba, err := filepath.Abs(b)
+	if err != nil {
+		return false
+	}
+	return aa == ba
+}
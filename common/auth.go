@@ -0,0 +1,318 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package common
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	// Register the hash functions used by the signing algorithms below
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+type authContextKey int
+
+const claimsKey authContextKey = 0
+
+/*
+TokenClaims are the claims from a token that we care about. "Selectors"
+lists the selectors that the bearer may request, and "Admin" allows
+management operations like downloading a backup of all the data.
+*/
+type TokenClaims struct {
+	Selectors  []string `json:"selectors"`
+	Admin      bool     `json:"admin"`
+	Expiration *int64   `json:"exp"`
+	NotBefore  *int64   `json:"nbf"`
+}
+
+/*
+A TokenVerifier validates signed JSON web tokens in the "Authorization"
+header of a request. Tokens may be signed with a shared secret using
+HS256, HS384, or HS512, or with an RSA private key using RS256, RS384, or
+RS512. Keys are read from local files and no outside service is used.
+*/
+type TokenVerifier struct {
+	hmacKey []byte
+	rsaKey  *rsa.PublicKey
+}
+
+/*
+CreateTokenVerifier creates a verifier from a file that contains a shared
+secret for HMAC tokens, a PEM file that contains an RSA public key, or both.
+Either file name may be empty, but not both. Trailing whitespace is
+removed from the shared secret.
+*/
+func CreateTokenVerifier(hmacKeyFile, rsaKeyFile string) (*TokenVerifier, error) {
+	if hmacKeyFile == "" && rsaKeyFile == "" {
+		return nil, errors.New("No key was specified for token validation")
+	}
+
+	v := &TokenVerifier{}
+
+	if hmacKeyFile != "" {
+		buf, err := ioutil.ReadFile(hmacKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		v.hmacKey = []byte(strings.TrimRight(string(buf), " \t\r\n"))
+		if len(v.hmacKey) == 0 {
+			return nil, fmt.Errorf("Key file %s is empty", hmacKeyFile)
+		}
+	}
+
+	if rsaKeyFile != "" {
+		buf, err := ioutil.ReadFile(rsaKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		v.rsaKey, err = parseRSAPublicKey(buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
+/*
+Verify checks the signature of a token in JWT "compact" format, and checks
+the "exp" and "nbf" claims if they are present. A token without a
+"selectors" claim may not request any selectors.
+*/
+func (v *TokenVerifier) Verify(token string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Token is not in JWT format")
+	}
+
+	hdrBuf, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("Invalid token header")
+	}
+	var hdr struct {
+		Alg string `json:"alg"`
+	}
+	err = json.Unmarshal(hdrBuf, &hdr)
+	if err != nil {
+		return nil, errors.New("Invalid token header")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("Invalid token signature")
+	}
+	err = v.verifySignature(hdr.Alg, []byte(parts[0]+"."+parts[1]), sig)
+	if err != nil {
+		return nil, err
+	}
+
+	claimsBuf, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("Invalid token claims")
+	}
+	claims := &TokenClaims{}
+	err = json.Unmarshal(claimsBuf, claims)
+	if err != nil {
+		return nil, errors.New("Invalid token claims")
+	}
+
+	now := time.Now().Unix()
+	if claims.Expiration != nil && now >= *claims.Expiration {
+		return nil, errors.New("Token has expired")
+	}
+	if claims.NotBefore != nil && now < *claims.NotBefore {
+		return nil, errors.New("Token is not valid yet")
+	}
+
+	return claims, nil
+}
+
+func (v *TokenVerifier) verifySignature(alg string, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("Unsupported token algorithm \"%s\"", alg)
+	}
+
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("Unsupported token algorithm \"%s\"", alg)
+	}
+
+	switch alg[:2] {
+	case "HS":
+		if v.hmacKey == nil {
+			return fmt.Errorf("Unsupported token algorithm \"%s\"", alg)
+		}
+		mac := hmac.New(hash.New, v.hmacKey)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errors.New("Invalid token signature")
+		}
+		return nil
+
+	case "RS":
+		if v.rsaKey == nil {
+			return fmt.Errorf("Unsupported token algorithm \"%s\"", alg)
+		}
+		h := hash.New()
+		h.Write(signed)
+		err := rsa.VerifyPKCS1v15(v.rsaKey, hash, h.Sum(nil), sig)
+		if err != nil {
+			return errors.New("Invalid token signature")
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("Unsupported token algorithm \"%s\"", alg)
+	}
+}
+
+/*
+Handler wraps an HTTP handler so that every request must have a valid
+bearer token. Requests without one get a 401 error. For the rest, the
+claims from the token are saved so that CheckSelectors and IsAdmin can
+find them.
+*/
+func (v *TokenVerifier) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		auth := req.Header.Get("Authorization")
+		if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+			resp.Header().Set("WWW-Authenticate", "Bearer")
+			SendAPIError("UNAUTHORIZED", "A valid bearer token is required",
+				"", http.StatusUnauthorized, resp, req)
+			return
+		}
+
+		claims, err := v.Verify(strings.TrimSpace(auth[7:]))
+		if err != nil {
+			resp.Header().Set("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+			SendAPIError("UNAUTHORIZED", "A valid bearer token is required",
+				err.Error(), http.StatusUnauthorized, resp, req)
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), claimsKey, claims)
+		h.ServeHTTP(resp, req.WithContext(ctx))
+	})
+}
+
+/*
+A SelectorAccessError is returned by CheckSelectors when a request
+asks for a selector that its token does not allow.
+*/
+type SelectorAccessError struct {
+	Selector string
+}
+
+func (e *SelectorAccessError) Error() string {
+	return fmt.Sprintf("Access to selector \"%s\" is not permitted", e.Selector)
+}
+
+/*
+CheckSelectors returns a SelectorAccessError if any of the selectors are
+not listed in the token that was validated for this request. If the request
+went through no TokenVerifier, then every selector is allowed.
+*/
+func CheckSelectors(req *http.Request, selectors []string) error {
+	claims, ok := req.Context().Value(claimsKey).(*TokenClaims)
+	if !ok {
+		return nil
+	}
+
+	for _, s := range selectors {
+		if !containsString(claims.Selectors, s) {
+			return &SelectorAccessError{Selector: s}
+		}
+	}
+	return nil
+}
+
+/*
+ErrNotAdmin is returned by CheckAdmin when the token does not have the
+"admin" claim.
+*/
+var ErrNotAdmin = errors.New("An admin token is required")
+
+/*
+CheckAdmin returns ErrNotAdmin if the request went through a TokenVerifier
+and the token does not have the "admin" claim. Like CheckSelectors, it
+allows every request that went through no TokenVerifier.
+*/
+func CheckAdmin(req *http.Request) error {
+	claims, ok := req.Context().Value(claimsKey).(*TokenClaims)
+	if ok && !claims.Admin {
+		return ErrNotAdmin
+	}
+	return nil
+}
+
+/*
+IsAdmin returns true if the request went through a TokenVerifier and
+the token has the "admin" claim.
+*/
+func IsAdmin(req *http.Request) bool {
+	claims, ok := req.Context().Value(claimsKey).(*TokenClaims)
+	return ok && claims.Admin
+}
+
+func parseRSAPublicKey(buf []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.New("RSA key file is not in PEM format")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Key file does not contain an RSA public key")
+	}
+	return rsaKey, nil
+}
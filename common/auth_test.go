@@ -0,0 +1,239 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package common
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const testHMACKey = "testsecret"
+
+var _ = Describe("Token tests", func() {
+	var tmpDir string
+	var rsaKey *rsa.PrivateKey
+	var verifier *TokenVerifier
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = ioutil.TempDir("", "authtest")
+		Expect(err).Should(Succeed())
+
+		rsaKey, err = rsa.GenerateKey(rand.Reader, 1024)
+		Expect(err).Should(Succeed())
+		pubBytes, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+		Expect(err).Should(Succeed())
+		pubPEM := pem.EncodeToMemory(&pem.Block{
+			Type:  "PUBLIC KEY",
+			Bytes: pubBytes,
+		})
+
+		hmacFile := path.Join(tmpDir, "hmac")
+		rsaFile := path.Join(tmpDir, "rsa.pem")
+		err = ioutil.WriteFile(hmacFile, []byte(testHMACKey+"\n"), 0600)
+		Expect(err).Should(Succeed())
+		err = ioutil.WriteFile(rsaFile, pubPEM, 0600)
+		Expect(err).Should(Succeed())
+
+		verifier, err = CreateTokenVerifier(hmacFile, rsaFile)
+		Expect(err).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("HMAC token", func() {
+		tok := makeHMACToken(map[string]interface{}{
+			"selectors": []string{"foo", "bar"},
+		}, testHMACKey)
+		claims, err := verifier.Verify(tok)
+		Expect(err).Should(Succeed())
+		Expect(claims.Selectors).Should(Equal([]string{"foo", "bar"}))
+		Expect(claims.Admin).Should(BeFalse())
+	})
+
+	It("RSA token", func() {
+		tok := makeRSAToken(map[string]interface{}{
+			"selectors": []string{"foo"},
+			"admin":     true,
+		}, rsaKey)
+		claims, err := verifier.Verify(tok)
+		Expect(err).Should(Succeed())
+		Expect(claims.Selectors).Should(Equal([]string{"foo"}))
+		Expect(claims.Admin).Should(BeTrue())
+	})
+
+	It("Bad signature", func() {
+		tok := makeHMACToken(map[string]interface{}{
+			"selectors": []string{"foo"},
+		}, "wrongsecret")
+		_, err := verifier.Verify(tok)
+		Expect(err).ShouldNot(Succeed())
+
+		other, err := rsa.GenerateKey(rand.Reader, 1024)
+		Expect(err).Should(Succeed())
+		tok = makeRSAToken(map[string]interface{}{
+			"selectors": []string{"foo"},
+		}, other)
+		_, err = verifier.Verify(tok)
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("Unsigned token", func() {
+		tok := makeToken("none", map[string]interface{}{
+			"selectors": []string{"foo"},
+		}, nil)
+		_, err := verifier.Verify(tok)
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("Expired token", func() {
+		tok := makeHMACToken(map[string]interface{}{
+			"selectors": []string{"foo"},
+			"exp":       time.Now().Add(-time.Minute).Unix(),
+		}, testHMACKey)
+		_, err := verifier.Verify(tok)
+		Expect(err).ShouldNot(Succeed())
+
+		tok = makeHMACToken(map[string]interface{}{
+			"selectors": []string{"foo"},
+			"nbf":       time.Now().Add(time.Minute).Unix(),
+		}, testHMACKey)
+		_, err = verifier.Verify(tok)
+		Expect(err).ShouldNot(Succeed())
+
+		tok = makeHMACToken(map[string]interface{}{
+			"selectors": []string{"foo"},
+			"exp":       time.Now().Add(time.Minute).Unix(),
+		}, testHMACKey)
+		_, err = verifier.Verify(tok)
+		Expect(err).Should(Succeed())
+	})
+
+	It("Garbage token", func() {
+		_, err := verifier.Verify("foo")
+		Expect(err).ShouldNot(Succeed())
+		_, err = verifier.Verify("foo.bar.baz")
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("Handler", func() {
+		var checkErr, adminErr error
+		var admin bool
+		h := verifier.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			checkErr = CheckSelectors(r, r.URL.Query()["selector"])
+			adminErr = CheckAdmin(r)
+			admin = IsAdmin(r)
+		}))
+
+		req := httptest.NewRequest("GET", "/changes?selector=foo", nil)
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		Expect(resp.Code).Should(Equal(http.StatusUnauthorized))
+		var apiErr APIError
+		err := json.Unmarshal(resp.Body.Bytes(), &apiErr)
+		Expect(err).Should(Succeed())
+		Expect(apiErr.Code).Should(Equal("UNAUTHORIZED"))
+
+		tok := makeHMACToken(map[string]interface{}{
+			"selectors": []string{"foo"},
+		}, testHMACKey)
+
+		req = httptest.NewRequest("GET", "/changes?selector=foo", nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		resp = httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		Expect(resp.Code).Should(Equal(http.StatusOK))
+		Expect(checkErr).Should(Succeed())
+		Expect(admin).Should(BeFalse())
+		Expect(adminErr).Should(Equal(ErrNotAdmin))
+
+		req = httptest.NewRequest("GET", "/changes?selector=foo&selector=bar", nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		resp = httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		Expect(checkErr).ShouldNot(Succeed())
+		Expect(checkErr.(*SelectorAccessError).Selector).Should(Equal("bar"))
+
+		adminTok := makeHMACToken(map[string]interface{}{
+			"admin": true,
+		}, testHMACKey)
+		req = httptest.NewRequest("GET", "/consumers", nil)
+		req.Header.Set("Authorization", "Bearer "+adminTok)
+		resp = httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		Expect(adminErr).Should(Succeed())
+		Expect(admin).Should(BeTrue())
+	})
+
+	It("No verifier", func() {
+		req := httptest.NewRequest("GET", "/changes?selector=foo", nil)
+		Expect(CheckSelectors(req, []string{"foo", "bar"})).Should(Succeed())
+		Expect(CheckAdmin(req)).Should(Succeed())
+		Expect(IsAdmin(req)).Should(BeFalse())
+	})
+
+	It("No keys", func() {
+		_, err := CreateTokenVerifier("", "")
+		Expect(err).ShouldNot(Succeed())
+	})
+})
+
+func makeHMACToken(claims map[string]interface{}, secret string) string {
+	return makeToken("HS256", claims, func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signed)
+		return mac.Sum(nil)
+	})
+}
+
+func makeRSAToken(claims map[string]interface{}, key *rsa.PrivateKey) string {
+	return makeToken("RS256", claims, func(signed []byte) []byte {
+		h := sha256.Sum256(signed)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+		Expect(err).Should(Succeed())
+		return sig
+	})
+}
+
+func makeToken(alg string, claims map[string]interface{}, sign func([]byte) []byte) string {
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." +
+		base64.RawURLEncoding.EncodeToString(body)
+	var sig []byte
+	if sign != nil {
+		sig = sign([]byte(signed))
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
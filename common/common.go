@@ -104,6 +104,12 @@ type Change struct {
 	// For an update oepration, the old value of the columns. For a delete, the
 	// value of the columns that are being deleted
 	OldRow Row `json:"oldRow,omitempty"`
+	// True if this change was generated by the change server rather than
+	// by Postgres. When an update moves a row from one selector to another,
+	// the change server replaces it with a delete for the old selector and
+	// an insert for the new one, and both have this flag set. Both changes
+	// have the same sequence, and the delete always comes first.
+	Synthetic bool `json:"synthetic,omitempty"`
 	// Sometimes we need to return an error instead of a change. If this is
 	// not null, then it means a replication error occurred.
 	Error error `json:"-"`
@@ -153,4 +159,28 @@ type ChangeList struct {
 	FirstSequence string `json:"firstSequence"`
 	// All the changes, in order of "commit sequence" and "commit index"
 	Changes []Change `json:"changes"`
+	// The transactions that the changes belong to, in the same order.
+	// This is only filled in when the client asked for atomic transactions.
+	Transactions []Transaction `json:"transactions,omitempty"`
+}
+
+/*
+A Transaction describes a group of changes in a ChangeList that were all
+committed by the same Postgres transaction.
+*/
+type Transaction struct {
+	// The Postgres transaction ID, in the same format as in "Change"
+	TransactionID uint64 `json:"txid"`
+	// The LSN when the transaction was committed. All the changes in the
+	// transaction have the same value for "CommitSequence."
+	CommitSequence uint64 `json:"commitSequence"`
+	// The value of "Sequence" for the first change in the list that is
+	// part of this transaction
+	FirstSequence string `json:"firstSequence"`
+	// The value of "Sequence" for the last change in the list that is
+	// part of this transaction
+	LastSequence string `json:"lastSequence"`
+	// If true, then the list does not contain all the changes from the
+	// transaction because it was too large to return all at once
+	Partial bool `json:"partial,omitempty"`
 }
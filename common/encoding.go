@@ -215,6 +215,17 @@ func UnmarshalChangeListProto(data []byte) (*ChangeList, error) {
 		cl.Changes = append(cl.Changes, *c)
 	}
 
+	for _, tpb := range clpb.GetTransactions() {
+		t := Transaction{
+			TransactionID:  tpb.GetTransactionID(),
+			CommitSequence: tpb.GetCommitSequence(),
+			FirstSequence:  tpb.GetFirstSequence(),
+			LastSequence:   tpb.GetLastSequence(),
+			Partial:        tpb.GetPartial(),
+		}
+		cl.Transactions = append(cl.Transactions, t)
+	}
+
 	return &cl, nil
 }
 
@@ -260,6 +271,19 @@ func (l *ChangeList) MarshalProto() []byte {
 		pb.Changes = append(pb.Changes, cpb)
 	}
 
+	for _, t := range l.Transactions {
+		tpb := &TransactionPb{
+			TransactionID:  proto.Uint64(t.TransactionID),
+			CommitSequence: proto.Uint64(t.CommitSequence),
+			FirstSequence:  proto.String(t.FirstSequence),
+			LastSequence:   proto.String(t.LastSequence),
+		}
+		if t.Partial {
+			tpb.Partial = proto.Bool(true)
+		}
+		pb.Transactions = append(pb.Transactions, tpb)
+	}
+
 	buf, err := proto.Marshal(pb)
 	if err != nil {
 		panic(err.Error())
@@ -302,6 +326,7 @@ func unconvertChangeProto(cp *ChangePb) *Change {
 		CommitIndex:    cp.GetCommitIndex(),
 		ChangeSequence: cp.GetChangeSequence(),
 		Timestamp:      cp.GetTimestamp(),
+		Synthetic:      cp.GetSynthetic(),
 	}
 
 	if cp.GetTransactionIDEpoch() > 0 {
@@ -432,6 +457,9 @@ func (c *Change) convertProto() *ChangePb {
 	if c.Timestamp != 0 {
 		cp.Timestamp = proto.Int64(c.Timestamp)
 	}
+	if c.Synthetic {
+		cp.Synthetic = proto.Bool(true)
+	}
 	cp.NewColumns = unmakeRow(c.NewRow)
 	cp.OldColumns = unmakeRow(c.OldRow)
 	return cp
@@ -82,9 +82,39 @@ var _ = Describe("Encoding Tests", func() {
 			Expect(nc.Table).Should(Equal(change.Table))
 			Expect(nc.NewRow).Should(Equal(change.NewRow))
 			Expect(nc.OldRow).Should(Equal(change.OldRow))
+			Expect(nc.Synthetic).Should(Equal(change.Synthetic))
 		}
 	})
 
+	It("Encode change list transactions", func() {
+		s := readFile("./testfiles/changelist.json")
+		cl, err := UnmarshalChangeList(s)
+		Expect(err).Should(Succeed())
+		cl.Transactions = []Transaction{
+			{
+				TransactionID:  10,
+				CommitSequence: 130,
+				FirstSequence:  "0.82.0",
+				LastSequence:   "0.82.0",
+			},
+			{
+				TransactionID:  11,
+				CommitSequence: 140,
+				FirstSequence:  "0.8c.0",
+				LastSequence:   "0.8c.1",
+				Partial:        true,
+			},
+		}
+
+		ncl, err := UnmarshalChangeListProto(cl.MarshalProto())
+		Expect(err).Should(Succeed())
+		Expect(ncl.Transactions).Should(Equal(cl.Transactions))
+
+		ncl, err = UnmarshalChangeList(cl.Marshal())
+		Expect(err).Should(Succeed())
+		Expect(ncl.Transactions).Should(Equal(cl.Transactions))
+	})
+
 	It("Encode change", func() {
 		err := quick.Check(func(iv int64, sv string, bv bool) bool {
 			nr := make(map[string]*ColumnVal)
@@ -0,0 +1,253 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+TextType is the Postgres type ID of the "text" type. Columns that are
+hashed by a ColumnPolicy always have this type.
+*/
+const TextType = 25
+
+// Postgres type IDs of other types whose values are hashed specially
+const (
+	byteaType  = 17
+	float4Type = 700
+)
+
+/*
+A ColumnAction describes what a ColumnPolicy does to a single column.
+*/
+type ColumnAction int
+
+// ColumnAction constants.
+const (
+	KeepColumn ColumnAction = iota
+	DropColumn
+	HashColumn
+)
+
+/*
+A ColumnPolicy lists columns that must be removed or hashed before
+rows leave the change server or the snapshot server. Both servers
+must be given the same policy so that snapshots and change lists stay
+consistent with each other.
+*/
+type ColumnPolicy struct {
+	// Salt is prepended to every value before it is hashed
+	Salt string `yaml:"salt"`
+	// Tables lists the rules for each table
+	Tables []TablePolicy `yaml:"tables"`
+}
+
+/*
+A TablePolicy lists the columns of a single table that are dropped or
+hashed. If "Selectors" is not empty, then the rule only applies to rows
+whose selector column has one of the listed values.
+*/
+type TablePolicy struct {
+	// Table is the name of the table, including the schema, like "public.foo"
+	Table     string   `yaml:"table"`
+	Selectors []string `yaml:"selectors"`
+	Drop      []string `yaml:"drop"`
+	Hash      []string `yaml:"hash"`
+}
+
+/*
+LoadColumnPolicy reads a policy from a YAML file. Since JSON is a subset
+of YAML, the file may be in JSON as well.
+*/
+func LoadColumnPolicy(fileName string) (*ColumnPolicy, error) {
+	buf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return ParseColumnPolicy(buf)
+}
+
+/*
+ParseColumnPolicy parses a policy from YAML or JSON.
+*/
+func ParseColumnPolicy(buf []byte) (*ColumnPolicy, error) {
+	p := &ColumnPolicy{}
+	err := yaml.Unmarshal(buf, p)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range p.Tables {
+		if t.Table == "" {
+			return nil, fmt.Errorf("Column policy is missing a table name")
+		}
+	}
+	return p, nil
+}
+
+/*
+HasTable returns true if the policy has any rules for the specified table.
+It is safe to call on a nil policy.
+*/
+func (p *ColumnPolicy) HasTable(table string) bool {
+	if p == nil {
+		return false
+	}
+	for _, t := range p.Tables {
+		if t.Table == table {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Action returns what should happen to a column of the specified table, for
+a row with the specified selector. If a column is both dropped and hashed,
+then it is dropped. It is safe to call on a nil policy.
+*/
+func (p *ColumnPolicy) Action(table, selector, column string) ColumnAction {
+	if p == nil {
+		return KeepColumn
+	}
+
+	action := KeepColumn
+	for _, t := range p.Tables {
+		if t.Table != table || !t.appliesTo(selector) {
+			continue
+		}
+		if containsString(t.Drop, column) {
+			return DropColumn
+		}
+		if containsString(t.Hash, column) {
+			action = HashColumn
+		}
+	}
+	return action
+}
+
+/*
+ApplyRow modifies a row in place, removing dropped columns and replacing
+the values of hashed columns. It is safe to call on a nil policy.
+*/
+func (p *ColumnPolicy) ApplyRow(table, selector string, row Row) {
+	if p == nil || row == nil || !p.HasTable(table) {
+		return
+	}
+	for name, val := range row {
+		switch p.Action(table, selector, name) {
+		case DropColumn:
+			delete(row, name)
+		case HashColumn:
+			row[name] = p.HashValue(val)
+		}
+	}
+}
+
+/*
+HashValue returns a new value that contains the SHA-256 hash of the text
+form of the original value plus the salt, in hex. The text form is the one
+that Postgres uses when a value is cast to "text," so that a snapshot, which
+reads hashed columns that way, gets the same hash as the changes. The type
+of the new value is always "text." Null values stay null.
+*/
+func (p *ColumnPolicy) HashValue(val *ColumnVal) *ColumnVal {
+	hv := &ColumnVal{
+		Type: TextType,
+	}
+	if val == nil || val.Value == nil {
+		return hv
+	}
+
+	h := sha256.New()
+	h.Write([]byte(p.Salt))
+	h.Write([]byte(pgText(val)))
+	hv.Value = hex.EncodeToString(h.Sum(nil))
+	return hv
+}
+
+/*
+pgText converts a value to text the way that Postgres does. Values that
+are already strings came from Postgres in that form.
+*/
+func pgText(val *ColumnVal) string {
+	switch val.Value.(type) {
+	case bool:
+		if val.Value.(bool) {
+			return "t"
+		}
+		return "f"
+	case []byte:
+		if val.Type == byteaType {
+			return "\\x" + hex.EncodeToString(val.Value.([]byte))
+		}
+	case float64:
+		if val.Type == float4Type {
+			return pgFloat(val.Value.(float64), 32)
+		}
+		return pgFloat(val.Value.(float64), 64)
+	}
+	return val.String()
+}
+
+/*
+pgFloat formats a floating-point number like Postgres, which uses the
+shortest form that reads back as the same value, and uses an exponent only
+if it is less than -4 or more than the number of significant digits that
+the type always has.
+*/
+func pgFloat(f float64, bitSize int) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	}
+
+	maxExp := 15
+	if bitSize == 32 {
+		maxExp = 6
+	}
+	s := strconv.FormatFloat(f, 'e', -1, bitSize)
+	exp, _ := strconv.Atoi(s[strings.IndexByte(s, 'e')+1:])
+	if exp < -4 || exp >= maxExp {
+		return s
+	}
+	return strconv.FormatFloat(f, 'f', -1, bitSize)
+}
+
+func (t TablePolicy) appliesTo(selector string) bool {
+	return len(t.Selectors) == 0 || containsString(t.Selectors, selector)
+}
+
+func containsString(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
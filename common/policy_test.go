@@ -0,0 +1,122 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Column policy tests", func() {
+	var policy *ColumnPolicy
+
+	BeforeEach(func() {
+		var err error
+		policy, err = LoadColumnPolicy("./testfiles/policy.yaml")
+		Expect(err).Should(Succeed())
+	})
+
+	It("Actions", func() {
+		Expect(policy.HasTable("public.users")).Should(BeTrue())
+		Expect(policy.HasTable("public.other")).Should(BeFalse())
+
+		Expect(policy.Action("public.users", "foo", "id")).Should(Equal(KeepColumn))
+		Expect(policy.Action("public.users", "foo", "password")).Should(Equal(DropColumn))
+		Expect(policy.Action("public.users", "foo", "email")).Should(Equal(HashColumn))
+		Expect(policy.Action("public.users", "foo", "phone")).Should(Equal(HashColumn))
+		Expect(policy.Action("public.users", "restricted", "phone")).Should(Equal(DropColumn))
+		Expect(policy.Action("public.orders", "foo", "total")).Should(Equal(KeepColumn))
+		Expect(policy.Action("public.orders", "restricted", "total")).Should(Equal(HashColumn))
+		Expect(policy.Action("public.other", "restricted", "password")).Should(Equal(KeepColumn))
+	})
+
+	It("Apply row", func() {
+		row := Row{
+			"id":       &ColumnVal{Value: "1", Type: 23},
+			"password": &ColumnVal{Value: "secret", Type: 1043},
+			"email":    &ColumnVal{Value: "foo@example.com", Type: 1043},
+			"phone":    &ColumnVal{Value: nil, Type: 1043},
+		}
+		policy.ApplyRow("public.users", "foo", row)
+
+		Expect(len(row)).Should(Equal(3))
+		Expect(row["id"].Value).Should(Equal("1"))
+		Expect(row["password"]).Should(BeNil())
+
+		h := sha256.Sum256([]byte("testsaltfoo@example.com"))
+		Expect(row["email"].Value).Should(Equal(hex.EncodeToString(h[:])))
+		Expect(row["email"].Type).Should(BeEquivalentTo(TextType))
+		Expect(row["phone"].Value).Should(BeNil())
+		Expect(row["phone"].Type).Should(BeEquivalentTo(TextType))
+	})
+
+	It("Hash is type independent", func() {
+		// Change lists have strings, and snapshots may not
+		Expect(policy.HashValue(&ColumnVal{Value: int64(123), Type: 20})).Should(
+			Equal(policy.HashValue(&ColumnVal{Value: "123", Type: 20})))
+	})
+
+	It("Hash matches Postgres text", func() {
+		// Snapshots read hashed columns with "::text," so the hash of a
+		// typed value must be the hash of what Postgres returns for it
+		for _, tc := range []struct {
+			val  *ColumnVal
+			text string
+		}{
+			{&ColumnVal{Value: true, Type: 16}, "t"},
+			{&ColumnVal{Value: false, Type: 16}, "f"},
+			{&ColumnVal{Value: []byte{0x0a, 0x0b}, Type: 17}, `\x0a0b`},
+			{&ColumnVal{Value: []byte("foo"), Type: TextType}, "foo"},
+			{&ColumnVal{Value: float64(1e21), Type: 701}, "1e+21"},
+			{&ColumnVal{Value: float64(1000000), Type: 701}, "1000000"},
+			{&ColumnVal{Value: float64(0.00001), Type: 701}, "1e-05"},
+			{&ColumnVal{Value: float64(-1.5), Type: 701}, "-1.5"},
+			{&ColumnVal{Value: float64(1.5e7), Type: 700}, "1.5e+07"},
+			{&ColumnVal{Value: float64(0.1), Type: 700}, "0.1"},
+		} {
+			Expect(policy.HashValue(tc.val)).Should(
+				Equal(policy.HashValue(&ColumnVal{Value: tc.text, Type: TextType})),
+				"Hash of %v should match \"%s\"", tc.val.Value, tc.text)
+		}
+	})
+
+	It("Nil policy", func() {
+		var np *ColumnPolicy
+		row := Row{
+			"password": &ColumnVal{Value: "secret", Type: 1043},
+		}
+		np.ApplyRow("public.users", "foo", row)
+		Expect(row["password"].Value).Should(Equal("secret"))
+		Expect(np.Action("public.users", "foo", "password")).Should(Equal(KeepColumn))
+	})
+
+	It("Invalid policy", func() {
+		_, err := ParseColumnPolicy([]byte("tables:\n- drop: [foo]\n"))
+		Expect(err).ShouldNot(Succeed())
+		_, err = ParseColumnPolicy([]byte("tables: 12"))
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("JSON policy", func() {
+		p, err := ParseColumnPolicy([]byte(
+			`{"tables": [{"table": "public.users", "drop": ["password"]}]}`))
+		Expect(err).Should(Succeed())
+		Expect(p.Action("public.users", "", "password")).Should(Equal(DropColumn))
+	})
+})
@@ -32,6 +32,7 @@ It has these top-level messages:
 	TableHeaderPb
 	RowPb
 	StreamMessagePb
+	TransactionPb
 */
 package common
 
@@ -359,7 +360,10 @@ type ChangePb struct {
 	// 64-bit Postgres transaction id, including the epoch. Will not
 	// roll over.
 	TransactionIDEpoch *uint64 `protobuf:"varint,11,opt,name=transactionIDEpoch" json:"transactionIDEpoch,omitempty"`
-	XXX_unrecognized   []byte  `json:"-"`
+	// True if the change server generated this change rather than Postgres.
+	// This happens when an update moves a row from one selector to another.
+	Synthetic        *bool  `protobuf:"varint,12,opt,name=synthetic" json:"synthetic,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
 }
 
 func (m *ChangePb) Reset()                    { *m = ChangePb{} }
@@ -444,11 +448,20 @@ func (m *ChangePb) GetTransactionIDEpoch() uint64 {
 	return 0
 }
 
+func (m *ChangePb) GetSynthetic() bool {
+	if m != nil && m.Synthetic != nil {
+		return *m.Synthetic
+	}
+	return false
+}
+
 type ChangeListPb struct {
-	LastSequence     *string     `protobuf:"bytes,1,opt,name=lastSequence" json:"lastSequence,omitempty"`
-	FirstSequence    *string     `protobuf:"bytes,2,opt,name=firstSequence" json:"firstSequence,omitempty"`
-	Changes          []*ChangePb `protobuf:"bytes,3,rep,name=changes" json:"changes,omitempty"`
-	XXX_unrecognized []byte      `json:"-"`
+	LastSequence  *string     `protobuf:"bytes,1,opt,name=lastSequence" json:"lastSequence,omitempty"`
+	FirstSequence *string     `protobuf:"bytes,2,opt,name=firstSequence" json:"firstSequence,omitempty"`
+	Changes       []*ChangePb `protobuf:"bytes,3,rep,name=changes" json:"changes,omitempty"`
+	// Only returned when the client asks for atomic transactions.
+	Transactions     []*TransactionPb `protobuf:"bytes,4,rep,name=transactions" json:"transactions,omitempty"`
+	XXX_unrecognized []byte           `json:"-"`
 }
 
 func (m *ChangeListPb) Reset()                    { *m = ChangeListPb{} }
@@ -477,6 +490,13 @@ func (m *ChangeListPb) GetChanges() []*ChangePb {
 	return nil
 }
 
+func (m *ChangeListPb) GetTransactions() []*TransactionPb {
+	if m != nil {
+		return m.Transactions
+	}
+	return nil
+}
+
 type SnapshotHeaderPb struct {
 	Timestamp        *string `protobuf:"bytes,1,req,name=timestamp" json:"timestamp,omitempty"`
 	Snapshot         *string `protobuf:"bytes,2,req,name=snapshot" json:"snapshot,omitempty"`
@@ -666,6 +686,61 @@ func _StreamMessagePb_OneofSizer(msg proto.Message) (n int) {
 	return n
 }
 
+type TransactionPb struct {
+	// 64-bit transaction ID, the same as "transactionIDEpoch" above.
+	TransactionID *uint64 `protobuf:"varint,1,opt,name=transactionID" json:"transactionID,omitempty"`
+	// LSN when the transaction was committed.
+	CommitSequence *uint64 `protobuf:"varint,2,opt,name=commitSequence" json:"commitSequence,omitempty"`
+	// Sequence of the first change in the list from this transaction.
+	FirstSequence *string `protobuf:"bytes,3,opt,name=firstSequence" json:"firstSequence,omitempty"`
+	// Sequence of the last change in the list from this transaction.
+	LastSequence *string `protobuf:"bytes,4,opt,name=lastSequence" json:"lastSequence,omitempty"`
+	// If true, then the list does not contain all the changes from this
+	// transaction, because it was too large.
+	Partial          *bool  `protobuf:"varint,5,opt,name=partial" json:"partial,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *TransactionPb) Reset()                    { *m = TransactionPb{} }
+func (m *TransactionPb) String() string            { return proto.CompactTextString(m) }
+func (*TransactionPb) ProtoMessage()               {}
+func (*TransactionPb) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{8} }
+
+func (m *TransactionPb) GetTransactionID() uint64 {
+	if m != nil && m.TransactionID != nil {
+		return *m.TransactionID
+	}
+	return 0
+}
+
+func (m *TransactionPb) GetCommitSequence() uint64 {
+	if m != nil && m.CommitSequence != nil {
+		return *m.CommitSequence
+	}
+	return 0
+}
+
+func (m *TransactionPb) GetFirstSequence() string {
+	if m != nil && m.FirstSequence != nil {
+		return *m.FirstSequence
+	}
+	return ""
+}
+
+func (m *TransactionPb) GetLastSequence() string {
+	if m != nil && m.LastSequence != nil {
+		return *m.LastSequence
+	}
+	return ""
+}
+
+func (m *TransactionPb) GetPartial() bool {
+	if m != nil && m.Partial != nil {
+		return *m.Partial
+	}
+	return false
+}
+
 func init() {
 	proto.RegisterType((*ValuePb)(nil), "common.ValuePb")
 	proto.RegisterType((*ColumnPb)(nil), "common.ColumnPb")
@@ -675,41 +750,47 @@ func init() {
 	proto.RegisterType((*TableHeaderPb)(nil), "common.TableHeaderPb")
 	proto.RegisterType((*RowPb)(nil), "common.RowPb")
 	proto.RegisterType((*StreamMessagePb)(nil), "common.StreamMessagePb")
+	proto.RegisterType((*TransactionPb)(nil), "common.TransactionPb")
 }
 
 func init() { proto.RegisterFile("transicator.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 490 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x74, 0x52, 0x4d, 0x8f, 0xd3, 0x30,
-	0x14, 0x24, 0x5f, 0x4d, 0xf3, 0xda, 0x6c, 0x5b, 0x2f, 0x8b, 0x22, 0x84, 0x60, 0x89, 0x10, 0xea,
-	0xa9, 0x07, 0x2e, 0x5c, 0x11, 0x5f, 0xda, 0x95, 0x40, 0x42, 0x14, 0x71, 0x44, 0x72, 0x52, 0xb3,
-	0x8d, 0x94, 0xd8, 0xc1, 0x76, 0x28, 0xfb, 0x1b, 0x38, 0xf3, 0x7f, 0x79, 0xb6, 0x93, 0xb2, 0x41,
-	0xbb, 0xc7, 0x37, 0x7e, 0x1f, 0x33, 0xe3, 0x81, 0x95, 0x96, 0x94, 0xab, 0xaa, 0xa4, 0x5a, 0xc8,
-	0x4d, 0x2b, 0x85, 0x16, 0x64, 0x52, 0x8a, 0xa6, 0x11, 0x3c, 0xff, 0xed, 0x41, 0xfc, 0x95, 0xd6,
-	0x1d, 0xfb, 0x54, 0x90, 0x25, 0x4c, 0x94, 0x96, 0x15, 0xbf, 0xca, 0xbc, 0x73, 0x6f, 0x9d, 0x5c,
-	0xdc, 0x23, 0x29, 0x04, 0x15, 0xd7, 0x99, 0x8f, 0x65, 0x80, 0xe5, 0x09, 0x84, 0x9d, 0xa9, 0x03,
-	0xac, 0x43, 0xac, 0x71, 0x60, 0x27, 0xba, 0xa2, 0x66, 0x59, 0x88, 0x88, 0x87, 0xc8, 0x02, 0xa2,
-	0xe2, 0x5a, 0x33, 0x95, 0x45, 0x08, 0xcc, 0xdd, 0x48, 0x21, 0x44, 0x9d, 0x4d, 0xb0, 0x9e, 0x62,
-	0x7d, 0x0a, 0x89, 0xae, 0x1a, 0xa6, 0x34, 0x6d, 0xda, 0x2c, 0x76, 0x7b, 0x5f, 0xc7, 0x10, 0xfd,
-	0x34, 0x1c, 0xf2, 0xf7, 0x30, 0x7d, 0x23, 0xea, 0xae, 0xe1, 0xc8, 0x66, 0x0e, 0x21, 0xa7, 0x0d,
-	0x43, 0x2e, 0xfe, 0x3a, 0x21, 0x8f, 0xfb, 0x16, 0xcb, 0x65, 0xf6, 0x62, 0xb1, 0x71, 0xfc, 0x37,
-	0x03, 0x77, 0xec, 0xd6, 0xd7, 0x2d, 0xb3, 0xd4, 0xa2, 0xfc, 0x8f, 0x8f, 0x8b, 0xf6, 0x94, 0x5f,
-	0x99, 0xa7, 0x15, 0x24, 0xa2, 0x65, 0x92, 0xea, 0x4a, 0x70, 0xbb, 0x2d, 0x42, 0x5d, 0x91, 0xa6,
-	0x86, 0xb7, 0x6f, 0x97, 0x2f, 0x61, 0xaa, 0xd8, 0x8f, 0x8e, 0xf1, 0xd2, 0x2d, 0x48, 0xc8, 0x03,
-	0x38, 0x31, 0x07, 0x2a, 0xbd, 0x1d, 0x70, 0xa3, 0x30, 0xb4, 0xb8, 0xdd, 0x7b, 0xc4, 0x23, 0x8b,
-	0x9f, 0xc2, 0xcc, 0xf5, 0x5f, 0xf2, 0x1d, 0xfb, 0x65, 0xd5, 0xa6, 0xe4, 0x0c, 0x52, 0x6b, 0x3c,
-	0x2d, 0xcd, 0xe9, 0xcb, 0xb7, 0x56, 0x6f, 0x4a, 0x9e, 0x01, 0x70, 0x76, 0x70, 0x3a, 0x55, 0x36,
-	0x3d, 0x0f, 0x50, 0xcf, 0x72, 0xd0, 0x73, 0x94, 0x8f, 0x5d, 0xa2, 0xde, 0x0d, 0x5d, 0xc9, 0x1d,
-	0x5d, 0xab, 0x9b, 0x76, 0x82, 0xb1, 0x93, 0x3c, 0x04, 0x32, 0xba, 0xfa, 0xae, 0x15, 0xe5, 0x3e,
-	0x9b, 0x19, 0x9a, 0xf9, 0x37, 0x98, 0x3b, 0x5b, 0x3e, 0x54, 0x4a, 0xe3, 0xf8, 0x7d, 0x98, 0xd7,
-	0x54, 0xfd, 0x13, 0x69, 0xff, 0xdd, 0xf0, 0xfe, 0x5e, 0xc9, 0x1b, 0xb0, 0x6f, 0xe1, 0xa7, 0x10,
-	0x3b, 0xed, 0x0a, 0x4d, 0x1a, 0xd3, 0xe9, 0xad, 0xce, 0x5f, 0xc2, 0x72, 0xcb, 0x69, 0xab, 0xf6,
-	0x42, 0x5f, 0x30, 0xba, 0x63, 0xf2, 0x7f, 0x8a, 0xde, 0xd1, 0xef, 0xbe, 0xcd, 0xfd, 0x40, 0xfe,
-	0x0a, 0xd2, 0x2f, 0xe6, 0x43, 0x8e, 0x53, 0xe3, 0xdf, 0x37, 0xa7, 0x7b, 0x27, 0xfc, 0xdb, 0x9d,
-	0xc8, 0xd7, 0x10, 0x7d, 0x16, 0x07, 0x9c, 0x7c, 0x02, 0x13, 0x9b, 0x14, 0x85, 0xb3, 0xc1, 0x2d,
-	0x51, 0xc9, 0x0b, 0x58, 0x6c, 0xb5, 0x64, 0xb4, 0xf9, 0xc8, 0x94, 0xa2, 0x36, 0x22, 0xcf, 0x87,
-	0x3c, 0x78, 0x36, 0x5d, 0x67, 0xc3, 0xc8, 0x88, 0x13, 0xa6, 0xf7, 0x11, 0x04, 0x52, 0x1c, 0xfa,
-	0x0c, 0xa6, 0x43, 0x97, 0xbd, 0x8b, 0x31, 0x4e, 0x20, 0x6e, 0xdc, 0xca, 0xbf, 0x01, 0x00, 0x00,
-	0xff, 0xff, 0x54, 0x19, 0xca, 0xac, 0x72, 0x03, 0x00, 0x00,
+	// 563 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x74, 0x52, 0x5f, 0x6f, 0xd3, 0x3e,
+	0x14, 0x8d, 0xf3, 0xa7, 0x49, 0x6e, 0x93, 0xb5, 0xf5, 0x7e, 0xfb, 0xc9, 0x42, 0x08, 0x42, 0x34,
+	0xa1, 0x48, 0x48, 0x7b, 0xd8, 0x0b, 0xaf, 0x68, 0x03, 0x94, 0x49, 0x20, 0x55, 0x6c, 0xe2, 0xdd,
+	0x49, 0xcd, 0x1a, 0x29, 0xb1, 0x43, 0xec, 0x52, 0x2a, 0xf1, 0x0d, 0xf8, 0x22, 0x7c, 0x4c, 0x64,
+	0xa7, 0xe9, 0xda, 0x6e, 0x3c, 0xe6, 0xe4, 0xf8, 0xde, 0x73, 0xce, 0x3d, 0x30, 0x53, 0x1d, 0xe5,
+	0xb2, 0x2a, 0xa9, 0x12, 0xdd, 0x45, 0xdb, 0x09, 0x25, 0xf0, 0xa8, 0x14, 0x4d, 0x23, 0x78, 0xfa,
+	0x1b, 0x81, 0xff, 0x95, 0xd6, 0x2b, 0x36, 0x2f, 0xf0, 0x14, 0x46, 0x52, 0x75, 0x15, 0xbf, 0x27,
+	0x28, 0x41, 0x59, 0x98, 0x5b, 0x38, 0x06, 0xa7, 0xe2, 0x8a, 0xd8, 0x09, 0xca, 0x9c, 0xdc, 0xc2,
+	0x27, 0xe0, 0xae, 0xf4, 0xb7, 0x93, 0xa0, 0xcc, 0xcd, 0x2d, 0xfd, 0x60, 0x21, 0x56, 0x45, 0xcd,
+	0x88, 0x9b, 0xa0, 0x0c, 0xe5, 0x16, 0x9e, 0x80, 0x57, 0x6c, 0x14, 0x93, 0xc4, 0x4b, 0x50, 0x16,
+	0xf5, 0x4f, 0x0a, 0x21, 0x6a, 0x32, 0x4a, 0x50, 0x16, 0xe4, 0x16, 0x3e, 0x85, 0x50, 0x55, 0x0d,
+	0x93, 0x8a, 0x36, 0x2d, 0xf1, 0xfb, 0xb9, 0x57, 0x3e, 0x78, 0x3f, 0xb4, 0x86, 0xf4, 0x23, 0x04,
+	0xd7, 0xa2, 0x5e, 0x35, 0x7c, 0x5e, 0xe0, 0x08, 0x5c, 0x4e, 0x1b, 0x46, 0x50, 0x62, 0x67, 0x21,
+	0x7e, 0xb1, 0xa5, 0x18, 0x2d, 0xe3, 0xcb, 0xc9, 0x45, 0xaf, 0xff, 0x62, 0xd0, 0x1e, 0x81, 0xab,
+	0x36, 0x2d, 0x33, 0xd2, 0xbc, 0xf4, 0x8f, 0x0d, 0xc1, 0xf5, 0x92, 0xf2, 0x7b, 0xfd, 0x6b, 0x06,
+	0xa1, 0x68, 0x59, 0x47, 0x55, 0x25, 0xb8, 0x99, 0xe6, 0xe1, 0x18, 0x3c, 0x45, 0xb5, 0x6e, 0xdb,
+	0x0c, 0x9f, 0x42, 0x20, 0xd9, 0xf7, 0x15, 0xe3, 0x65, 0x3f, 0x20, 0xc4, 0xff, 0xc3, 0x89, 0x5e,
+	0x50, 0xa9, 0xdb, 0x01, 0xd7, 0x0e, 0x5d, 0x83, 0x9b, 0xb9, 0x3b, 0xdc, 0x33, 0xf8, 0x29, 0x8c,
+	0x7b, 0xfe, 0x0d, 0x5f, 0xb0, 0x9f, 0xc6, 0x6d, 0x8c, 0xcf, 0x20, 0x36, 0xc1, 0xd3, 0x52, 0xaf,
+	0xbe, 0x79, 0x6f, 0xfc, 0xc6, 0xf8, 0x1c, 0x80, 0xb3, 0x75, 0xef, 0x53, 0x92, 0x20, 0x71, 0xb2,
+	0xf1, 0xe5, 0x74, 0xf0, 0xb3, 0xb3, 0x7f, 0x0e, 0x20, 0xea, 0xc5, 0xc0, 0x0a, 0xff, 0xc1, 0x9a,
+	0xed, 0xc7, 0x09, 0x3a, 0x4e, 0xfc, 0x0c, 0xf0, 0xc1, 0xd6, 0x0f, 0xad, 0x28, 0x97, 0x64, 0x6c,
+	0x64, 0xce, 0x20, 0x94, 0x1b, 0xae, 0x96, 0x4c, 0x55, 0x25, 0x89, 0xf4, 0x49, 0x74, 0x01, 0xa2,
+	0x3e, 0xaa, 0x4f, 0x95, 0x54, 0xf3, 0x02, 0xff, 0x07, 0x51, 0x4d, 0xe5, 0x83, 0x71, 0xd3, 0x05,
+	0xed, 0xe5, 0x5b, 0xd5, 0xed, 0xc1, 0xb6, 0x81, 0x5f, 0x81, 0xdf, 0xe7, 0x21, 0x89, 0x73, 0x24,
+	0x71, 0x88, 0xff, 0x0d, 0x44, 0x7b, 0x7a, 0x24, 0x71, 0x0d, 0xef, 0x6c, 0xe0, 0xdd, 0x3d, 0xfc,
+	0x9b, 0x17, 0xe9, 0x5b, 0x98, 0xde, 0x72, 0xda, 0xca, 0xa5, 0x50, 0x39, 0xa3, 0x0b, 0xd6, 0x1d,
+	0x7b, 0x44, 0xbb, 0x83, 0x6d, 0x69, 0xfd, 0x09, 0xd3, 0x77, 0x10, 0xdf, 0xe9, 0x8b, 0xee, 0x5e,
+	0x1d, 0xd6, 0x47, 0xeb, 0xdc, 0x46, 0x69, 0x3f, 0x1d, 0x65, 0x9a, 0x81, 0xf7, 0x45, 0xac, 0xe7,
+	0x05, 0x7e, 0x09, 0x23, 0x53, 0x35, 0x49, 0x50, 0xe2, 0x3c, 0xd1, 0xb5, 0xb4, 0x80, 0xc9, 0xad,
+	0xea, 0x18, 0x6d, 0x3e, 0x33, 0x29, 0xa9, 0x31, 0xf9, 0x7a, 0x28, 0x14, 0x4a, 0xd0, 0x81, 0xbb,
+	0x7d, 0x4d, 0xb9, 0x85, 0x9f, 0x83, 0xd3, 0x89, 0xf5, 0xb6, 0xc4, 0xf1, 0xc0, 0x32, 0x7b, 0x73,
+	0xeb, 0x2a, 0x04, 0xbf, 0xe9, 0x47, 0xa6, 0xbf, 0x20, 0x3e, 0x48, 0xe6, 0x71, 0x99, 0xd0, 0xae,
+	0x90, 0x87, 0x45, 0xb5, 0x0d, 0xfe, 0xe8, 0x5e, 0x7d, 0xaf, 0x8f, 0x8f, 0xeb, 0x1a, 0x74, 0x02,
+	0x7e, 0x4b, 0x3b, 0x55, 0xd1, 0xda, 0xd4, 0x39, 0xf8, 0x3b, 0x00, 0xcd, 0x76, 0x26, 0x11, 0x31,
+	0x04, 0x00, 0x00,
 }
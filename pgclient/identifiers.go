@@ -0,0 +1,42 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pgclient
+
+import (
+	"strings"
+)
+
+/*
+QuoteIdentifier quotes the name of a schema, table, or column when Postgres
+would, so that it may be used in SQL and so that names match the ones that
+Postgres itself produces. Unlike Postgres, it doesn't quote names that are
+reserved words unless asked to with "always."
+*/
+func QuoteIdentifier(name string, always bool) string {
+	safe := !always && name != "" && (name[0] < '0' || name[0] > '9')
+	for _, c := range name {
+		if !safe {
+			break
+		}
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '_' {
+			safe = false
+		}
+	}
+	if safe {
+		return name
+	}
+	return "\"" + strings.Replace(name, "\"", "\"\"", -1) + "\""
+}
@@ -0,0 +1,39 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pgclient
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Identifiers", func() {
+	It("Quote when Postgres would", func() {
+		Expect(QuoteIdentifier("public", false)).Should(Equal("public"))
+		Expect(QuoteIdentifier("table_2", false)).Should(Equal("table_2"))
+		Expect(QuoteIdentifier("MixedCase", false)).Should(Equal("\"MixedCase\""))
+		Expect(QuoteIdentifier("2table", false)).Should(Equal("\"2table\""))
+		Expect(QuoteIdentifier("with space", false)).Should(Equal("\"with space\""))
+		Expect(QuoteIdentifier("a\"b", false)).Should(Equal("\"a\"\"b\""))
+		Expect(QuoteIdentifier("", false)).Should(Equal("\"\""))
+	})
+
+	It("Always quote", func() {
+		Expect(QuoteIdentifier("user", true)).Should(Equal("\"user\""))
+		Expect(QuoteIdentifier("MixedCase", true)).Should(Equal("\"MixedCase\""))
+		Expect(QuoteIdentifier("a\"b", true)).Should(Equal("\"a\"\"b\""))
+	})
+})
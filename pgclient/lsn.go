@@ -0,0 +1,50 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pgclient
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+ParseLSN parses a position in the WAL in the format that Postgres uses,
+which is two hexadecimal numbers separated by a slash, such as
+"16/B374D848."
+*/
+func ParseLSN(s string) (uint64, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("Invalid LSN \"%s\"", s)
+	}
+	hi, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid LSN \"%s\"", s)
+	}
+	lo, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid LSN \"%s\"", s)
+	}
+	return hi<<32 | lo, nil
+}
+
+/*
+FormatLSN formats a position in the WAL the same way that Postgres does.
+*/
+func FormatLSN(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", lsn>>32, lsn&0xffffffff)
+}
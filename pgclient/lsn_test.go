@@ -0,0 +1,40 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package pgclient
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("LSN", func() {
+	It("Parse and format", func() {
+		lsn, err := ParseLSN("16/B374D848")
+		Expect(err).Should(Succeed())
+		Expect(lsn).Should(Equal(uint64(0x16B374D848)))
+		Expect(FormatLSN(lsn)).Should(Equal("16/B374D848"))
+		lsn, err = ParseLSN("0/0")
+		Expect(err).Should(Succeed())
+		Expect(lsn).Should(BeZero())
+		Expect(FormatLSN(lsn)).Should(Equal("0/0"))
+
+		for _, in := range []string{"", "16", "16/", "/1", "G/1", "1/2/3",
+			"100000000/0", "16/B3zz", "16/B3 ", "+1/0", "0x1/0"} {
+			_, err = ParseLSN(in)
+			Expect(err).ShouldNot(Succeed())
+		}
+	})
+})
@@ -83,6 +83,7 @@ type PgType int
 
 // Constants for well-known OIDs that we care about
 const (
+	Bool        PgType = 16
 	Bytea       PgType = 17
 	Int8        PgType = 20
 	Int2        PgType = 21
@@ -20,7 +20,7 @@ package pgclient
 import "fmt"
 
 const (
-	_PgType_name_0 = "Bytea"
+	_PgType_name_0 = "BoolBytea"
 	_PgType_name_1 = "Int8Int2"
 	_PgType_name_2 = "Int4"
 	_PgType_name_3 = "OID"
@@ -30,7 +30,7 @@ const (
 )
 
 var (
-	_PgType_index_0 = [...]uint8{0, 5}
+	_PgType_index_0 = [...]uint8{0, 4, 9}
 	_PgType_index_1 = [...]uint8{0, 4, 8}
 	_PgType_index_2 = [...]uint8{0, 4}
 	_PgType_index_3 = [...]uint8{0, 3}
@@ -41,8 +41,9 @@ var (
 
 func (i PgType) String() string {
 	switch {
-	case i == 17:
-		return _PgType_name_0
+	case 16 <= i && i <= 17:
+		i -= 16
+		return _PgType_name_0[_PgType_index_0[i]:_PgType_index_0[i+1]]
 	case 20 <= i && i <= 21:
 		i -= 20
 		return _PgType_name_1[_PgType_index_1[i]:_PgType_index_1[i+1]]
@@ -0,0 +1,389 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package replication
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/apigee-labs/transicator/common"
+	"github.com/apigee-labs/transicator/pgclient"
+)
+
+// Types of the messages that the "pgoutput" plugin sends
+const (
+	pgoBegin    = 'B'
+	pgoCommit   = 'C'
+	pgoOrigin   = 'O'
+	pgoRelation = 'R'
+	pgoType     = 'Y'
+	pgoInsert   = 'I'
+	pgoUpdate   = 'U'
+	pgoDelete   = 'D'
+	pgoTruncate = 'T'
+)
+
+// Kinds of column values in "pgoutput" tuples
+const (
+	pgoNull      = 'n'
+	pgoUnchanged = 'u'
+	pgoText      = 't'
+)
+
+// unchangedToastValue is what the transicator plugin sends for a large
+// value that did not change, and which Postgres does not send again.
+const unchangedToastValue = "\"unchanged-toast-datum\""
+
+// Transaction IDs below this are special, and have no epoch
+const firstNormalXID = 3
+
+/*
+A pgRelation is what a "Relation" message tells us about a table. Postgres
+sends one before the first change to each table on each connection, and
+again whenever the table changes.
+*/
+type pgRelation struct {
+	table   string
+	columns []pgColumn
+}
+
+type pgColumn struct {
+	name  string
+	typ   pgclient.PgType
+	isKey bool
+}
+
+/*
+A pgOutputDecoder turns the binary messages of the "pgoutput" plugin,
+which is built in to Postgres 10 and later, into the same changes that
+the transicator plugin produces. Unlike the transicator plugin, pgoutput
+sends the commit LSN and the transaction ID once, at the start of each
+transaction, and describes each table once, so the decoder remembers them.
+Values arrive as text, and are converted to the same Go types that the
+transicator plugin uses for each Postgres type.
+*/
+type pgOutputDecoder struct {
+	xidConverter
+	relations map[int32]*pgRelation
+	commitLSN uint64
+	xid       uint64
+	timestamp int64
+	index     uint32
+}
+
+/*
+newPgOutputDecoder creates a decoder for one replication connection.
+"nextXID" is the next transaction ID including the epoch, as returned by
+"txid_current_snapshot," and it is used to add the epoch to the 32-bit
+transaction IDs that pgoutput sends.
+*/
+func newPgOutputDecoder(nextXID uint64) *pgOutputDecoder {
+	return &pgOutputDecoder{
+		xidConverter: xidConverter{lastXID: nextXID},
+		relations:    make(map[int32]*pgRelation),
+	}
+}
+
+/*
+decode reads one message. "lsn" is the WAL position of the message. It
+returns no changes, and no error, for messages that are not changes.
+*/
+func (d *pgOutputDecoder) decode(lsn int64, buf []byte) ([]*common.Change, error) {
+	if len(buf) == 0 {
+		return nil, fmt.Errorf("Empty pgoutput message")
+	}
+	m := pgclient.NewInputMessage(pgclient.PgInputType(buf[0]), buf[1:])
+
+	switch buf[0] {
+	case pgoBegin:
+		return nil, d.decodeBegin(m)
+	case pgoCommit:
+		return nil, nil
+	case pgoRelation:
+		return nil, d.decodeRelation(m)
+	case pgoInsert, pgoUpdate, pgoDelete:
+		c, err := d.decodeChange(buf[0], lsn, m)
+		if err != nil {
+			return nil, err
+		}
+		return []*common.Change{c}, nil
+	case pgoOrigin, pgoType:
+		return nil, nil
+	case pgoTruncate:
+		log.Warnf("Ignoring a TRUNCATE at LSN %d, which can't be replicated as changes", lsn)
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("Unknown pgoutput message type '%c'", buf[0])
+	}
+}
+
+func (d *pgOutputDecoder) decodeBegin(m *pgclient.InputMessage) error {
+	finalLSN, err := m.ReadInt64()
+	if err != nil {
+		return err
+	}
+	commitTime, err := m.ReadInt64()
+	if err != nil {
+		return err
+	}
+	xid, err := m.ReadInt32()
+	if err != nil {
+		return err
+	}
+
+	d.commitLSN = uint64(finalLSN)
+	d.timestamp = common.PgTimestampToTime(commitTime).Unix()
+	d.xid = d.convertXID(uint32(xid))
+	d.index = 0
+	return nil
+}
+
+func (d *pgOutputDecoder) decodeRelation(m *pgclient.InputMessage) error {
+	id, err := m.ReadInt32()
+	if err != nil {
+		return err
+	}
+	namespace, err := m.ReadString()
+	if err != nil {
+		return err
+	}
+	name, err := m.ReadString()
+	if err != nil {
+		return err
+	}
+	// Replica identity, which the tuples tell us about anyway
+	_, err = m.ReadByte()
+	if err != nil {
+		return err
+	}
+	numCols, err := m.ReadInt16()
+	if err != nil {
+		return err
+	}
+
+	rel := &pgRelation{
+		table:   tableName(namespace, name),
+		columns: make([]pgColumn, numCols),
+	}
+	for i := range rel.columns {
+		flags, err := m.ReadInt8()
+		if err != nil {
+			return err
+		}
+		colName, err := m.ReadString()
+		if err != nil {
+			return err
+		}
+		typ, err := m.ReadInt32()
+		if err != nil {
+			return err
+		}
+		// Type modifier
+		_, err = m.ReadInt32()
+		if err != nil {
+			return err
+		}
+		rel.columns[i] = pgColumn{
+			name:  colName,
+			typ:   pgclient.PgType(typ),
+			isKey: flags&1 != 0,
+		}
+	}
+
+	d.relations[id] = rel
+	return nil
+}
+
+func (d *pgOutputDecoder) decodeChange(
+	msgType byte, lsn int64, m *pgclient.InputMessage) (*common.Change, error) {
+
+	id, err := m.ReadInt32()
+	if err != nil {
+		return nil, err
+	}
+	rel := d.relations[id]
+	if rel == nil {
+		return nil, fmt.Errorf("Change for unknown relation %d", id)
+	}
+
+	c := &common.Change{
+		Table:          rel.table,
+		CommitSequence: d.commitLSN,
+		ChangeSequence: uint64(lsn),
+		CommitIndex:    d.index,
+		TransactionID:  d.xid,
+		Timestamp:      d.timestamp,
+	}
+	d.index++
+
+	switch msgType {
+	case pgoInsert:
+		c.Operation = common.Insert
+	case pgoUpdate:
+		c.Operation = common.Update
+	case pgoDelete:
+		c.Operation = common.Delete
+	}
+
+	for {
+		kind, err := m.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		row, err := rel.decodeTuple(m)
+		if err != nil {
+			return nil, err
+		}
+
+		switch kind {
+		case 'N':
+			// The new row always comes last
+			c.NewRow = row
+			return c, nil
+		case 'K', 'O':
+			// The key or the whole old row, depending on the replica identity
+			c.OldRow = row
+			if msgType == pgoDelete {
+				return c, nil
+			}
+		default:
+			return nil, fmt.Errorf("Unknown tuple type '%c'", kind)
+		}
+	}
+}
+
+/*
+decodeTuple reads the values of one row. Like the transicator plugin, it
+includes every column, with a nil value for columns that are null or
+that are not part of the key.
+*/
+func (rel *pgRelation) decodeTuple(m *pgclient.InputMessage) (common.Row, error) {
+	numCols, err := m.ReadInt16()
+	if err != nil {
+		return nil, err
+	}
+	if int(numCols) != len(rel.columns) {
+		return nil, fmt.Errorf("Tuple for %s has %d columns instead of %d",
+			rel.table, numCols, len(rel.columns))
+	}
+
+	row := make(common.Row, numCols)
+	for _, col := range rel.columns {
+		kind, err := m.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		cv := &common.ColumnVal{
+			Type: int32(col.typ),
+		}
+
+		switch kind {
+		case pgoNull:
+		case pgoUnchanged:
+			cv.Value = unchangedToastValue
+		case pgoText:
+			size, err := m.ReadInt32()
+			if err != nil {
+				return nil, err
+			}
+			if size < 0 || int(size) > len(m.ReadRemaining()) {
+				return nil, fmt.Errorf("Invalid length %d for %s", size, col.name)
+			}
+			val, err := m.ReadBytes(int(size))
+			if err != nil {
+				return nil, err
+			}
+			cv.Value = convertTextValue(col.typ, string(val))
+		default:
+			return nil, fmt.Errorf("Unknown value type '%c' for %s", kind, col.name)
+		}
+		row[col.name] = cv
+	}
+	return row, nil
+}
+
+/*
+convertTextValue turns the text form of a value into the same Go type as
+the transicator plugin uses: a bool, an int64, a float64, a byte slice, or
+a string for every other type.
+*/
+func convertTextValue(typ pgclient.PgType, s string) interface{} {
+	switch typ {
+	case pgclient.Bool:
+		return s == "t"
+	case pgclient.Int2, pgclient.Int4, pgclient.Int8, pgclient.OID:
+		if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+			return v
+		}
+	case pgclient.Float4, pgclient.Float8:
+		if v, err := strconv.ParseFloat(s, 64); err == nil {
+			return v
+		}
+	case pgclient.Bytea:
+		if strings.HasPrefix(s, "\\x") {
+			if v, err := hex.DecodeString(s[2:]); err == nil {
+				return v
+			}
+		}
+	}
+	return s
+}
+
+/*
+An xidConverter adds the epoch to the 32-bit transaction IDs that the
+built-in plugins send. It starts from the next transaction ID when the
+connection was made, and then follows the transactions that it sees.
+*/
+type xidConverter struct {
+	// The last transaction ID that we saw, including the epoch
+	lastXID uint64
+}
+
+/*
+convertXID adds the epoch to a 32-bit transaction ID, the same way that
+the transicator plugin does. Transactions are decoded in commit order, so
+each one is close to the one before, and it may be on either side of a
+wraparound.
+*/
+func (d *xidConverter) convertXID(xid uint32) uint64 {
+	if xid < firstNormalXID {
+		return uint64(xid)
+	}
+
+	epoch := d.lastXID >> 32
+	last := uint32(d.lastXID)
+	diff := int32(xid - last)
+	if xid > last && diff < 0 && epoch > 0 {
+		epoch--
+	} else if xid < last && diff > 0 {
+		epoch++
+	}
+
+	full := epoch<<32 | uint64(xid)
+	d.lastXID = full
+	return full
+}
+
+/*
+tableName returns the name of a table the way that the transicator plugin
+does, with the schema and with each part quoted when Postgres would quote it.
+*/
+func tableName(schema, table string) string {
+	return pgclient.QuoteIdentifier(schema, false) + "." + pgclient.QuoteIdentifier(table, false)
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package replication
+
+import (
+	"bufio"
+	"encoding/hex"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/apigee-labs/transicator/common"
+	"github.com/apigee-labs/transicator/pgclient"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const pgOutputTestFile = "./testfiles/pgoutput.txt"
+
+/*
+A testMessage is one line of a file of recorded plugin output, which has
+the WAL position of the message and then the message itself.
+*/
+type testMessage struct {
+	lsn  int64
+	data string
+}
+
+func readTestMessages(fileName string) []testMessage {
+	f, err := os.Open(fileName)
+	Expect(err).Should(Succeed())
+	defer f.Close()
+
+	var msgs []testMessage
+	scan := bufio.NewScanner(f)
+	scan.Buffer(nil, 1024*1024)
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		Expect(fields).Should(HaveLen(2))
+		lsn, err := pgclient.ParseLSN(fields[0])
+		Expect(err).Should(Succeed())
+		msgs = append(msgs, testMessage{
+			lsn:  int64(lsn),
+			data: fields[1],
+		})
+	}
+	Expect(scan.Err()).Should(Succeed())
+	return msgs
+}
+
+var _ = Describe("pgoutput decoding", func() {
+	// Messages are in hex, since they are binary
+	decodeFile := func(d *pgOutputDecoder) []*common.Change {
+		var changes []*common.Change
+		for _, m := range readTestMessages(pgOutputTestFile) {
+			buf, err := hex.DecodeString(m.data)
+			Expect(err).Should(Succeed())
+			c, err := d.decode(m.lsn, buf)
+			Expect(err).Should(Succeed())
+			changes = append(changes, c...)
+		}
+		return changes
+	}
+
+	It("Decode messages", func() {
+		d := newPgOutputDecoder(1<<32 | 990)
+		changes := decodeFile(d)
+		Expect(changes).Should(HaveLen(6))
+
+		commitTime, err := time.Parse(time.RFC3339, "2017-03-01T12:00:00Z")
+		Expect(err).Should(Succeed())
+
+		// First transaction: two inserts
+		c := changes[0]
+		Expect(c.Operation).Should(Equal(common.Insert))
+		Expect(c.Table).Should(Equal("public.transicator_test"))
+		Expect(c.CommitSequence).Should(BeEquivalentTo(0x16B3A40))
+		Expect(c.ChangeSequence).Should(BeEquivalentTo(0x16B3748))
+		Expect(c.CommitIndex).Should(BeEquivalentTo(0))
+		Expect(c.TransactionID).Should(BeEquivalentTo(1<<32 | 1000))
+		Expect(c.Timestamp).Should(Equal(commitTime.Unix()))
+		Expect(c.OldRow).Should(BeNil())
+		Expect(c.NewRow).Should(HaveLen(8))
+		Expect(c.NewRow["id"].Value).Should(Equal("one"))
+		Expect(c.NewRow["id"].Type).Should(BeEquivalentTo(1043))
+		Expect(c.NewRow["bool"].Value).Should(Equal(true))
+		Expect(c.NewRow["int"].Value).Should(Equal(int64(123)))
+		Expect(c.NewRow["bigint"].Value).Should(Equal(int64(-9000000000)))
+		Expect(c.NewRow["double"].Value).Should(Equal(3.5))
+		Expect(c.NewRow["rawdata"].Value).Should(Equal([]byte{1, 2, 0xff}))
+		Expect(c.NewRow["timestamp"].Value).Should(Equal("2017-03-01 12:00:00+00"))
+
+		c = changes[1]
+		Expect(c.Operation).Should(Equal(common.Insert))
+		Expect(c.CommitSequence).Should(BeEquivalentTo(0x16B3A40))
+		Expect(c.ChangeSequence).Should(BeEquivalentTo(0x16B3890))
+		Expect(c.CommitIndex).Should(BeEquivalentTo(1))
+		Expect(c.NewRow["bool"].Value).Should(Equal(false))
+		Expect(c.NewRow["int"].Value).Should(BeNil())
+		Expect(c.NewRow["int"].Type).Should(BeEquivalentTo(pgclient.Int4))
+
+		// Second transaction: two updates
+		c = changes[2]
+		Expect(c.Operation).Should(Equal(common.Update))
+		Expect(c.CommitSequence).Should(BeEquivalentTo(0x16B3C00))
+		Expect(c.CommitIndex).Should(BeEquivalentTo(0))
+		Expect(c.TransactionID).Should(BeEquivalentTo(1<<32 | 1001))
+		Expect(c.Timestamp).Should(Equal(commitTime.Unix() + 1))
+		Expect(c.OldRow["int"].Value).Should(Equal(int64(123)))
+		Expect(c.NewRow["int"].Value).Should(Equal(int64(124)))
+
+		c = changes[3]
+		Expect(c.Operation).Should(Equal(common.Update))
+		Expect(c.CommitIndex).Should(BeEquivalentTo(1))
+		Expect(c.OldRow).Should(BeNil())
+		Expect(c.NewRow["double"].Value).Should(Equal(1e10))
+		Expect(c.NewRow["rawdata"].Value).Should(Equal(unchangedToastValue))
+
+		// Third transaction: a table that must be quoted, and a delete
+		c = changes[4]
+		Expect(c.Operation).Should(Equal(common.Insert))
+		Expect(c.Table).Should(Equal("public.\"MixedCase\""))
+		Expect(c.CommitSequence).Should(BeEquivalentTo(0x16B3E00))
+		Expect(c.CommitIndex).Should(BeEquivalentTo(0))
+		Expect(c.TransactionID).Should(BeEquivalentTo(1<<32 | 1002))
+		Expect(c.NewRow["id"].Value).Should(Equal(int64(1)))
+		Expect(c.NewRow["val"].Value).Should(Equal("hello"))
+
+		c = changes[5]
+		Expect(c.Operation).Should(Equal(common.Delete))
+		Expect(c.Table).Should(Equal("public.transicator_test"))
+		Expect(c.ChangeSequence).Should(BeEquivalentTo(0x16B3D10))
+		Expect(c.CommitIndex).Should(BeEquivalentTo(1))
+		Expect(c.NewRow).Should(BeNil())
+		Expect(c.OldRow["id"].Value).Should(Equal("two"))
+		Expect(c.OldRow["testid"].Value).Should(BeNil())
+	})
+
+	It("Decode errors", func() {
+		d := newPgOutputDecoder(0)
+		_, err := d.decode(1, nil)
+		Expect(err).ShouldNot(Succeed())
+		_, err = d.decode(1, []byte("X"))
+		Expect(err).ShouldNot(Succeed())
+		// Relation 1 was never described
+		_, err = d.decode(1, []byte{'I', 0, 0, 0, 1, 'N', 0, 0})
+		Expect(err).ShouldNot(Succeed())
+		// Too short
+		_, err = d.decode(1, []byte{'B', 0, 0})
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("Transaction ID epochs", func() {
+		d := newPgOutputDecoder(1<<32 | 1000)
+		Expect(d.convertXID(1001)).Should(BeEquivalentTo(1<<32 | 1001))
+		// Decoding lags the current transaction ID
+		Expect(d.convertXID(900)).Should(BeEquivalentTo(1<<32 | 900))
+		Expect(d.convertXID(2)).Should(BeEquivalentTo(2))
+
+		d = newPgOutputDecoder(1<<32 | 0xfffffff0)
+		Expect(d.convertXID(5)).Should(BeEquivalentTo(2<<32 | 5))
+		Expect(d.convertXID(0xfffffff8)).Should(BeEquivalentTo(1<<32 | 0xfffffff8))
+
+		d = newPgOutputDecoder(1<<32 | 5)
+		Expect(d.convertXID(0xfffffff0)).Should(BeEquivalentTo(0xfffffff0))
+	})
+
+	It("Table names", func() {
+		Expect(tableName("public", "table_2")).Should(Equal("public.table_2"))
+		Expect(tableName("public", "MixedCase")).Should(Equal("public.\"MixedCase\""))
+		Expect(tableName("public", "2table")).Should(Equal("public.\"2table\""))
+		Expect(tableName("with space", "t")).Should(Equal("\"with space\".t"))
+		Expect(tableName("public", "a\"b")).Should(Equal("public.\"a\"\"b\""))
+	})
+})
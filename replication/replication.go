@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -41,6 +42,13 @@ const (
 	dropRetries = 10
 )
 
+// Logical decoding plugins that the replicator can read
+const (
+	TransicatorPlugin = "transicator_output"
+	PgOutputPlugin    = "pgoutput"
+	Wal2JSONPlugin    = "wal2json"
+)
+
 type replCommand int
 
 const (
@@ -65,14 +73,29 @@ const (
 	Stopped
 )
 
+/*
+A walDecoder turns the messages of a plugin other than the transicator
+plugin into changes. A message may hold any number of changes.
+*/
+type walDecoder interface {
+	decode(lsn int64, buf []byte) ([]*common.Change, error)
+}
+
 /*
 A Replicator is a client for the logical replication protocol.
 */
 type Replicator struct {
+	// Fields used with "atomic" come first so they are aligned
+	receivedLSN      uint64
+	serverLSN        uint64
 	slotName         string
 	rawConnectString string
 	connectString    string
 	filter           func(c *common.Change) bool
+	pluginName       string
+	formatVersion    int
+	publication      string
+	decoder          walDecoder
 	state            int32
 	stopWaiter       *sync.WaitGroup
 	changeChan       chan *common.Change
@@ -141,6 +164,63 @@ func (r *Replicator) SetChangeFilter(f func(*common.Change) bool) {
 	r.filter = f
 }
 
+/*
+SetPublication makes the replicator read the tables in a publication using
+the "pgoutput" plugin that is built in to Postgres 10 and later, instead
+of the transicator plugin, which can't be installed on some managed
+Postgres services. It must be called before Start, and the replication
+slot must use the "pgoutput" plugin too. "Start" creates the slot with the
+right plugin if it does not exist.
+*/
+func (r *Replicator) SetPublication(name string) {
+	r.publication = name
+}
+
+/*
+SetPlugin chooses the logical decoding plugin to read changes from. It
+may be TransicatorPlugin, which is the default, PgOutputPlugin, which
+also needs SetPublication, or Wal2JSONPlugin. "version" is the wal2json
+format version, which is 1 or 2, and it is ignored for the other plugins.
+Like SetPublication, it must be called before Start, and the replication
+slot must use the same plugin.
+*/
+func (r *Replicator) SetPlugin(name string, version int) error {
+	err := CheckPlugin(name, version)
+	if err != nil {
+		return err
+	}
+	r.pluginName = name
+	r.formatVersion = version
+	return nil
+}
+
+/*
+CheckPlugin returns an error if SetPlugin would not accept a plugin.
+*/
+func CheckPlugin(name string, version int) error {
+	switch name {
+	case TransicatorPlugin, PgOutputPlugin:
+		return nil
+	case Wal2JSONPlugin:
+		if version != 1 && version != 2 {
+			return fmt.Errorf("Invalid wal2json format version %d", version)
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unknown logical decoding plugin \"%s\"", name)
+	}
+}
+
+func (r *Replicator) plugin() string {
+	if r.pluginName != "" {
+		return r.pluginName
+	}
+	if r.publication != "" {
+		return PgOutputPlugin
+	}
+	return TransicatorPlugin
+}
+
 /*
 Start replication. Start will succeed even if the database cannot be
 reached.
@@ -155,6 +235,72 @@ func (r *Replicator) Start() {
 	}
 }
 
+/*
+CreateSlot creates the logical replication slot "sn" if it does not exist
+already. "Start" does this automatically, but calling it ahead of time
+makes Postgres keep every change from this point on, even before
+replication starts.
+"connect" is a postgres URL to be passed to the "pgclient" module.
+*/
+func CreateSlot(connect, sn string) error {
+	return CreatePluginSlot(connect, sn, TransicatorPlugin)
+}
+
+/*
+CreatePluginSlot is like CreateSlot, but it creates a slot for a
+replicator that uses another plugin, such as PgOutputPlugin.
+*/
+func CreatePluginSlot(connect, sn, plugin string) error {
+	slotName := strings.ToLower(sn)
+
+	ddb, err := sql.Open("transicator", connect)
+	if err != nil {
+		return err
+	}
+	defer ddb.Close()
+
+	row := ddb.QueryRow(
+		"select count(*) from pg_replication_slots where slot_name = $1", slotName)
+	var count int
+	err = row.Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	_, err = ddb.Exec(
+		"select * from pg_create_logical_replication_slot($1, $2)",
+		slotName, plugin)
+	return err
+}
+
+/*
+SlotPosition returns the LSN at which the replication slot named "sn" starts
+to decode changes. Transactions that committed before this point will never
+be delivered by the slot. This requires Postgres 9.6 or later.
+*/
+func SlotPosition(connect, sn string) (uint64, error) {
+	slotName := strings.ToLower(sn)
+
+	ddb, err := sql.Open("transicator", connect)
+	if err != nil {
+		return 0, err
+	}
+	defer ddb.Close()
+
+	row := ddb.QueryRow(
+		"select confirmed_flush_lsn::text from pg_replication_slots where slot_name = $1",
+		slotName)
+	var lsn string
+	err = row.Scan(&lsn)
+	if err != nil {
+		return 0, err
+	}
+	return pgclient.ParseLSN(lsn)
+}
+
 /*
 DropSlot deletes the logical replication slot created by "Start".
 "connect" is a postgres URL to be passed to the "pgclient" module.
@@ -221,6 +367,46 @@ func (r *Replicator) setState(s State) {
 	atomic.StoreInt32(&r.state, int32(s))
 }
 
+/*
+ReceivedLSN returns the WAL position up to which we have received and
+delivered every change from Postgres.
+*/
+func (r *Replicator) ReceivedLSN() uint64 {
+	return atomic.LoadUint64(&r.receivedLSN)
+}
+
+/*
+ServerLSN returns the WAL position that Postgres last told us about,
+either in a keepalive or along with a change.
+*/
+func (r *Replicator) ServerLSN() uint64 {
+	return atomic.LoadUint64(&r.serverLSN)
+}
+
+/*
+Lag returns the number of bytes of WAL between the position that Postgres
+last told us about and the position that we have received. It is zero
+if we are caught up.
+*/
+func (r *Replicator) Lag() uint64 {
+	server := r.ServerLSN()
+	received := r.ReceivedLSN()
+	if server > received {
+		return server - received
+	}
+	return 0
+}
+
+/*
+advanceLSN atomically raises "p" to "lsn" if it is higher. Only the read
+loop updates the positions, so a simple load and store is enough.
+*/
+func advanceLSN(p *uint64, lsn int64) {
+	if uint64(lsn) > atomic.LoadUint64(p) {
+		atomic.StoreUint64(p, uint64(lsn))
+	}
+}
+
 /*
 Acknowledge acknowledges to the server that we have committed a change, and
 will result in a message being sent back to the database to the same
@@ -251,10 +437,31 @@ func (r *Replicator) connect() (*pgclient.PgConnection, error) {
 		}
 	}()
 
-	slotCreated := false
-	startMsg := pgclient.NewOutputMessage(pgclient.Query)
 	startSQL :=
 		fmt.Sprintf("START_REPLICATION SLOT %s LOGICAL 0/0 (protobuf)", r.slotName)
+	r.decoder = nil
+	if r.plugin() != TransicatorPlugin {
+		// Other plugins send transaction IDs without the epoch
+		nextXID, err := readNextXID(conn)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading the transaction ID epoch: %s", err)
+		}
+
+		switch r.plugin() {
+		case PgOutputPlugin:
+			startSQL = fmt.Sprintf(
+				"START_REPLICATION SLOT %s LOGICAL 0/0 (proto_version '1', publication_names '%s')",
+				r.slotName, strings.Replace(r.publication, "'", "''", -1))
+			r.decoder = newPgOutputDecoder(nextXID)
+		case Wal2JSONPlugin:
+			startSQL = fmt.Sprintf("START_REPLICATION SLOT %s LOGICAL 0/0 (%s)",
+				r.slotName, wal2JSONOptions(r.formatVersion))
+			r.decoder = newWal2JSONDecoder(r.formatVersion, nextXID)
+		}
+	}
+
+	slotCreated := false
+	startMsg := pgclient.NewOutputMessage(pgclient.Query)
 	log.Debugf("Sending SQL to start replication: %s\n", startSQL)
 	startMsg.WriteString(startSQL)
 	err = conn.WriteMessage(startMsg)
@@ -277,7 +484,7 @@ func (r *Replicator) connect() (*pgclient.PgConnection, error) {
 
 				log.Debugf("Creating new replication slot %s", r.slotName)
 				_, _, err = conn.SimpleQuery(fmt.Sprintf(
-					"CREATE_REPLICATION_SLOT %s LOGICAL transicator_output", r.slotName))
+					"CREATE_REPLICATION_SLOT %s LOGICAL %s", r.slotName, r.plugin()))
 				if err != nil {
 					return nil, err
 				}
@@ -309,6 +516,22 @@ func (r *Replicator) connect() (*pgclient.PgConnection, error) {
 	}
 }
 
+/*
+readNextXID returns the next transaction ID, including the epoch, so that
+the decoders can add the epoch to transaction IDs. This needs Postgres 10
+or later, which accepts SQL on a replication connection.
+*/
+func readNextXID(conn *pgclient.PgConnection) (uint64, error) {
+	_, rows, err := conn.SimpleQuery("select txid_snapshot_xmax(txid_current_snapshot())")
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) != 1 || len(rows[0]) != 1 {
+		return 0, fmt.Errorf("Unexpected result reading the transaction ID")
+	}
+	return strconv.ParseUint(rows[0][0], 10, 64)
+}
+
 /*
 This is the main loop. It handles connecting and reconnecting, and then
 receives commands from the client and passes them on as appropriate.
@@ -552,42 +775,58 @@ func (r *Replicator) handleCopyData(m *pgclient.InputMessage) bool {
 }
 
 func (r *Replicator) handleWALData(m *pgclient.InputMessage) {
-	m.ReadInt64() // StartWAL
-	m.ReadInt64() // end WAL
+	startWAL, _ := m.ReadInt64()
+	endWAL, _ := m.ReadInt64()
 	m.ReadInt64() // Timestamp
 	buf := m.ReadRemaining()
 
-	var c *common.Change
+	var changes []*common.Change
 	var err error
 
-	if r.jsonMode {
-		c, err = common.UnmarshalChange(buf)
+	if r.decoder != nil {
+		changes, err = r.decoder.decode(startWAL, buf)
 	} else {
-		c, err = common.UnmarshalChangeProto(buf)
-		if err != nil {
-			// Defensive code in case we have an old version of the output plugin
-			// that does not understand the "protobuf" option.
+		var c *common.Change
+		if r.jsonMode {
 			c, err = common.UnmarshalChange(buf)
-			if err == nil {
-				log.Warn("Error decoding protobuf -- looks like Postgres is sending JSON")
-				r.jsonMode = true
+		} else {
+			c, err = common.UnmarshalChangeProto(buf)
+			if err != nil {
+				// Defensive code in case we have an old version of the output plugin
+				// that does not understand the "protobuf" option.
+				c, err = common.UnmarshalChange(buf)
+				if err == nil {
+					log.Warn("Error decoding protobuf -- looks like Postgres is sending JSON")
+					r.jsonMode = true
+				}
 			}
 		}
+		changes = []*common.Change{c}
 	}
 
 	if err == nil {
-		if r.filter == nil || r.filter(c) {
-			r.changeChan <- c
+		for _, c := range changes {
+			if r.filter == nil || r.filter(c) {
+				r.changeChan <- c
+			}
 		}
 	} else {
 		log.Warningf("Received invalid change %s: %s", string(buf), err)
 	}
+	advanceLSN(&r.receivedLSN, startWAL)
+	advanceLSN(&r.serverLSN, endWAL)
 }
 
 func (r *Replicator) handleKeepalive(m *pgclient.InputMessage) bool {
-	m.ReadInt64() // end WAL
+	endWAL, _ := m.ReadInt64()
 	m.ReadInt64() // Timestamp
 	replyNow, _ := m.ReadByte()
+	advanceLSN(&r.serverLSN, endWAL)
+	if len(r.changeChan) == 0 {
+		// Postgres sent every change before the keepalive, and the client
+		// has taken all of them, so we are caught up to this point.
+		advanceLSN(&r.receivedLSN, endWAL)
+	}
 	log.Debugf("Got heartbeat. Reply now = %d", replyNow)
 	if replyNow != 0 {
 		// Postgres 9.5 does this on a graceful shutdown, and never exits unless
@@ -29,4 +29,17 @@ var _ = Describe("Replication unit tests", func() {
 		nu = addParam("http://localhost?bar=baz", "foo", "bar")
 		Expect(nu).Should(Equal("http://localhost?bar=baz&foo=bar"))
 	})
+
+	It("Lag", func() {
+		r := &Replicator{}
+		Expect(r.Lag()).Should(BeZero())
+		advanceLSN(&r.serverLSN, 100)
+		Expect(r.Lag()).Should(BeEquivalentTo(100))
+		advanceLSN(&r.receivedLSN, 40)
+		Expect(r.Lag()).Should(BeEquivalentTo(60))
+		advanceLSN(&r.receivedLSN, 20)
+		Expect(r.ReceivedLSN()).Should(BeEquivalentTo(40))
+		advanceLSN(&r.receivedLSN, 120)
+		Expect(r.Lag()).Should(BeZero())
+	})
 })
@@ -0,0 +1,319 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package replication
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/apigee-labs/transicator/common"
+	"github.com/apigee-labs/transicator/pgclient"
+)
+
+// Postgres formats commit times like this, with or without minutes in the
+// time zone offset
+var wal2JSONTimeFormats = []string{
+	"2006-01-02 15:04:05.999999999-07",
+	"2006-01-02 15:04:05.999999999-07:00",
+}
+
+/*
+wal2JSONTransaction is a whole transaction in wal2json format version 1.
+*/
+type wal2JSONTransaction struct {
+	XID       uint32             `json:"xid"`
+	Timestamp string             `json:"timestamp"`
+	Changes   []wal2JSONChangeV1 `json:"change"`
+}
+
+type wal2JSONChangeV1 struct {
+	Kind           string        `json:"kind"`
+	Schema         string        `json:"schema"`
+	Table          string        `json:"table"`
+	ColumnNames    []string      `json:"columnnames"`
+	ColumnTypeOIDs []int32       `json:"columntypeoids"`
+	ColumnValues   []interface{} `json:"columnvalues"`
+	OldKeys        *struct {
+		KeyNames    []string      `json:"keynames"`
+		KeyTypeOIDs []int32       `json:"keytypeoids"`
+		KeyValues   []interface{} `json:"keyvalues"`
+	} `json:"oldkeys"`
+}
+
+/*
+wal2JSONAction is one message in wal2json format version 2, which is
+either the start or the end of a transaction, or a single change.
+*/
+type wal2JSONAction struct {
+	Action    string           `json:"action"`
+	XID       uint32           `json:"xid"`
+	Timestamp string           `json:"timestamp"`
+	NextLSN   string           `json:"nextlsn"`
+	Schema    string           `json:"schema"`
+	Table     string           `json:"table"`
+	Columns   []wal2JSONColumn `json:"columns"`
+	Identity  []wal2JSONColumn `json:"identity"`
+}
+
+type wal2JSONColumn struct {
+	Name    string      `json:"name"`
+	TypeOID int32       `json:"typeoid"`
+	Value   interface{} `json:"value"`
+}
+
+/*
+A wal2JSONDecoder turns the output of the "wal2json" plugin into the same
+changes that the transicator plugin produces. Format version 1 sends each
+transaction as one message, and version 2 sends the start and the end of
+each transaction, and each change, as separate messages.
+
+Neither version sends the LSN of the commit record the way the transicator
+plugin does, so the commit sequence of each change is the LSN of the end
+of the commit record instead. That is still in commit order.
+*/
+type wal2JSONDecoder struct {
+	xidConverter
+	version int
+	// The transaction that version 2 is in the middle of
+	commitLSN uint64
+	xid       uint64
+	timestamp int64
+	index     uint32
+}
+
+func newWal2JSONDecoder(version int, nextXID uint64) *wal2JSONDecoder {
+	return &wal2JSONDecoder{
+		xidConverter: xidConverter{lastXID: nextXID},
+		version:      version,
+	}
+}
+
+/*
+wal2JSONOptions returns the options for "START_REPLICATION" that make
+wal2json send everything that the decoder needs.
+*/
+func wal2JSONOptions(version int) string {
+	opts := `"include-xids" '1', "include-timestamp" '1', "include-type-oids" '1'`
+	if version == 2 {
+		opts = `"format-version" '2', "include-lsn" '1', ` + opts
+	}
+	return opts
+}
+
+/*
+decode reads one message. "lsn" is the WAL position of the message, which
+for format version 1 is the end of the commit record.
+*/
+func (d *wal2JSONDecoder) decode(lsn int64, buf []byte) ([]*common.Change, error) {
+	if d.version == 1 {
+		return d.decodeTransaction(lsn, buf)
+	}
+	c, err := d.decodeAction(lsn, buf)
+	if c == nil || err != nil {
+		return nil, err
+	}
+	return []*common.Change{c}, nil
+}
+
+func (d *wal2JSONDecoder) decodeTransaction(lsn int64, buf []byte) ([]*common.Change, error) {
+	var txn wal2JSONTransaction
+	err := unmarshalWal2JSON(buf, &txn)
+	if err != nil {
+		return nil, err
+	}
+	xid := d.convertXID(txn.XID)
+	timestamp, err := parseWal2JSONTime(txn.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []*common.Change
+	for _, wc := range txn.Changes {
+		c := &common.Change{
+			Table:          tableName(wc.Schema, wc.Table),
+			CommitSequence: uint64(lsn),
+			ChangeSequence: uint64(lsn),
+			CommitIndex:    uint32(len(changes)),
+			TransactionID:  xid,
+			Timestamp:      timestamp,
+		}
+
+		switch wc.Kind {
+		case "insert":
+			c.Operation = common.Insert
+		case "update":
+			c.Operation = common.Update
+		case "delete":
+			c.Operation = common.Delete
+		case "message":
+			continue
+		case "truncate":
+			log.Warnf("Ignoring a TRUNCATE of %s, which can't be replicated as changes", c.Table)
+			continue
+		default:
+			return nil, fmt.Errorf("Unknown wal2json change kind \"%s\"", wc.Kind)
+		}
+
+		if wc.ColumnNames != nil {
+			c.NewRow, err = makeWal2JSONRow(wc.ColumnNames, wc.ColumnTypeOIDs, wc.ColumnValues)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if wc.OldKeys != nil {
+			c.OldRow, err = makeWal2JSONRow(wc.OldKeys.KeyNames, wc.OldKeys.KeyTypeOIDs, wc.OldKeys.KeyValues)
+			if err != nil {
+				return nil, err
+			}
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+func (d *wal2JSONDecoder) decodeAction(lsn int64, buf []byte) (*common.Change, error) {
+	var a wal2JSONAction
+	err := unmarshalWal2JSON(buf, &a)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &common.Change{
+		Table:          tableName(a.Schema, a.Table),
+		CommitSequence: d.commitLSN,
+		ChangeSequence: uint64(lsn),
+		CommitIndex:    d.index,
+		TransactionID:  d.xid,
+		Timestamp:      d.timestamp,
+	}
+
+	switch a.Action {
+	case "B":
+		if a.NextLSN == "" {
+			return nil, fmt.Errorf("wal2json did not send the \"nextlsn\" of a transaction")
+		}
+		d.commitLSN, err = pgclient.ParseLSN(a.NextLSN)
+		if err != nil {
+			return nil, err
+		}
+		d.timestamp, err = parseWal2JSONTime(a.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		d.xid = d.convertXID(a.XID)
+		d.index = 0
+		return nil, nil
+	case "C", "M":
+		return nil, nil
+	case "T":
+		log.Warnf("Ignoring a TRUNCATE of %s, which can't be replicated as changes", c.Table)
+		return nil, nil
+	case "I":
+		c.Operation = common.Insert
+	case "U":
+		c.Operation = common.Update
+	case "D":
+		c.Operation = common.Delete
+	default:
+		return nil, fmt.Errorf("Unknown wal2json action \"%s\"", a.Action)
+	}
+	d.index++
+
+	if a.Columns != nil {
+		c.NewRow = makeWal2JSONColumns(a.Columns)
+	}
+	if a.Identity != nil {
+		c.OldRow = makeWal2JSONColumns(a.Identity)
+	}
+	return c, nil
+}
+
+/*
+unmarshalWal2JSON keeps numbers as text, so that large integers don't lose
+precision on the way to an int64.
+*/
+func unmarshalWal2JSON(buf []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	err := dec.Decode(v)
+	if err != nil {
+		return fmt.Errorf("Invalid wal2json message: %s", err)
+	}
+	return nil
+}
+
+func makeWal2JSONRow(names []string, oids []int32, values []interface{}) (common.Row, error) {
+	if len(values) != len(names) || (oids != nil && len(oids) != len(names)) {
+		return nil, fmt.Errorf("wal2json sent %d column names, %d types, and %d values",
+			len(names), len(oids), len(values))
+	}
+	row := make(common.Row, len(names))
+	for i, name := range names {
+		var typ pgclient.PgType
+		if oids != nil {
+			typ = pgclient.PgType(oids[i])
+		}
+		row[name] = &common.ColumnVal{
+			Value: convertWal2JSONValue(typ, values[i]),
+			Type:  int32(typ),
+		}
+	}
+	return row, nil
+}
+
+func makeWal2JSONColumns(cols []wal2JSONColumn) common.Row {
+	row := make(common.Row, len(cols))
+	for _, col := range cols {
+		typ := pgclient.PgType(col.TypeOID)
+		row[col.Name] = &common.ColumnVal{
+			Value: convertWal2JSONValue(typ, col.Value),
+			Type:  int32(typ),
+		}
+	}
+	return row
+}
+
+/*
+convertWal2JSONValue converts a value to the same Go type as the
+transicator plugin uses. wal2json sends numbers and booleans as JSON, and
+every other value as a string in the Postgres text format.
+*/
+func convertWal2JSONValue(typ pgclient.PgType, v interface{}) interface{} {
+	switch val := v.(type) {
+	case json.Number:
+		return convertTextValue(typ, val.String())
+	case string:
+		return convertTextValue(typ, val)
+	default:
+		return v
+	}
+}
+
+func parseWal2JSONTime(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	for _, layout := range wal2JSONTimeFormats {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, fmt.Errorf("Invalid wal2json timestamp \"%s\"", s)
+}
@@ -0,0 +1,171 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package replication
+
+import (
+	"time"
+
+	"github.com/apigee-labs/transicator/common"
+	"github.com/apigee-labs/transicator/pgclient"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	wal2JSONV1TestFile = "./testfiles/wal2json-v1.txt"
+	wal2JSONV2TestFile = "./testfiles/wal2json-v2.txt"
+)
+
+var _ = Describe("wal2json decoding", func() {
+	decodeFile := func(d *wal2JSONDecoder, fileName string) []*common.Change {
+		var changes []*common.Change
+		for _, m := range readTestMessages(fileName) {
+			c, err := d.decode(m.lsn, []byte(m.data))
+			Expect(err).Should(Succeed())
+			changes = append(changes, c...)
+		}
+		return changes
+	}
+
+	// Both versions of the test file contain the same transactions
+	verifyChanges := func(changes []*common.Change) {
+		Expect(changes).Should(HaveLen(6))
+
+		commitTime, err := time.Parse(time.RFC3339, "2017-03-01T12:00:00Z")
+		Expect(err).Should(Succeed())
+
+		// First transaction: two inserts
+		c := changes[0]
+		Expect(c.Operation).Should(Equal(common.Insert))
+		Expect(c.Table).Should(Equal("public.transicator_test"))
+		Expect(c.CommitSequence).Should(BeEquivalentTo(0x16B3A70))
+		Expect(c.CommitIndex).Should(BeEquivalentTo(0))
+		Expect(c.TransactionID).Should(BeEquivalentTo(1<<32 | 1000))
+		Expect(c.Timestamp).Should(Equal(commitTime.Unix()))
+		Expect(c.OldRow).Should(BeNil())
+		Expect(c.NewRow).Should(HaveLen(8))
+		Expect(c.NewRow["id"].Value).Should(Equal("one"))
+		Expect(c.NewRow["id"].Type).Should(BeEquivalentTo(1043))
+		Expect(c.NewRow["bool"].Value).Should(Equal(true))
+		Expect(c.NewRow["bool"].Type).Should(BeEquivalentTo(pgclient.Bool))
+		Expect(c.NewRow["int"].Value).Should(Equal(int64(123)))
+		Expect(c.NewRow["bigint"].Value).Should(Equal(int64(-9000000000)))
+		Expect(c.NewRow["double"].Value).Should(Equal(3.5))
+		Expect(c.NewRow["rawdata"].Value).Should(Equal([]byte{1, 2, 0xff}))
+		Expect(c.NewRow["timestamp"].Value).Should(Equal("2017-03-01 12:00:00+00"))
+
+		c = changes[1]
+		Expect(c.Operation).Should(Equal(common.Insert))
+		Expect(c.CommitSequence).Should(BeEquivalentTo(0x16B3A70))
+		Expect(c.CommitIndex).Should(BeEquivalentTo(1))
+		Expect(c.NewRow["bool"].Value).Should(Equal(false))
+		Expect(c.NewRow["int"].Value).Should(BeNil())
+		Expect(c.NewRow["int"].Type).Should(BeEquivalentTo(pgclient.Int4))
+		// Too big for a float64 without losing precision
+		Expect(c.NewRow["bigint"].Value).Should(Equal(int64(9000000000000000001)))
+
+		// Second transaction: two updates
+		c = changes[2]
+		Expect(c.Operation).Should(Equal(common.Update))
+		Expect(c.CommitSequence).Should(BeEquivalentTo(0x16B3C30))
+		Expect(c.CommitIndex).Should(BeEquivalentTo(0))
+		Expect(c.TransactionID).Should(BeEquivalentTo(1<<32 | 1001))
+		Expect(c.Timestamp).Should(Equal(commitTime.Unix() + 1))
+		Expect(c.OldRow["int"].Value).Should(Equal(int64(123)))
+		Expect(c.NewRow["int"].Value).Should(Equal(int64(124)))
+
+		c = changes[3]
+		Expect(c.Operation).Should(Equal(common.Update))
+		Expect(c.CommitIndex).Should(BeEquivalentTo(1))
+		Expect(c.OldRow).Should(BeNil())
+		Expect(c.NewRow["double"].Value).Should(Equal(1e10))
+
+		// Third transaction: a table that must be quoted, and a delete
+		c = changes[4]
+		Expect(c.Operation).Should(Equal(common.Insert))
+		Expect(c.Table).Should(Equal("public.\"MixedCase\""))
+		Expect(c.CommitSequence).Should(BeEquivalentTo(0x16B3E30))
+		Expect(c.CommitIndex).Should(BeEquivalentTo(0))
+		Expect(c.TransactionID).Should(BeEquivalentTo(1<<32 | 1002))
+		// The commit time has a different time zone
+		Expect(c.Timestamp).Should(Equal(commitTime.Unix() + 2))
+		Expect(c.NewRow["id"].Value).Should(Equal(int64(1)))
+		Expect(c.NewRow["val"].Value).Should(Equal("hello"))
+
+		c = changes[5]
+		Expect(c.Operation).Should(Equal(common.Delete))
+		Expect(c.Table).Should(Equal("public.transicator_test"))
+		Expect(c.CommitIndex).Should(BeEquivalentTo(1))
+		Expect(c.NewRow).Should(BeNil())
+		Expect(c.OldRow).Should(HaveLen(1))
+		Expect(c.OldRow["id"].Value).Should(Equal("two"))
+	}
+
+	It("Format version 1", func() {
+		changes := decodeFile(newWal2JSONDecoder(1, 1<<32|990), wal2JSONV1TestFile)
+		verifyChanges(changes)
+		// Each transaction is one message, sent at the end of the commit
+		for _, c := range changes {
+			Expect(c.ChangeSequence).Should(Equal(c.CommitSequence))
+		}
+	})
+
+	It("Format version 2", func() {
+		changes := decodeFile(newWal2JSONDecoder(2, 1<<32|990), wal2JSONV2TestFile)
+		verifyChanges(changes)
+		Expect(changes[0].ChangeSequence).Should(BeEquivalentTo(0x16B3748))
+		Expect(changes[5].ChangeSequence).Should(BeEquivalentTo(0x16B3D10))
+	})
+
+	It("Decode errors", func() {
+		d := newWal2JSONDecoder(1, 0)
+		_, err := d.decode(1, []byte("{"))
+		Expect(err).ShouldNot(Succeed())
+		_, err = d.decode(1, []byte(`{"xid":1,"timestamp":"yesterday","change":[]}`))
+		Expect(err).ShouldNot(Succeed())
+		_, err = d.decode(1, []byte(`{"xid":1,"change":[{"kind":"upsert"}]}`))
+		Expect(err).ShouldNot(Succeed())
+		_, err = d.decode(1, []byte(
+			`{"xid":1,"change":[{"kind":"insert","columnnames":["a","b"],"columnvalues":[1]}]}`))
+		Expect(err).ShouldNot(Succeed())
+
+		d = newWal2JSONDecoder(2, 0)
+		_, err = d.decode(1, []byte(`{"action":"X"}`))
+		Expect(err).ShouldNot(Succeed())
+		// Without "include-lsn" there is no commit sequence
+		_, err = d.decode(1, []byte(`{"action":"B","xid":1}`))
+		Expect(err).ShouldNot(Succeed())
+		_, err = d.decode(1, []byte(`{"action":"B","xid":1,"nextlsn":"nope"}`))
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	It("Options", func() {
+		Expect(wal2JSONOptions(1)).ShouldNot(ContainSubstring("format-version"))
+		Expect(wal2JSONOptions(2)).Should(ContainSubstring(`"format-version" '2'`))
+		Expect(wal2JSONOptions(2)).Should(ContainSubstring(`"include-lsn" '1'`))
+	})
+
+	It("Plugin setting", func() {
+		r := &Replicator{}
+		Expect(r.plugin()).Should(Equal(TransicatorPlugin))
+		r.SetPublication("pub")
+		Expect(r.plugin()).Should(Equal(PgOutputPlugin))
+		Expect(r.SetPlugin(Wal2JSONPlugin, 2)).Should(Succeed())
+		Expect(r.plugin()).Should(Equal(Wal2JSONPlugin))
+		Expect(r.SetPlugin(Wal2JSONPlugin, 3)).ShouldNot(Succeed())
+		Expect(r.SetPlugin("decoderbufs", 0)).ShouldNot(Succeed())
+	})
+})
@@ -44,6 +44,14 @@ func SetConfigDefaults() {
 	pflag.StringP("selectorcolumn", "S", "", "Set selector column")
 	viper.SetDefault("selectorColumn", defaultSelectorColumn)
 
+	pflag.String("policy", "", "YAML file listing columns to drop or hash")
+	viper.SetDefault("policyFile", "")
+
+	pflag.String("hmackey", "", "File containing the secret for HMAC-signed bearer tokens")
+	viper.SetDefault("hmacKeyFile", "")
+	pflag.String("rsakey", "", "PEM file containing the public key for RSA-signed bearer tokens")
+	viper.SetDefault("rsaKeyFile", "")
+
 	pflag.StringP("tempdir", "T", "", "Set temporary directory for snapshot files")
 	viper.SetDefault("tempdir", defaultTempDir)
 
@@ -80,6 +88,9 @@ func getConfig() error {
 	viper.BindPFlag("help", pflag.Lookup("help"))
 	viper.BindPFlag("selectorColumn", pflag.Lookup("selectorcolumn"))
 	viper.BindPFlag("tempdir", pflag.Lookup("tempdir"))
+	viper.BindPFlag("policyFile", pflag.Lookup("policy"))
+	viper.BindPFlag("hmacKeyFile", pflag.Lookup("hmackey"))
+	viper.BindPFlag("rsaKeyFile", pflag.Lookup("rsakey"))
 
 	viper.SetConfigName(appName)
 	// Load config values from file
@@ -29,6 +29,7 @@ const (
 	unsupportedMediaType errorCode = iota
 	serverError          errorCode = iota
 	invalidRequestParam  errorCode = iota
+	forbiddenScope       errorCode = iota
 )
 
 func sendAPIError(code errorCode, description string,
@@ -38,6 +39,18 @@ func sendAPIError(code errorCode, description string,
 	common.SendAPIError(ec, em, description, sc, resp, req)
 }
 
+/*
+sendParamError sends the right error for a problem with the query
+parameters, which is a 403 if the client may not use a selector.
+*/
+func sendParamError(err error, resp http.ResponseWriter, req *http.Request) {
+	if _, ok := err.(*common.SelectorAccessError); ok {
+		sendAPIError(forbiddenScope, err.Error(), resp, req)
+	} else {
+		sendAPIError(invalidRequestParam, err.Error(), resp, req)
+	}
+}
+
 func (e errorCode) errInfo() (string, string, int) {
 	switch e {
 	case missingScope:
@@ -48,6 +61,8 @@ func (e errorCode) errInfo() (string, string, int) {
 		return "INTERNAL_SERVER_ERROR", "An error occurred in the server", http.StatusInternalServerError
 	case invalidRequestParam:
 		return "INVALID_REQUEST_PARAM", "An invalid param was in the request", http.StatusBadRequest
+	case forbiddenScope:
+		return "FORBIDDEN", "The client may not access the requested scope", http.StatusForbidden
 	default:
 		return "UNKNOWN", "An unknown error occurred", http.StatusInternalServerError
 	}
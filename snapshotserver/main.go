@@ -24,6 +24,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/apid/goscaffold"
+	"github.com/apigee-labs/transicator/common"
 	"github.com/apigee-labs/transicator/pgclient"
 	"github.com/julienschmidt/httprouter"
 	"github.com/spf13/viper"
@@ -79,6 +80,9 @@ func Run() (*goscaffold.HTTPScaffold, error) {
 	debug := viper.GetBool("debug")
 	selectorColumn = viper.GetString("selectorColumn")
 	tempSnapshotDir = viper.GetString("tempdir")
+	policyFile := viper.GetString("policyFile")
+	hmacKeyFile := viper.GetString("hmacKeyFile")
+	rsaKeyFile := viper.GetString("rsaKeyFile")
 
 	cml := viper.GetInt("connMaxLife")
 	mic := viper.GetInt("maxIdleConns")
@@ -95,6 +99,23 @@ func Run() (*goscaffold.HTTPScaffold, error) {
 		log.SetLevel(log.DebugLevel)
 	}
 
+	if policyFile != "" {
+		columnPolicy, err = common.LoadColumnPolicy(policyFile)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Loaded column policy from %s", policyFile)
+	}
+
+	var tokenVerifier *common.TokenVerifier
+	if hmacKeyFile != "" || rsaKeyFile != "" {
+		tokenVerifier, err = common.CreateTokenVerifier(hmacKeyFile, rsaKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		log.Info("Bearer tokens are required on all API calls")
+	}
+
 	log.Infof("Connecting to Postgres DB %s\n", pgURL)
 	mainDB, err = sql.Open("transicator", pgURL)
 	if err != nil {
@@ -166,7 +187,12 @@ func Run() (*goscaffold.HTTPScaffold, error) {
 	})
 	scaf.SetMarkdown("GET", "/markdown", nil)
 
-	err = scaf.StartListen(router)
+	var handler http.Handler = router
+	if tokenVerifier != nil {
+		handler = tokenVerifier.Handler(router)
+	}
+
+	err = scaf.StartListen(handler)
 	return scaf, err
 }
 
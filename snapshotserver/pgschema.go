@@ -22,6 +22,8 @@ type pgColumn struct {
 	name       string
 	typid      int
 	primaryKey bool
+	// hashed is set when the column policy hashes the column
+	hashed bool
 }
 
 // A pgTable describes a table
@@ -0,0 +1,171 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package snapshotserver
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/apigee-labs/transicator/common"
+	"github.com/apigee-labs/transicator/pgclient"
+)
+
+// columnPolicy lists columns to drop or hash before rows are returned.
+// It must be the same as the policy given to the change server.
+var columnPolicy *common.ColumnPolicy
+
+/*
+policyColumns returns the columns that we will read from a table
+for a snapshot of the specified selectors.
+Tables that have a column policy are read one selector at a time, so
+that we always know which rules apply to each row, even if the selector
+column itself is dropped. Every row of a table in a snapshot has the same
+set of columns, however, so if the rules are different for each selector,
+then a column is left out only if it is dropped for all the selectors,
+and it is read as text if it is hashed for any of them. Reading hashed
+columns as text from Postgres ensures that we hash exactly the same
+string that the change server sees in the replication stream.
+*/
+func policyColumns(table string, cols []pgColumn, scopes []string) []pgColumn {
+	var pcs []pgColumn
+
+	for _, col := range cols {
+		dropped := true
+		for _, scope := range scopes {
+			switch columnPolicy.Action(table, scope, col.name) {
+			case common.KeepColumn:
+				dropped = false
+			case common.HashColumn:
+				dropped = false
+				col.hashed = true
+			}
+		}
+		if dropped {
+			continue
+		}
+		if col.hashed {
+			col.typid = common.TextType
+		}
+		pcs = append(pcs, col)
+	}
+	return pcs
+}
+
+/*
+applyTablePolicy changes the description of a table so that it describes
+what we will actually put in the snapshot. If any column of the primary key
+is dropped, then there is no primary key any more.
+*/
+func applyTablePolicy(t *pgTable, scopes []string) {
+	table := t.schema + "." + t.name
+	t.columns = policyColumns(table, t.columns, scopes)
+
+	for _, pk := range t.primaryKeys {
+		found := false
+		for _, col := range t.columns {
+			if col.name == pk {
+				found = true
+			}
+		}
+		if !found {
+			log.Debugf("Primary key of %s removed by column policy", table)
+			t.primaryKeys = nil
+			return
+		}
+	}
+}
+
+/*
+getPolicyColumns finds out what columns we will read from a table that
+is not described by a pgTable. It returns the same error as a regular
+snapshot query if the table has no selector column.
+*/
+func getPolicyColumns(db *sql.DB, table string, scopes []string) ([]pgColumn, error) {
+	q := fmt.Sprintf("select * from %s where %s in %s limit 0",
+		table, selectorColumn, GetTenants(scopes))
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names, types, err := parseColumnNames(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	var cols []pgColumn
+	for i := range names {
+		col := pgColumn{
+			name:  names[i],
+			typid: int(types[i]),
+		}
+		cols = append(cols, col)
+	}
+	return policyColumns(table, cols, scopes), nil
+}
+
+/*
+makePolicySQL returns a query that reads the rows of a table for a single
+selector, converting hashed columns to text. The selector is the query's
+only parameter. Column names are always quoted, since they come from
+Postgres and may be mixed-case or reserved words.
+*/
+func makePolicySQL(table string, cols []pgColumn) string {
+	s := &bytes.Buffer{}
+	s.WriteString("select ")
+	for i, col := range cols {
+		if i > 0 {
+			s.WriteString(",")
+		}
+		name := pgclient.QuoteIdentifier(col.name, true)
+		if col.hashed {
+			s.WriteString(fmt.Sprintf("%s::text as %s", name, name))
+		} else {
+			s.WriteString(name)
+		}
+	}
+	s.WriteString(fmt.Sprintf(" from %s where %s = $1", table, selectorColumn))
+	return s.String()
+}
+
+/*
+policyValue returns the value that goes in the snapshot for a single column
+of a row with the specified selector. Values of columns that are only
+dropped for some selectors are null.
+*/
+func policyValue(table, scope string, col pgColumn, v interface{}) interface{} {
+	switch columnPolicy.Action(table, scope, col.name) {
+	case common.DropColumn:
+		return nil
+	case common.HashColumn:
+		switch v.(type) {
+		case *interface{}:
+			v = *(v.(*interface{}))
+		case **string:
+			if sp := *(v.(**string)); sp == nil {
+				v = nil
+			} else {
+				v = *sp
+			}
+		}
+		return columnPolicy.HashValue(&common.ColumnVal{Value: v}).Value
+	default:
+		return v
+	}
+}
@@ -0,0 +1,33 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package snapshotserver
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Column policy", func() {
+	It("Policy SQL", func() {
+		cols := []pgColumn{
+			{name: "id"},
+			{name: "MixedCase"},
+			{name: "user", hashed: true},
+		}
+		Expect(makePolicySQL("public.policy_test", cols)).Should(Equal(
+			`select "id","MixedCase","user"::text as "user" from public.policy_test where _change_selector = $1`))
+	})
+})
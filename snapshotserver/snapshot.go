@@ -78,6 +78,11 @@ func GetScopes(
 		log.Errorf("apidclusterId Missing, Request Ignored")
 		return
 	}
+	err := common.CheckSelectors(r, []string{cid})
+	if err != nil {
+		sendParamError(err, w, r)
+		return
+	}
 
 	data, err := GetScopeData(cid, db)
 	if err != nil {
@@ -166,31 +171,86 @@ func fillTable(rows *sql.Rows, snapData *common.Snapshot, table string) (err err
 	}
 
 	for rows.Next() {
-		srvItem := common.Row{}
-		cols := make([]interface{}, len(columnNames))
-		for i := range cols {
-			cols[i] = new(interface{})
-		}
-		err = rows.Scan(cols...)
+		srvItem, err := scanRow(rows, columnNames, columnTypes)
 		if err != nil {
 			log.Errorf("Failed to get tenant data  in Table %s : %+v", table, err)
 			return err
 		}
+		stdItem.AddRowstoTable(srvItem)
+	}
+	snapData.AddTables(stdItem)
+	return nil
+}
+
+/*
+fillPolicyTable is like fillTable, but for a table that has a column
+policy. It reads the rows for each selector separately and applies
+the policy to each one.
+*/
+func fillPolicyTable(
+	db *sql.DB, snapData *common.Snapshot,
+	table string, tenantID []string) error {
+
+	cols, err := getPolicyColumns(db, table, tenantID)
+	if err != nil {
+		return err
+	}
+
+	stdItem := common.Table{
+		Rows: []common.Row{},
+		Name: table,
+	}
+
+	for _, scope := range tenantID {
+		rows, err := db.Query(makePolicySQL(table, cols), scope)
+		if err != nil {
+			return err
+		}
 
-		for i, cv := range cols {
-			cvp := cv.(*interface{})
-			scv := &common.ColumnVal{
-				Value: *cvp,
-				Type:  columnTypes[i],
+		columnNames, columnTypes, err := parseColumnNames(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		for rows.Next() {
+			srvItem, err := scanRow(rows, columnNames, columnTypes)
+			if err != nil {
+				rows.Close()
+				return err
 			}
-			srvItem[columnNames[i]] = scv
+			columnPolicy.ApplyRow(table, scope, srvItem)
+			stdItem.AddRowstoTable(srvItem)
 		}
-		stdItem.AddRowstoTable(srvItem)
+		rows.Close()
 	}
+
 	snapData.AddTables(stdItem)
 	return nil
 }
 
+func scanRow(rows *sql.Rows, columnNames []string, columnTypes []int32) (common.Row, error) {
+	cols := make([]interface{}, len(columnNames))
+	for i := range cols {
+		cols[i] = new(interface{})
+	}
+	err := rows.Scan(cols...)
+	if err != nil {
+		return nil, err
+	}
+
+	row := common.Row{}
+	for i, cv := range cols {
+		cvp := cv.(*interface{})
+		scv := &common.ColumnVal{
+			Value: *cvp,
+			Type:  columnTypes[i],
+		}
+		row[columnNames[i]] = scv
+	}
+	return row, nil
+}
+
 /*
 GetTenantSnapshotData pulls the snapshot for a given set of tenants and sends
 them back to a response writer.
@@ -254,6 +314,19 @@ func writeJSONSnapshot(
 	db *sql.DB, w io.Writer) error {
 
 	for _, tn := range tables {
+		if columnPolicy.HasTable(tn) {
+			err := fillPolicyTable(db, snapData, tn, tenantID)
+			if err != nil {
+				if strings.Contains(err.Error(), "errorMissingColumn") {
+					log.Debugf("Skipping table %s: no %s column", tn, selectorColumn)
+					continue
+				}
+				log.Errorf("Failed to get tenant data in Table %s : %+v", tn, err)
+				return err
+			}
+			continue
+		}
+
 		// Postgres won't let us parameterize the table name here, and we don't
 		// know how to parameterize the list in the "in" parameter
 		q := fmt.Sprintf("select * from %s where %s in %s",
@@ -291,6 +364,19 @@ func writeProtoSnapshot(
 	}
 
 	for _, t := range tables {
+		if columnPolicy.HasTable(t) {
+			err = writeProtoPolicyTable(sw, t, tenantID, db)
+			if err != nil {
+				if strings.Contains(err.Error(), "errorMissingColumn") {
+					log.Debugf("Skipping table %s: no %s column", t, selectorColumn)
+					continue
+				}
+				log.Errorf("Failed to get tenant data in Table %s : %+v", t, err)
+				return err
+			}
+			continue
+		}
+
 		q := fmt.Sprintf("select * from %s where %s in %s", t, selectorColumn, GetTenants(tenantID))
 		rows, err := db.Query(q)
 		if err != nil {
@@ -354,6 +440,66 @@ func writeProtoSnapshot(
 	return nil
 }
 
+/*
+writeProtoPolicyTable writes a single table that has a column policy,
+one selector at a time.
+*/
+func writeProtoPolicyTable(
+	sw *common.SnapshotWriter, t string, tenantID []string,
+	db *sql.DB) error {
+
+	pcs, err := getPolicyColumns(db, t, tenantID)
+	if err != nil {
+		return err
+	}
+
+	var cis []common.ColumnInfo
+	for _, pc := range pcs {
+		ci := common.ColumnInfo{
+			Name: pc.name,
+			Type: int32(pc.typid),
+		}
+		cis = append(cis, ci)
+	}
+
+	err = sw.StartTable(t, cis)
+	if err != nil {
+		return err
+	}
+
+	for _, scope := range tenantID {
+		rows, err := db.Query(makePolicySQL(t, pcs), scope)
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			cols := make([]interface{}, len(pcs))
+			for i := range cols {
+				cols[i] = new(interface{})
+			}
+			err = rows.Scan(cols...)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+
+			for i, pc := range pcs {
+				cols[i] = policyValue(t, scope, pc, cols[i])
+			}
+
+			err = sw.WriteRow(cols)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+	}
+
+	return sw.EndTable()
+}
+
 func getSchemaAndTableNames(db *sql.DB) ([]string, error) {
 	nameRows, err := db.Query(`
 		SELECT table_schema, table_name FROM information_schema.tables
@@ -421,7 +567,7 @@ func GenSnapshot(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	changeSelectorInput, err := getCheckChangeSelectorParams(r)
 	if err != nil {
-		sendAPIError(invalidRequestParam, err.Error(), w, r)
+		sendParamError(err, w, r)
 		return
 	}
 	if len(changeSelectorInput) == 0 {
@@ -460,7 +606,7 @@ func DownloadSnapshot(
 	db *sql.DB, p httprouter.Params) {
 	scopes, err := getCheckChangeSelectorParams(r)
 	if err != nil {
-		sendAPIError(invalidRequestParam, err.Error(), w, r)
+		sendParamError(err, w, r)
 		return
 	}
 	if len(scopes) == 0 {
@@ -503,7 +649,8 @@ func DownloadSnapshot(
 /*
 getChangeSelectorParams combines all 'scope' and 'selector' query
 params into one slice after checking for valid characters. The
-'selector' query param is an alias for 'scope'
+'selector' query param is an alias for 'scope'. A SelectorAccessError
+is returned if the client's token does not allow any of them.
 */
 func getCheckChangeSelectorParams(r *http.Request) ([]string, error) {
 	scopes := r.URL.Query()["scope"]
@@ -518,5 +665,10 @@ func getCheckChangeSelectorParams(r *http.Request) ([]string, error) {
 			return nil, errors.New("Invalid char in selector param")
 		}
 	}
-	return append(scopes, selectors...), nil
+	all := append(scopes, selectors...)
+	err := common.CheckSelectors(r, all)
+	if err != nil {
+		return nil, err
+	}
+	return all, nil
 }
@@ -75,6 +75,12 @@ func WriteSqliteSnapshot(scopes []string, db *sql.DB, w http.ResponseWriter, r *
 		return err
 	}
 
+	for tid, pgTable := range tables {
+		if columnPolicy.HasTable(tid) {
+			applyTablePolicy(pgTable, scopes)
+		}
+	}
+
 	err = writeMetadata(pgTx, tdb, tables)
 	if err != nil {
 		sendAPIError(http.StatusInternalServerError, err.Error(), w, r)
@@ -233,12 +239,33 @@ func makeSqliteTableSQL(t *pgTable) string {
 }
 
 func copyData(pgTx *sql.Tx, tdb *sql.DB, scopes []string, pgTable *pgTable) error {
+	tableName := pgTable.schema + "." + pgTable.name
+	if columnPolicy.HasTable(tableName) {
+		// Read each selector separately so that we know which rules apply
+		for _, scope := range scopes {
+			sql := makePolicySQL(tableName, pgTable.columns)
+			err := copyQueryData(pgTx, tdb, sql, scope, pgTable, scope)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 
 	sql := fmt.Sprintf("select * from %s.%s where %s in %s",
 		pgTable.schema, pgTable.name, selectorColumn, GetTenants(scopes))
+	return copyQueryData(pgTx, tdb, sql, "", pgTable)
+}
+
+/*
+copyQueryData copies the results of a single Postgres query to SQLite.
+If "scope" is set, then the column policy is applied to the rows using
+that selector. "args" are the parameters of the query.
+*/
+func copyQueryData(pgTx *sql.Tx, tdb *sql.DB, sql, scope string, pgTable *pgTable, args ...interface{}) error {
 	log.Debugf("Postgres query: %s", sql)
 
-	pgRows, err := pgTx.Query(sql)
+	pgRows, err := pgTx.Query(sql, args...)
 	if err != nil {
 		return err
 	}
@@ -291,6 +318,13 @@ func copyData(pgTx *sql.Tx, tdb *sql.DB, scopes []string, pgTable *pgTable) erro
 
 		patchColTypes(cols)
 
+		if scope != "" {
+			tableName := pgTable.schema + "." + pgTable.name
+			for i, col := range pgTable.columns {
+				cols[i] = policyValue(tableName, scope, col, cols[i])
+			}
+		}
+
 		_, err := tx.Stmt(stmt).Exec(cols...)
 		if err != nil {
 			tx.Rollback()
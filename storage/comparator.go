@@ -16,6 +16,7 @@ limitations under the License.
 package storage
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/apigee-labs/transicator/common"
 	"strings"
@@ -27,6 +28,9 @@ const (
 	SequenceComparatorName = "transicator-sequence-v1"
 )
 
+// Length of a sequence at the start of a key in the "sequence" collection
+const sequenceKeyLen = 12
+
 var entryComparator = new(entryCmp)
 var sequenceComparator = new(sequenceCmp)
 
@@ -76,19 +80,48 @@ func (c entryCmp) Name() string {
 type sequenceCmp struct {
 }
 
+/*
+Compare tests the order of two keys in the "sequence" collection. Keys are
+sorted by sequence, and then by the scope that follows it, since several
+entries may have the same sequence. Keys from older versions have no scope,
+so they sort first, and their order is the same as before.
+*/
 func (s sequenceCmp) Compare(a, b []byte) int {
-	s1, err := common.ParseSequenceBytes(a)
+	s1, scope1, err := parseSequenceKey(a)
 	if err != nil {
 		panic(fmt.Sprintf("Error parsing sequence: %s", err))
 	}
-	s2, err := common.ParseSequenceBytes(b)
+	s2, scope2, err := parseSequenceKey(b)
 	if err != nil {
 		panic(fmt.Sprintf("Error parsing sequence: %s", err))
 	}
 
-	return s1.Compare(s2)
+	if seqCmp := s1.Compare(s2); seqCmp != 0 {
+		return seqCmp
+	}
+	return bytes.Compare(scope1, scope2)
 }
 
 func (s sequenceCmp) Name() string {
 	return SequenceComparatorName
 }
+
+/*
+sequenceKey is the key in the "sequence" collection for an entry.
+*/
+func sequenceKey(scope string, lsn uint64, index uint32) []byte {
+	return append(common.MakeSequence(lsn, index).Bytes(), scope...)
+}
+
+/*
+parseSequenceKey splits a key from the "sequence" collection into the
+sequence and the scope.
+*/
+func parseSequenceKey(key []byte) (seq common.Sequence, scope []byte, err error) {
+	if len(key) > sequenceKeyLen {
+		scope = key[sequenceKeyLen:]
+		key = key[:sequenceKeyLen]
+	}
+	seq, err = common.ParseSequenceBytes(key)
+	return
+}
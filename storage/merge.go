@@ -0,0 +1,165 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package storage
+
+import (
+	"container/heap"
+)
+
+const (
+	// Smallest and largest number of rows to read at a time from one scope
+	minScanPage = 8
+	maxScanPage = 1024
+)
+
+type readResult struct {
+	lsn   uint64
+	index uint32
+	data  []byte
+}
+type readResults []readResult
+
+/*
+A scopeIterator returns the entries for one scope in sequence order.
+"next" must be called before the first entry is available.
+*/
+type scopeIterator interface {
+	// Move to the next entry, and return false if there are no more
+	next() (bool, error)
+	// Return the current entry
+	entry() *readResult
+	// Release resources
+	close()
+}
+
+/*
+mergeScopes merges the entries from the iterators in sequence order, and
+returns up to "limit" of them that pass the filter. Iterators are only read
+as far as they need to be, so when there are many scopes, we do much less
+work than if we read "limit" entries from each one and sorted them.
+The iterators are closed when we are done.
+*/
+func mergeScopes(iters []scopeIterator, limit int,
+	filter func([]byte) bool) ([][]byte, error) {
+	defer func() {
+		for _, it := range iters {
+			it.close()
+		}
+	}()
+
+	if limit <= 0 {
+		return nil, nil
+	}
+
+	h := make(iteratorHeap, 0, len(iters))
+	for _, it := range iters {
+		found, err := nextMatch(it, filter)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			h = append(h, it)
+		}
+	}
+	heap.Init(&h)
+
+	var results [][]byte
+	for len(h) > 0 {
+		it := h[0]
+		results = append(results, it.entry().data)
+		if len(results) >= limit {
+			break
+		}
+
+		found, err := nextMatch(it, filter)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+	return results, nil
+}
+
+// nextMatch advances the iterator to the next entry that passes the filter
+func nextMatch(it scopeIterator, filter func([]byte) bool) (bool, error) {
+	for {
+		found, err := it.next()
+		if !found || err != nil {
+			return false, err
+		}
+		if filter == nil || filter(it.entry().data) {
+			return true, nil
+		}
+	}
+}
+
+/*
+firstPageSize decides how many rows to read from each scope at first
+when reading pages. We try to read just enough that we don't have to go
+back, which for a single scope means everything up to the limit. The merge
+needs one more row than each scope returns to know that the scope is done,
+so we read that too.
+*/
+func firstPageSize(limit, scopes int) int {
+	if scopes < 1 {
+		scopes = 1
+	}
+	size := limit/scopes + 1
+	if size < minScanPage {
+		size = minScanPage
+	}
+	if size > limit {
+		size = limit
+	}
+	return size
+}
+
+// iteratorHeap implements heap.Interface for iterators ordered by sequence
+
+type iteratorHeap []scopeIterator
+
+func (h iteratorHeap) Len() int {
+	return len(h)
+}
+
+func (h iteratorHeap) Less(i, j int) bool {
+	ei := h[i].entry()
+	ej := h[j].entry()
+	if ei.lsn < ej.lsn {
+		return true
+	}
+	return ei.lsn == ej.lsn && ei.index < ej.index
+}
+
+func (h iteratorHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *iteratorHeap) Push(x interface{}) {
+	*h = append(*h, x.(scopeIterator))
+}
+
+func (h *iteratorHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	it := old[n-1]
+	*h = old[:n-1]
+	return it
+}
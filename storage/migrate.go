@@ -0,0 +1,163 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"fmt"
+	"math"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Log progress after copying this many batches
+const migrateLogBatches = 100
+
+/*
+Migrate copies every entry in "src" to "dst," "batchSize" entries at a time.
+Each batch is written with PutBatch, so "dst" always holds a prefix of
+"src" in the order returned by ScanAll. That means that a migration that
+was interrupted can be run again: a batch whose last entry is already in
+"dst" was already copied, and is skipped. It returns the number of entries
+that were copied, and the number that were skipped.
+
+Each entry keeps the time when it was inserted into "src," so entries are
+purged from "dst" when they would have been purged from "src." All the
+metadata is copied first.
+*/
+func Migrate(src, dst DB, batchSize int) (copied, skipped uint64, err error) {
+	if batchSize <= 0 {
+		return 0, 0, fmt.Errorf("Invalid batch size %d", batchSize)
+	}
+
+	metadata, err := src.ListMetadata("")
+	if err != nil {
+		return
+	}
+	for key, value := range metadata {
+		err = dst.PutMetadata(key, value)
+		if err != nil {
+			return
+		}
+	}
+
+	var scope string
+	var lsn uint64
+	var index uint32
+	batches := 0
+
+	for {
+		var entries []Entry
+		entries, err = src.ScanAll(scope, lsn, index, batchSize)
+		if err != nil || len(entries) == 0 {
+			return
+		}
+
+		last := entries[len(entries)-1]
+		var found []byte
+		found, err = dst.Get(last.Scope, last.LSN, last.Index)
+		if err != nil {
+			return
+		}
+		if found != nil {
+			skipped += uint64(len(entries))
+		} else {
+			err = dst.PutBatch(entries)
+			if err != nil {
+				return
+			}
+			copied += uint64(len(entries))
+		}
+
+		batches++
+		if batches%migrateLogBatches == 0 {
+			log.Infof("Copied %d entries and skipped %d", copied, skipped)
+		}
+		if len(entries) < batchSize {
+			return
+		}
+		scope, lsn, index = nextEntryKey(last)
+	}
+}
+
+/*
+VerifyMigration checks that "dst" has the same number of entries as "src,"
+and the same first and last sequences. It is used after Migrate.
+*/
+func VerifyMigration(src, dst DB, batchSize int) error {
+	if batchSize <= 0 {
+		return fmt.Errorf("Invalid batch size %d", batchSize)
+	}
+
+	srcCount, err := countEntries(src, batchSize)
+	if err != nil {
+		return err
+	}
+	dstCount, err := countEntries(dst, batchSize)
+	if err != nil {
+		return err
+	}
+	if srcCount != dstCount {
+		return fmt.Errorf("Source has %d entries but destination has %d",
+			srcCount, dstCount)
+	}
+
+	_, srcFirst, srcLast, err := src.Scan(nil, 0, 0, 0, nil)
+	if err != nil {
+		return err
+	}
+	_, dstFirst, dstLast, err := dst.Scan(nil, 0, 0, 0, nil)
+	if err != nil {
+		return err
+	}
+	if srcFirst.Compare(dstFirst) != 0 {
+		return fmt.Errorf("Source first sequence is %s but destination is %s",
+			srcFirst, dstFirst)
+	}
+	if srcLast.Compare(dstLast) != 0 {
+		return fmt.Errorf("Source last sequence is %s but destination is %s",
+			srcLast, dstLast)
+	}
+	return nil
+}
+
+func countEntries(db DB, batchSize int) (uint64, error) {
+	var count uint64
+	var scope string
+	var lsn uint64
+	var index uint32
+
+	for {
+		entries, err := db.ScanAll(scope, lsn, index, batchSize)
+		if err != nil {
+			return 0, err
+		}
+		count += uint64(len(entries))
+		if len(entries) < batchSize {
+			return count, nil
+		}
+		last := entries[len(entries)-1]
+		scope, lsn, index = nextEntryKey(last)
+	}
+}
+
+// nextEntryKey returns the position in ScanAll right after "e"
+func nextEntryKey(e Entry) (string, uint64, uint32) {
+	if e.Index == math.MaxUint32 {
+		return e.Scope, e.LSN + 1, 0
+	}
+	return e.Scope, e.LSN, e.Index + 1
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+const (
+	migrateSrcDir = "./migratesrc"
+	migrateDstDir = "./migratedst"
+)
+
+var _ = describeEngines("Migration", func(engineName string) {
+	var src DB
+	// Most entries were inserted a day ago, and the rest just now
+	srcTime := time.Now().Add(-24 * time.Hour)
+
+	BeforeEach(func() {
+		db, err := Open(engineName, migrateSrcDir)
+		Expect(err).Should(Succeed())
+
+		// Include the internal scope and two entries with the same sequence
+		var entries []Entry
+		for lsn := uint64(1); lsn <= 100; lsn++ {
+			entries = append(entries, Entry{
+				Scope:     fmt.Sprintf("scope%d", lsn%7),
+				LSN:       lsn,
+				Data:      []byte(fmt.Sprintf("Entry %d", lsn)),
+				Timestamp: srcTime,
+			})
+		}
+		entries = append(entries,
+			Entry{Scope: "", LSN: 101, Index: 0, Data: []byte("Internal")},
+			Entry{Scope: "scope1", LSN: 101, Index: 1, Data: []byte("Moved from")},
+			Entry{Scope: "scope2", LSN: 101, Index: 1, Data: []byte("Moved to")})
+		Expect(db.PutBatch(entries)).Should(Succeed())
+		Expect(db.PutMetadata("consumer/test", []byte("Metadata"))).Should(Succeed())
+		db.Close()
+
+		src, err = OpenReadOnly(engineName, migrateSrcDir)
+		Expect(err).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		src.Close()
+		Expect(src.Delete()).Should(Succeed())
+	})
+
+	It("Read only", func() {
+		Expect(src.Put("foo", 200, 0, []byte("Nope"))).ShouldNot(Succeed())
+
+		_, err := OpenReadOnly(engineName, "./does/not/exist")
+		Expect(err).ShouldNot(Succeed())
+	})
+
+	for _, e := range Engines() {
+		dstEngine := e
+
+		It(fmt.Sprintf("Migrate to %s", dstEngine), func() {
+			dst, err := Open(dstEngine, migrateDstDir)
+			Expect(err).Should(Succeed())
+			defer dst.Delete()
+			defer dst.Close()
+
+			copied, skipped, err := Migrate(src, dst, 10)
+			Expect(err).Should(Succeed())
+			Expect(copied).Should(BeEquivalentTo(103))
+			Expect(skipped).Should(BeZero())
+			Expect(VerifyMigration(src, dst, 10)).Should(Succeed())
+
+			scopes := []string{"", "scope0", "scope1", "scope2", "scope3",
+				"scope4", "scope5", "scope6"}
+			expected, _, _, err := src.Scan(scopes, 0, 0, 1000, nil)
+			Expect(err).Should(Succeed())
+			migrated, _, _, err := dst.Scan(scopes, 0, 0, 1000, nil)
+			Expect(err).Should(Succeed())
+			Expect(len(migrated)).Should(Equal(len(expected)))
+			for i := range expected {
+				Expect(bytes.Equal(migrated[i], expected[i])).Should(BeTrue())
+			}
+
+			md, err := dst.GetMetadata("consumer/test")
+			Expect(err).Should(Succeed())
+			Expect(md).Should(Equal([]byte("Metadata")))
+
+			// Insertion times are the same as in the source
+			srcEntries, err := src.ScanAll("", 0, 0, 1000)
+			Expect(err).Should(Succeed())
+			dstEntries, err := dst.ScanAll("", 0, 0, 1000)
+			Expect(err).Should(Succeed())
+			Expect(len(dstEntries)).Should(Equal(len(srcEntries)))
+			for i := range srcEntries {
+				Expect(dstEntries[i].Timestamp.UnixNano()).Should(
+					Equal(srcEntries[i].Timestamp.UnixNano()))
+			}
+			Expect(dstEntries[0].Timestamp.After(srcTime)).Should(BeTrue())
+			Expect(dstEntries[len(dstEntries)-1].Timestamp.UnixNano()).Should(
+				Equal(srcTime.UnixNano()))
+
+			// So the old ones are purged and the new ones are not
+			purged, err := dst.Purge(srcTime.Add(time.Hour))
+			Expect(err).Should(Succeed())
+			Expect(purged).Should(BeEquivalentTo(100))
+		})
+
+		It(fmt.Sprintf("Resume migration to %s", dstEngine), func() {
+			dst, err := Open(dstEngine, migrateDstDir)
+			Expect(err).Should(Succeed())
+			defer dst.Delete()
+			defer dst.Close()
+
+			// Pretend that we stopped after three batches
+			first, err := src.ScanAll("", 0, 0, 30)
+			Expect(err).Should(Succeed())
+			Expect(dst.PutBatch(first)).Should(Succeed())
+			Expect(VerifyMigration(src, dst, 10)).ShouldNot(Succeed())
+
+			copied, skipped, err := Migrate(src, dst, 10)
+			Expect(err).Should(Succeed())
+			Expect(copied).Should(BeEquivalentTo(73))
+			Expect(skipped).Should(BeEquivalentTo(30))
+			Expect(VerifyMigration(src, dst, 10)).Should(Succeed())
+
+			// Nothing left to do
+			copied, skipped, err = Migrate(src, dst, 10)
+			Expect(err).Should(Succeed())
+			Expect(copied).Should(BeZero())
+			Expect(skipped).Should(BeEquivalentTo(103))
+		})
+	}
+})
@@ -30,6 +30,15 @@ create table if not exists transicator_entries
 create index if not exists transicator_sequence
 on transicator_entries
 (lsn, ix);
+
+create index if not exists transicator_time
+on transicator_entries
+(ts, lsn, ix);
+
+create table if not exists transicator_metadata
+(key text primary key,
+ value blob
+) without rowid;
 `
 
 const insertSQL = `
@@ -37,12 +46,30 @@ insert or replace into transicator_entries (scope, lsn, ix, ts, data)
 values (?, ?, ?, ?, ?)
 `
 
+const deleteSQL = `
+delete from transicator_entries where scope = ? and lsn = ? and ix = ?
+`
+
 const readRangeSQL = `
 select lsn, ix, data from transicator_entries
 where scope = ? and ((lsn > ?) or (lsn == ? and ix >= ?))
 order by lsn, ix
 `
 
+const readPageSQL = `
+select lsn, ix, data from transicator_entries
+where scope = ? and ((lsn > ?) or (lsn == ? and ix >= ?))
+order by lsn, ix
+limit ?
+`
+
+const readAllSQL = `
+select scope, lsn, ix, ts, data from transicator_entries
+where scope > ? or (scope = ? and ((lsn > ?) or (lsn == ? and ix >= ?)))
+order by scope, lsn, ix
+limit ?
+`
+
 const readFirstSQL = `
 select lsn, ix from transicator_entries order by lsn asc, ix asc limit 1
 `
@@ -54,3 +81,84 @@ select lsn, ix from transicator_entries order by lsn desc, ix desc limit 1
 const purgeByTimeSQL = `
 delete from transicator_entries where ts < ?
 `
+
+const purgeByTimeBeforeSQL = `
+delete from transicator_entries
+where ts < ? and ((lsn < ?) or (lsn == ? and ix < ?))
+`
+
+const readFirstSinceSQL = `
+select lsn, ix from transicator_entries
+where ts >= ? and substr(scope, 1, ?) <> ?
+order by lsn, ix limit 1
+`
+
+const readScopesSQL = `
+select distinct scope from transicator_entries order by scope
+`
+
+const readLastOldSQL = `
+select lsn, ix from transicator_entries
+where scope = ? and ts < ? and ((lsn < ?) or (lsn == ? and ix < ?))
+order by lsn desc, ix desc limit 1
+`
+
+const readLastOverCountSQL = `
+select lsn, ix from transicator_entries
+where scope = ?
+order by lsn desc, ix desc limit 1 offset ?
+`
+
+const readLastBeforeSQL = `
+select lsn, ix from transicator_entries
+where scope = ? and ((lsn < ?) or (lsn == ? and ix < ?))
+order by lsn desc, ix desc limit 1
+`
+
+const purgeScopeByTimeSQL = `
+delete from transicator_entries
+where scope = ? and ts < ? and ((lsn < ?) or (lsn == ? and ix < ?))
+`
+
+const purgeScopeThroughSQL = `
+delete from transicator_entries
+where scope = ? and ((lsn < ?) or (lsn == ? and ix <= ?))
+`
+
+const readNthSQL = `
+select lsn, ix from transicator_entries
+where substr(scope, 1, ?) <> ? and ((lsn < ?) or (lsn == ? and ix < ?))
+order by lsn, ix limit 1 offset ?
+`
+
+const readLastPurgeableSQL = `
+select lsn, ix from transicator_entries
+where substr(scope, 1, ?) <> ? and ((lsn < ?) or (lsn == ? and ix < ?))
+order by lsn desc, ix desc limit 1
+`
+
+const purgeThroughSQL = `
+delete from transicator_entries
+where substr(scope, 1, ?) <> ? and ((lsn < ?) or (lsn == ? and ix <= ?))
+`
+
+const hasMetadataSQL = `
+select count(*) from sqlite_master
+where type = 'table' and name = 'transicator_metadata'
+`
+
+const putMetadataSQL = `
+insert or replace into transicator_metadata (key, value) values (?, ?)
+`
+
+const getMetadataSQL = `
+select value from transicator_metadata where key = ?
+`
+
+const deleteMetadataSQL = `
+delete from transicator_metadata where key = ?
+`
+
+const listMetadataSQL = `
+select key, value from transicator_metadata where key >= ? order by key
+`
@@ -17,20 +17,72 @@ limitations under the License.
 package storage
 
 import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
 	"time"
 
 	"github.com/apigee-labs/transicator/common"
-	"io"
 )
 
+// Names of the storage engines. Not all of them are built in every binary.
+const (
+	RocksDBEngine = "rocksdb"
+	SQLiteEngine  = "sqlite"
+	BoltEngine    = "bolt"
+)
+
+// The engine used by default is the first one in this list that is built in
+var enginePreference = []string{RocksDBEngine, SQLiteEngine, BoltEngine}
+
 /*
-An Entry represents a whole record in one go.
+An engine is one implementation of the DB interface. Each implementation
+registers itself in "init" so that the engine can be picked at runtime.
+*/
+type engine struct {
+	open         func(baseFile string) (DB, error)
+	openReadOnly func(baseFile string) (DB, error)
+	exists       func(baseFile string) bool
+	// nil if the engine can't restore backups
+	restore func(baseFile string, r io.Reader) error
+}
+
+var engines = make(map[string]*engine)
+
+// NoLimit is passed as the "limit" to purge entries no matter their sequence
+var NoLimit = common.MakeSequence(math.MaxUint64, math.MaxUint32)
+
+// InternalScopePrefix starts the scopes that the change server uses for its
+// own records. PurgeOldest never deletes them.
+const InternalScopePrefix = "__transicator"
+
+func registerEngine(name string, e *engine) {
+	engines[name] = e
+}
+
+/*
+An Entry represents a whole record in one go. "Timestamp" is the insertion
+time that Purge and FirstSequenceSince use. ScanAll fills it in, and
+PutBatch keeps it unless it is zero, in which case the current time is used.
+Callers that set it should use times that go up with the sequence, like
+the commit time of each change.
 */
 type Entry struct {
-	Scope string
-	LSN   uint64
-	Index uint32
-	Data  []byte
+	Scope     string
+	LSN       uint64
+	Index     uint32
+	Data      []byte
+	Timestamp time.Time
+}
+
+// insertTime returns the time to store for an entry written at "now"
+func (e Entry) insertTime(now time.Time) time.Time {
+	if e.Timestamp.IsZero() {
+		return now
+	}
+	return e.Timestamp
 }
 
 /*
@@ -60,6 +112,10 @@ type DB interface {
 	// Insert a bunch of entries in one atomic batch
 	PutBatch(entries []Entry) error
 
+	// Delete the entry with the scope, LSN, and index of each of "entries"
+	// in one atomic batch. The data in the entries is ignored.
+	DeleteBatch(entries []Entry) error
+
 	// Retrieve a single entry
 	Get(scope string, lsn uint64, index uint32) ([]byte, error)
 
@@ -71,9 +127,64 @@ type DB interface {
 		limit int,
 		filter func([]byte) bool) ([][]byte, common.Sequence, common.Sequence, error)
 
+	// Read up to "limit" entries from every scope, starting with the entry
+	// for "startScope," "startLSN," and "startIndex." All the entries for
+	// each scope are returned together in sequence order, and the scopes
+	// are always returned in the same order. This is used to copy the
+	// whole database.
+	ScanAll(startScope string, startLSN uint64, startIndex uint32,
+		limit int) ([]Entry, error)
+
 	// Delete entries older than "oldest"
 	Purge(oldest time.Time) (purgeCount uint64, err error)
 
+	// Delete entries older than "oldest" whose sequence is before "limit."
+	// The entry at "limit" and every entry after it are kept.
+	PurgeBefore(oldest time.Time, limit common.Sequence) (purgeCount uint64, err error)
+
+	// Return the names of all the scopes that have entries, in sorted order
+	Scopes() ([]string, error)
+
+	// Return the lowest sequence of an entry whose timestamp is at or after
+	// "t." Entries whose scope starts with InternalScopePrefix are ignored.
+	// "found" is false if every other entry is older than that.
+	FirstSequenceSince(t time.Time) (seq common.Sequence, found bool, err error)
+
+	// Delete entries for one scope that were inserted before "oldest," and
+	// all but the newest "maxCount" of them if "maxCount" is more than zero.
+	// If "oldest" is the zero time, entries are not deleted by age. Entries
+	// at or after "limit" are never deleted. Also returns the sequence of
+	// the newest entry that was deleted.
+	PurgeScope(scope string, oldest time.Time, maxCount int, limit common.Sequence) (purgeCount uint64, lastPurged common.Sequence, err error)
+
+	// Delete the "count" entries with the lowest sequences, plus any others
+	// with the same sequence as the last one. Entries at or after "limit,"
+	// and entries whose scope starts with InternalScopePrefix, are never
+	// deleted. Also returns the sequence of the newest entry that was deleted.
+	PurgeOldest(count int, limit common.Sequence) (purgeCount uint64, lastPurged common.Sequence, err error)
+
+	// Return an estimate of the space used by the entries, in bytes. Space
+	// that the engine has freed for reuse is not included, so this goes down
+	// after a purge even if the files on disk stay the same size.
+	Size() (int64, error)
+
+	// Save a small value under "key." Metadata is kept apart from the
+	// entries, so it is never returned by Scan and never purged.
+	PutMetadata(key string, value []byte) error
+
+	// Retrieve the metadata for "key," or nil if there is none
+	GetMetadata(key string) ([]byte, error)
+
+	// Delete the metadata for "key." It is not an error if there is none.
+	DeleteMetadata(key string) error
+
+	// Save or delete a bunch of metadata in one atomic batch. Keys whose
+	// value is nil are deleted.
+	PutMetadataBatch(values map[string][]byte) error
+
+	// Return all the metadata whose keys start with "prefix"
+	ListMetadata(prefix string) (map[string][]byte, error)
+
 	// Make a backup of the current database at the specified file name. The
 	// function will return a channel that can be used to read the status of
 	// the backup as it is being made.
@@ -83,3 +194,228 @@ type DB interface {
 	// and write the persistent db file to the specified writer.
 	GetBackup(w io.Writer) error
 }
+
+/*
+Engines returns the names of all the storage engines that were built in
+to this binary, in alphabetical order.
+*/
+func Engines() []string {
+	var names []string
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+DefaultEngine returns the name of the engine to use when none is specified.
+RocksDB is only built in when asked for, so it is preferred when present,
+and SQLite is preferred over Bolt when cgo is available.
+*/
+func DefaultEngine() string {
+	for _, name := range enginePreference {
+		if engines[name] != nil {
+			return name
+		}
+	}
+	return ""
+}
+
+func getEngine(name string) (*engine, error) {
+	e := engines[name]
+	if e == nil {
+		return nil, fmt.Errorf("Invalid storage engine \"%s\"", name)
+	}
+	return e, nil
+}
+
+/*
+Open opens a database in the directory "baseFile" using the named
+storage engine. Opened databases should be closed when done.
+*/
+func Open(engineName, baseFile string) (DB, error) {
+	e, err := getEngine(engineName)
+	if err != nil {
+		return nil, err
+	}
+	return e.open(baseFile)
+}
+
+/*
+OpenReadOnly opens an existing database in the directory "baseFile" using
+the named storage engine. Nothing may be written to it.
+*/
+func OpenReadOnly(engineName, baseFile string) (DB, error) {
+	e, err := getEngine(engineName)
+	if err != nil {
+		return nil, err
+	}
+	if !e.exists(baseFile) {
+		return nil, fmt.Errorf("No database in %s", baseFile)
+	}
+	return e.openReadOnly(baseFile)
+}
+
+/*
+Exists returns true if there is already a database for the named
+engine in "baseFile."
+*/
+func Exists(engineName, baseFile string) bool {
+	e, err := getEngine(engineName)
+	if err != nil {
+		return false
+	}
+	return e.exists(baseFile)
+}
+
+/*
+Restore creates a new database in "baseFile" from a backup in the format
+written by GetBackup for the same engine. There must not already be a
+database there.
+*/
+func Restore(engineName, baseFile string, r io.Reader) error {
+	e, err := getEngine(engineName)
+	if err != nil {
+		return err
+	}
+	if e.restore == nil {
+		return fmt.Errorf("Restore is not supported by the %s engine", engineName)
+	}
+	return e.restore(baseFile, r)
+}
+
+// createDBDir ensures that "base" is a directory and returns the file name
+func createDBDir(baseFile string) (string, error) {
+	st, err := os.Stat(baseFile)
+	if err != nil {
+		err = os.Mkdir(baseFile, 0775)
+		if err != nil {
+			return "", err
+		}
+	} else if !st.IsDir() {
+		return "", fmt.Errorf("Database location %s is not a directory", baseFile)
+	}
+
+	return fmt.Sprintf("%s/transicator", baseFile), err
+}
+
+/*
+fileExists returns true if there is a database in "baseFile," for the
+engines that keep everything in one file.
+*/
+func fileExists(baseFile string) bool {
+	_, err := os.Stat(fmt.Sprintf("%s/transicator", baseFile))
+	return err == nil
+}
+
+/*
+restoreFile restores a backup for the engines that keep everything in one
+file, where the backup is a copy of that file. The backup is written to a
+temporary file first, so that if the reader fails, no database is left
+behind.
+*/
+func restoreFile(baseFile string, r io.Reader) error {
+	if fileExists(baseFile) {
+		return fmt.Errorf("Database already exists in %s", baseFile)
+	}
+	fileName, err := createDBDir(baseFile)
+	if err != nil {
+		return err
+	}
+
+	tmpName := fileName + ".restore"
+	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0664)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return os.Rename(tmpName, fileName)
+}
+
+func returnBackupError(pc chan BackupProgress, err error) {
+	pc <- BackupProgress{
+		Done:  true,
+		Error: err,
+	}
+}
+
+/*
+searchByTime finds the first entry whose timestamp is at or after "t" for
+the engines that keep the timestamp in their sequence index. "next"
+returns the sequence and timestamp (in nanoseconds) of the first entry at
+or after a sequence that is not internal, and "found" is false if there is
+none. Changes are committed in sequence order, so their times are in the
+same order, and a binary search over the LSNs and then over the indexes of
+one LSN takes a hundred lookups at most. Internal entries have to be
+skipped because they get the time when they were written instead.
+*/
+func searchByTime(t time.Time,
+	next func(start common.Sequence) (seq common.Sequence, ts int64, found bool, err error)) (common.Sequence, bool, error) {
+
+	cutoff := t.UnixNano()
+	// True if the first entry at or after "start" was inserted at or after
+	// the cutoff, or if there is no entry at all.
+	isAfter := func(start common.Sequence) (bool, error) {
+		_, ts, found, err := next(start)
+		return !found || ts >= cutoff, err
+	}
+
+	// Find the first LSN whose first entry is late enough. Only the LSN
+	// before that one may have entries on both sides of the cutoff.
+	lsn, err := searchUint64(0, math.MaxUint64, func(lsn uint64) (bool, error) {
+		return isAfter(common.MakeSequence(lsn, 0))
+	})
+	if err != nil {
+		return common.Sequence{}, false, err
+	}
+
+	start := common.MakeSequence(lsn, 0)
+	if lsn > 0 {
+		index, err := searchUint64(0, math.MaxUint32, func(index uint64) (bool, error) {
+			seq, ts, found, err := next(common.MakeSequence(lsn-1, uint32(index)))
+			return !found || seq.LSN >= lsn || ts >= cutoff, err
+		})
+		if err != nil {
+			return common.Sequence{}, false, err
+		}
+		start = common.MakeSequence(lsn-1, uint32(index))
+	}
+
+	seq, ts, found, err := next(start)
+	if err == nil && found && ts < cutoff {
+		// Only if every index of the LSN was too early
+		seq, _, found, err = next(common.MakeSequence(lsn, 0))
+	}
+	return seq, found, err
+}
+
+/*
+searchUint64 returns the smallest number from "lo" through "hi" for which
+"f" returns true, or "hi" if it returns true for none of them. "f" must
+return false up to some number and true for every one after it.
+*/
+func searchUint64(lo, hi uint64, f func(uint64) (bool, error)) (uint64, error) {
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		ok, err := f(mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo, nil
+}
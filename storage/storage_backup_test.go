@@ -1,5 +1,3 @@
-// +build !rocksdb
-
 /*
 Copyright 2017 The Transicator Authors
 
@@ -32,10 +30,15 @@ const (
 	backupFile = "./testDBBackup"
 )
 
-var _ = Describe("Backup tests", func() {
+var _ = describeEngines("Backup tests", func(engineName string) {
+	if engines[engineName].restore == nil {
+		// RocksDB does not support backups
+		return
+	}
+
 	BeforeEach(func() {
 		var err error
-		testDB, err = Open(testDBDir)
+		testDB, err = Open(engineName, testDBDir)
 		Expect(err).Should(Succeed())
 	})
 
@@ -84,7 +87,7 @@ var _ = Describe("Backup tests", func() {
 			}
 		}
 
-		bdb, err := Open(backupFile)
+		bdb, err := Open(engineName, backupFile)
 		Expect(err).Should(Succeed())
 
 		ret, err = bdb.Get("foo", 1, 1)
@@ -107,7 +110,7 @@ var _ = Describe("Backup tests", func() {
 			}
 		}
 
-		bdb, err := Open(backupFile)
+		bdb, err := Open(engineName, backupFile)
 		Expect(err).Should(Succeed())
 		defer bdb.Close()
 
@@ -164,7 +167,7 @@ var _ = Describe("Backup tests", func() {
 		fileWriter.Close()
 
 		// compare backup
-		bdb, err := Open(backupFile)
+		bdb, err := Open(engineName, backupFile)
 		Expect(err).Should(Succeed())
 		defer bdb.Close()
 
@@ -176,6 +179,34 @@ var _ = Describe("Backup tests", func() {
 			Expect(bytes.Equal(b, testBlobs[i])).Should(BeTrue())
 		}
 	})
+
+	It("Restore", func() {
+		testBlobs := generateRandomRecords()
+
+		buf := &bytes.Buffer{}
+		err := testDB.GetBackup(buf)
+		Expect(err).Should(Succeed())
+
+		Expect(Exists(engineName, backupFile)).Should(BeFalse())
+		err = Restore(engineName, backupFile, buf)
+		Expect(err).Should(Succeed())
+		Expect(Exists(engineName, backupFile)).Should(BeTrue())
+
+		bdb, err := Open(engineName, backupFile)
+		Expect(err).Should(Succeed())
+		defer bdb.Close()
+
+		readBlobs, _, _, err := bdb.Scan([]string{"seq"}, 0, 0, len(testBlobs), nil)
+		Expect(err).Should(Succeed())
+		Expect(len(readBlobs)).Should(Equal(len(testBlobs)))
+		for i, b := range readBlobs {
+			Expect(bytes.Equal(b, testBlobs[i])).Should(BeTrue())
+		}
+
+		// Can't restore on top of an existing database
+		err = Restore(engineName, backupFile, &bytes.Buffer{})
+		Expect(err).ShouldNot(Succeed())
+	})
 })
 
 // Generate some random byte records for testing.
@@ -22,6 +22,7 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/apigee-labs/transicator/common"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"time"
@@ -41,8 +42,19 @@ var largeScopes, cleanScopes []string
 var largeScopeNames, cleanScopeNames []string
 var purgePoint time.Time
 
+const (
+	scanDBDir        = "./benchscandata"
+	scanBenchScopes  = 5000
+	scanBenchEntries = 20
+	scanBenchLimit   = 1000
+)
+
+var scanInit = &sync.Once{}
+var scanDB DB
+var scanScopeNames []string
+
 func BenchmarkInserts(b *testing.B) {
-	db, err := Open(benchDBDir)
+	db, err := Open(DefaultEngine(), benchDBDir)
 	if err != nil {
 		b.Fatalf("Error on open: %s\n", err)
 	}
@@ -59,7 +71,7 @@ func BenchmarkInserts(b *testing.B) {
 }
 
 func BenchmarkBatch10Inserts(b *testing.B) {
-	db, err := Open(benchDBDir)
+	db, err := Open(DefaultEngine(), benchDBDir)
 	if err != nil {
 		b.Fatalf("Error on open: %s\n", err)
 	}
@@ -167,6 +179,92 @@ func BenchmarkSequence0To100WithMetadataAfterClean(b *testing.B) {
 	}
 }
 
+/*
+sortedScanner is implemented by every storage engine so that we can compare
+the merge in "Scan" with the old way of reading everything and sorting it.
+*/
+type sortedScanner interface {
+	scanSorted(scopes []string, startLSN uint64, startIndex uint32,
+		limit int, filter func([]byte) bool) ([][]byte, common.Sequence, common.Sequence, error)
+}
+
+func BenchmarkScanMerge1(b *testing.B) {
+	runScanBench(1, false, b)
+}
+
+func BenchmarkScanMerge100(b *testing.B) {
+	runScanBench(100, false, b)
+}
+
+func BenchmarkScanMerge5000(b *testing.B) {
+	runScanBench(5000, false, b)
+}
+
+func BenchmarkScanSort1(b *testing.B) {
+	runScanBench(1, true, b)
+}
+
+func BenchmarkScanSort100(b *testing.B) {
+	runScanBench(100, true, b)
+}
+
+func BenchmarkScanSort5000(b *testing.B) {
+	runScanBench(5000, true, b)
+}
+
+/*
+runScanBench reads 1000 entries at a time from the start of a database with
+5000 scopes of 20 entries each, using "scopes" of them.
+*/
+func runScanBench(scopes int, sorted bool, b *testing.B) {
+	scanInit.Do(func() {
+		initScanDB(b)
+	})
+
+	names := scanScopeNames[:scopes]
+	ss, ok := scanDB.(sortedScanner)
+	if sorted && !ok {
+		b.Skip("Storage engine does not support sorted scans")
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var entries [][]byte
+		var err error
+		if sorted {
+			entries, _, _, err = ss.scanSorted(names, 0, 0, scanBenchLimit, nil)
+		} else {
+			entries, _, _, err = scanDB.Scan(names, 0, 0, scanBenchLimit, nil)
+		}
+		if err != nil {
+			b.Fatalf("Error on read: %s\n", err)
+		}
+		if len(entries) == 0 {
+			b.Fatal("Expected at least one entry")
+		}
+	}
+}
+
+func initScanDB(b *testing.B) {
+	var err error
+	scanDB, err = Open(DefaultEngine(), scanDBDir)
+	if err != nil {
+		b.Fatalf("Error on open: %s\n", err)
+	}
+
+	for i := 0; i < scanBenchScopes; i++ {
+		scanScopeNames = append(scanScopeNames, fmt.Sprintf("Scope-%d", i))
+	}
+
+	// Interleave the scopes so that a merge has to look at all of them
+	var scopes []string
+	for i := 0; i < scanBenchScopes*scanBenchEntries; i++ {
+		scopes = append(scopes, scanScopeNames[i%scanBenchScopes])
+	}
+	b.Logf("Inserting %d records\n", len(scopes))
+	doInserts(scanDB, scopes, len(scopes), 1000)
+}
+
 func purgeRecords(b *testing.B, db DB) {
 	b.Logf("Purging about half the records...\n")
 	purged, err := db.Purge(purgePoint)
@@ -184,7 +282,7 @@ func initLargeDB(b *testing.B) {
 }
 
 func initDB(b *testing.B, dir string, insertScopes []string) (DB, time.Time) {
-	db, err := Open(dir)
+	db, err := Open(DefaultEngine(), dir)
 	if err != nil {
 		b.Fatalf("Error on open: %s\n", err)
 	}
@@ -260,3 +358,25 @@ func makeScopeList(numScopes, stddev, mean, minSize int) ([]string, []string) {
 
 	return permuted, scopeNames
 }
+
+// Needed to sort read results by LSN and index
+
+func (r readResults) Len() int {
+	return len(r)
+}
+
+func (r readResults) Less(i, j int) bool {
+	if r[i].lsn < r[j].lsn {
+		return true
+	}
+	if r[i].lsn == r[j].lsn && r[i].index < r[j].index {
+		return true
+	}
+	return false
+}
+
+func (r readResults) Swap(i, j int) {
+	tmp := r[i]
+	r[i] = r[j]
+	r[j] = tmp
+}
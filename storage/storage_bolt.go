@@ -0,0 +1,814 @@
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/apigee-labs/transicator/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+ * The Bolt engine keeps two buckets.
+ *
+ * "entries" holds the data. Keys sort by scope, then LSN, then index:
+ *   Length of scope name (uvarint)
+ *   Scope (string, UTF-8)
+ *   LSN (uint64, big-endian)
+ *   Index (uint32, big-endian)
+ *
+ * "sequences" is used to find the first and last sequences and to purge.
+ * Keys sort by sequence:
+ *   Sequence (12 bytes, as written by common.Sequence.Bytes)
+ *   Scope (string, UTF-8)
+ * Values are the time that the entry was written, in nanoseconds
+ * (uint64, big-endian).
+ *
+ * "metadata" holds values saved by PutMetadata, keyed by name.
+ */
+
+var (
+	boltEntriesBucket   = []byte("entries")
+	boltSequencesBucket = []byte("sequences")
+	boltMetadataBucket  = []byte("metadata")
+)
+
+const (
+	// Size of a sequence at the end of an entry key
+	boltSequenceLen = 12
+	// Number of entries to look at in each transaction during a purge
+	boltPurgeBatch = 1000
+)
+
+/*
+A Bolt is a handle to a database that uses Bolt, which is written
+entirely in Go.
+*/
+type Bolt struct {
+	baseFile string
+	db       *bolt.DB
+}
+
+func init() {
+	registerEngine(BoltEngine, &engine{
+		open: func(baseFile string) (DB, error) {
+			db, err := OpenBolt(baseFile)
+			if err != nil {
+				return nil, err
+			}
+			return db, nil
+		},
+		openReadOnly: func(baseFile string) (DB, error) {
+			db, err := openBolt(baseFile, true)
+			if err != nil {
+				return nil, err
+			}
+			return db, nil
+		},
+		exists:  fileExists,
+		restore: restoreFile,
+	})
+}
+
+/*
+OpenBolt opens a Bolt database and makes it available for reads and writes.
+Opened databases should be closed when done.
+
+The "baseFile" parameter refers to the name of a directory. Bolt keeps the
+whole database in a single file inside this directory.
+*/
+func OpenBolt(baseFile string) (*Bolt, error) {
+	return openBolt(baseFile, false)
+}
+
+func openBolt(baseFile string, readOnly bool) (*Bolt, error) {
+	fileName, err := createDBDir(baseFile)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("Opening Bolt DB at %s\n", fileName)
+	db, err := bolt.Open(fileName, 0664, &bolt.Options{
+		Timeout:  time.Second,
+		ReadOnly: readOnly,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if readOnly {
+		err = db.View(func(tx *bolt.Tx) error {
+			if tx.Bucket(boltEntriesBucket) == nil || tx.Bucket(boltSequencesBucket) == nil {
+				return fmt.Errorf("%s is not a transicator database", fileName)
+			}
+			return nil
+		})
+	} else {
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(boltEntriesBucket)
+			if err == nil {
+				_, err = tx.CreateBucketIfNotExists(boltSequencesBucket)
+			}
+			if err == nil {
+				_, err = tx.CreateBucketIfNotExists(boltMetadataBucket)
+			}
+			return err
+		})
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Bolt{
+		baseFile: baseFile,
+		db:       db,
+	}, nil
+}
+
+/*
+Close closes the database cleanly.
+*/
+func (s *Bolt) Close() {
+	log.Infof("Closed DB in %s", s.baseFile)
+	s.db.Close()
+}
+
+/*
+Delete deletes all the files used by the database.
+*/
+func (s *Bolt) Delete() error {
+	return os.RemoveAll(s.baseFile)
+}
+
+/*
+Put writes an entry to the database indexed by scope, lsn, and index in order
+*/
+func (s *Bolt) Put(scope string, lsn uint64, index uint32, data []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putBolt(tx, time.Now(), scope, lsn, index, data)
+	})
+}
+
+/*
+PutBatch writes a whole bunch in a single transaction.
+*/
+func (s *Bolt) PutBatch(entries []Entry) error {
+	now := time.Now()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, entry := range entries {
+			err := putBolt(tx, entry.insertTime(now), entry.Scope, entry.LSN, entry.Index, entry.Data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/*
+DeleteBatch deletes a whole bunch in a single transaction.
+*/
+func (s *Bolt) DeleteBatch(entries []Entry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		for _, entry := range entries {
+			err := tx.Bucket(boltEntriesBucket).Delete(boltEntryKey(entry.Scope, entry.LSN, entry.Index))
+			if err == nil {
+				err = tx.Bucket(boltSequencesBucket).Delete(boltSequenceKey(entry.Scope, entry.LSN, entry.Index))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func putBolt(tx *bolt.Tx, now time.Time, scope string, lsn uint64, index uint32, data []byte) error {
+	err := tx.Bucket(boltEntriesBucket).Put(boltEntryKey(scope, lsn, index), data)
+	if err != nil {
+		return err
+	}
+	tb := make([]byte, 8)
+	binary.BigEndian.PutUint64(tb, uint64(now.UnixNano()))
+	return tx.Bucket(boltSequencesBucket).Put(boltSequenceKey(scope, lsn, index), tb)
+}
+
+/*
+Get returns what was written by PutEntry. It's mainly used for testing.
+*/
+func (s *Bolt) Get(scope string, lsn uint64, index uint32) (ret []byte, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		ret = copyBytes(tx.Bucket(boltEntriesBucket).Get(boltEntryKey(scope, lsn, index)))
+		return nil
+	})
+	return
+}
+
+/*
+Scan returns entries in sequence number order a list of scopes.
+It also returns the sequences of the first and last records in the DB.
+The first entry returned will be the first entry that matches the specified
+startLSN and startIndex. No more than "limit" entries will be returned.
+To retrieve the very next entry after an entry, simply increment the index
+by 1. Everything is read in one read-only transaction, so the results are
+consistent even if data is being inserted to the database.
+The array returned is the array of entries (again, in "sequence" order).
+*/
+func (s *Bolt) Scan(
+	scopes []string,
+	startLSN uint64, startIndex uint32,
+	limit int, filter func([]byte) bool) (final [][]byte, firstSeq common.Sequence, lastSeq common.Sequence, err error) {
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		var txErr error
+		firstSeq, lastSeq, txErr = readBoltLimits(tx)
+		if txErr != nil {
+			return txErr
+		}
+
+		entries := tx.Bucket(boltEntriesBucket)
+		iters := make([]scopeIterator, len(scopes))
+		for i, scope := range scopes {
+			iters[i] = &boltScopeIterator{
+				cursor: entries.Cursor(),
+				prefix: boltScopePrefix(scope),
+				start:  boltEntryKey(scope, startLSN, startIndex),
+			}
+		}
+		final, txErr = mergeScopes(iters, limit, filter)
+		return txErr
+	})
+	return
+}
+
+/*
+ScanAll reads entries from every scope in key order. Scopes are sorted by
+the length of their name first, and then by name.
+*/
+func (s *Bolt) ScanAll(
+	startScope string, startLSN uint64, startIndex uint32,
+	limit int) (entries []Entry, err error) {
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltEntriesBucket).Cursor()
+		sequences := tx.Bucket(boltSequencesBucket)
+		for k, v := c.Seek(boltEntryKey(startScope, startLSN, startIndex)); k != nil && len(entries) < limit; k, v = c.Next() {
+			scope, lsn, index, err := parseBoltEntryKey(k)
+			if err != nil {
+				return err
+			}
+			var ts time.Time
+			if tb := sequences.Get(boltSequenceKey(scope, lsn, index)); len(tb) == 8 {
+				ts = time.Unix(0, int64(binary.BigEndian.Uint64(tb)))
+			}
+			entries = append(entries, Entry{
+				Scope:     scope,
+				LSN:       lsn,
+				Index:     index,
+				Data:      copyBytes(v),
+				Timestamp: ts,
+			})
+		}
+		return nil
+	})
+	return
+}
+
+/*
+Purge deletes everything from the database that was inserted before the time
+specified in "oldest." The work is split into many small transactions so
+that new entries may be inserted while a purge is running.
+*/
+func (s *Bolt) Purge(oldest time.Time) (purgeCount uint64, err error) {
+	return s.PurgeBefore(oldest, NoLimit)
+}
+
+/*
+PurgeBefore is like Purge, but only deletes entries whose sequence is
+before "limit." Since the sequences bucket is in sequence order, it stops
+as soon as it gets to "limit."
+*/
+func (s *Bolt) PurgeBefore(oldest time.Time, limit common.Sequence) (purgeCount uint64, err error) {
+	var next []byte
+	for {
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			var count uint64
+			var txErr error
+			count, next, txErr = purgeBoltBatch(tx, next, oldest, limit)
+			purgeCount += count
+			return txErr
+		})
+		if err != nil || next == nil {
+			return
+		}
+	}
+}
+
+/*
+purgeBoltBatch looks at up to boltPurgeBatch entries, starting at "start,"
+and deletes the ones that are older than "oldest." It returns the key to
+start the next batch from, or nil if there are no more entries before
+"limit."
+*/
+func purgeBoltBatch(tx *bolt.Tx, start []byte, oldest time.Time, limit common.Sequence) (uint64, []byte, error) {
+	sequences := tx.Bucket(boltSequencesBucket)
+	entries := tx.Bucket(boltEntriesBucket)
+	cutoff := uint64(oldest.UnixNano())
+
+	var old [][]byte
+	var next []byte
+	limitKey := limit.Bytes()
+	c := sequences.Cursor()
+	k, v := c.First()
+	if start != nil {
+		k, v = c.Seek(start)
+	}
+	for count := 0; k != nil; k, v = c.Next() {
+		if bytes.Compare(k[:boltSequenceLen], limitKey) >= 0 {
+			break
+		}
+		if count == boltPurgeBatch {
+			next = copyBytes(k)
+			break
+		}
+		count++
+		if len(v) == 8 && binary.BigEndian.Uint64(v) < cutoff {
+			old = append(old, copyBytes(k))
+		}
+	}
+
+	// Deleting from a cursor while moving it may skip entries, so
+	// delete everything that we found afterwards.
+	for _, k := range old {
+		scope, lsn, index, err := parseBoltSequenceKey(k)
+		if err != nil {
+			return 0, nil, err
+		}
+		err = entries.Delete(boltEntryKey(scope, lsn, index))
+		if err == nil {
+			err = sequences.Delete(k)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	return uint64(len(old)), next, nil
+}
+
+/*
+Scopes returns the names of all the scopes that have entries, sorted.
+*/
+func (s *Bolt) Scopes() (scopes []string, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltEntriesBucket).Cursor()
+		k, _ := c.First()
+		for k != nil {
+			scope, _, _, err := parseBoltEntryKey(k)
+			if err != nil {
+				return err
+			}
+			scopes = append(scopes, scope)
+
+			// Skip the rest of the entries for the scope
+			k, _ = c.Seek(boltEntryKey(scope, math.MaxUint64, math.MaxUint32))
+			if k != nil && bytes.HasPrefix(k, boltScopePrefix(scope)) {
+				k, _ = c.Next()
+			}
+		}
+		return nil
+	})
+	// Keys start with the length of the scope, so they are not in name order
+	sort.Strings(scopes)
+	return
+}
+
+/*
+FirstSequenceSince searches the sequences bucket, whose values are the
+timestamps, in a single transaction.
+*/
+func (s *Bolt) FirstSequenceSince(t time.Time) (seq common.Sequence, found bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltSequencesBucket).Cursor()
+		var txErr error
+		seq, found, txErr = searchByTime(t, func(start common.Sequence) (common.Sequence, int64, bool, error) {
+			k, v := c.Seek(start.Bytes())
+			for k != nil && bytes.HasPrefix(k[boltSequenceLen:], []byte(InternalScopePrefix)) {
+				k, v = c.Next()
+			}
+			if k == nil {
+				return common.Sequence{}, 0, false, nil
+			}
+			_, lsn, index, err := parseBoltSequenceKey(k)
+			if err != nil {
+				return common.Sequence{}, 0, false, err
+			}
+			var ts int64
+			if len(v) == 8 {
+				ts = int64(binary.BigEndian.Uint64(v))
+			}
+			return common.MakeSequence(lsn, index), ts, true, nil
+		})
+		return txErr
+	})
+	return
+}
+
+/*
+PurgeScope removes entries for one scope that are too old, or that are not
+among the newest "maxCount," in a single transaction. Entries for a scope
+are in sequence order, so it stops when it gets to "limit."
+*/
+func (s *Bolt) PurgeScope(scope string, oldest time.Time, maxCount int, limit common.Sequence) (purgeCount uint64, lastPurged common.Sequence, err error) {
+	cutoff := uint64(oldest.UnixNano())
+	prefix := boltScopePrefix(scope)
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(boltEntriesBucket)
+		sequences := tx.Bucket(boltSequencesBucket)
+
+		total := 0
+		c := entries.Cursor()
+		if maxCount > 0 {
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				total++
+			}
+		}
+
+		var old [][]byte
+		i := 0
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			_, lsn, index, err := parseBoltEntryKey(k)
+			if err != nil {
+				return err
+			}
+			if common.MakeSequence(lsn, index).Compare(limit) >= 0 {
+				break
+			}
+			overCount := maxCount > 0 && i < total-maxCount
+			i++
+			if !overCount {
+				if oldest.IsZero() {
+					break
+				}
+				ts := sequences.Get(boltSequenceKey(scope, lsn, index))
+				if len(ts) != 8 || binary.BigEndian.Uint64(ts) >= cutoff {
+					continue
+				}
+			}
+			old = append(old, copyBytes(k))
+			lastPurged = common.MakeSequence(lsn, index)
+		}
+
+		// Deleting from a cursor while moving it may skip entries, so
+		// delete everything that we found afterwards.
+		for _, k := range old {
+			_, lsn, index, err := parseBoltEntryKey(k)
+			if err != nil {
+				return err
+			}
+			err = entries.Delete(k)
+			if err == nil {
+				err = sequences.Delete(boltSequenceKey(scope, lsn, index))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		purgeCount = uint64(len(old))
+		return nil
+	})
+	if err != nil {
+		return 0, common.Sequence{}, err
+	}
+	return
+}
+
+/*
+PurgeOldest removes the "count" entries with the lowest sequences that are
+before "limit" and not internal, using the sequences bucket to find them.
+*/
+func (s *Bolt) PurgeOldest(count int, limit common.Sequence) (purgeCount uint64, lastPurged common.Sequence, err error) {
+	if count <= 0 {
+		return
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(boltEntriesBucket)
+		sequences := tx.Bucket(boltSequencesBucket)
+
+		var old [][]byte
+		c := sequences.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			scope, lsn, index, err := parseBoltSequenceKey(k)
+			if err != nil {
+				return err
+			}
+			seq := common.MakeSequence(lsn, index)
+			if seq.Compare(limit) >= 0 ||
+				(len(old) >= count && seq.Compare(lastPurged) != 0) {
+				break
+			}
+			if strings.HasPrefix(scope, InternalScopePrefix) {
+				continue
+			}
+			old = append(old, copyBytes(k))
+			lastPurged = seq
+		}
+
+		// Deleting from a cursor while moving it may skip entries, so
+		// delete everything that we found afterwards.
+		for _, k := range old {
+			scope, lsn, index, err := parseBoltSequenceKey(k)
+			if err != nil {
+				return err
+			}
+			err = entries.Delete(boltEntryKey(scope, lsn, index))
+			if err == nil {
+				err = sequences.Delete(k)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		purgeCount = uint64(len(old))
+		return nil
+	})
+	if err != nil {
+		return 0, common.Sequence{}, err
+	}
+	return
+}
+
+/*
+Size returns the size of the database file, less the pages that are free
+for reuse. Bolt never makes the file smaller.
+*/
+func (s *Bolt) Size() (size int64, err error) {
+	pageSize := int64(s.db.Info().PageSize)
+	err = s.db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	stats := s.db.Stats()
+	size -= int64(stats.FreePageN+stats.PendingPageN) * pageSize
+	return
+}
+
+/*
+PutMetadata saves a value in the metadata bucket.
+*/
+func (s *Bolt) PutMetadata(key string, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if value == nil {
+			value = []byte{}
+		}
+		return tx.Bucket(boltMetadataBucket).Put([]byte(key), value)
+	})
+}
+
+/*
+GetMetadata returns a value from the metadata bucket, or nil.
+*/
+func (s *Bolt) GetMetadata(key string) (value []byte, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		// Databases from older versions that were opened read-only
+		// may not have the bucket
+		if b := tx.Bucket(boltMetadataBucket); b != nil {
+			value = copyBytes(b.Get([]byte(key)))
+		}
+		return nil
+	})
+	return
+}
+
+/*
+DeleteMetadata removes a value from the metadata bucket.
+*/
+func (s *Bolt) DeleteMetadata(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMetadataBucket).Delete([]byte(key))
+	})
+}
+
+/*
+PutMetadataBatch saves and deletes metadata in a single transaction.
+*/
+func (s *Bolt) PutMetadataBatch(values map[string][]byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltMetadataBucket)
+		for key, value := range values {
+			var err error
+			if value == nil {
+				err = b.Delete([]byte(key))
+			} else {
+				err = b.Put([]byte(key), value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+/*
+ListMetadata returns every value in the metadata bucket whose key starts
+with "prefix."
+*/
+func (s *Bolt) ListMetadata(prefix string) (map[string][]byte, error) {
+	ret := make(map[string][]byte)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltMetadataBucket)
+		if b == nil {
+			return nil
+		}
+		pb := []byte(prefix)
+		c := b.Cursor()
+		for k, v := c.Seek(pb); k != nil && bytes.HasPrefix(k, pb); k, v = c.Next() {
+			ret[string(k)] = copyBytes(v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+/*
+GetBackup writes a consistent copy of the database file to the specified
+writer. It's the caller's responsibility to close the writer, if needed.
+*/
+func (s *Bolt) GetBackup(w io.Writer) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+/*
+Backup creates a backup of the current database in the specified directory,
+and sends results using the supplied channel. Bolt copies the whole file in
+one step, so there is only one result.
+*/
+func (s *Bolt) Backup(dest string) <-chan BackupProgress {
+	pc := make(chan BackupProgress, 1)
+	go s.runBackup(dest, pc)
+	return pc
+}
+
+func (s *Bolt) runBackup(dest string, pc chan BackupProgress) {
+	// if the specified database file existed, return error
+	if _, err := os.Stat(dest); err == nil {
+		returnBackupError(pc, errors.New("dest dir existed"))
+		return
+	}
+	fileName, err := createDBDir(dest)
+	if err != nil {
+		returnBackupError(pc, err)
+		return
+	}
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(fileName, 0664)
+	})
+	if err != nil {
+		returnBackupError(pc, err)
+		return
+	}
+	pc <- BackupProgress{
+		Done: true,
+	}
+}
+
+func readBoltLimits(tx *bolt.Tx) (firstSeq, lastSeq common.Sequence, err error) {
+	c := tx.Bucket(boltSequencesBucket).Cursor()
+	k, _ := c.First()
+	if k == nil {
+		return
+	}
+	firstSeq, err = common.ParseSequenceBytes(k[:boltSequenceLen])
+	if err != nil {
+		return
+	}
+	k, _ = c.Last()
+	lastSeq, err = common.ParseSequenceBytes(k[:boltSequenceLen])
+	return
+}
+
+/*
+A boltScopeIterator reads the entries for one scope with a Bolt cursor.
+It is only valid inside the transaction that created the cursor.
+*/
+type boltScopeIterator struct {
+	cursor  *bolt.Cursor
+	prefix  []byte
+	start   []byte
+	cur     readResult
+	started bool
+}
+
+func (b *boltScopeIterator) next() (bool, error) {
+	var k, v []byte
+	if b.started {
+		k, v = b.cursor.Next()
+	} else {
+		k, v = b.cursor.Seek(b.start)
+		b.started = true
+	}
+
+	if k == nil || len(k) != len(b.prefix)+boltSequenceLen ||
+		!bytes.HasPrefix(k, b.prefix) {
+		// Reached the end of our range
+		return false, nil
+	}
+
+	seq := k[len(b.prefix):]
+	b.cur = readResult{
+		lsn:   binary.BigEndian.Uint64(seq),
+		index: binary.BigEndian.Uint32(seq[8:]),
+		data:  copyBytes(v),
+	}
+	return true, nil
+}
+
+func (b *boltScopeIterator) entry() *readResult {
+	return &b.cur
+}
+
+func (b *boltScopeIterator) close() {
+}
+
+func boltScopePrefix(scope string) []byte {
+	ib := make([]byte, binary.MaxVarintLen64)
+	c := binary.PutUvarint(ib, uint64(len(scope)))
+	return append(ib[:c], scope...)
+}
+
+func boltEntryKey(scope string, lsn uint64, index uint32) []byte {
+	return append(boltScopePrefix(scope), common.MakeSequence(lsn, index).Bytes()...)
+}
+
+func parseBoltEntryKey(key []byte) (scope string, lsn uint64, index uint32, err error) {
+	sl, n := binary.Uvarint(key)
+	if n <= 0 || uint64(len(key)-n) != sl+boltSequenceLen {
+		err = errors.New("Invalid entry key")
+		return
+	}
+	scope = string(key[n : n+int(sl)])
+	seq := key[n+int(sl):]
+	lsn = binary.BigEndian.Uint64(seq)
+	index = binary.BigEndian.Uint32(seq[8:])
+	return
+}
+
+func boltSequenceKey(scope string, lsn uint64, index uint32) []byte {
+	return append(common.MakeSequence(lsn, index).Bytes(), scope...)
+}
+
+func parseBoltSequenceKey(key []byte) (scope string, lsn uint64, index uint32, err error) {
+	if len(key) < boltSequenceLen {
+		err = errors.New("Invalid sequence key")
+		return
+	}
+	lsn = binary.BigEndian.Uint64(key)
+	index = binary.BigEndian.Uint32(key[8:])
+	scope = string(key[boltSequenceLen:])
+	return
+}
+
+// Bolt's slices are only valid inside a transaction, so make a copy
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	ret := make([]byte, len(b))
+	copy(ret, b)
+	return ret
+}
@@ -29,6 +29,7 @@ import (
 
 func TestStorage(t *testing.T) {
 	RegisterFailHandler(Fail)
+	addEngineTests()
 	junitReporter := reporters.NewJUnitReporter("../test-reports/storage.xml")
 	RunSpecsWithDefaultAndCustomReporters(t, "Storage suite", []Reporter{junitReporter})
 }
@@ -47,5 +48,43 @@ func TestMain(m *testing.M) {
 		cleanDB.Close()
 		cleanDB.Delete()
 	}
+	if scanDB != nil {
+		fmt.Printf("Deleting %s\n", scanDBDir)
+		scanDB.Close()
+		scanDB.Delete()
+	}
 	os.Exit(ret)
 }
+
+type engineTests struct {
+	text string
+	body func(engineName string)
+}
+
+var allEngineTests []engineTests
+
+/*
+describeEngines runs the same tests against every storage engine that is
+built in. The tests are passed the name of the engine. Engines register
+themselves in "init," which runs after package variables are set, so the
+tests are only added to the suite in "TestStorage."
+*/
+func describeEngines(text string, body func(engineName string)) bool {
+	allEngineTests = append(allEngineTests, engineTests{
+		text: text,
+		body: body,
+	})
+	return true
+}
+
+func addEngineTests() {
+	for _, engineName := range Engines() {
+		for _, t := range allEngineTests {
+			name := engineName
+			body := t.body
+			Describe(fmt.Sprintf("%s (%s)", t.text, name), func() {
+				body(name)
+			})
+		}
+	}
+}
@@ -19,10 +19,15 @@ limitations under the License.
 package storage
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"math"
+	"os"
 	"sort"
+	"strconv"
+	"strings"
 
 	"time"
 
@@ -51,28 +56,36 @@ type RocksDB struct {
 	db           *gorocksdb.DB
 	sequenceCF   *gorocksdb.ColumnFamilyHandle
 	entriesCF    *gorocksdb.ColumnFamilyHandle
+	metadataCF   *gorocksdb.ColumnFamilyHandle
 	dbOpts       *gorocksdb.Options
 	dfltOpts     *gorocksdb.Options
 	sequenceOpts *gorocksdb.Options
 	entriesOpts  *gorocksdb.Options
 }
 
-type readResult struct {
-	lsn   uint64
-	index uint32
-	data  []byte
+func init() {
+	registerEngine(RocksDBEngine, &engine{
+		open: OpenRocksDB,
+		openReadOnly: func(baseFile string) (DB, error) {
+			return openRocksDB(baseFile, true)
+		},
+		exists: rocksExists,
+	})
 }
-type readResults []readResult
 
 /*
-Open opens a RocksDB database and makes it available for reads and writes.
-Opened databases should be closed when done.
+OpenRocksDB opens a RocksDB database and makes it available for reads and
+writes. Opened databases should be closed when done.
 
 The "baseFile" parameter refers to the name of a directory where RocksDB can
 store its data. RocksDB will create many files inside this directory. To create
 an empty database, make sure that it is empty.
 */
-func Open(baseFile string) (DB, error) {
+func OpenRocksDB(baseFile string) (DB, error) {
+	return openRocksDB(baseFile, false)
+}
+
+func openRocksDB(baseFile string, readOnly bool) (DB, error) {
 
 	success := false
 	stor := &RocksDB{
@@ -99,16 +112,20 @@ func Open(baseFile string) (DB, error) {
 	stor.sequenceOpts = gorocksdb.NewDefaultOptions()
 	stor.sequenceOpts.SetComparator(sequenceComparator)
 
+	cfNames := []string{defaultCFName, entriesCFName, sequenceCFName}
+	cfOpts := []*gorocksdb.Options{stor.dfltOpts, stor.entriesOpts, stor.sequenceOpts}
 	var cfs []*gorocksdb.ColumnFamilyHandle
-	stor.db, cfs, err = gorocksdb.OpenDbColumnFamilies(
-		dbOpts,
-		baseFile,
-		[]string{defaultCFName, entriesCFName, sequenceCFName},
-		[]*gorocksdb.Options{stor.dfltOpts, stor.entriesOpts, stor.sequenceOpts},
-	)
+	if readOnly {
+		stor.db, cfs, err = gorocksdb.OpenDbForReadOnlyColumnFamilies(
+			dbOpts, baseFile, cfNames, cfOpts, false)
+	} else {
+		stor.db, cfs, err = gorocksdb.OpenDbColumnFamilies(
+			dbOpts, baseFile, cfNames, cfOpts)
+	}
 	if err != nil {
 		return nil, err
 	}
+	stor.metadataCF = cfs[0]
 	stor.entriesCF = cfs[1]
 	stor.sequenceCF = cfs[2]
 
@@ -158,7 +175,7 @@ func (s *RocksDB) Put(scope string, lsn uint64, index uint32, data []byte) error
 	batch := gorocksdb.NewWriteBatch()
 	defer batch.Destroy()
 
-	s.putOne(batch, scope, lsn, index, data)
+	s.putOne(batch, time.Now(), scope, lsn, index, data)
 
 	return s.db.Write(defaultWriteOptions, batch)
 }
@@ -170,19 +187,42 @@ func (s *RocksDB) PutBatch(entries []Entry) error {
 	batch := gorocksdb.NewWriteBatch()
 	defer batch.Destroy()
 
+	now := time.Now()
+	for _, entry := range entries {
+		s.putOne(batch, entry.insertTime(now), entry.Scope, entry.LSN, entry.Index, entry.Data)
+	}
+
+	return s.db.Write(defaultWriteOptions, batch)
+}
+
+/*
+DeleteBatch deletes a whole bunch in a single write batch.
+*/
+func (s *RocksDB) DeleteBatch(entries []Entry) error {
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+
 	for _, entry := range entries {
-		s.putOne(batch, entry.Scope, entry.LSN, entry.Index, entry.Data)
+		s.deleteOne(batch, entry.Scope, entry.LSN, entry.Index)
 	}
 
 	return s.db.Write(defaultWriteOptions, batch)
 }
 
-func (s *RocksDB) putOne(b *gorocksdb.WriteBatch, scope string, lsn uint64, index uint32, data []byte) {
+func (s *RocksDB) putOne(b *gorocksdb.WriteBatch, now time.Time, scope string, lsn uint64, index uint32, data []byte) {
 	keyBuf := lsnAndOffsetToKey(scope, lsn, index)
-	b.PutCF(s.entriesCF, keyBuf, prependTimestamp(time.Now(), data))
+	b.PutCF(s.entriesCF, keyBuf, prependTimestamp(now, data))
 
-	seqBuf := common.MakeSequence(lsn, index).Bytes()
-	b.PutCF(s.sequenceCF, seqBuf, nil)
+	// The time is also kept in the sequence so that FirstSequenceSince
+	// doesn't have to read the entries
+	b.PutCF(s.sequenceCF, sequenceKey(scope, lsn, index), prependTimestamp(now, nil))
+}
+
+func (s *RocksDB) deleteOne(b *gorocksdb.WriteBatch, scope string, lsn uint64, index uint32) {
+	b.DeleteCF(s.entriesCF, lsnAndOffsetToKey(scope, lsn, index))
+	b.DeleteCF(s.sequenceCF, sequenceKey(scope, lsn, index))
+	// Older versions did not put the scope in the key
+	b.DeleteCF(s.sequenceCF, common.MakeSequence(lsn, index).Bytes())
 }
 
 /*
@@ -230,24 +270,47 @@ func (s *RocksDB) Scan(
 		return
 	}
 
-	// Read range for each scope
-	var results readResults
-	for _, scope := range scopes {
-		var rr readResults
-		rr, err = s.readOneRange(scope, startLSN, startIndex, limit, ropts, filter)
-		if err != nil {
-			return
+	// Merge the ranges for each scope, each with its own iterator
+	iters := make([]scopeIterator, len(scopes))
+	for i, scope := range scopes {
+		it := s.db.NewIteratorCF(ropts, s.entriesCF)
+		it.Seek(lsnAndOffsetToKey(scope, startLSN, startIndex))
+		iters[i] = &rocksScopeIterator{
+			it:     it,
+			endKey: lsnAndOffsetToKey(scope, math.MaxInt64, math.MaxInt32),
 		}
-		results = append(results, rr...)
 	}
+	final, err = mergeScopes(iters, limit, filter)
+	return
+}
 
-	// Sort and then take limit
-	sort.Sort(results)
+/*
+ScanAll reads entries from every scope in key order, which is by scope and
+then by sequence.
+*/
+func (s *RocksDB) ScanAll(
+	startScope string, startLSN uint64, startIndex uint32,
+	limit int) ([]Entry, error) {
+
+	it := s.db.NewIteratorCF(defaultReadOptions, s.entriesCF)
+	defer it.Close()
 
-	for count := 0; count < len(results) && count < limit; count++ {
-		final = append(final, results[count].data)
+	var entries []Entry
+	for it.Seek(lsnAndOffsetToKey(startScope, startLSN, startIndex)); it.Valid() && len(entries) < limit; it.Next() {
+		scope, lsn, index, err := keyToLsnAndOffset(readIterKey(it))
+		if err != nil {
+			return nil, err
+		}
+		ts, data := extractTimestamp(readSlice(it.Value()))
+		entries = append(entries, Entry{
+			Scope:     scope,
+			LSN:       lsn,
+			Index:     index,
+			Data:      data,
+			Timestamp: ts,
+		})
 	}
-	return
+	return entries, nil
 }
 
 /*
@@ -257,6 +320,14 @@ then a non-nil error will be returned. Be aware that this operation may
 take a long time, so it is important to run it in a separate goroutine.
 */
 func (s *RocksDB) Purge(oldest time.Time) (purgeCount uint64, err error) {
+	return s.PurgeBefore(oldest, NoLimit)
+}
+
+/*
+PurgeBefore is like Purge, but only deletes entries whose sequence is
+before "limit."
+*/
+func (s *RocksDB) PurgeBefore(oldest time.Time, limit common.Sequence) (purgeCount uint64, err error) {
 	it := s.db.NewIteratorCF(defaultReadOptions, s.entriesCF)
 	defer it.Close()
 	it.SeekToFirst()
@@ -264,7 +335,16 @@ func (s *RocksDB) Purge(oldest time.Time) (purgeCount uint64, err error) {
 	for ; it.Valid(); it.Next() {
 		// No need to copy the slice here -- we just read the timestamp
 		ts, _ := extractTimestamp(it.Value().Data())
-		if ts.Before(oldest) {
+		if !ts.Before(oldest) {
+			continue
+		}
+		var lsn uint64
+		var index uint32
+		_, lsn, index, err = keyToLsnAndOffset(it.Key().Data())
+		if err != nil {
+			return
+		}
+		if common.MakeSequence(lsn, index).Compare(limit) < 0 {
 			err = s.deleteIterKey(it)
 			if err != nil {
 				return
@@ -275,6 +355,224 @@ func (s *RocksDB) Purge(oldest time.Time) (purgeCount uint64, err error) {
 	return
 }
 
+/*
+Scopes returns the names of all the scopes that have entries, sorted.
+*/
+func (s *RocksDB) Scopes() ([]string, error) {
+	it := s.db.NewIteratorCF(defaultReadOptions, s.entriesCF)
+	defer it.Close()
+
+	var scopes []string
+	it.SeekToFirst()
+	for it.Valid() {
+		scope, _, _, err := keyToLsnAndOffset(readIterKey(it))
+		if err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, scope)
+
+		// Skip the rest of the entries for the scope
+		endKey := lsnAndOffsetToKey(scope, math.MaxInt64, math.MaxInt32)
+		it.Seek(endKey)
+		if it.Valid() && entryComparator.Compare(it.Key().Data(), endKey) == 0 {
+			it.Next()
+		}
+	}
+	sort.Strings(scopes)
+	return scopes, nil
+}
+
+/*
+PurgeScope removes entries for one scope that are too old, or that are not
+among the newest "maxCount," in a single batch. Entries for a scope are in
+sequence order, so it stops when it gets to "limit."
+*/
+func (s *RocksDB) PurgeScope(scope string, oldest time.Time, maxCount int, limit common.Sequence) (purgeCount uint64, lastPurged common.Sequence, err error) {
+	snap := s.db.NewSnapshot()
+	defer snap.Release()
+
+	ropts := gorocksdb.NewDefaultReadOptions()
+	ropts.SetSnapshot(snap)
+	defer ropts.Destroy()
+
+	it := s.db.NewIteratorCF(ropts, s.entriesCF)
+	defer it.Close()
+
+	startKey := lsnAndOffsetToKey(scope, 0, 0)
+	endKey := lsnAndOffsetToKey(scope, math.MaxInt64, math.MaxInt32)
+	inRange := func() bool {
+		return it.Valid() && entryComparator.Compare(it.Key().Data(), endKey) <= 0
+	}
+
+	total := 0
+	if maxCount > 0 {
+		for it.Seek(startKey); inRange(); it.Next() {
+			total++
+		}
+	}
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+
+	i := 0
+	for it.Seek(startKey); inRange(); it.Next() {
+		keyData := readIterKey(it)
+		var lsn uint64
+		var index uint32
+		_, lsn, index, err = keyToLsnAndOffset(keyData)
+		if err != nil {
+			return 0, common.Sequence{}, err
+		}
+		if common.MakeSequence(lsn, index).Compare(limit) >= 0 {
+			break
+		}
+
+		overCount := maxCount > 0 && i < total-maxCount
+		i++
+		if !overCount {
+			if oldest.IsZero() {
+				break
+			}
+			// No need to copy the slice here -- we just read the timestamp
+			ts, _ := extractTimestamp(it.Value().Data())
+			if !ts.Before(oldest) {
+				continue
+			}
+		}
+		s.deleteOne(batch, scope, lsn, index)
+		purgeCount++
+		lastPurged = common.MakeSequence(lsn, index)
+	}
+
+	err = s.db.Write(defaultWriteOptions, batch)
+	if err != nil {
+		return 0, common.Sequence{}, err
+	}
+	return
+}
+
+/*
+PurgeOldest removes the "count" entries with the lowest sequences that are
+before "limit" and not internal. The sequence column family tells us the
+newest sequence to remove, and then the entries for each scope are removed
+up to that sequence. The purged range is compacted right away so that
+"Size" reflects the purge.
+*/
+func (s *RocksDB) PurgeOldest(count int, limit common.Sequence) (purgeCount uint64, lastPurged common.Sequence, err error) {
+	if count <= 0 {
+		return
+	}
+
+	var firstSeqKey, lastSeqKey []byte
+	seqIt := s.db.NewIteratorCF(defaultReadOptions, s.sequenceCF)
+	n := 0
+	for seqIt.SeekToFirst(); seqIt.Valid() && n < count; seqIt.Next() {
+		seqKey := readIterKey(seqIt)
+		var seq common.Sequence
+		var scope []byte
+		seq, scope, err = parseSequenceKey(seqKey)
+		if err != nil {
+			seqIt.Close()
+			return 0, common.Sequence{}, err
+		}
+		if seq.Compare(limit) >= 0 {
+			break
+		}
+		if firstSeqKey == nil {
+			firstSeqKey = seqKey
+		}
+		if bytes.HasPrefix(scope, []byte(InternalScopePrefix)) {
+			continue
+		}
+		lastSeqKey = seqKey
+		lastPurged = seq
+		n++
+	}
+	seqIt.Close()
+	if n == 0 {
+		return
+	}
+
+	scopes, err := s.Scopes()
+	if err != nil {
+		return 0, common.Sequence{}, err
+	}
+
+	it := s.db.NewIteratorCF(defaultReadOptions, s.entriesCF)
+	defer it.Close()
+
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
+
+	// The range of keys that was deleted from each scope
+	var purgedRanges []gorocksdb.Range
+
+	for _, scope := range scopes {
+		if strings.HasPrefix(scope, InternalScopePrefix) {
+			continue
+		}
+		var scopeRange gorocksdb.Range
+		for it.Seek(lsnAndOffsetToKey(scope, 0, 0)); it.Valid(); it.Next() {
+			keyData := readIterKey(it)
+			var keyScope string
+			var lsn uint64
+			var index uint32
+			keyScope, lsn, index, err = keyToLsnAndOffset(keyData)
+			if err != nil {
+				return 0, common.Sequence{}, err
+			}
+			seq := common.MakeSequence(lsn, index)
+			if keyScope != scope || seq.Compare(lastPurged) > 0 {
+				break
+			}
+			s.deleteOne(batch, scope, lsn, index)
+			purgeCount++
+			if scopeRange.Start == nil {
+				scopeRange.Start = keyData
+			}
+			scopeRange.Limit = keyData
+		}
+		if scopeRange.Start != nil {
+			purgedRanges = append(purgedRanges, scopeRange)
+		}
+	}
+
+	err = s.db.Write(defaultWriteOptions, batch)
+	if err != nil {
+		return 0, common.Sequence{}, err
+	}
+
+	// Compact just what we deleted, so that Size goes down without
+	// rewriting the rest of the database. RocksDB includes the end of
+	// each range.
+	for _, r := range purgedRanges {
+		s.db.CompactRangeCF(s.entriesCF, r)
+	}
+	s.db.CompactRangeCF(s.sequenceCF, gorocksdb.Range{
+		Start: firstSeqKey,
+		Limit: lastSeqKey,
+	})
+	return
+}
+
+/*
+Size returns RocksDB's estimate of the live data in the entry and sequence
+column families, plus what is still in memory.
+*/
+func (s *RocksDB) Size() (int64, error) {
+	var size int64
+	for _, cf := range []*gorocksdb.ColumnFamilyHandle{s.entriesCF, s.sequenceCF} {
+		for _, prop := range []string{"rocksdb.estimate-live-data-size", "rocksdb.cur-size-all-mem-tables"} {
+			v, err := strconv.ParseInt(s.db.GetPropertyCF(prop, cf), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("Invalid value for %s: %s", prop, err)
+			}
+			size += v
+		}
+	}
+	return size, nil
+}
+
 /*
 Backup is not supported for the RocksDB back end.
 */
@@ -287,69 +585,130 @@ func (s *RocksDB) Backup(dest string) <-chan BackupProgress {
 	return bc
 }
 
+// rocksExists returns true if there is already a database in "baseFile"
+func rocksExists(baseFile string) bool {
+	_, err := os.Stat(baseFile)
+	return err == nil
+}
+
 /*
-GetBackup is not supported.
+FirstSequenceSince searches the sequence column family, whose values are
+the timestamps. Entries written by older versions have no time there,
+so they are treated as older than everything else.
 */
-func (s *RocksDB) GetBackup(w io.Writer) (err error) {
-	return errors.New("Not implemented")
+func (s *RocksDB) FirstSequenceSince(t time.Time) (common.Sequence, bool, error) {
+	snap := s.db.NewSnapshot()
+	defer snap.Release()
+
+	ropts := gorocksdb.NewDefaultReadOptions()
+	ropts.SetSnapshot(snap)
+	defer ropts.Destroy()
+
+	it := s.db.NewIteratorCF(ropts, s.sequenceCF)
+	defer it.Close()
+
+	return searchByTime(t, func(start common.Sequence) (common.Sequence, int64, bool, error) {
+		var seq common.Sequence
+		var scope []byte
+		var err error
+		for it.Seek(start.Bytes()); ; it.Next() {
+			kb := readIterKey(it)
+			if kb == nil {
+				return common.Sequence{}, 0, false, it.Err()
+			}
+			seq, scope, err = parseSequenceKey(kb)
+			if err != nil {
+				return common.Sequence{}, 0, false, err
+			}
+			if !bytes.HasPrefix(scope, []byte(InternalScopePrefix)) {
+				break
+			}
+		}
+		var ts int64
+		if vb := readSlice(it.Value()); len(vb) > 0 {
+			t, _ := extractTimestamp(vb)
+			ts = t.UnixNano()
+		}
+		return seq, ts, true, nil
+	})
 }
 
-func (s *RocksDB) deleteIterKey(it *gorocksdb.Iterator) error {
+/*
+PutMetadata saves a value in the default column family.
+*/
+func (s *RocksDB) PutMetadata(key string, value []byte) error {
+	return s.db.PutCF(defaultWriteOptions, s.metadataCF, []byte(key), value)
+}
+
+/*
+GetMetadata returns a value from the default column family, or nil.
+*/
+func (s *RocksDB) GetMetadata(key string) ([]byte, error) {
+	return s.readEntry([]byte(key), s.metadataCF, defaultReadOptions)
+}
+
+/*
+DeleteMetadata removes a value from the default column family.
+*/
+func (s *RocksDB) DeleteMetadata(key string) error {
+	return s.db.DeleteCF(defaultWriteOptions, s.metadataCF, []byte(key))
+}
+
+/*
+PutMetadataBatch saves and deletes metadata in a single write batch.
+*/
+func (s *RocksDB) PutMetadataBatch(values map[string][]byte) error {
 	batch := gorocksdb.NewWriteBatch()
 	defer batch.Destroy()
 
-	keyData := readIterKey(it)
-	_, lsn, index, err := keyToLsnAndOffset(keyData)
-	if err != nil {
-		return err
+	for key, value := range values {
+		if value == nil {
+			batch.DeleteCF(s.metadataCF, []byte(key))
+		} else {
+			batch.PutCF(s.metadataCF, []byte(key), value)
+		}
 	}
-
-	batch.DeleteCF(s.sequenceCF, common.MakeSequence(lsn, index).Bytes())
-	batch.DeleteCF(s.entriesCF, keyData)
 	return s.db.Write(defaultWriteOptions, batch)
 }
 
-func (s *RocksDB) readOneRange(scope string, startLSN uint64,
-	startIndex uint32, limit int, ro *gorocksdb.ReadOptions,
-	filter func([]byte) bool) (readResults, error) {
-
-	startKeyBuf := lsnAndOffsetToKey(scope, startLSN, startIndex)
-	endKeyBuf := lsnAndOffsetToKey(scope, math.MaxInt64, math.MaxInt32)
-
-	it := s.db.NewIteratorCF(ro, s.entriesCF)
+/*
+ListMetadata returns every value in the default column family whose key
+starts with "prefix."
+*/
+func (s *RocksDB) ListMetadata(prefix string) (map[string][]byte, error) {
+	it := s.db.NewIteratorCF(defaultReadOptions, s.metadataCF)
 	defer it.Close()
 
-	it.Seek(startKeyBuf)
-
-	var results readResults
-
-	for ; it.Valid() && len(results) < limit; it.Next() {
-		iterKey := it.Key().Data()
-		if entryComparator.Compare(iterKey, endKeyBuf) > 0 {
-			// Reached the end of our range
-			//fmt.Printf("Stopped due to end of range, iterKey is %s, endKey is %s\n", hex.Dump(iterKey), hex.Dump(endKeyBuf))
+	ret := make(map[string][]byte)
+	pb := []byte(prefix)
+	for it.Seek(pb); it.Valid(); it.Next() {
+		key := readIterKey(it)
+		if !bytes.HasPrefix(key, pb) {
 			break
 		}
+		ret[string(key)] = readSlice(it.Value())
+	}
+	return ret, it.Err()
+}
 
-		_, iterLSN, iterIx, err := keyToLsnAndOffset(iterKey)
-		if err != nil {
-			return nil, err
-		}
+/*
+GetBackup is not supported.
+*/
+func (s *RocksDB) GetBackup(w io.Writer) (err error) {
+	return errors.New("Not implemented")
+}
 
-		bb := readSlice(it.Value())
-		_, buf := extractTimestamp(bb)
+func (s *RocksDB) deleteIterKey(it *gorocksdb.Iterator) error {
+	batch := gorocksdb.NewWriteBatch()
+	defer batch.Destroy()
 
-		if filter == nil || filter(buf) {
-			result := readResult{
-				lsn:   iterLSN,
-				index: iterIx,
-				data:  buf,
-			}
-			results = append(results, result)
-		}
+	scope, lsn, index, err := keyToLsnAndOffset(readIterKey(it))
+	if err != nil {
+		return err
 	}
 
-	return results, nil
+	s.deleteOne(batch, scope, lsn, index)
+	return s.db.Write(defaultWriteOptions, batch)
 }
 
 func (s *RocksDB) readEntry(key []byte, cf *gorocksdb.ColumnFamilyHandle, ro *gorocksdb.ReadOptions) ([]byte, error) {
@@ -368,7 +727,7 @@ func (s *RocksDB) readLimits(ro *gorocksdb.ReadOptions) (firstSeq, lastSeq commo
 	seqIter.SeekToFirst()
 	kb := readIterKey(seqIter)
 	if kb != nil {
-		firstSeq, err = common.ParseSequenceBytes(kb)
+		firstSeq, _, err = parseSequenceKey(kb)
 		if err != nil {
 			return
 		}
@@ -378,7 +737,7 @@ func (s *RocksDB) readLimits(ro *gorocksdb.ReadOptions) (firstSeq, lastSeq commo
 		if kb == nil {
 			lastSeq = firstSeq
 		} else {
-			lastSeq, err = common.ParseSequenceBytes(kb)
+			lastSeq, _, err = parseSequenceKey(kb)
 			if err != nil {
 				return
 			}
@@ -407,24 +766,48 @@ func readSlice(s *gorocksdb.Slice) []byte {
 	return ret
 }
 
-// Needed to sort read results by LSN and index
-
-func (r readResults) Len() int {
-	return len(r)
+/*
+A rocksScopeIterator reads the entries for one scope from a RocksDB iterator.
+*/
+type rocksScopeIterator struct {
+	it      *gorocksdb.Iterator
+	endKey  []byte
+	cur     readResult
+	started bool
 }
 
-func (r readResults) Less(i, j int) bool {
-	if r[i].lsn < r[j].lsn {
-		return true
+func (r *rocksScopeIterator) next() (bool, error) {
+	if r.started {
+		r.it.Next()
+	}
+	r.started = true
+
+	if !r.it.Valid() {
+		return false, nil
 	}
-	if r[i].lsn == r[j].lsn && r[i].index < r[j].index {
-		return true
+	iterKey := r.it.Key().Data()
+	if entryComparator.Compare(iterKey, r.endKey) > 0 {
+		// Reached the end of our range
+		return false, nil
 	}
-	return false
+
+	_, lsn, ix, err := keyToLsnAndOffset(iterKey)
+	if err != nil {
+		return false, err
+	}
+	_, buf := extractTimestamp(readSlice(r.it.Value()))
+	r.cur = readResult{
+		lsn:   lsn,
+		index: ix,
+		data:  buf,
+	}
+	return true, nil
+}
+
+func (r *rocksScopeIterator) entry() *readResult {
+	return &r.cur
 }
 
-func (r readResults) Swap(i, j int) {
-	tmp := r[i]
-	r[i] = r[j]
-	r[j] = tmp
+func (r *rocksScopeIterator) close() {
+	r.it.Close()
 }
@@ -0,0 +1,110 @@
+// +build rocksdb
+
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package storage
+
+import (
+	"math"
+	"sort"
+
+	"github.com/apigee-labs/transicator/common"
+	"github.com/tecbot/gorocksdb"
+)
+
+/*
+scanSorted does the same thing as Scan, but the old way: by reading "limit" entries from every scope and then
+sorting them all. It is only here so that benchmarks can compare the two.
+*/
+func (s *RocksDB) scanSorted(
+	scopes []string,
+	startLSN uint64, startIndex uint32,
+	limit int, filter func([]byte) bool) (final [][]byte, firstSeq common.Sequence, lastSeq common.Sequence, err error) {
+
+	snap := s.db.NewSnapshot()
+	defer snap.Release()
+
+	ropts := gorocksdb.NewDefaultReadOptions()
+	ropts.SetSnapshot(snap)
+	defer ropts.Destroy()
+
+	firstSeq, lastSeq, err = s.readLimits(ropts)
+	if err != nil {
+		return
+	}
+
+	// Read range for each scope
+	var results readResults
+	for _, scope := range scopes {
+		var rr readResults
+		rr, err = s.readOneRange(scope, startLSN, startIndex, limit, ropts, filter)
+		if err != nil {
+			return
+		}
+		results = append(results, rr...)
+	}
+
+	// Sort and then take limit
+	sort.Sort(results)
+
+	for count := 0; count < len(results) && count < limit; count++ {
+		final = append(final, results[count].data)
+	}
+	return
+}
+
+func (s *RocksDB) readOneRange(scope string, startLSN uint64,
+	startIndex uint32, limit int, ro *gorocksdb.ReadOptions,
+	filter func([]byte) bool) (readResults, error) {
+
+	startKeyBuf := lsnAndOffsetToKey(scope, startLSN, startIndex)
+	endKeyBuf := lsnAndOffsetToKey(scope, math.MaxInt64, math.MaxInt32)
+
+	it := s.db.NewIteratorCF(ro, s.entriesCF)
+	defer it.Close()
+
+	it.Seek(startKeyBuf)
+
+	var results readResults
+
+	for ; it.Valid() && len(results) < limit; it.Next() {
+		iterKey := it.Key().Data()
+		if entryComparator.Compare(iterKey, endKeyBuf) > 0 {
+			// Reached the end of our range
+			//fmt.Printf("Stopped due to end of range, iterKey is %s, endKey is %s\n", hex.Dump(iterKey), hex.Dump(endKeyBuf))
+			break
+		}
+
+		_, iterLSN, iterIx, err := keyToLsnAndOffset(iterKey)
+		if err != nil {
+			return nil, err
+		}
+
+		bb := readSlice(it.Value())
+		_, buf := extractTimestamp(bb)
+
+		if filter == nil || filter(buf) {
+			result := readResult{
+				lsn:   iterLSN,
+				index: iterIx,
+				data:  buf,
+			}
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
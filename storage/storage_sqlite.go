@@ -1,4 +1,4 @@
-// +build !rocksdb
+// +build cgo
 
 /*
 Copyright 2016 The Transicator Authors
@@ -19,12 +19,12 @@ limitations under the License.
 package storage
 
 import (
-	"sort"
-
 	"database/sql"
 
 	"fmt"
+	"math"
 	"os"
+	"strings"
 	"time"
 
 	"io"
@@ -49,27 +49,49 @@ type SQL struct {
 	db          *sql.DB
 	insert      *sql.Stmt
 	readRange   *sql.Stmt
+	readPage    *sql.Stmt
+	readAll     *sql.Stmt
 	readFirst   *sql.Stmt
 	readLast    *sql.Stmt
 	purgeByTime *sql.Stmt
+	// false if a database that was opened read-only has no metadata table
+	hasMetadata bool
 }
 
-type readResult struct {
-	lsn   uint64
-	index uint32
-	data  []byte
+func init() {
+	registerEngine(SQLiteEngine, &engine{
+		open: func(baseFile string) (DB, error) {
+			db, err := OpenSQL(baseFile)
+			if err != nil {
+				return nil, err
+			}
+			return db, nil
+		},
+		openReadOnly: func(baseFile string) (DB, error) {
+			db, err := openSQL(baseFile, true)
+			if err != nil {
+				return nil, err
+			}
+			return db, nil
+		},
+		exists:  fileExists,
+		restore: restoreFile,
+	})
 }
-type readResults []readResult
 
 /*
-Open opens a SQLite database and makes it available for reads and writes.
+OpenSQL opens a SQLite database and makes it available for reads and writes.
 Opened databases should be closed when done.
 
 The "baseFile" parameter refers to the name of a directory where RocksDB can
 store its data. SQLite will create a few inside this directory. To create
 an empty database, make sure that it is empty.
 */
-func Open(baseFile string) (*SQL, error) {
+func OpenSQL(baseFile string) (*SQL, error) {
+	return openSQL(baseFile, false)
+}
+
+func openSQL(baseFile string, readOnly bool) (*SQL, error) {
 
 	success := false
 
@@ -77,6 +99,9 @@ func Open(baseFile string) (*SQL, error) {
 	if err != nil {
 		return nil, err
 	}
+	if readOnly {
+		url = fmt.Sprintf("file:%s?mode=ro", url)
+	}
 
 	log.Infof("Opening SQLite DB at %s\n", url)
 	db, err := sql.Open(driverName, url)
@@ -90,20 +115,38 @@ func Open(baseFile string) (*SQL, error) {
 		}
 	}()
 
-	_, err = db.Exec(createTableSQL)
-	if err != nil {
-		return nil, err
+	if !readOnly {
+		_, err = db.Exec(createTableSQL)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	stor := &SQL{
-		baseFile: baseFile,
-		db:       db,
+		baseFile:    baseFile,
+		db:          db,
+		hasMetadata: true,
+	}
+	if readOnly {
+		// Databases from older versions don't have the metadata table
+		var count int
+		err = db.QueryRow(hasMetadataSQL).Scan(&count)
+		if err != nil {
+			return nil, err
+		}
+		stor.hasMetadata = count > 0
 	}
 
 	stor.insert, err = db.Prepare(insertSQL)
 	if err == nil {
 		stor.readRange, err = db.Prepare(readRangeSQL)
 	}
+	if err == nil {
+		stor.readPage, err = db.Prepare(readPageSQL)
+	}
+	if err == nil {
+		stor.readAll, err = db.Prepare(readAllSQL)
+	}
 	if err == nil {
 		stor.readFirst, err = db.Prepare(readFirstSQL)
 	}
@@ -122,21 +165,6 @@ func Open(baseFile string) (*SQL, error) {
 	return stor, nil
 }
 
-// createDBDir ensures that "base" is a directory and returns the file name
-func createDBDir(baseFile string) (string, error) {
-	st, err := os.Stat(baseFile)
-	if err != nil {
-		err = os.Mkdir(baseFile, 0775)
-		if err != nil {
-			return "", err
-		}
-	} else if !st.IsDir() {
-		return "", fmt.Errorf("Database location %s is not a directory", baseFile)
-	}
-
-	return fmt.Sprintf("%s/transicator", baseFile), err
-}
-
 /*
 Close closes the database cleanly.
 */
@@ -176,7 +204,32 @@ func (s *SQL) PutBatch(entries []Entry) error {
 	for _, entry := range entries {
 		_, err = is.Exec(
 			entry.Scope, entry.LSN, entry.Index,
-			time.Now().UnixNano(), entry.Data)
+			entry.insertTime(time.Now()).UnixNano(), entry.Data)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+/*
+DeleteBatch deletes a whole bunch in one transaction.
+*/
+func (s *SQL) DeleteBatch(entries []Entry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ds, err := tx.Prepare(deleteSQL)
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+
+	for _, entry := range entries {
+		_, err = ds.Exec(entry.Scope, entry.LSN, entry.Index)
 		if err != nil {
 			return err
 		}
@@ -230,25 +283,53 @@ func (s *SQL) Scan(
 		return
 	}
 
-	// Read range for each scope
-	var results readResults
-	for _, scope := range scopes {
-		var rr readResults
-		rr, err = s.readOneRange(scope, startLSN, startIndex, limit, tx, filter)
-		if err != nil {
-			return
+	// Merge the ranges for each scope. Each one is read a page at a time
+	// since only one query may be active on the statement at once.
+	rps := tx.Stmt(s.readPage)
+	defer rps.Close()
+
+	pageSize := firstPageSize(limit, len(scopes))
+	iters := make([]scopeIterator, len(scopes))
+	for i, scope := range scopes {
+		iters[i] = &sqlScopeIterator{
+			stmt:     rps,
+			scope:    scope,
+			lsn:      startLSN,
+			index:    startIndex,
+			pageSize: pageSize,
 		}
-		results = append(results, rr...)
 	}
-	tx.Commit()
+	final, err = mergeScopes(iters, limit, filter)
+	return
+}
+
+/*
+ScanAll reads entries from every scope in primary key order, which is by
+scope and then by sequence.
+*/
+func (s *SQL) ScanAll(
+	startScope string, startLSN uint64, startIndex uint32,
+	limit int) ([]Entry, error) {
 
-	// Sort and then take limit
-	sort.Sort(results)
+	rows, err := s.readAll.Query(startScope, startScope, startLSN, startLSN,
+		startIndex, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	for count := 0; count < len(results) && count < limit; count++ {
-		final = append(final, results[count].data)
+	var entries []Entry
+	for rows.Next() {
+		var e Entry
+		var ts int64
+		err = rows.Scan(&e.Scope, &e.LSN, &e.Index, &ts, &e.Data)
+		if err != nil {
+			return nil, err
+		}
+		e.Timestamp = time.Unix(0, ts)
+		entries = append(entries, e)
 	}
-	return
+	return entries, rows.Err()
 }
 
 /*
@@ -263,6 +344,298 @@ func (s *SQL) Purge(oldest time.Time) (uint64, error) {
 	return uint64(ra), nil
 }
 
+/*
+FirstSequenceSince finds the lowest sequence of an entry that is not
+internal and whose timestamp is at or after "t."
+*/
+func (s *SQL) FirstSequenceSince(t time.Time) (common.Sequence, bool, error) {
+	found, seq, err := readSeqRow(s.db.QueryRow(readFirstSinceSQL,
+		t.UnixNano(), len(InternalScopePrefix), InternalScopePrefix))
+	return seq, found, err
+}
+
+/*
+PurgeBefore removes all entries older than the specified time whose
+sequence is before "limit."
+*/
+func (s *SQL) PurgeBefore(oldest time.Time, limit common.Sequence) (uint64, error) {
+	limit = sqlLimit(limit)
+	res, err := s.db.Exec(purgeByTimeBeforeSQL, oldest.UnixNano(), limit.LSN, limit.LSN, limit.Index)
+	if err != nil {
+		return 0, err
+	}
+	ra, _ := res.RowsAffected()
+	return uint64(ra), nil
+}
+
+/*
+Scopes returns the names of all the scopes that have entries, sorted.
+*/
+func (s *SQL) Scopes() ([]string, error) {
+	rows, err := s.db.Query(readScopesSQL)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var scopes []string
+	for rows.Next() {
+		var scope string
+		err = rows.Scan(&scope)
+		if err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, rows.Err()
+}
+
+/*
+PurgeScope removes entries for one scope that are too old, or that are not
+among the newest "maxCount," as long as they are before "limit."
+*/
+func (s *SQL) PurgeScope(scope string, oldest time.Time, maxCount int, limit common.Sequence) (purgeCount uint64, lastPurged common.Sequence, err error) {
+	limit = sqlLimit(limit)
+
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	if !oldest.IsZero() {
+		var found bool
+		found, lastPurged, err = readSeqRow(tx.QueryRow(readLastOldSQL,
+			scope, oldest.UnixNano(), limit.LSN, limit.LSN, limit.Index))
+		if err != nil {
+			return
+		}
+		if found {
+			var res sql.Result
+			res, err = tx.Exec(purgeScopeByTimeSQL,
+				scope, oldest.UnixNano(), limit.LSN, limit.LSN, limit.Index)
+			if err != nil {
+				return
+			}
+			ra, _ := res.RowsAffected()
+			purgeCount += uint64(ra)
+		}
+	}
+
+	if maxCount > 0 {
+		var found bool
+		var through common.Sequence
+		found, through, err = readSeqRow(tx.QueryRow(readLastOverCountSQL, scope, maxCount))
+		if err == nil && found && through.Compare(limit) >= 0 {
+			found, through, err = readSeqRow(tx.QueryRow(readLastBeforeSQL,
+				scope, limit.LSN, limit.LSN, limit.Index))
+		}
+		if err != nil {
+			return
+		}
+		if found {
+			var res sql.Result
+			res, err = tx.Exec(purgeScopeThroughSQL, scope, through.LSN, through.LSN, through.Index)
+			if err != nil {
+				return
+			}
+			ra, _ := res.RowsAffected()
+			purgeCount += uint64(ra)
+			if through.Compare(lastPurged) > 0 {
+				lastPurged = through
+			}
+		}
+	}
+
+	err = tx.Commit()
+	return
+}
+
+/*
+PurgeOldest removes the "count" entries with the lowest sequences that are
+before "limit" and not internal.
+*/
+func (s *SQL) PurgeOldest(count int, limit common.Sequence) (purgeCount uint64, lastPurged common.Sequence, err error) {
+	if count <= 0 {
+		return
+	}
+	limit = sqlLimit(limit)
+	prefixLen := len(InternalScopePrefix)
+
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	var found bool
+	found, lastPurged, err = readSeqRow(tx.QueryRow(readNthSQL,
+		prefixLen, InternalScopePrefix, limit.LSN, limit.LSN, limit.Index, count-1))
+	if err == nil && !found {
+		// Fewer than "count" entries, so delete all of them
+		found, lastPurged, err = readSeqRow(tx.QueryRow(readLastPurgeableSQL,
+			prefixLen, InternalScopePrefix, limit.LSN, limit.LSN, limit.Index))
+	}
+	if err != nil || !found {
+		return 0, common.Sequence{}, err
+	}
+
+	var res sql.Result
+	res, err = tx.Exec(purgeThroughSQL, prefixLen, InternalScopePrefix,
+		lastPurged.LSN, lastPurged.LSN, lastPurged.Index)
+	if err != nil {
+		return 0, common.Sequence{}, err
+	}
+	ra, _ := res.RowsAffected()
+	purgeCount = uint64(ra)
+
+	err = tx.Commit()
+	return
+}
+
+/*
+Size returns the size of the pages in the database that are in use.
+Pages that were freed by a purge stay in the file and are reused.
+*/
+func (s *SQL) Size() (int64, error) {
+	var pageSize, pageCount, freeCount int64
+	err := s.db.QueryRow("pragma page_size").Scan(&pageSize)
+	if err == nil {
+		err = s.db.QueryRow("pragma page_count").Scan(&pageCount)
+	}
+	if err == nil {
+		err = s.db.QueryRow("pragma freelist_count").Scan(&freeCount)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return (pageCount - freeCount) * pageSize, nil
+}
+
+/*
+PutMetadata saves a value in the metadata table.
+*/
+func (s *SQL) PutMetadata(key string, value []byte) error {
+	_, err := s.db.Exec(putMetadataSQL, key, value)
+	return err
+}
+
+/*
+GetMetadata returns a value from the metadata table, or nil.
+*/
+func (s *SQL) GetMetadata(key string) ([]byte, error) {
+	if !s.hasMetadata {
+		return nil, nil
+	}
+	var value []byte
+	err := s.db.QueryRow(getMetadataSQL, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err == nil && value == nil {
+		value = []byte{}
+	}
+	return value, err
+}
+
+/*
+DeleteMetadata removes a value from the metadata table.
+*/
+func (s *SQL) DeleteMetadata(key string) error {
+	_, err := s.db.Exec(deleteMetadataSQL, key)
+	return err
+}
+
+/*
+PutMetadataBatch saves and deletes metadata in one transaction.
+*/
+func (s *SQL) PutMetadataBatch(values map[string][]byte) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ps, err := tx.Prepare(putMetadataSQL)
+	if err != nil {
+		return err
+	}
+	defer ps.Close()
+	ds, err := tx.Prepare(deleteMetadataSQL)
+	if err != nil {
+		return err
+	}
+	defer ds.Close()
+
+	for key, value := range values {
+		if value == nil {
+			_, err = ds.Exec(key)
+		} else {
+			_, err = ps.Exec(key, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+/*
+ListMetadata returns every value in the metadata table whose key starts
+with "prefix."
+*/
+func (s *SQL) ListMetadata(prefix string) (map[string][]byte, error) {
+	ret := make(map[string][]byte)
+	if !s.hasMetadata {
+		return ret, nil
+	}
+
+	rows, err := s.db.Query(listMetadataSQL, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var value []byte
+		err = rows.Scan(&key, &value)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		ret[key] = value
+	}
+	return ret, rows.Err()
+}
+
+/*
+sqlLimit makes sure that a limit fits in the signed integers that SQLite
+uses. No entry can have a bigger LSN than that anyway.
+*/
+func sqlLimit(limit common.Sequence) common.Sequence {
+	if limit.LSN > math.MaxInt64 {
+		return common.MakeSequence(math.MaxInt64, math.MaxUint32)
+	}
+	return limit
+}
+
+func readSeqRow(row *sql.Row) (bool, common.Sequence, error) {
+	var lsn uint64
+	var ix uint32
+	err := row.Scan(&lsn, &ix)
+	if err == sql.ErrNoRows {
+		return false, common.Sequence{}, nil
+	} else if err != nil {
+		return false, common.Sequence{}, err
+	}
+	return true, common.MakeSequence(lsn, ix), nil
+}
+
 /*
 GetBackup creates a backup of the current database in a temp filename,
 and write the persistent db file to the specified writer.
@@ -360,13 +733,6 @@ func (s *SQL) runBackup(dest string, pc chan BackupProgress) {
 	backup.Finish()
 }
 
-func returnBackupError(pc chan BackupProgress, err error) {
-	pc <- BackupProgress{
-		Done:  true,
-		Error: err,
-	}
-}
-
 func (s *SQL) openRawConnection(baseFile string) (*sqlite3.SQLiteConn, error) {
 	url, err := createDBDir(baseFile)
 	if err != nil {
@@ -381,42 +747,6 @@ func (s *SQL) openRawConnection(baseFile string) (*sqlite3.SQLiteConn, error) {
 	return sqlConn.(*sqlite3.SQLiteConn), nil
 }
 
-func (s *SQL) readOneRange(scope string, startLSN uint64,
-	startIndex uint32, limit int, tx *sql.Tx,
-	filter func([]byte) bool) (results readResults, err error) {
-
-	var rows *sql.Rows
-	rrs := tx.Stmt(s.readRange)
-	defer rrs.Close()
-	rows, err = rrs.Query(scope, startLSN, startLSN, startIndex)
-	if err != nil {
-		return
-	}
-	defer rows.Close()
-
-	count := 0
-	for count < limit && rows.Next() {
-		var lsn uint64
-		var index uint32
-		var data []byte
-		err = rows.Scan(&lsn, &index, &data)
-		if err != nil {
-			return
-		}
-		if filter == nil || filter(data) {
-			result := readResult{
-				lsn:   lsn,
-				index: index,
-				data:  data,
-			}
-			results = append(results, result)
-			count++
-		}
-	}
-
-	return results, nil
-}
-
 func (s *SQL) readLimits(tx *sql.Tx) (firstSeq, lastSeq common.Sequence, err error) {
 	rfs := tx.Stmt(s.readFirst)
 	defer rfs.Close()
@@ -451,24 +781,79 @@ func (s *SQL) readLimits(tx *sql.Tx) (firstSeq, lastSeq common.Sequence, err err
 	return
 }
 
-// Needed to sort read results by LSN and index
+/*
+An sqlScopeIterator reads the entries for one scope a page at a time. Each
+page is twice as big as the last, up to a limit, so that we make few
+queries for scopes that have a lot to return.
+*/
+type sqlScopeIterator struct {
+	stmt     *sql.Stmt
+	scope    string
+	lsn      uint64
+	index    uint32
+	pageSize int
+	page     readResults
+	pos      int
+	done     bool
+}
+
+func (it *sqlScopeIterator) next() (bool, error) {
+	it.pos++
+	if it.pos < len(it.page) {
+		return true, nil
+	}
+	if it.done {
+		return false, nil
+	}
 
-func (r readResults) Len() int {
-	return len(r)
+	err := it.readPage()
+	if err != nil {
+		return false, err
+	}
+	it.pos = 0
+	return len(it.page) > 0, nil
 }
 
-func (r readResults) Less(i, j int) bool {
-	if r[i].lsn < r[j].lsn {
-		return true
+func (it *sqlScopeIterator) readPage() error {
+	rows, err := it.stmt.Query(it.scope, it.lsn, it.lsn, it.index, it.pageSize)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	it.page = it.page[:0]
+	for rows.Next() {
+		var r readResult
+		err = rows.Scan(&r.lsn, &r.index, &r.data)
+		if err != nil {
+			return err
+		}
+		it.page = append(it.page, r)
 	}
-	if r[i].lsn == r[j].lsn && r[i].index < r[j].index {
-		return true
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	if len(it.page) < it.pageSize {
+		it.done = true
+	} else {
+		last := it.page[len(it.page)-1]
+		it.lsn = last.lsn
+		it.index = last.index + 1
+		if it.pageSize < maxScanPage {
+			it.pageSize *= 2
+			if it.pageSize > maxScanPage {
+				it.pageSize = maxScanPage
+			}
+		}
 	}
-	return false
+	return nil
+}
+
+func (it *sqlScopeIterator) entry() *readResult {
+	return &it.page[it.pos]
 }
 
-func (r readResults) Swap(i, j int) {
-	tmp := r[i]
-	r[i] = r[j]
-	r[j] = tmp
+func (it *sqlScopeIterator) close() {
 }
@@ -0,0 +1,102 @@
+// +build cgo
+
+/*
+Copyright 2016 The Transicator Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package storage
+
+import (
+	"database/sql"
+	"sort"
+
+	"github.com/apigee-labs/transicator/common"
+)
+
+/*
+scanSorted does the same thing as Scan, but the old way: by reading "limit" entries from every scope and then
+sorting them all. It is only here so that benchmarks can compare the two.
+*/
+func (s *SQL) scanSorted(
+	scopes []string,
+	startLSN uint64, startIndex uint32,
+	limit int, filter func([]byte) bool) (final [][]byte, firstSeq common.Sequence, lastSeq common.Sequence, err error) {
+
+	var tx *sql.Tx
+	tx, err = s.db.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Commit()
+
+	firstSeq, lastSeq, err = s.readLimits(tx)
+	if err != nil {
+		return
+	}
+
+	// Read range for each scope
+	var results readResults
+	for _, scope := range scopes {
+		var rr readResults
+		rr, err = s.readOneRange(scope, startLSN, startIndex, limit, tx, filter)
+		if err != nil {
+			return
+		}
+		results = append(results, rr...)
+	}
+
+	// Sort and then take limit
+	sort.Sort(results)
+
+	for count := 0; count < len(results) && count < limit; count++ {
+		final = append(final, results[count].data)
+	}
+	return
+}
+
+func (s *SQL) readOneRange(scope string, startLSN uint64,
+	startIndex uint32, limit int, tx *sql.Tx,
+	filter func([]byte) bool) (results readResults, err error) {
+
+	var rows *sql.Rows
+	rrs := tx.Stmt(s.readRange)
+	defer rrs.Close()
+	rows, err = rrs.Query(scope, startLSN, startLSN, startIndex)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	count := 0
+	for count < limit && rows.Next() {
+		var lsn uint64
+		var index uint32
+		var data []byte
+		err = rows.Scan(&lsn, &index, &data)
+		if err != nil {
+			return
+		}
+		if filter == nil || filter(data) {
+			result := readResult{
+				lsn:   lsn,
+				index: index,
+				data:  data,
+			}
+			results = append(results, result)
+			count++
+		}
+	}
+
+	return results, nil
+}
@@ -35,11 +35,11 @@ const (
 
 var testDB DB
 
-var _ = Describe("Storage Main Test", func() {
+var _ = describeEngines("Storage Main Test", func(engineName string) {
 
 	BeforeEach(func() {
 		var err error
-		testDB, err = Open(testDBDir)
+		testDB, err = Open(engineName, testDBDir)
 		Expect(err).Should(Succeed())
 	})
 
@@ -51,10 +51,10 @@ var _ = Describe("Storage Main Test", func() {
 
 	It("Open and reopen", func() {
 		fmt.Fprintln(GinkgoWriter, "Open and re-open")
-		stor, err := Open("./openleveldb")
+		stor, err := Open(engineName, "./openleveldb")
 		Expect(err).Should(Succeed())
 		stor.Close()
-		stor, err = Open("./openleveldb")
+		stor, err = Open(engineName, "./openleveldb")
 		Expect(err).Should(Succeed())
 		stor.Close()
 		err = stor.Delete()
@@ -62,8 +62,13 @@ var _ = Describe("Storage Main Test", func() {
 		fmt.Fprintln(GinkgoWriter, "Open and re-open done")
 	})
 
+	It("Bad engine", func() {
+		_, err := Open("nosuchengine", "./does/not/matter")
+		Expect(err).ShouldNot(Succeed())
+	})
+
 	It("Bad path", func() {
-		_, err := Open("./does/not/exist")
+		_, err := Open(engineName, "./does/not/exist")
 		Expect(err).ShouldNot(Succeed())
 	})
 
@@ -171,6 +176,61 @@ var _ = Describe("Storage Main Test", func() {
 			[][]byte{val2, val1, val1})
 	})
 
+	It("Merging many entries", func() {
+		// Enough entries that each scope is read in more than one page
+		var batch []Entry
+		for lsn := uint64(1); lsn <= 1000; lsn++ {
+			batch = append(batch, Entry{
+				Scope: fmt.Sprintf("s%d", lsn%3),
+				LSN:   lsn,
+				Data:  []byte(fmt.Sprintf("%d", lsn)),
+			})
+		}
+		Expect(testDB.PutBatch(batch)).Should(Succeed())
+
+		scopes := []string{"s0", "s1", "s2", "s3"}
+		ret, _, _, err := testDB.Scan(scopes, 0, 0, 500, nil)
+		Expect(err).Should(Succeed())
+		Expect(len(ret)).Should(Equal(500))
+		for i, r := range ret {
+			Expect(string(r)).Should(Equal(fmt.Sprintf("%d", i+1)))
+		}
+
+		ret, _, _, err = testDB.Scan(scopes, 900, 1, 500, nil)
+		Expect(err).Should(Succeed())
+		Expect(len(ret)).Should(Equal(100))
+		Expect(string(ret[0])).Should(Equal("901"))
+
+		// Skip everything that doesn't end in zero
+		ret, _, _, err = testDB.Scan(scopes, 0, 0, 50,
+			func(buf []byte) bool {
+				return buf[len(buf)-1] == '0'
+			})
+		Expect(err).Should(Succeed())
+		Expect(len(ret)).Should(Equal(50))
+		for i, r := range ret {
+			Expect(string(r)).Should(Equal(fmt.Sprintf("%d", (i+1)*10)))
+		}
+	})
+
+	It("Delete batch", func() {
+		Expect(testDB.PutBatch([]Entry{
+			{Scope: "a", LSN: 1, Index: 0, Data: []byte("one")},
+			{Scope: "a", LSN: 2, Index: 0, Data: []byte("two")},
+			{Scope: "b", LSN: 2, Index: 1, Data: []byte("three")},
+			{Scope: "a", LSN: 3, Index: 0, Data: []byte("four")},
+		})).Should(Succeed())
+
+		Expect(testDB.DeleteBatch([]Entry{
+			{Scope: "a", LSN: 1, Index: 0},
+			{Scope: "a", LSN: 2, Index: 0},
+			{Scope: "a", LSN: 4, Index: 0},
+		})).Should(Succeed())
+		testGetSequence("a", 0, 0, 100, [][]byte{[]byte("four")})
+		testGetSequence("b", 0, 0, 100, [][]byte{[]byte("three")})
+		rangeEqual(2, 1, 3, 0)
+	})
+
 	It("Purge empty database", func() {
 		count, err := testDB.Purge(time.Now())
 		Expect(err).Should(Succeed())
@@ -234,6 +294,336 @@ var _ = Describe("Storage Main Test", func() {
 		Expect(count).Should(BeZero())
 		rangeEqual(0, 0, 0, 0)
 	})
+
+	It("Scopes", func() {
+		scopes, err := testDB.Scopes()
+		Expect(err).Should(Succeed())
+		Expect(scopes).Should(BeEmpty())
+
+		err = testDB.PutBatch([]Entry{
+			{Scope: "b", LSN: 1, Index: 0, Data: []byte("one")},
+			{Scope: "a", LSN: 2, Index: 0, Data: []byte("two")},
+			{Scope: "", LSN: 3, Index: 0, Data: []byte("three")},
+			{Scope: "b", LSN: 4, Index: 0, Data: []byte("four")},
+			{Scope: "ab", LSN: 5, Index: 0, Data: []byte("five")},
+		})
+		Expect(err).Should(Succeed())
+
+		scopes, err = testDB.Scopes()
+		Expect(err).Should(Succeed())
+		Expect(scopes).Should(Equal([]string{"", "a", "ab", "b"}))
+	})
+
+	It("Purge scope by count", func() {
+		for lsn := uint64(1); lsn <= 10; lsn++ {
+			Expect(testDB.Put("a", lsn, 0, []byte(fmt.Sprintf("a%d", lsn)))).Should(Succeed())
+			Expect(testDB.Put("b", lsn, 1, []byte(fmt.Sprintf("b%d", lsn)))).Should(Succeed())
+		}
+
+		count, last, err := testDB.PurgeScope("a", time.Time{}, 3, NoLimit)
+		Expect(err).Should(Succeed())
+		Expect(count).Should(BeEquivalentTo(7))
+		Expect(last).Should(Equal(common.MakeSequence(7, 0)))
+		testGetSequence("a", 0, 0, 100, [][]byte{
+			[]byte("a8"), []byte("a9"), []byte("a10")})
+
+		// Other scopes are untouched
+		ret, _, _, err := testDB.Scan([]string{"b"}, 0, 0, 100, nil)
+		Expect(err).Should(Succeed())
+		Expect(len(ret)).Should(Equal(10))
+
+		// Nothing more to purge
+		count, last, err = testDB.PurgeScope("a", time.Time{}, 3, NoLimit)
+		Expect(err).Should(Succeed())
+		Expect(count).Should(BeZero())
+		Expect(last).Should(Equal(common.Sequence{}))
+
+		// Scopes that don't exist are fine too
+		count, _, err = testDB.PurgeScope("nope", time.Now(), 1, NoLimit)
+		Expect(err).Should(Succeed())
+		Expect(count).Should(BeZero())
+	})
+
+	It("Purge scope by age", func() {
+		Expect(testDB.Put("a", 1, 0, []byte("one"))).Should(Succeed())
+		Expect(testDB.Put("a", 2, 0, []byte("two"))).Should(Succeed())
+		Expect(testDB.Put("b", 3, 0, []byte("three"))).Should(Succeed())
+		time.Sleep(10 * time.Millisecond)
+		purgePoint := time.Now()
+		Expect(testDB.Put("a", 4, 0, []byte("four"))).Should(Succeed())
+		Expect(testDB.Put("a", 5, 0, []byte("five"))).Should(Succeed())
+		Expect(testDB.Put("a", 6, 0, []byte("six"))).Should(Succeed())
+
+		count, last, err := testDB.PurgeScope("a", purgePoint, 0, NoLimit)
+		Expect(err).Should(Succeed())
+		Expect(count).Should(BeEquivalentTo(2))
+		Expect(last).Should(Equal(common.MakeSequence(2, 0)))
+		testGetSequence("a", 0, 0, 100, [][]byte{
+			[]byte("four"), []byte("five"), []byte("six")})
+		testGetSequence("b", 0, 0, 100, [][]byte{[]byte("three")})
+
+		// Age and count together: the count removes one more
+		count, last, err = testDB.PurgeScope("a", purgePoint, 2, NoLimit)
+		Expect(err).Should(Succeed())
+		Expect(count).Should(BeEquivalentTo(1))
+		Expect(last).Should(Equal(common.MakeSequence(4, 0)))
+		testGetSequence("a", 0, 0, 100, [][]byte{
+			[]byte("five"), []byte("six")})
+	})
+
+	It("Purge scope before limit", func() {
+		for lsn := uint64(1); lsn <= 10; lsn++ {
+			Expect(testDB.Put("a", lsn, 0, []byte(fmt.Sprintf("a%d", lsn)))).Should(Succeed())
+		}
+
+		// The count would purge seven, but the limit stops it at four
+		count, last, err := testDB.PurgeScope("a", time.Time{}, 3, common.MakeSequence(5, 0))
+		Expect(err).Should(Succeed())
+		Expect(count).Should(BeEquivalentTo(4))
+		Expect(last).Should(Equal(common.MakeSequence(4, 0)))
+
+		count, last, err = testDB.PurgeScope("a", time.Now(), 0, common.MakeSequence(7, 0))
+		Expect(err).Should(Succeed())
+		Expect(count).Should(BeEquivalentTo(2))
+		Expect(last).Should(Equal(common.MakeSequence(6, 0)))
+		testGetSequence("a", 0, 0, 100, [][]byte{
+			[]byte("a7"), []byte("a8"), []byte("a9"), []byte("a10")})
+	})
+
+	It("Purge one scope at a shared sequence", func() {
+		// A row that moved between selectors has an entry in each one
+		Expect(testDB.Put("a", 1, 0, []byte("a1"))).Should(Succeed())
+		Expect(testDB.Put("a", 2, 0, []byte("a2"))).Should(Succeed())
+		Expect(testDB.Put("b", 2, 0, []byte("b2"))).Should(Succeed())
+		Expect(testDB.Put("b", 3, 0, []byte("b3"))).Should(Succeed())
+
+		count, last, err := testDB.PurgeScope("a", time.Now().Add(time.Hour), 0, NoLimit)
+		Expect(err).Should(Succeed())
+		Expect(count).Should(BeEquivalentTo(2))
+		Expect(last).Should(Equal(common.MakeSequence(2, 0)))
+		rangeEqual(2, 0, 3, 0)
+		testGetSequence("b", 0, 0, 100, [][]byte{[]byte("b2"), []byte("b3")})
+
+		seq, found, err := testDB.FirstSequenceSince(time.Time{})
+		Expect(err).Should(Succeed())
+		Expect(found).Should(BeTrue())
+		Expect(seq).Should(Equal(common.MakeSequence(2, 0)))
+
+		count, last, err = testDB.PurgeOldest(1, NoLimit)
+		Expect(err).Should(Succeed())
+		Expect(count).Should(BeEquivalentTo(1))
+		Expect(last).Should(Equal(common.MakeSequence(2, 0)))
+		rangeEqual(3, 0, 3, 0)
+	})
+
+	It("Purge before limit", func() {
+		for lsn := uint64(1); lsn <= 10; lsn++ {
+			Expect(testDB.Put(fmt.Sprintf("s%d", lsn%3), lsn, 0,
+				[]byte(fmt.Sprintf("%d", lsn)))).Should(Succeed())
+		}
+
+		count, err := testDB.PurgeBefore(time.Now(), common.MakeSequence(4, 0))
+		Expect(err).Should(Succeed())
+		Expect(count).Should(BeEquivalentTo(3))
+		rangeEqual(4, 0, 10, 0)
+
+		count, err = testDB.PurgeBefore(time.Now(), common.MakeSequence(4, 0))
+		Expect(err).Should(Succeed())
+		Expect(count).Should(BeZero())
+
+		count, err = testDB.PurgeBefore(time.Now(), NoLimit)
+		Expect(err).Should(Succeed())
+		Expect(count).Should(BeEquivalentTo(7))
+		rangeEqual(0, 0, 0, 0)
+	})
+
+	It("First sequence since", func() {
+		_, found, err := testDB.FirstSequenceSince(time.Time{})
+		Expect(err).Should(Succeed())
+		Expect(found).Should(BeFalse())
+
+		Expect(testDB.Put("a", 1, 0, []byte("1"))).Should(Succeed())
+		Expect(testDB.Put("b", 2, 0, []byte("2"))).Should(Succeed())
+		Expect(testDB.Put("a", 1000000, 0, []byte("3"))).Should(Succeed())
+		Expect(testDB.Put("a", 1000000, 1, []byte("4"))).Should(Succeed())
+		time.Sleep(10 * time.Millisecond)
+		t1 := time.Now()
+		time.Sleep(10 * time.Millisecond)
+		// The same LSN, in two batches on either side of the time
+		Expect(testDB.Put("b", 1000000, 2, []byte("5"))).Should(Succeed())
+		Expect(testDB.Put("a", 1000001, 0, []byte("6"))).Should(Succeed())
+		Expect(testDB.Put("a", 5000000000, 0, []byte("7"))).Should(Succeed())
+		time.Sleep(10 * time.Millisecond)
+		t2 := time.Now()
+
+		seq, found, err := testDB.FirstSequenceSince(time.Time{})
+		Expect(err).Should(Succeed())
+		Expect(found).Should(BeTrue())
+		Expect(seq).Should(Equal(common.MakeSequence(1, 0)))
+
+		seq, found, err = testDB.FirstSequenceSince(t1)
+		Expect(err).Should(Succeed())
+		Expect(found).Should(BeTrue())
+		Expect(seq).Should(Equal(common.MakeSequence(1000000, 2)))
+
+		_, found, err = testDB.FirstSequenceSince(t2)
+		Expect(err).Should(Succeed())
+		Expect(found).Should(BeFalse())
+	})
+
+	It("First sequence since ignores internal entries", func() {
+		base := time.Now().Add(-time.Hour)
+		Expect(testDB.PutBatch([]Entry{
+			{Scope: "a", LSN: 1, Data: []byte("1"), Timestamp: base},
+			{Scope: "a", LSN: 2, Data: []byte("2"), Timestamp: base.Add(2 * time.Second)},
+			// Written later, at the last sequence, when a cleanup started
+			{Scope: InternalScopePrefix + "_internal", LSN: 2, Timestamp: base.Add(time.Minute)},
+			{Scope: "a", LSN: 3, Data: []byte("3"), Timestamp: base.Add(3 * time.Second)},
+		})).Should(Succeed())
+
+		seq, found, err := testDB.FirstSequenceSince(base.Add(time.Second))
+		Expect(err).Should(Succeed())
+		Expect(found).Should(BeTrue())
+		Expect(seq).Should(Equal(common.MakeSequence(2, 0)))
+
+		seq, found, err = testDB.FirstSequenceSince(base.Add(3 * time.Second))
+		Expect(err).Should(Succeed())
+		Expect(found).Should(BeTrue())
+		Expect(seq).Should(Equal(common.MakeSequence(3, 0)))
+
+		_, found, err = testDB.FirstSequenceSince(base.Add(10 * time.Second))
+		Expect(err).Should(Succeed())
+		Expect(found).Should(BeFalse())
+	})
+
+	It("Metadata", func() {
+		val, err := testDB.GetMetadata("foo")
+		Expect(err).Should(Succeed())
+		Expect(val).Should(BeNil())
+
+		Expect(testDB.PutMetadata("foo", []byte("bar"))).Should(Succeed())
+		Expect(testDB.PutMetadata("consumer/one", []byte("1"))).Should(Succeed())
+		Expect(testDB.PutMetadata("consumer/two", []byte("2"))).Should(Succeed())
+		Expect(testDB.PutMetadata("consumer/two", []byte("22"))).Should(Succeed())
+
+		val, err = testDB.GetMetadata("foo")
+		Expect(err).Should(Succeed())
+		Expect(val).Should(Equal([]byte("bar")))
+
+		all, err := testDB.ListMetadata("consumer/")
+		Expect(err).Should(Succeed())
+		Expect(all).Should(Equal(map[string][]byte{
+			"consumer/one": []byte("1"),
+			"consumer/two": []byte("22"),
+		}))
+
+		// Metadata is not an entry, so it is never scanned or purged
+		rangeEqual(0, 0, 0, 0)
+		count, err := testDB.Purge(time.Now())
+		Expect(err).Should(Succeed())
+		Expect(count).Should(BeZero())
+
+		Expect(testDB.DeleteMetadata("consumer/one")).Should(Succeed())
+		Expect(testDB.DeleteMetadata("consumer/three")).Should(Succeed())
+		all, err = testDB.ListMetadata("")
+		Expect(err).Should(Succeed())
+		Expect(all).Should(HaveLen(2))
+		Expect(all).Should(HaveKey("foo"))
+		Expect(all).Should(HaveKey("consumer/two"))
+
+		Expect(testDB.PutMetadataBatch(map[string][]byte{
+			"foo":          nil,
+			"consumer/two": []byte("2"),
+			"consumer/six": []byte("6"),
+			"consumer/ten": nil,
+		})).Should(Succeed())
+		all, err = testDB.ListMetadata("")
+		Expect(err).Should(Succeed())
+		Expect(all).Should(Equal(map[string][]byte{
+			"consumer/two": []byte("2"),
+			"consumer/six": []byte("6"),
+		}))
+	})
+
+	It("Purge oldest", func() {
+		count, last, err := testDB.PurgeOldest(10, NoLimit)
+		Expect(err).Should(Succeed())
+		Expect(count).Should(BeZero())
+		Expect(last).Should(Equal(common.Sequence{}))
+
+		for lsn := uint64(1); lsn <= 10; lsn++ {
+			Expect(testDB.Put(fmt.Sprintf("s%d", lsn%3), lsn, 0,
+				[]byte(fmt.Sprintf("%d", lsn)))).Should(Succeed())
+		}
+		// Two entries with the same sequence are purged together
+		Expect(testDB.Put("s0", 4, 0, []byte("moved"))).Should(Succeed())
+
+		count, last, err = testDB.PurgeOldest(3, NoLimit)
+		Expect(err).Should(Succeed())
+		Expect(count).Should(BeEquivalentTo(3))
+		Expect(last).Should(Equal(common.MakeSequence(3, 0)))
+		rangeEqual(4, 0, 10, 0)
+
+		count, last, err = testDB.PurgeOldest(1, NoLimit)
+		Expect(err).Should(Succeed())
+		Expect(count).Should(BeEquivalentTo(2))
+		Expect(last).Should(Equal(common.MakeSequence(4, 0)))
+		testGetSequence("s0", 0, 0, 100, [][]byte{[]byte("6"), []byte("9")})
+		testGetSequence("s1", 0, 0, 100, [][]byte{[]byte("7"), []byte("10")})
+
+		count, last, err = testDB.PurgeOldest(100, NoLimit)
+		Expect(err).Should(Succeed())
+		Expect(count).Should(BeEquivalentTo(6))
+		Expect(last).Should(Equal(common.MakeSequence(10, 0)))
+		rangeEqual(0, 0, 0, 0)
+	})
+
+	It("Purge oldest before limit", func() {
+		for lsn := uint64(1); lsn <= 10; lsn++ {
+			Expect(testDB.Put("s", lsn, 0, []byte(fmt.Sprintf("%d", lsn)))).Should(Succeed())
+		}
+		Expect(testDB.Put(InternalScopePrefix+"_internal", 2, 0, nil)).Should(Succeed())
+		Expect(testDB.Put(InternalScopePrefix+"_purged/s", 3, 0, []byte("x"))).Should(Succeed())
+
+		// Entries that were added after the purge started are not touched
+		count, last, err := testDB.PurgeOldest(100, common.MakeSequence(6, 0))
+		Expect(err).Should(Succeed())
+		Expect(count).Should(BeEquivalentTo(5))
+		Expect(last).Should(Equal(common.MakeSequence(5, 0)))
+		testGetSequence("s", 0, 0, 100, [][]byte{
+			[]byte("6"), []byte("7"), []byte("8"), []byte("9"), []byte("10")})
+
+		// Internal records are never purged
+		count, _, err = testDB.PurgeOldest(100, NoLimit)
+		Expect(err).Should(Succeed())
+		Expect(count).Should(BeEquivalentTo(5))
+		val, err := testDB.Get(InternalScopePrefix+"_purged/s", 3, 0)
+		Expect(err).Should(Succeed())
+		Expect(val).Should(Equal([]byte("x")))
+		scopes, err := testDB.Scopes()
+		Expect(err).Should(Succeed())
+		Expect(scopes).Should(Equal([]string{
+			InternalScopePrefix + "_internal", InternalScopePrefix + "_purged/s"}))
+	})
+
+	It("Size", func() {
+		val := bytes.Repeat([]byte("x"), 1000)
+		var entries []Entry
+		for lsn := uint64(1); lsn <= 1000; lsn++ {
+			entries = append(entries, Entry{Scope: "a", LSN: lsn, Data: val})
+		}
+		Expect(testDB.PutBatch(entries)).Should(Succeed())
+
+		full, err := testDB.Size()
+		Expect(err).Should(Succeed())
+		Expect(full).Should(BeNumerically(">", 0))
+
+		_, _, err = testDB.PurgeOldest(900, NoLimit)
+		Expect(err).Should(Succeed())
+		purged, err := testDB.Size()
+		Expect(err).Should(Succeed())
+		Expect(purged).Should(BeNumerically("<", full))
+	})
 })
 
 func testGetSequence(tag string, lsn uint64,